@@ -1,100 +1,244 @@
+// Command client is a command line TFTP client.
+//
+//	client get [flags] host[:port] remote [local]
+//	client get -r [flags] host[:port] list [dir]
+//	client put [flags] host[:port] local [remote]
+//	client put -r [flags] host[:port] dir [prefix]
+//	client batch [flags] host[:port] script
+//
+// get -r fetches every remote name listed one per line in the local file
+// list ("-" for stdin) into dir, recreating any subdirectories in the names.
+// put -r uploads every regular file under dir, named by its path relative to
+// dir, under prefix.
+//
+// A batch script has one transfer per line, "get remote [local]" or
+// "put local [remote]". Blank lines and lines starting with # are skipped.
+//
+// TFTP cannot start a transfer part way through a file, so a get that fails
+// with a timeout or network error is resumed by reissuing the request and
+// skipping the bytes already saved. With -c an existing local file is
+// treated as a partial download and resumed the same way. A put that fails
+// is reissued from the start.
+//
+// Every transfer is attempted even if an earlier one fails. The exit status
+// is that of the first failure:
+//
+//	0       success
+//	1       local or network error
+//	2       usage error
+//	3       timed out
+//	10-18   error from the server, 10 + the TFTP error code
+//	19      error from the server with a code no RFC defines
+//
+// With -json, each transfer is reported as a JSON object on its own line on
+// stdout, and nothing else is written to stdout.
 package main
 
 import (
-	"../tftp"
+	"../tftp/client"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"net"
+	"io"
+	"os"
+	"os/signal"
+	"time"
 )
 
-func read_file(conn net.Conn, s string) {
-
-	// Construct a read-file packet and send it to the server
-
-	var pr_send = new(tftp.PacketRequest)
-	pr_send.Mode = "octet"
-	pr_send.Op = 1
-	pr_send.Filename = s
-
-	b := make([]byte, 1024)
-	b = tftp.Packet.Serialize(pr_send)
-
-	conn.Write(b)
+// Exit statuses.
+const (
+	exitOK        = 0
+	exitFailed    = 1
+	exitUsage     = 2
+	exitTimeout   = 3
+	exitTFTP      = 10 // plus the TFTP error code, up to maxTFTPCode
+	exitTFTPOther = exitTFTP + maxTFTPCode + 1
+
+	// maxTFTPCode is the highest TFTP error code defined, option
+	// negotiation (RFC 2347). Higher codes all exit exitTFTPOther, so
+	// none can run past the 255 an exit status holds.
+	maxTFTPCode = 8
+)
 
-	//simple write - send to server
-	//conn.Write([]byte("Hello from client"))
+// config holds the flags shared by all subcommands.
+type config struct {
+	client   client.Client
+	reissue  int
+	resume   bool
+	mirror   bool
+	json     bool
+	progress bool
+	quiet    bool
+
+	stdout io.Writer
+	stderr io.Writer
 }
 
-func process_read_file(conn net.Conn, s string) {
-
-	//simple Read
-	//buffer := make([]byte, 1024)
-	//conn.Read(buffer)
-
-	// Process a reply from the server
-	buffer := make([]byte, 1024)
-	conn.Read(buffer)
+func (cfg *config) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(cfg.stderr)
+
+	c := &cfg.client
+	fs.StringVar(&c.Mode, "mode", "octet", "transfer mode, octet or netascii")
+	fs.IntVar(&c.BlockSize, "blksize", client.DefaultBlockSize, "block size to request (RFC 2348)")
+	fs.IntVar(&c.WindowSize, "windowsize", 1, "window size to request (RFC 7440)")
+	fs.BoolVar(&c.TransferSize, "tsize", true, "request the transfer size (RFC 2349)")
+	fs.DurationVar(&c.Timeout, "timeout", client.DefaultTimeout, "retransmission timeout; whole seconds are sent as the timeout option")
+	fs.IntVar(&c.Retries, "retries", client.DefaultRetries, "retransmissions without progress before a transfer times out")
+
+	fs.IntVar(&cfg.reissue, "reissue", 3, "times to reissue a request after a timeout or network error")
+	fs.BoolVar(&cfg.resume, "c", false, "get: resume into an existing local file")
+	fs.BoolVar(&cfg.mirror, "r", false, "transfer a list of files (get) or a directory tree (put)")
+	fs.BoolVar(&cfg.json, "json", false, "report each transfer as a line of JSON on stdout")
+	fs.BoolVar(&cfg.progress, "progress", isTerminal(os.Stderr), "show a progress bar on stderr")
+	fs.BoolVar(&cfg.quiet, "q", false, "don't report successful transfers")
+	return fs
+}
 
-	pr_receive, err := tftp.ParsePacket(buffer)
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
 
-	fmt.Printf("Parsed Packet Err: %d Packet: %+v \n", err, pr_receive)
+func usage(w io.Writer) {
+	fmt.Fprint(w, `usage:
+  client get [flags] host[:port] remote [local]
+  client get -r [flags] host[:port] list [dir]
+  client put [flags] host[:port] local [remote]
+  client put -r [flags] host[:port] dir [prefix]
+  client batch [flags] host[:port] script
 
-	//log.Println(buffer)
-	//fmt.Printf("Reply from Server: %v \n", buffer)
+Run "client <command> -h" for the flags.
+`)
 }
 
-func write_file(conn net.Conn, s string) {
-
-	// Construct a write-file packet and send it to the server
+// run runs the command line args and returns the exit status.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return exitUsage
+	}
 
-	var pr_send = new(tftp.PacketRequest)
-	pr_send.Mode = "octet"
-	pr_send.Op = 2
-	pr_send.Filename = s
+	cfg := &config{stdout: stdout, stderr: stderr}
+	cmd := args[0]
+	fs := cfg.flags(cmd)
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	if cfg.json || cfg.quiet {
+		cfg.progress = false
+	}
 
-	b := make([]byte, 1024)
-	b = tftp.Packet.Serialize(pr_send)
+	var jobs []job
+	var err error
+	host := fs.Arg(0)
+	rest := fs.Args()
+	if len(rest) > 0 {
+		rest = rest[1:]
+	}
 
-	conn.Write(b)
+	switch {
+	case cmd == "get" && !cfg.mirror && (len(rest) == 1 || len(rest) == 2):
+		jobs = []job{getJob(rest...)}
+	case cmd == "get" && cfg.mirror && (len(rest) == 1 || len(rest) == 2):
+		jobs, err = listJobs(rest[0], optional(rest, 1, "."))
+	case cmd == "put" && !cfg.mirror && (len(rest) == 1 || len(rest) == 2):
+		jobs = []job{putJob(rest...)}
+	case cmd == "put" && cfg.mirror && (len(rest) == 1 || len(rest) == 2):
+		jobs, err = treeJobs(rest[0], optional(rest, 1, ""))
+	case cmd == "batch" && len(rest) == 1:
+		jobs, err = scriptJobs(rest[0])
+	default:
+		usage(stderr)
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "client: %s\n", err)
+		return exitFailed
+	}
 
+	status := exitOK
+	for _, j := range jobs {
+		res := cfg.transfer(ctx, host, j)
+		cfg.report(res)
+		if status == exitOK {
+			status = res.Exit
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return status
 }
 
-func process_write_file(conn net.Conn, s string) {
-
-	//simple Read
-	//buffer := make([]byte, 1024)
-	//conn.Read(buffer)
-
-	// Process a reply from the server
-	buffer := make([]byte, 1024)
-	conn.Read(buffer)
-
-	pr_receive, err := tftp.ParsePacket(buffer)
-
-	fmt.Printf("Parsed Packet Err: %d Packet: %+v \n", err, pr_receive)
+func optional(args []string, i int, def string) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return def
+}
 
-	//log.Println(buffer)
-	//fmt.Printf("Reply from Server: %v \n", buffer)
+// result describes one transfer, for the report.
+type result struct {
+	Op       string  `json:"op"`
+	Remote   string  `json:"remote"`
+	Local    string  `json:"local"`
+	Bytes    int64   `json:"bytes"`
+	Seconds  float64 `json:"seconds"`
+	Rate     float64 `json:"bytes_per_second"`
+	Attempts int     `json:"attempts"`
+	Error    string  `json:"error,omitempty"`
+	Code     *uint16 `json:"tftp_code,omitempty"`
+	Exit     int     `json:"exit"`
 }
 
-func main() {
+func (cfg *config) report(res result) {
+	if cfg.json {
+		b, _ := json.Marshal(res)
+		fmt.Fprintf(cfg.stdout, "%s\n", b)
+		return
+	}
+	if res.Error != "" {
+		fmt.Fprintf(cfg.stderr, "client: %s %s: %s\n", res.Op, res.Remote, res.Error)
+		return
+	}
+	if !cfg.quiet {
+		fmt.Fprintf(cfg.stderr, "%s %s: %d bytes in %.2fs (%s/s)\n",
+			res.Op, res.Remote, res.Bytes, res.Seconds, formatBytes(res.Rate))
+	}
+}
 
-	//Connect to the tftp server on localhost. Listen on port 69.
+// exitStatus returns the exit status for a transfer error, and the TFTP
+// error code if there is one.
+func exitStatus(err error) (int, *uint16) {
+	var e *client.Error
+	switch {
+	case err == nil:
+		return exitOK, nil
+	case errors.As(err, &e):
+		code := uint16(e.Code)
+		if code > maxTFTPCode {
+			return exitTFTPOther, &code
+		}
+		return exitTFTP + int(code), &code
+	case errors.Is(err, client.ErrTimeout):
+		return exitTimeout, nil
+	}
+	return exitFailed, nil
+}
 
-	conn , err := net.Dial("udp", ":69")
+// finish fills in the result fields derived from the outcome of a transfer.
+func finish(res *result, start time.Time, err error) {
+	res.Seconds = time.Since(start).Seconds()
+	if res.Seconds > 0 {
+		res.Rate = float64(res.Bytes) / res.Seconds
+	}
+	res.Exit, res.Code = exitStatus(err)
 	if err != nil {
-		log.Fatal(err)
+		res.Error = err.Error()
 	}
-	defer conn.Close()
-
-	fmt.Printf("Connection: %+v \n", conn)
-
-	// Generate requests
-
-	//write_file(conn, "xyz.txt")
-	read_file(conn, "xyz.txt")
-	write_file(conn, "xyz.txt")
-
-	log.Println("xyz.txt \n")
-
-}
\ No newline at end of file
+}
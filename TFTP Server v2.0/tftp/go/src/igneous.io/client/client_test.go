@@ -0,0 +1,208 @@
+package main
+
+import (
+	"../tftp"
+	"../tftp/client"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScriptJobs(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "script")
+	os.WriteFile(script, []byte(`
+# comment
+get boot/pxelinux.0
+get a.cfg local.cfg
+  put fw.bin
+put out/log.txt logs/1.txt
+`), 0666)
+
+	jobs, err := scriptJobs(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []job{
+		{"get", "boot/pxelinux.0", "pxelinux.0"},
+		{"get", "a.cfg", "local.cfg"},
+		{"put", "fw.bin", "fw.bin"},
+		{"put", "logs/1.txt", "out/log.txt"},
+	}
+	if !reflect.DeepEqual(jobs, expected) {
+		t.Errorf("Got %v; expected %v", jobs, expected)
+	}
+
+	os.WriteFile(script, []byte("get a\ndelete b\n"), 0666)
+	if _, err := scriptJobs(script); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("Expected an error for line 2; got %v", err)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		name, local string
+	}{
+		{"a", "dir/a"},
+		{"a/b/c", "dir/a/b/c"},
+		{"/a/b", "dir/a/b"},
+		{"../a", ""},
+		{"a/../../b", ""},
+		{"a/./b", ""},
+		{"a/", ""},
+	}
+
+	for _, test := range tests {
+		local, err := localPath("dir", test.name)
+		if test.local == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error; got %q", test.name, local)
+			}
+		} else if err != nil || local != filepath.FromSlash(test.local) {
+			t.Errorf("%q: got %q, %v; expected %q", test.name, local, err, test.local)
+		}
+	}
+}
+
+func TestTreeJobs(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sub"), 0777)
+	os.WriteFile(filepath.Join(dir, "a"), nil, 0666)
+	os.WriteFile(filepath.Join(dir, "sub", "b"), nil, 0666)
+
+	jobs, err := treeJobs(dir, "img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []job{
+		{"put", "img/a", filepath.Join(dir, "a")},
+		{"put", "img/sub/b", filepath.Join(dir, "sub", "b")},
+	}
+	if !reflect.DeepEqual(jobs, expected) {
+		t.Errorf("Got %v; expected %v", jobs, expected)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		exit int
+	}{
+		{nil, exitOK},
+		{client.ErrTimeout, exitTimeout},
+		{&client.Error{Code: 1, Msg: "File not found."}, 11},
+		{fmt.Errorf("wrapped: %w", &client.Error{Code: 6}), 16},
+		{&client.Error{Code: 8}, 18},
+		{&client.Error{Code: 9}, exitTFTPOther},
+		{&client.Error{Code: 246}, exitTFTPOther},
+		{&client.Error{Code: 0xffff}, exitTFTPOther},
+		{os.ErrNotExist, exitFailed},
+	}
+
+	for _, test := range tests {
+		if exit, _ := exitStatus(test.err); exit != test.exit {
+			t.Errorf("%v: exit status %d; expected %d", test.err, exit, test.exit)
+		}
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	p := &progress{name: "f", total: 4096, n: 1024}
+	if line := p.line(time.Second); line != "f  [=======>                      ]  25%  1.0 KiB  1.0 KiB/s" {
+		t.Errorf("Got %q", line)
+	}
+
+	p = &progress{name: "f", total: -1, n: 3 << 20}
+	if line := p.line(2 * time.Second); line != "f  3.0 MiB  1.5 MiB/s" {
+		t.Errorf("Got %q", line)
+	}
+}
+
+// A server that never answers gives a timeout, reported in JSON with the
+// timeout exit status after the request is reissued.
+
+func TestRunTimeoutJSON(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	local := filepath.Join(t.TempDir(), "f")
+	var stdout, stderr bytes.Buffer
+	args := []string{"get", "-json", "-timeout", "5ms", "-retries", "1", "-reissue", "1", silent.LocalAddr().String(), "f", local}
+
+	if exit := run(context.Background(), args, &stdout, &stderr); exit != exitTimeout {
+		t.Errorf("Exit status %d; expected %d. stderr: %s", exit, exitTimeout, stderr.String())
+	}
+
+	var res result
+	if err := json.Unmarshal(stdout.Bytes(), &res); err != nil {
+		t.Fatalf("Bad JSON %q: %s", stdout.String(), err)
+	}
+	if res.Op != "get" || res.Remote != "f" || res.Attempts != 2 || res.Exit != exitTimeout || res.Error == "" {
+		t.Errorf("Unexpected result %+v", res)
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"get"}, {"get", "host"}, {"fetch", "host", "f"}, {"batch", "host"}, {"put", "-bogus", "host", "f"}} {
+		var stdout, stderr bytes.Buffer
+		if exit := run(context.Background(), args, &stdout, &stderr); exit != exitUsage {
+			t.Errorf("%q: exit status %d; expected %d", args, exit, exitUsage)
+		}
+	}
+}
+
+// A get the server refuses leaves an existing local file as it was, with or
+// without -c, and leaves nothing behind where there was no file.
+func TestRunRefusedGet(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	go func() {
+		refusal := (&tftp.PacketError{Code: uint16(tftp.ErrCodeFileNotFound), Msg: "File not found."}).Serialize()
+		buf := make([]byte, tftp.MaxPacketSize)
+		for {
+			_, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(refusal, addr)
+		}
+	}()
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing")
+	if err := os.WriteFile(existing, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, flags := range [][]string{nil, {"-c"}} {
+		var stdout, stderr bytes.Buffer
+		args := append(append([]string{"get"}, flags...), server.LocalAddr().String(), "f", existing)
+		if exit := run(context.Background(), args, &stdout, &stderr); exit != exitTFTP+1 {
+			t.Errorf("%q: exit status %d; expected %d. stderr: %s", args, exit, exitTFTP+1, stderr.String())
+		}
+		if got, err := os.ReadFile(existing); err != nil || string(got) != "keep me" {
+			t.Errorf("%q: local file holds %q, %v; expected it untouched", args, got, err)
+		}
+
+		missing := filepath.Join(dir, "missing", "f")
+		args = append(append([]string{"get"}, flags...), server.LocalAddr().String(), "f", missing)
+		run(context.Background(), args, &stdout, &stderr)
+		if _, err := os.Stat(missing); !os.IsNotExist(err) {
+			t.Errorf("%q: refused get left a local file behind: %v", args, err)
+		}
+	}
+}
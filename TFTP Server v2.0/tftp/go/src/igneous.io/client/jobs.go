@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// job is one transfer to run. Remote names always use forward slashes.
+type job struct {
+	op     string // "get" or "put"
+	remote string
+	local  string
+}
+
+// getJob makes a get of remote, saved as local, or under the last element of
+// the remote name if local is not given.
+func getJob(args ...string) job {
+	j := job{op: "get", remote: args[0], local: path.Base(args[0])}
+	if len(args) > 1 {
+		j.local = args[1]
+	}
+	return j
+}
+
+// putJob makes a put of local, stored as remote, or under the local file's
+// name if remote is not given.
+func putJob(args ...string) job {
+	j := job{op: "put", local: args[0], remote: filepath.Base(args[0])}
+	if len(args) > 1 {
+		j.remote = args[1]
+	}
+	return j
+}
+
+// listJobs makes a get for each remote name listed in the file list, saved
+// under dir at the same relative path.
+func listJobs(list, dir string) ([]job, error) {
+	names, err := readLines(list)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []job
+	for _, line := range names {
+		local, err := localPath(dir, line.text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", list, line.num, err)
+		}
+		jobs = append(jobs, job{op: "get", remote: line.text, local: local})
+	}
+	return jobs, nil
+}
+
+// localPath returns where the remote name is saved under dir. Names that
+// would land outside dir are refused.
+func localPath(dir, name string) (string, error) {
+	clean := path.Clean("/" + name)[1:]
+	if clean == "" || clean != strings.TrimPrefix(name, "/") {
+		return "", fmt.Errorf("%q is not a plain relative file name", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+// treeJobs makes a put for each regular file under dir, named by its path
+// relative to dir under prefix.
+func treeJobs(dir, prefix string) ([]job, error) {
+	var jobs []job
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, job{op: "put", local: p, remote: path.Join(prefix, filepath.ToSlash(rel))})
+		return nil
+	})
+	return jobs, err
+}
+
+// scriptJobs reads a batch script.
+func scriptJobs(script string) ([]job, error) {
+	lines, err := readLines(script)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []job
+	for _, line := range lines {
+		fields := strings.Fields(line.text)
+		switch {
+		case fields[0] == "get" && (len(fields) == 2 || len(fields) == 3):
+			jobs = append(jobs, getJob(fields[1:]...))
+		case fields[0] == "put" && (len(fields) == 2 || len(fields) == 3):
+			jobs = append(jobs, putJob(fields[1:]...))
+		default:
+			return nil, fmt.Errorf("%s:%d: expected \"get remote [local]\" or \"put local [remote]\"", script, line.num)
+		}
+	}
+	return jobs, nil
+}
+
+type line struct {
+	num  int
+	text string
+}
+
+// readLines returns the non-blank lines of the named file ("-" for stdin)
+// that are not # comments, trimmed of surrounding space.
+func readLines(name string) ([]line, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return parseLines(r)
+}
+
+func parseLines(r io.Reader) ([]line, error) {
+	var lines []line
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		lines = append(lines, line{n, text})
+	}
+	return lines, s.Err()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// progressInterval is how often the progress bar is redrawn.
+const progressInterval = 100 * time.Millisecond
+
+const barWidth = 30
+
+// progress counts the bytes of a transfer, and draws a progress bar with the
+// throughput on stderr if cfg.progress is set.
+type progress struct {
+	w     io.Writer // nil when the bar is off
+	name  string
+	total int64 // -1 if unknown
+	n     int64
+	start time.Time
+	drawn time.Time
+}
+
+func (cfg *config) newProgress(name string, total int64) *progress {
+	p := &progress{name: name, total: total, start: time.Now()}
+	if cfg.progress {
+		p.w = cfg.stderr
+	}
+	return p
+}
+
+// reader returns r, counting the bytes read from it.
+func (p *progress) reader(r io.Reader) *progressReader {
+	return &progressReader{r, p}
+}
+
+func (p *progress) add(n int) {
+	p.n += int64(n)
+	if p.w != nil && time.Since(p.drawn) >= progressInterval {
+		p.draw()
+	}
+}
+
+func (p *progress) draw() {
+	p.drawn = time.Now()
+	fmt.Fprintf(p.w, "\r%s\x1b[K", p.line(p.drawn.Sub(p.start)))
+}
+
+// done draws the final state of the bar, and ends its line.
+func (p *progress) done() {
+	if p.w != nil {
+		p.draw()
+		fmt.Fprintln(p.w)
+	}
+}
+
+// line formats the progress bar after elapsed time.
+func (p *progress) line(elapsed time.Duration) string {
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.n) / elapsed.Seconds()
+	}
+	stats := fmt.Sprintf("%s  %s/s", formatBytes(float64(p.n)), formatBytes(rate))
+
+	if p.total <= 0 {
+		return fmt.Sprintf("%s  %s", p.name, stats)
+	}
+
+	frac := float64(p.n) / float64(p.total)
+	if frac > 1 {
+		frac = 1
+	}
+	filled := int(frac * barWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	return fmt.Sprintf("%s  [%s] %3.0f%%  %s", p.name, bar, frac*100, stats)
+}
+
+// formatBytes formats a byte count with a binary unit.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.add(n)
+	return n, err
+}
+
+// Len returns the number of bytes left to read, when the total is known.
+// The client uses it to send the tsize option on puts.
+func (r *progressReader) Len() int {
+	if r.p.total < 0 {
+		return -1
+	}
+	return int(r.p.total - r.p.n)
+}
+
+// isTerminal reports whether f is a terminal, rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
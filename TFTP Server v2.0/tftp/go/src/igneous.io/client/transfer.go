@@ -0,0 +1,183 @@
+package main
+
+import (
+	"../tftp/client"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// transfer runs one job against the server at host, reissuing the request
+// after failures that may be transient.
+func (cfg *config) transfer(ctx context.Context, host string, j job) result {
+	res := result{Op: j.op, Remote: j.remote, Local: j.local}
+	start := time.Now()
+
+	var err error
+	if j.op == "get" {
+		err = cfg.get(ctx, host, j, &res)
+	} else {
+		err = cfg.put(ctx, host, j, &res)
+	}
+
+	finish(&res, start, err)
+	return res
+}
+
+// reissuable reports whether a failed transfer is worth trying again. Errors
+// from the server are answers, and are not retried.
+func reissuable(ctx context.Context, err error) bool {
+	var e *client.Error
+	return ctx.Err() == nil && !errors.As(err, &e)
+}
+
+func (cfg *config) get(ctx context.Context, host string, j job, res *result) error {
+	_, err := os.Lstat(j.local)
+	existed := err == nil
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if cfg.resume {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	w := &localFile{name: j.local, flags: flags}
+
+	var saved int64
+	if cfg.resume {
+		if err := w.open(); err != nil {
+			return err
+		}
+		if saved, err = w.f.Seek(0, io.SeekEnd); err != nil {
+			w.f.Close()
+			return err
+		}
+	}
+
+	for res.Attempts = 1; ; res.Attempts++ {
+		var n int64
+		n, err = cfg.fetch(ctx, host, j.remote, w, saved)
+		saved += n
+		if err == nil || res.Attempts > cfg.reissue || !reissuable(ctx, err) {
+			break
+		}
+		cfg.notef("%s: %s; reissuing the request at byte %d", j.remote, err, saved)
+	}
+	res.Bytes = saved
+
+	// An empty remote file still makes an empty local one.
+	if err == nil {
+		err = w.open()
+	}
+	if w.f != nil {
+		if cerr := w.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	// Keep a partial file so it can be resumed with -c, but don't leave an
+	// empty one behind for a file the server refused. A file that was there
+	// before is never removed.
+	if err != nil && saved == 0 && w.f != nil && !existed {
+		os.Remove(j.local)
+	}
+	return err
+}
+
+// localFile is where get saves a download. The file is opened, and
+// truncated, on the first write, so a get the server refuses leaves an
+// existing file as it was.
+type localFile struct {
+	name  string
+	flags int
+	f     *os.File
+}
+
+func (l *localFile) open() error {
+	if l.f != nil {
+		return nil
+	}
+	if dir := filepath.Dir(l.name); dir != "." {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(l.name, l.flags, 0666)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	return nil
+}
+
+func (l *localFile) Write(p []byte) (int, error) {
+	if err := l.open(); err != nil {
+		return 0, err
+	}
+	return l.f.Write(p)
+}
+
+// fetch reads the remote file, skips the first offset bytes, and writes the
+// rest to w. It returns the number of bytes written.
+func (cfg *config) fetch(ctx context.Context, host, remote string, w io.Writer, offset int64) (int64, error) {
+	rc, err := cfg.client.Get(ctx, host, remote)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	size, _ := rc.(*client.Reader).Size()
+	p := cfg.newProgress(remote, size)
+	defer p.done()
+	r := p.reader(rc)
+
+	if offset > 0 {
+		skipped, err := io.CopyN(io.Discard, r, offset)
+		if err == io.EOF {
+			return 0, fmt.Errorf("local file is %d bytes, longer than the remote file (%d bytes)", offset, skipped)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return io.Copy(w, r)
+}
+
+func (cfg *config) put(ctx context.Context, host string, j job, res *result) error {
+	f, err := os.Open(j.local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	for res.Attempts = 1; ; res.Attempts++ {
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		p := cfg.newProgress(j.remote, fi.Size())
+		err = cfg.client.Put(ctx, host, j.remote, p.reader(f))
+		p.done()
+		res.Bytes = p.n
+
+		if err == nil || res.Attempts > cfg.reissue || !reissuable(ctx, err) {
+			return err
+		}
+		cfg.notef("%s: %s; reissuing the request", j.remote, err)
+	}
+}
+
+// notef writes a note about the progress of a transfer to stderr, unless the
+// output is JSON or quiet.
+func (cfg *config) notef(format string, args ...interface{}) {
+	if !cfg.json && !cfg.quiet {
+		fmt.Fprintf(cfg.stderr, "client: "+format+"\n", args...)
+	}
+}
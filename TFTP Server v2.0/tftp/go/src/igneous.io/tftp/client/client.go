@@ -0,0 +1,250 @@
+// Package client implements a TFTP client: RFC 1350 transfers in octet and
+// netascii mode, with option negotiation for blksize (RFC 2348), tsize and
+// timeout (RFC 2349) and windowsize (RFC 7440).
+//
+// Each transfer uses its own socket, so the local port is the transfer ID.
+// The server answers from a port of its own choosing; the first reply fixes
+// the server's transfer ID, and packets from any other port are answered with
+// ERROR 5 and otherwise ignored.
+package client
+
+import (
+	"../../tftp"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultPort      = 69
+	DefaultBlockSize = 512
+	DefaultTimeout   = time.Second
+	DefaultRetries   = 5
+
+	MinBlockSize = 8     // RFC 2348
+	MaxBlockSize = 65464 // RFC 2348
+)
+
+// Option names.
+const (
+	OptBlockSize    = "blksize"
+	OptTransferSize = "tsize"
+	OptTimeout      = "timeout"
+	OptWindowSize   = "windowsize"
+)
+
+// Client holds the settings used for transfers. The zero value transfers in
+// octet mode without options, retrying every DefaultTimeout up to
+// DefaultRetries times.
+type Client struct {
+	// Mode is "octet" (the default) or "netascii".
+	Mode string
+
+	// BlockSize requests the blksize option when it is set and not 512.
+	// The server may answer with a smaller size.
+	BlockSize int
+
+	// WindowSize requests the windowsize option when it is greater than 1.
+	// The server may answer with a smaller window.
+	WindowSize int
+
+	// TransferSize requests the tsize option. For Get the server's answer is
+	// reported by Reader.Size; for Put the size is sent when the reader's
+	// length can be determined without reading it.
+	TransferSize bool
+
+	// Timeout is how long to wait for a reply before retransmitting. When it
+	// is set to a whole number of seconds from 1 to 255, the timeout option
+	// is requested as well, so the server uses the same interval.
+	Timeout time.Duration
+
+	// Retries is the number of retransmits without progress before a transfer
+	// fails with ErrTimeout.
+	Retries int
+
+	// ListenPacket opens the local socket for a transfer. The default is a
+	// UDP socket on an ephemeral port; tests replace it to run transfers over
+	// a simulated network.
+	ListenPacket func() (net.PacketConn, error)
+}
+
+// DefaultClient is used by the package level Get and Put.
+var DefaultClient = &Client{}
+
+// Get reads the named file from the server at addr using DefaultClient.
+func Get(ctx context.Context, addr, name string) (io.ReadCloser, error) {
+	return DefaultClient.Get(ctx, addr, name)
+}
+
+// Put writes r to the named file on the server at addr using DefaultClient.
+func Put(ctx context.Context, addr, name string, r io.Reader) error {
+	return DefaultClient.Put(ctx, addr, name, r)
+}
+
+func (c *Client) mode() string {
+	if c.Mode == "" {
+		return "octet"
+	}
+	return c.Mode
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
+func (c *Client) retries() int {
+	if c.Retries <= 0 {
+		return DefaultRetries
+	}
+	return c.Retries
+}
+
+func (c *Client) validMode() bool {
+	return c.mode() == "octet" || c.mode() == "netascii"
+}
+
+// options returns the options to request, or nil if the defaults will do.
+// tsize is the transfer size to send, or negative to leave it out.
+func (c *Client) options(tsize int64) map[string]string {
+	options := make(map[string]string)
+	if c.BlockSize != 0 && c.BlockSize != DefaultBlockSize {
+		options[OptBlockSize] = strconv.Itoa(c.BlockSize)
+	}
+	if c.WindowSize > 1 {
+		options[OptWindowSize] = strconv.Itoa(c.WindowSize)
+	}
+	if s := c.Timeout / time.Second; c.Timeout%time.Second == 0 && s >= 1 && s <= 255 {
+		options[OptTimeout] = strconv.Itoa(int(s))
+	}
+	if c.TransferSize && tsize >= 0 {
+		options[OptTransferSize] = strconv.FormatInt(tsize, 10)
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return options
+}
+
+// negotiated holds the transfer parameters after option negotiation.
+type negotiated struct {
+	blockSize  int
+	windowSize int
+	timeout    time.Duration
+	tsize      int64 // -1 if unknown
+}
+
+func (c *Client) defaults() negotiated {
+	return negotiated{
+		blockSize:  DefaultBlockSize,
+		windowSize: 1,
+		timeout:    c.timeout(),
+		tsize:      -1,
+	}
+}
+
+// accept checks the options in an OACK against the ones requested, and
+// returns the parameters to use. RFC 2347: the server may only acknowledge
+// options that were requested, and may only lower blksize and windowsize.
+func (c *Client) accept(requested, acked map[string]string) (negotiated, error) {
+	n := c.defaults()
+	for name, value := range acked {
+		if _, ok := requested[name]; !ok {
+			return n, &Error{Code: tftp.ErrCodeOptionNegotiation, Msg: "unrequested option " + name}
+		}
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || v < 0 {
+			return n, &Error{Code: tftp.ErrCodeOptionNegotiation, Msg: "bad value for " + name}
+		}
+		switch name {
+		case OptBlockSize:
+			if v < MinBlockSize || v > int64(c.BlockSize) {
+				return n, &Error{Code: tftp.ErrCodeOptionNegotiation, Msg: "bad value for " + name}
+			}
+			n.blockSize = int(v)
+		case OptWindowSize:
+			if v < 1 || v > int64(c.WindowSize) {
+				return n, &Error{Code: tftp.ErrCodeOptionNegotiation, Msg: "bad value for " + name}
+			}
+			n.windowSize = int(v)
+		case OptTimeout:
+			if value != requested[name] {
+				return n, &Error{Code: tftp.ErrCodeOptionNegotiation, Msg: "bad value for " + name}
+			}
+			n.timeout = time.Duration(v) * time.Second
+		case OptTransferSize:
+			n.tsize = v
+		}
+	}
+	return n, nil
+}
+
+// resolve adds the default port to addr if it has none.
+func resolve(addr string) (net.Addr, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(DefaultPort))
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
+// sizeOf returns the number of bytes r will produce, if that can be told without reading it.
+func sizeOf(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }: // bytes.Buffer, bytes.Reader, strings.Reader
+		return int64(r.Len())
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return fi.Size() - offset
+	}
+	return -1
+}
+
+// newTransfer opens the socket for one transfer with the server at addr.
+func (c *Client) newTransfer(ctx context.Context, addr string) (*transfer, error) {
+	if !c.validMode() {
+		return nil, &Error{Code: tftp.ErrCodeIllegalOperation, Msg: "unsupported mode " + c.Mode}
+	}
+	peer, err := resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+	listen := c.ListenPacket
+	if listen == nil {
+		listen = func() (net.PacketConn, error) { return net.ListenPacket("udp", ":0") }
+	}
+	conn, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	return newTransfer(ctx, conn, peer, c.timeout(), c.retries()), nil
+}
+
+// sendRequest sends req, retransmitting until the server answers with a
+// packet accepted by want, and returns that packet.
+func (t *transfer) sendRequest(req tftp.Packet, want func(tftp.Packet) bool) (tftp.Packet, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.send(req); err != nil {
+			return nil, err
+		}
+		p, err := t.receive(time.Now().Add(t.timeout), want)
+		if err == errRetransmit {
+			if attempt >= t.retries {
+				return nil, ErrTimeout
+			}
+			continue
+		}
+		return p, err
+	}
+}
@@ -0,0 +1,535 @@
+package client
+
+import (
+	"../../tftp"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is a small TFTP server with options and windowing, used to
+// exercise the client. Each transfer gets its own socket, as RFC 1350 asks.
+type testServer struct {
+	t     *testing.T
+	pc    net.PacketConn
+	start sync.Once
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	requests []tftp.PacketRequest
+
+	noOptions bool                             // ignore options, as an RFC 1350 server would
+	drop      func(p tftp.Packet) bool         // drop an outgoing packet
+	sent      func(p tftp.Packet, to net.Addr) // called after each packet is sent
+	maxBlock  int                              // lower blksize to this in the OACK, if set
+}
+
+func newTestServer(t *testing.T) *testServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{t: t, pc: pc, files: make(map[string][]byte)}
+	t.Cleanup(func() { pc.Close() })
+	return s
+}
+
+// addr returns the server's address. The server starts serving on the first
+// call, so tests set up its behaviour before then.
+func (s *testServer) addr() string {
+	s.start.Do(func() { go s.serve() })
+	return s.pc.LocalAddr().String()
+}
+
+func (s *testServer) serve() {
+	buf := make([]byte, tftp.MaxPacketSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		p, err := tftp.ParsePacket(buf[:n])
+		if req, ok := p.(*tftp.PacketRequest); ok && err == nil {
+			s.mu.Lock()
+			s.requests = append(s.requests, *req)
+			s.mu.Unlock()
+			go s.transfer(*req, addr)
+		}
+	}
+}
+
+func (s *testServer) file(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[name]
+	return data, ok
+}
+
+func (s *testServer) store(name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = data
+}
+
+func (s *testServer) lastRequest() tftp.PacketRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+// serverConn is one transfer's socket on the test server.
+type serverConn struct {
+	s    *testServer
+	conn net.PacketConn
+	peer net.Addr
+	buf  []byte
+}
+
+func (c *serverConn) send(p tftp.Packet) {
+	if c.s.drop != nil && c.s.drop(p) {
+		return
+	}
+	c.conn.WriteTo(p.Serialize(), c.peer)
+	if c.s.sent != nil {
+		c.s.sent(p, c.peer)
+	}
+}
+
+// serverTimeout is the test server's retransmission timeout.
+const serverTimeout = 50 * time.Millisecond
+
+// receive returns the next packet from the client, or nil at the deadline.
+func (c *serverConn) receive(deadline time.Time) tftp.Packet {
+	for {
+		c.conn.SetReadDeadline(deadline)
+		n, addr, err := c.conn.ReadFrom(c.buf)
+		if err != nil {
+			return nil
+		}
+		if addr.String() != c.peer.String() {
+			continue
+		}
+		p, err := tftp.ParsePacket(c.buf[:n])
+		if err != nil {
+			continue
+		}
+		return p
+	}
+}
+
+func (s *testServer) transfer(req tftp.PacketRequest, peer net.Addr) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	c := &serverConn{s: s, conn: conn, peer: peer, buf: make([]byte, 4+MaxBlockSize)}
+
+	data, exists := s.file(req.Filename)
+	if req.Op == tftp.OpRRQ && !exists {
+		c.send(&tftp.PacketError{Code: 1, Msg: "File not found."})
+		return
+	}
+	if req.Op == tftp.OpWRQ && exists {
+		c.send(&tftp.PacketError{Code: 6, Msg: "File already exists."})
+		return
+	}
+
+	blockSize, windowSize := DefaultBlockSize, 1
+	var oack *tftp.PacketOAck
+	if !s.noOptions && len(req.Options) > 0 {
+		oack = &tftp.PacketOAck{Options: make(map[string]string)}
+		for name, value := range req.Options {
+			v, _ := strconv.Atoi(value)
+			switch name {
+			case OptBlockSize:
+				if s.maxBlock != 0 && v > s.maxBlock {
+					v = s.maxBlock
+				}
+				blockSize = v
+				oack.Options[name] = strconv.Itoa(v)
+			case OptWindowSize:
+				windowSize = v
+				oack.Options[name] = value
+			case OptTimeout:
+				oack.Options[name] = value
+			case OptTransferSize:
+				if req.Op == tftp.OpRRQ {
+					value = strconv.Itoa(len(data))
+				}
+				oack.Options[name] = value
+			}
+		}
+	}
+
+	if req.Op == tftp.OpRRQ {
+		if oack != nil {
+			if !c.await(oack, 0) {
+				return
+			}
+		}
+		c.sendFile(data, blockSize, windowSize)
+	} else {
+		first := tftp.Packet(&tftp.PacketAck{BlockNum: 0})
+		if oack != nil {
+			first = oack
+		}
+		c.receiveFile(req.Filename, first, blockSize, windowSize)
+	}
+}
+
+// await sends p until the client acks block.
+func (c *serverConn) await(p tftp.Packet, block uint16) bool {
+	for i := 0; i < 20; i++ {
+		c.send(p)
+		deadline := time.Now().Add(serverTimeout)
+		for r := c.receive(deadline); r != nil; r = c.receive(deadline) {
+			if ack, ok := r.(*tftp.PacketAck); ok && ack.BlockNum == block {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *serverConn) sendFile(data []byte, blockSize, windowSize int) {
+	blocks := len(data)/blockSize + 1
+	block := func(b int) tftp.Packet {
+		start := (b - 1) * blockSize
+		end := start + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		return &tftp.PacketData{BlockNum: uint16(b), Data: data[start:end]}
+	}
+
+	base := 1
+	for tries := 0; base <= blocks && tries < 20; tries++ {
+		for b := base; b < base+windowSize && b <= blocks; b++ {
+			c.send(block(b))
+		}
+		deadline := time.Now().Add(serverTimeout)
+		for r := c.receive(deadline); r != nil; r = c.receive(deadline) {
+			ack, ok := r.(*tftp.PacketAck)
+			if !ok {
+				continue
+			}
+			if b := base + int(ack.BlockNum-uint16(base)); b >= base && b < base+windowSize {
+				base = b + 1
+				tries = 0
+				break
+			}
+		}
+	}
+}
+
+func (c *serverConn) receiveFile(name string, first tftp.Packet, blockSize, windowSize int) {
+	var data []byte
+	expected := uint16(1)
+	sinceAck := 0
+	last := first
+
+	c.send(first)
+	for tries := 0; tries < 20; {
+		r := c.receive(time.Now().Add(serverTimeout))
+		if r == nil {
+			tries++
+			c.send(last)
+			continue
+		}
+		dp, ok := r.(*tftp.PacketData)
+		if !ok {
+			continue
+		}
+		if dp.BlockNum != expected {
+			// A retransmission, so our last ACK was lost.
+			c.send(last)
+			continue
+		}
+		tries = 0
+		data = append(data, dp.Data...)
+		expected++
+		sinceAck++
+		if len(dp.Data) < blockSize || sinceAck == windowSize {
+			last = &tftp.PacketAck{BlockNum: dp.BlockNum}
+			c.send(last)
+			sinceAck = 0
+		}
+		if len(dp.Data) < blockSize {
+			c.s.store(name, data)
+			c.dally(last)
+			return
+		}
+	}
+}
+
+// dally answers retransmissions of the final block for a while, in case the
+// final ACK was lost.
+func (c *serverConn) dally(last tftp.Packet) {
+	deadline := time.Now().Add(3 * serverTimeout)
+	for r := c.receive(deadline); r != nil; r = c.receive(deadline) {
+		if _, ok := r.(*tftp.PacketData); ok {
+			c.send(last)
+		}
+	}
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestPutGet(t *testing.T) {
+	clients := []struct {
+		name string
+		c    *Client
+	}{
+		{"defaults", &Client{Timeout: 100 * time.Millisecond}},
+		{"blksize", &Client{Timeout: 100 * time.Millisecond, BlockSize: 1024}},
+		{"windowsize", &Client{Timeout: 100 * time.Millisecond, WindowSize: 4}},
+		{"all", &Client{Timeout: time.Second, BlockSize: 700, WindowSize: 3, TransferSize: true}},
+	}
+
+	for _, tc := range clients {
+		s := newTestServer(t)
+		for _, size := range []int{0, 1, 511, 512, 513, 1024, 2100, 10000} {
+			name := fmt.Sprintf("%s-%d", tc.name, size)
+			data := testData(size)
+
+			if err := tc.c.PutBytes(context.Background(), s.addr(), name, data); err != nil {
+				t.Errorf("%s: Put: %s", name, err)
+				continue
+			}
+			if stored, _ := s.file(name); !bytes.Equal(stored, data) {
+				t.Errorf("%s: server stored %d bytes; expected %d", name, len(stored), len(data))
+			}
+
+			got, err := tc.c.GetBytes(context.Background(), s.addr(), name)
+			if err != nil {
+				t.Errorf("%s: Get: %s", name, err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("%s: Get returned %d bytes; expected %d", name, len(got), len(data))
+			}
+		}
+	}
+}
+
+func TestOptionNegotiation(t *testing.T) {
+	s := newTestServer(t)
+	s.maxBlock = 600
+	s.store("f", testData(5000))
+
+	c := &Client{BlockSize: 1428, WindowSize: 8, TransferSize: true, Timeout: 2 * time.Second}
+	rc, err := c.Get(context.Background(), s.addr(), "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	want := map[string]string{"blksize": "1428", "windowsize": "8", "tsize": "0", "timeout": "2"}
+	if got := s.lastRequest().Options; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Requested options %v; expected %v", got, want)
+	}
+
+	r := rc.(*Reader)
+	if size, ok := r.Size(); !ok || size != 5000 {
+		t.Errorf("Size returned %d, %v; expected 5000", size, ok)
+	}
+	if r.n.blockSize != 600 {
+		t.Errorf("Expected the server's smaller block size 600; got %d", r.n.blockSize)
+	}
+}
+
+func TestServerWithoutOptions(t *testing.T) {
+	s := newTestServer(t)
+	s.noOptions = true
+	data := testData(3000)
+
+	c := &Client{BlockSize: 1024, WindowSize: 4, TransferSize: true, Timeout: 100 * time.Millisecond}
+	if err := c.PutBytes(context.Background(), s.addr(), "f", data); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	got, err := c.GetBytes(context.Background(), s.addr(), "f")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Get returned %d bytes, %v", len(got), err)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	s := newTestServer(t)
+	s.store("exists", []byte("x"))
+	c := &Client{Timeout: 100 * time.Millisecond}
+
+	if _, err := c.Get(context.Background(), s.addr(), "missing"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("Get missing file: expected ErrFileNotFound; got %v", err)
+	}
+	err := c.PutBytes(context.Background(), s.addr(), "exists", []byte("y"))
+	if !errors.Is(err, ErrFileExists) {
+		t.Errorf("Put existing file: expected ErrFileExists; got %v", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Msg != "File already exists." {
+		t.Errorf("Expected the server's message; got %v", err)
+	}
+}
+
+func TestRetransmission(t *testing.T) {
+	s := newTestServer(t)
+
+	// Drop the first copy of every third DATA and ACK the server sends.
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	s.drop = func(p tftp.Packet) bool {
+		var key string
+		switch p := p.(type) {
+		case *tftp.PacketData:
+			key = fmt.Sprintf("DATA %d", p.BlockNum)
+			if p.BlockNum%3 != 0 {
+				return false
+			}
+		case *tftp.PacketAck:
+			key = fmt.Sprintf("ACK %d", p.BlockNum)
+			if p.BlockNum%3 != 0 {
+				return false
+			}
+		default:
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+		return true
+	}
+
+	for _, window := range []int{1, 4} {
+		c := &Client{Timeout: 30 * time.Millisecond, WindowSize: window}
+		name := fmt.Sprintf("lossy-%d", window)
+		data := testData(20 * DefaultBlockSize)
+
+		if err := c.PutBytes(context.Background(), s.addr(), name, data); err != nil {
+			t.Fatalf("Window %d: Put: %s", window, err)
+		}
+		mu.Lock()
+		seen = make(map[string]bool)
+		mu.Unlock()
+
+		got, err := c.GetBytes(context.Background(), s.addr(), name)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("Window %d: Get returned %d bytes, %v", window, len(got), err)
+		}
+	}
+}
+
+func TestWrongTID(t *testing.T) {
+	s := newTestServer(t)
+	s.store("f", testData(2000))
+
+	stray, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stray.Close()
+
+	// Once the client has locked on to the server's TID, inject a DATA from another port.
+
+	var once sync.Once
+	s.sent = func(p tftp.Packet, client net.Addr) {
+		once.Do(func() {
+			stray.WriteTo((&tftp.PacketData{BlockNum: 2, Data: []byte("bogus")}).Serialize(), client)
+		})
+	}
+
+	c := &Client{Timeout: 100 * time.Millisecond}
+	got, err := c.GetBytes(context.Background(), s.addr(), "f")
+	if want, _ := s.file("f"); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("Get returned %d bytes, %v", len(got), err)
+	}
+
+	buf := make([]byte, tftp.MaxPacketSize)
+	stray.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := stray.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Stray sender got no reply: %s", err)
+	}
+	if p, _ := tftp.ParsePacket(buf[:n]); !errors.Is(asError(p), ErrUnknownTID) {
+		t.Errorf("Stray sender expected ERROR 5; got %#v", p)
+	}
+}
+
+func asError(p tftp.Packet) error {
+	if e, ok := p.(*tftp.PacketError); ok {
+		return tftp.ErrorFromPacket(e)
+	}
+	return nil
+}
+
+func TestTimeoutAndCancel(t *testing.T) {
+	// A server that never answers.
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	c := &Client{Timeout: 10 * time.Millisecond, Retries: 3}
+	if _, err := c.Get(context.Background(), silent.LocalAddr().String(), "f"); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout; got %v", err)
+	}
+
+	c = &Client{Timeout: 10 * time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = c.PutBytes(ctx, silent.LocalAddr().String(), "f", []byte("x"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Cancelled transfer took %v", elapsed)
+	}
+}
+
+func TestNetascii(t *testing.T) {
+	s := newTestServer(t)
+	c := &Client{Mode: "netascii", Timeout: 100 * time.Millisecond}
+
+	local := []byte("line one\nline two\r\nbare cr\r end\n")
+	wire := []byte("line one\r\nline two\r\x00\r\nbare cr\r\x00 end\r\n")
+
+	if err := c.PutBytes(context.Background(), s.addr(), "text", local); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := s.file("text"); !bytes.Equal(stored, wire) {
+		t.Errorf("Server stored %q; expected %q", stored, wire)
+	}
+	if got, err := c.GetBytes(context.Background(), s.addr(), "text"); err != nil || !bytes.Equal(got, local) {
+		t.Errorf("Get returned %q, %v; expected %q", got, err, local)
+	}
+}
+
+func TestCloseAbortsTransfer(t *testing.T) {
+	s := newTestServer(t)
+	s.store("big", testData(100*DefaultBlockSize))
+
+	c := &Client{Timeout: 100 * time.Millisecond}
+	rc, err := c.Get(context.Background(), s.addr(), "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Read(make([]byte, 10))
+	if err := rc.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"../../tftp"
+	"errors"
+)
+
+// Error is a TFTP error, received from the peer in an ERROR packet or sent to it
+// when the client gives up on a transfer. It is the tftp package's Error, so the
+// client and server agree on what each code means. Compare against the Err
+// values with errors.Is, which matches on Code alone.
+type Error = tftp.Error
+
+// Error codes from RFC 1350 and RFC 2347.
+var (
+	ErrNotDefined        = tftp.ErrNotDefined
+	ErrFileNotFound      = tftp.ErrFileNotFound
+	ErrAccessViolation   = tftp.ErrAccessViolation
+	ErrDiskFull          = tftp.ErrDiskFull
+	ErrIllegalOperation  = tftp.ErrIllegalOperation
+	ErrUnknownTID        = tftp.ErrUnknownTID
+	ErrFileExists        = tftp.ErrFileExists
+	ErrNoSuchUser        = tftp.ErrNoSuchUser
+	ErrOptionNegotiation = tftp.ErrOptionNegotiation
+)
+
+// ErrTimeout is returned when the peer stops answering and the retries are used up.
+var ErrTimeout = errors.New("tftp: transfer timed out")
@@ -0,0 +1,217 @@
+package client
+
+import (
+	"../../tftp"
+	"context"
+	"io"
+	"time"
+)
+
+// Reader streams a file from the server. Blocks are fetched as Read needs
+// them, so a slow reader slows the transfer rather than buffering the file.
+type Reader struct {
+	t   *transfer
+	n   negotiated
+	src io.Reader // readBlocks, or a netascii decoder wrapping it
+
+	expected uint64 // next block number expected, counting past rollover
+	sinceAck int    // blocks received since the last ACK
+	lastAck  uint16
+	data     []byte // unread part of the current block, aliases t.rbuf
+	done     bool
+	err      error
+}
+
+// Get sends a read request for the named file, and returns a reader for its
+// contents once the server has answered. Errors from the server, such as
+// ErrFileNotFound, are returned by Get itself. The caller must Close the
+// reader; closing it before EOF aborts the transfer.
+//
+// The returned io.ReadCloser is a *Reader.
+func (c *Client) Get(ctx context.Context, addr, name string) (io.ReadCloser, error) {
+	t, err := c.newTransfer(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &tftp.PacketRequest{
+		Op:       tftp.OpRRQ,
+		Filename: name,
+		Mode:     c.mode(),
+		Options:  c.options(0),
+	}
+
+	// The server answers with an OACK if it took any options, otherwise it
+	// starts sending data.
+	p, err := t.sendRequest(req, func(p tftp.Packet) bool {
+		switch p := p.(type) {
+		case *tftp.PacketOAck:
+			return req.Options != nil
+		case *tftp.PacketData:
+			return p.BlockNum == 1
+		}
+		return false
+	})
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+
+	r := &Reader{t: t, n: c.defaults(), expected: 1}
+	r.src = readerFunc(r.readBlocks)
+	if c.mode() == "netascii" {
+		r.src = newNetasciiDecoder(r.src)
+	}
+
+	switch p := p.(type) {
+	case *tftp.PacketOAck:
+		if r.n, err = c.accept(req.Options, p.Options); err != nil {
+			t.abort(err.(*Error))
+			t.close()
+			return nil, err
+		}
+		t.timeout = r.n.timeout
+
+		// RFC 2347: the client acknowledges the OACK with ACK 0.
+		if err := r.ack(0); err != nil {
+			t.close()
+			return nil, err
+		}
+	case *tftp.PacketData:
+		r.deliver(p)
+	}
+
+	return r, nil
+}
+
+// Size returns the file size reported by the server in the tsize option.
+// In netascii mode this is the size on the wire, before line endings are
+// converted.
+func (r *Reader) Size() (int64, bool) {
+	return r.n.tsize, r.n.tsize >= 0
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	return r.src.Read(p)
+}
+
+// Close releases the transfer's socket. If the file has not been read to the
+// end, the server is sent an ERROR so it stops the transfer.
+func (r *Reader) Close() error {
+	if !r.done && r.err == nil {
+		r.t.abort(&Error{Code: tftp.ErrCodeNotDefined, Msg: "Transfer cancelled."})
+	}
+	return r.t.close()
+}
+
+// readBlocks is the octet mode reader, it returns the data blocks as sent.
+func (r *Reader) readBlocks(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// next receives the next block in sequence, acknowledging as required.
+// If the transfer fails, the server is told unless the failure is an ERROR
+// from the server.
+func (r *Reader) next() error {
+	err := r.receiveNext()
+	if err != nil {
+		if _, ok := err.(*Error); !ok && err != ErrTimeout {
+			r.t.abort(&Error{Code: tftp.ErrCodeNotDefined, Msg: err.Error()})
+		}
+	}
+	return err
+}
+
+func (r *Reader) receiveNext() error {
+	retries := 0
+	nakSent := false
+
+	for {
+		p, err := r.t.receive(time.Now().Add(r.t.timeout), func(p tftp.Packet) bool {
+			_, ok := p.(*tftp.PacketData)
+			return ok
+		})
+		if err == errRetransmit {
+			// RFC 7440: on timeout, the receiver acknowledges the last block
+			// received in sequence, so the sender resends from there.
+			if retries++; retries > r.t.retries {
+				r.t.abort(&Error{Code: tftp.ErrCodeNotDefined, Msg: "Timeout."})
+				return ErrTimeout
+			}
+			if err := r.ack(r.lastAck); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		dp := p.(*tftp.PacketData)
+		if dp.BlockNum != uint16(r.expected) {
+			// A block from earlier means our ACK was lost; one from later
+			// means a block in the window was lost. Either way, acknowledge
+			// the last block received in sequence - once per gap, so the
+			// duplicates don't multiply on the sender's side.
+			if !nakSent {
+				nakSent = true
+				if err := r.ack(uint16(r.expected - 1)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		r.deliver(dp)
+		return nil
+	}
+}
+
+// deliver makes an in sequence block available to Read, and acknowledges it
+// at the end of a window or the end of the file.
+func (r *Reader) deliver(dp *tftp.PacketData) {
+	r.expected++
+	r.sinceAck++
+	r.data = dp.Data
+
+	last := len(dp.Data) < r.n.blockSize
+	if last || r.sinceAck >= r.n.windowSize {
+		r.ack(dp.BlockNum)
+	}
+	if last {
+		r.done = true
+	}
+}
+
+func (r *Reader) ack(blockNum uint16) error {
+	r.sinceAck = 0
+	r.lastAck = blockNum
+	return r.t.send(&tftp.PacketAck{BlockNum: blockNum})
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// GetBytes reads the whole of the named file. It is a convenience for small files.
+func (c *Client) GetBytes(ctx context.Context, addr, name string) ([]byte, error) {
+	rc, err := c.Get(ctx, addr, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
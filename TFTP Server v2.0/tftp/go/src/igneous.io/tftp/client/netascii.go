@@ -0,0 +1,103 @@
+package client
+
+import (
+	"bufio"
+	"io"
+)
+
+// netascii (RFC 764, as used by RFC 1350) ends lines with CR LF, and sends a
+// bare CR as CR NUL. Locally, lines end with LF.
+
+// netasciiEncoder converts a local stream to netascii: LF becomes CR LF, and
+// CR becomes CR NUL.
+type netasciiEncoder struct {
+	r          *bufio.Reader
+	pending    byte
+	hasPending bool
+}
+
+func newNetasciiEncoder(r io.Reader) io.Reader {
+	return &netasciiEncoder{r: bufio.NewReader(r)}
+}
+
+func (e *netasciiEncoder) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if e.hasPending {
+			p[n] = e.pending
+			e.hasPending = false
+			n++
+			continue
+		}
+
+		// Don't block for more input once something has been produced.
+		if n > 0 && e.r.Buffered() == 0 {
+			break
+		}
+
+		c, err := e.r.ReadByte()
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+
+		switch c {
+		case '\n':
+			p[n], e.pending, e.hasPending = '\r', '\n', true
+		case '\r':
+			p[n], e.pending, e.hasPending = '\r', 0, true
+		default:
+			p[n] = c
+		}
+		n++
+	}
+	return n, nil
+}
+
+// netasciiDecoder converts netascii to a local stream: CR LF becomes LF, and
+// CR NUL becomes CR. A CR followed by anything else is passed through.
+type netasciiDecoder struct {
+	r *bufio.Reader
+}
+
+func newNetasciiDecoder(r io.Reader) io.Reader {
+	return &netasciiDecoder{r: bufio.NewReader(r)}
+}
+
+func (d *netasciiDecoder) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if n > 0 && d.r.Buffered() == 0 {
+			break
+		}
+
+		c, err := d.r.ReadByte()
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+
+		// A CR at the end of a block is resolved by the first byte of the next.
+		if c == '\r' {
+			next, err := d.r.ReadByte()
+			switch {
+			case err == io.EOF:
+			case err != nil:
+				return n, err
+			case next == '\n':
+				c = '\n'
+			case next == 0:
+			default:
+				d.r.UnreadByte()
+			}
+		}
+
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestNetasciiConversion(t *testing.T) {
+	tests := []struct {
+		local, wire string
+	}{
+		{"", ""},
+		{"abc", "abc"},
+		{"\n", "\r\n"},
+		{"\r", "\r\x00"},
+		{"a\nb\n", "a\r\nb\r\n"},
+		{"a\r\nb", "a\r\x00\r\nb"},
+		{"\r\r\n\n", "\r\x00\r\x00\r\n\r\n"},
+	}
+
+	for _, test := range tests {
+		// One byte reads split every CR from the byte after it.
+		for _, wrap := range []func(io.Reader) io.Reader{identity, iotest.OneByteReader} {
+			wire, err := io.ReadAll(newNetasciiEncoder(wrap(strings.NewReader(test.local))))
+			if err != nil || string(wire) != test.wire {
+				t.Errorf("Encode %q: got %q, %v; expected %q", test.local, wire, err, test.wire)
+			}
+
+			local, err := io.ReadAll(newNetasciiDecoder(wrap(strings.NewReader(test.wire))))
+			if err != nil || string(local) != test.local {
+				t.Errorf("Decode %q: got %q, %v; expected %q", test.wire, local, err, test.local)
+			}
+		}
+	}
+
+	// A CR followed by anything else is passed through.
+	local, _ := io.ReadAll(newNetasciiDecoder(bytes.NewReader([]byte("a\rb\r"))))
+	if string(local) != "a\rb\r" {
+		t.Errorf("Decode of stray CRs returned %q", local)
+	}
+}
+
+func identity(r io.Reader) io.Reader { return r }
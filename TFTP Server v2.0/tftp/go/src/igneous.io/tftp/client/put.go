@@ -0,0 +1,169 @@
+package client
+
+import (
+	"../../tftp"
+	"bytes"
+	"context"
+	"io"
+	"time"
+)
+
+// Put sends a write request for the named file, and sends the contents of r.
+// It returns once the server has acknowledged the final block.
+func (c *Client) Put(ctx context.Context, addr, name string, r io.Reader) error {
+	t, err := c.newTransfer(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	// The size sent with tsize is the size on the wire, which is only known
+	// up front in octet mode.
+	tsize := int64(-1)
+	if c.mode() == "octet" {
+		tsize = sizeOf(r)
+	} else {
+		r = newNetasciiEncoder(r)
+	}
+
+	req := &tftp.PacketRequest{
+		Op:       tftp.OpWRQ,
+		Filename: name,
+		Mode:     c.mode(),
+		Options:  c.options(tsize),
+	}
+
+	// The server answers with an OACK if it took any options, otherwise ACK 0.
+	p, err := t.sendRequest(req, func(p tftp.Packet) bool {
+		switch p := p.(type) {
+		case *tftp.PacketOAck:
+			return req.Options != nil
+		case *tftp.PacketAck:
+			return p.BlockNum == 0
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
+	n := c.defaults()
+	if oack, ok := p.(*tftp.PacketOAck); ok {
+		if n, err = c.accept(req.Options, oack.Options); err != nil {
+			t.abort(err.(*Error))
+			return err
+		}
+		t.timeout = n.timeout
+	}
+
+	s := &sender{t: t, n: n, src: r, base: 1, next: 1}
+	s.window = make([][]byte, n.windowSize)
+	for i := range s.window {
+		s.window[i] = make([]byte, 0, n.blockSize)
+	}
+
+	err = s.run()
+	if err != nil {
+		if _, ok := err.(*Error); !ok && err != ErrTimeout {
+			t.abort(tftp.ErrorFor(err))
+		}
+	}
+	return err
+}
+
+// sender sends a file a window of blocks at a time (RFC 7440; a window of one
+// is plain RFC 1350 lock step). Blocks are kept until acknowledged, for
+// retransmission.
+type sender struct {
+	t      *transfer
+	n      negotiated
+	src    io.Reader
+	window [][]byte // block b is held in window[(b-1) % windowSize]
+
+	base    uint64 // oldest unacknowledged block, counting past rollover
+	next    uint64 // next block to send for the first time
+	lastNum uint64 // number of the final, short block once it has been read; 0 before
+}
+
+func (s *sender) run() error {
+	retries := 0
+
+	for {
+		// Fill the window with new blocks.
+		for s.next < s.base+uint64(s.n.windowSize) && (s.lastNum == 0 || s.next <= s.lastNum) {
+			if err := s.read(s.next); err != nil {
+				return err
+			}
+			if err := s.sendBlock(s.next); err != nil {
+				return err
+			}
+			s.next++
+		}
+
+		p, err := s.t.receive(time.Now().Add(s.t.timeout), func(p tftp.Packet) bool {
+			_, ok := p.(*tftp.PacketAck)
+			return ok
+		})
+		if err == errRetransmit {
+			if retries++; retries > s.t.retries {
+				s.t.abort(&Error{Code: tftp.ErrCodeNotDefined, Msg: "Timeout."})
+				return ErrTimeout
+			}
+			for b := s.base; b < s.next; b++ {
+				if err := s.sendBlock(b); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// Only an ACK for a block in flight moves the window. Anything else
+		// is a duplicate or delayed ACK, and is ignored rather than answered
+		// with a resend (the Sorcerer's Apprentice bug) - the retransmit
+		// timer covers real loss.
+		ack := p.(*tftp.PacketAck).BlockNum
+		for b := s.base; b < s.next; b++ {
+			if uint16(b) == ack {
+				s.base = b + 1
+				retries = 0
+				break
+			}
+		}
+
+		if s.lastNum != 0 && s.base > s.lastNum {
+			return nil
+		}
+	}
+}
+
+// read fills the window slot for block b from the source.
+func (s *sender) read(b uint64) error {
+	slot := &s.window[(b-1)%uint64(len(s.window))]
+	*slot = (*slot)[:s.n.blockSize]
+
+	n, err := io.ReadFull(s.src, *slot)
+	*slot = (*slot)[:n]
+
+	switch err {
+	case nil:
+		return nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		// A short block, possibly empty, ends the transfer.
+		s.lastNum = b
+		return nil
+	}
+	return err
+}
+
+func (s *sender) sendBlock(b uint64) error {
+	data := s.window[(b-1)%uint64(len(s.window))]
+	return s.t.send(&tftp.PacketData{BlockNum: uint16(b), Data: data})
+}
+
+// PutBytes writes data to the named file. It is a convenience for small files.
+func (c *Client) PutBytes(ctx context.Context, addr, name string, data []byte) error {
+	return c.Put(ctx, addr, name, bytes.NewReader(data))
+}
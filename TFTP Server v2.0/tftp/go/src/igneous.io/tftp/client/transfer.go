@@ -0,0 +1,131 @@
+package client
+
+import (
+	"../../tftp"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// errRetransmit is returned by receive when the wait ends with nothing
+// acceptable from the peer, and the caller should retransmit.
+var errRetransmit = errors.New("tftp: retransmit")
+
+// transfer is the socket and peer state for one transfer.
+type transfer struct {
+	ctx     context.Context
+	stop    func() bool
+	conn    net.PacketConn
+	peer    net.Addr
+	locked  bool // true once the server's transfer ID is known
+	timeout time.Duration
+	retries int
+
+	rbuf []byte
+	sbuf []byte
+	set  tftp.PacketSet
+}
+
+func newTransfer(ctx context.Context, conn net.PacketConn, peer net.Addr, timeout time.Duration, retries int) *transfer {
+	t := &transfer{
+		ctx:     ctx,
+		conn:    conn,
+		peer:    peer,
+		timeout: timeout,
+		retries: retries,
+		rbuf:    make([]byte, 4+MaxBlockSize),
+	}
+
+	// Cancelling the context unblocks a pending read; receive then returns ctx.Err().
+	t.stop = context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	return t
+}
+
+func (t *transfer) close() error {
+	t.stop()
+	return t.conn.Close()
+}
+
+func (t *transfer) send(p tftp.Packet) error {
+	return t.sendTo(p, t.peer)
+}
+
+func (t *transfer) sendTo(p tftp.Packet, addr net.Addr) error {
+	t.sbuf = p.AppendSerialize(t.sbuf[:0])
+	_, err := t.conn.WriteTo(t.sbuf, addr)
+	return err
+}
+
+// abort tells the peer the transfer is over. Errors are not acknowledged or
+// retransmitted, so this is a single best effort send.
+func (t *transfer) abort(e *Error) {
+	t.send(e.Packet())
+}
+
+// fromPeer reports whether addr is the transfer's peer. Until the server's
+// first reply any port on the server's host is accepted, and becomes the
+// server's transfer ID.
+func (t *transfer) fromPeer(addr net.Addr) bool {
+	if t.locked {
+		return addr.String() == t.peer.String()
+	}
+	if !sameHost(t.peer, addr) {
+		return false
+	}
+	t.peer = addr
+	t.locked = true
+	return true
+}
+
+func sameHost(server, addr net.Addr) bool {
+	s, ok1 := server.(*net.UDPAddr)
+	a, ok2 := addr.(*net.UDPAddr)
+	if !ok1 || !ok2 {
+		return server.String() == addr.String()
+	}
+	return s.IP.IsUnspecified() || s.IP.Equal(a.IP)
+}
+
+// receive waits until deadline for a packet from the peer accepted by want.
+// Packets want rejects are dropped. An ERROR from the peer is returned as an
+// *Error. The returned packet is only valid until the next receive.
+func (t *transfer) receive(deadline time.Time, want func(tftp.Packet) bool) (tftp.Packet, error) {
+	for {
+		if err := t.ctx.Err(); err != nil {
+			return nil, err
+		}
+		t.conn.SetReadDeadline(deadline)
+
+		n, addr, err := t.conn.ReadFrom(t.rbuf)
+		if err != nil {
+			if ctxErr := t.ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, errRetransmit
+			}
+			return nil, err
+		}
+
+		// RFC 1350: a packet from the wrong port gets an error, and the transfer carries on.
+		if !t.fromPeer(addr) {
+			t.sendTo((&Error{Code: tftp.ErrCodeUnknownTID, Msg: "Unknown transfer ID."}).Packet(), addr)
+			continue
+		}
+
+		p, err := t.set.Parse(t.rbuf[:n])
+		if err != nil {
+			continue
+		}
+		if e, ok := p.(*tftp.PacketError); ok {
+			return nil, tftp.ErrorFromPacket(e)
+		}
+		if want(p) {
+			return p, nil
+		}
+	}
+}
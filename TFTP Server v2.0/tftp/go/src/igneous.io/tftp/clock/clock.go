@@ -0,0 +1,193 @@
+// Package clock lets code that waits on timers run against virtual time.
+//
+// Code that reads the time or starts timers through a Clock uses Real in
+// production, and a Fake in tests. A test advances the Fake by hand, so a
+// timeout of thirty seconds fires as soon as the test asks it to, and always
+// in the same order relative to the rest of the test.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the subset of the time package that the transfer code uses.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTimer(d time.Duration) Timer
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a time.Timer, with its channel behind a method so a Fake can
+// supply it.
+type Timer interface {
+	// C returns the channel the time is sent on when the timer fires. It is
+	// nil for a timer from AfterFunc.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing. It returns false if the timer has
+	// already fired or been stopped.
+	Stop() bool
+}
+
+// Real returns the Clock of the time package.
+func Real() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                  { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration { return time.Since(t) }
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+// Fake is a Clock whose time only moves when Advance is called.
+type Fake struct {
+	mu      sync.Mutex
+	changed *sync.Cond // broadcast when a timer is added or removed
+	now     time.Time
+	timers  []*fakeTimer // pending timers
+}
+
+// NewFake returns a Fake set to now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return f.add(d, make(chan time.Time, 1), nil)
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	return f.add(d, nil, fn)
+}
+
+func (f *Fake) add(d time.Duration, c chan time.Time, fn func()) *fakeTimer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTimer{f: f, when: f.now.Add(d), c: c, fn: fn}
+	f.timers = append(f.timers, t)
+	f.changed.Broadcast()
+	return t
+}
+
+// Advance moves the time forward by d, firing the timers that come due on
+// the way, in order. The time is set to each timer's deadline as it fires.
+// Functions from AfterFunc run on the caller's goroutine, before Advance
+// returns.
+//
+// Timers started by other goroutines in response, after Advance is called,
+// are not fired by it, even if they fall within d; use BlockUntil to wait
+// for them and Advance again.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	end := f.now.Add(d)
+	due := make([]*fakeTimer, 0, len(f.timers))
+	for _, t := range f.timers {
+		if !t.when.After(end) {
+			due = append(due, t)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].when.Before(due[j].when) })
+	f.mu.Unlock()
+
+	for _, t := range due {
+		f.mu.Lock()
+		if !f.remove(t) {
+			f.mu.Unlock()
+			continue // stopped by a timer that fired before it
+		}
+		if t.when.After(f.now) {
+			f.now = t.when
+		}
+		f.mu.Unlock()
+
+		if t.fn != nil {
+			t.fn()
+		} else {
+			select {
+			case t.c <- t.when:
+			default:
+			}
+		}
+	}
+
+	f.mu.Lock()
+	if end.After(f.now) {
+		f.now = end
+	}
+	f.mu.Unlock()
+}
+
+// BlockUntil waits until at least n timers are pending, for a test to know
+// the code under test has reached the wait it means to advance past.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.timers) < n {
+		f.changed.Wait()
+	}
+}
+
+// Pending returns the number of timers that have neither fired nor been
+// stopped.
+func (f *Fake) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// remove drops t from the pending timers, and reports whether it was there.
+// f.mu must be held.
+func (f *Fake) remove(t *fakeTimer) bool {
+	for i, p := range f.timers {
+		if p == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			f.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	f    *Fake
+	when time.Time
+	c    chan time.Time
+	fn   func()
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	return t.f.remove(t)
+}
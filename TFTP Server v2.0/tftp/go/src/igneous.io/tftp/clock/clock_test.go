@@ -0,0 +1,91 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeTimerFiresWhenDue(t *testing.T) {
+	f := NewFake(epoch)
+	tm := f.NewTimer(time.Second)
+
+	f.Advance(999 * time.Millisecond)
+	select {
+	case <-tm.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	f.Advance(time.Millisecond)
+	select {
+	case at := <-tm.C():
+		if !at.Equal(epoch.Add(time.Second)) {
+			t.Errorf("fired at %v, want %v", at, epoch.Add(time.Second))
+		}
+	default:
+		t.Fatal("timer did not fire")
+	}
+
+	if tm.Stop() {
+		t.Error("Stop after firing returned true")
+	}
+	if n := f.Pending(); n != 0 {
+		t.Errorf("%d timers pending, want 0", n)
+	}
+}
+
+func TestFakeStop(t *testing.T) {
+	f := NewFake(epoch)
+	tm := f.NewTimer(time.Second)
+	if !tm.Stop() {
+		t.Fatal("Stop returned false")
+	}
+	f.Advance(time.Hour)
+	select {
+	case <-tm.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+}
+
+func TestFakeAfterFuncOrder(t *testing.T) {
+	f := NewFake(epoch)
+	var got []time.Duration
+	record := func() { got = append(got, f.Since(epoch)) }
+	f.AfterFunc(3*time.Second, record)
+	f.AfterFunc(time.Second, record)
+	late := f.AfterFunc(2*time.Second, record)
+
+	// A timer may stop one due after it.
+	f.AfterFunc(1500*time.Millisecond, func() { late.Stop() })
+
+	f.Advance(10 * time.Second)
+
+	want := []time.Duration{time.Second, 3 * time.Second}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("fired at %v, want %v", got, want)
+	}
+	if now := f.Since(epoch); now != 10*time.Second {
+		t.Errorf("time advanced by %v, want 10s", now)
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(epoch)
+	done := make(chan struct{})
+	go func() {
+		<-f.NewTimer(time.Minute).C()
+		close(done)
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(time.Minute)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("goroutine did not see the timer fire")
+	}
+}
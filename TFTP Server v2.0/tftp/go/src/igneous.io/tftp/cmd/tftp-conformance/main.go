@@ -0,0 +1,145 @@
+// Command tftp-conformance runs the conformance checks against a TFTP server
+// and reports pass or fail for each, with the RFC clause it covers.
+//
+//	tftp-conformance [flags] host[:port]
+//
+// The server must accept writes, the checks upload the files they read.
+// The exit status is 1 if any check fails.
+package main
+
+import (
+	"../../conformance"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	runFlag        = flag.String("run", "", "run only the checks whose name matches this regular expression")
+	listFlag       = flag.Bool("list", false, "list the checks and exit")
+	jsonFlag       = flag.Bool("json", false, "write the results as JSON")
+	shortFlag      = flag.Bool("short", false, "skip the slow checks")
+	timeoutFlag    = flag.Duration("timeout", 2*time.Second, "how long to wait for an immediate reply")
+	retransmitFlag = flag.Duration("retransmit-wait", 10*time.Second, "how long to wait for the server to retransmit")
+	prefixFlag     = flag.String("prefix", "", "prefix for the names of uploaded files")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: tftp-conformance [flags] host[:port]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	checks := conformance.Checks
+	if *runFlag != "" {
+		re, err := regexp.Compile(*runFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tftp-conformance: -run: %s\n", err)
+			os.Exit(2)
+		}
+		checks = nil
+		for _, c := range conformance.Checks {
+			if re.MatchString(c.Name) {
+				checks = append(checks, c)
+			}
+		}
+	}
+
+	if *listFlag {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, c := range checks {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, c.Clause, c.Desc)
+		}
+		w.Flush()
+		return
+	}
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	addr := flag.Arg(0)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "69")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cfg := conformance.Config{
+		Addr:           addr,
+		Timeout:        *timeoutFlag,
+		RetransmitWait: *retransmitFlag,
+		Prefix:         *prefixFlag,
+		Short:          *shortFlag,
+	}
+
+	var results []conformance.Result
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, c := range checks {
+		if ctx.Err() != nil {
+			break
+		}
+		r := c.Run(ctx, cfg)
+		results = append(results, r)
+		if !*jsonFlag {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Status, r.Clause, r.Name, r.Duration.Round(time.Millisecond), r.Detail)
+			w.Flush()
+		}
+	}
+
+	if *jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	} else {
+		summarize(results)
+	}
+
+	for _, r := range results {
+		if r.Status == conformance.Fail {
+			os.Exit(1)
+		}
+	}
+}
+
+// summarize prints the pass, fail and skip counts for each RFC clause.
+func summarize(results []conformance.Result) {
+	counts := make(map[string]*[3]int)
+	for _, r := range results {
+		if counts[r.Clause] == nil {
+			counts[r.Clause] = new([3]int)
+		}
+		counts[r.Clause][r.Status]++
+	}
+
+	clauses := make([]string, 0, len(counts))
+	for clause := range counts {
+		clauses = append(clauses, clause)
+	}
+	sort.Strings(clauses)
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CLAUSE\tPASS\tFAIL\tSKIP\t")
+	for _, clause := range clauses {
+		c := counts[clause]
+		status := "ok"
+		if c[conformance.Fail] > 0 {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", clause,
+			strconv.Itoa(c[conformance.Pass]), strconv.Itoa(c[conformance.Fail]), strconv.Itoa(c[conformance.Skip]), status)
+	}
+	w.Flush()
+}
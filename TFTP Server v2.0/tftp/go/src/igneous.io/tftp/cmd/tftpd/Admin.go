@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The admin API - an HTTP server for operators, on its own address (-admin), apart from the TFTP clients.
+// Responses are JSON, but for the metrics, which are in the Prometheus text format.
+//
+//   GET /files                            every committed file in the cache
+//   GET /files/{name}                     one file, and its versions - the name may contain slashes
+//   POST /rollback/{name}[?version=n]     make an earlier version current, by default the one before the
+//                                         current version - see Versions.go
+//   GET /metrics                          what the chunk store holds, and the dedup ratio - see ChunkStore.go
+//
+// Uploads in progress are not listed.
+//
+// A rollback must carry an X-Admin-Token header, holding the token given with -admin-token if there is one. A
+// browser does not send a custom header cross-site without a CORS preflight, which the admin API never answers, so
+// even without a token a web page cannot make an operator's browser roll a file back.
+
+// What the admin API tells about a file.
+
+type adminFile struct {
+	Name string `json:"name"`
+	Size int `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	ReadOnly bool `json:"readOnly,omitempty"`
+	Checksums Checksums `json:"checksums"`
+	Version int `json:"version,omitempty"`
+	Versions []adminVersion `json:"versions,omitempty"`
+}
+
+type adminVersion struct {
+	Version int `json:"version"`
+	Size int `json:"size"`
+	Time time.Time `json:"time"`
+	Source string `json:"source,omitempty"`
+	Checksums Checksums `json:"checksums"`
+}
+
+func newAdminVersion(v fileVersion) adminVersion {
+
+	return adminVersion{
+		Version: v.Number,
+		Size: v.File.Size(),
+		Time: v.Time,
+		Source: v.Source,
+		Checksums: v.File.Checksums(),
+	}
+}
+
+func newAdminFile(name string, f *CacheFile) adminFile {
+
+	return adminFile{
+		Name: name,
+		Size: f.Size(),
+		ModTime: f.ModTime(),
+		ReadOnly: f.readOnly,
+		Checksums: f.Checksums(),
+	}
+}
+
+// Serves the admin API on addr, in the background. Returns once it is listening.
+
+func serveAdmin(addr string, token string) error {
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go http.Serve(ln, adminHandler(token))
+	return nil
+}
+
+func adminHandler(token string) http.Handler {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files", adminMethod(http.MethodGet, adminListFiles))
+	mux.HandleFunc("/files/", adminMethod(http.MethodGet, adminGetFile))
+	mux.HandleFunc("/rollback/", adminMethod(http.MethodPost, adminAuth(token, adminRollback)))
+	mux.HandleFunc("/metrics", adminMethod(http.MethodGet, adminMetrics))
+	return mux
+}
+
+// Refuses a request without an X-Admin-Token header, or, if token is set, with another token.
+
+func adminAuth(token string, h http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := r.Header["X-Admin-Token"]
+		if ok == false || (token != "" && subtle.ConstantTimeCompare([]byte(got[0]), []byte(token)) != 1) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong X-Admin-Token"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Refuses every method but method - and HEAD, for GET.
+
+func adminMethod(method string, h http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method && (method != http.MethodGet || r.Method != http.MethodHead) {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": r.Method + " not allowed"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+func adminListFiles(w http.ResponseWriter, r *http.Request) {
+
+	debugLog.Printf("Take Metadata Lock \n")
+
+	lockMetadataChanges.Lock()
+
+	promoteVersions()
+
+	files := []adminFile{}
+	for name, f := range fileCacheMap {
+		if f.Committed() == true {
+			files = append(files, newAdminFile(name, f))
+		}
+	}
+
+	deferredMetadataUnlock()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	writeJSON(w, http.StatusOK, files)
+}
+
+func adminGetFile(w http.ResponseWriter, r *http.Request) {
+
+	name := strings.TrimPrefix(r.URL.Path, "/files/")
+
+	debugLog.Printf("Take Metadata Lock \n")
+
+	lockMetadataChanges.Lock()
+
+	promoteVersion(name)
+
+	f, ok := fileCacheMap[name]
+	if ok == true && f.Committed() == false {
+		ok = false
+	}
+
+	var af adminFile
+	if ok == true {
+		af = newAdminFile(name, f)
+		if maxVersions > 0 {
+			for _, v := range versionsOf(name) {
+				af.Versions = append(af.Versions, newAdminVersion(v))
+				af.Version = v.Number
+			}
+		}
+	}
+
+	deferredMetadataUnlock()
+
+	if ok == false {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "file not found: " + name})
+		return
+	}
+	writeJSON(w, http.StatusOK, af)
+}
+
+func adminRollback(w http.ResponseWriter, r *http.Request) {
+
+	name := strings.TrimPrefix(r.URL.Path, "/rollback/")
+
+	number := 0
+	if s := r.URL.Query().Get("version"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad version: " + s})
+			return
+		}
+		number = n
+	}
+
+	v, err := rollbackVersion(name, number)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusOK, newAdminVersion(v))
+	}
+}
+
+func adminMetrics(w http.ResponseWriter, r *http.Request) {
+
+	st := chunkStore.Stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, m := range []struct {
+		name, help string
+		value float64
+	}{
+		{"tftpd_store_chunks", "Chunks held in the cache.", float64(st.Chunks)},
+		{"tftpd_store_logical_bytes", "Bytes in the files in the cache.", float64(st.LogicalBytes)},
+		{"tftpd_store_physical_bytes", "Bytes held for the files in the cache, each shared chunk once.", float64(st.PhysicalBytes)},
+		{"tftpd_store_dedup_ratio", "Logical bytes per physical byte.", st.DedupRatio()},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", m.name, m.help, m.name, m.name,
+			strconv.FormatFloat(m.value, 'g', -1, 64))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
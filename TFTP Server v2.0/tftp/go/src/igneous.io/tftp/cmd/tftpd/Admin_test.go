@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getJSON(t *testing.T, url string, v any) int {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %s", url, err)
+	}
+	return resp.StatusCode
+}
+
+// The admin API lists the committed files with their checksums, and looks up one by a name that may hold slashes.
+
+func TestAdminFiles(t *testing.T) {
+	srv := httptest.NewServer(adminHandler(""))
+	t.Cleanup(srv.Close)
+
+	files := addSnapshotFiles(t, 100, 2000)
+
+	nested := testFileName(t) + "/pxelinux.cfg/default"
+	addCommittedFile(nested, 300)
+	t.Cleanup(func() { dropFiles(map[string][]byte{nested: nil}) })
+	files[nested] = nil
+
+	uploading := testFileName(t)
+	lockMetadataChanges.Lock()
+	fileCacheMap[uploading] = new(CacheFile)
+	lockMetadataChanges.Unlock()
+	t.Cleanup(func() { dropFiles(map[string][]byte{uploading: nil}) })
+
+	var list []adminFile
+	if status := getJSON(t, srv.URL + "/files", &list); status != http.StatusOK {
+		t.Fatalf("GET /files: status %d", status)
+	}
+
+	listed := make(map[string]adminFile)
+	for _, af := range list {
+		listed[af.Name] = af
+	}
+	for name := range files {
+		f, _ := cachedFile(name)
+		if af, ok := listed[name]; ok == false || af.Size != f.Size() || af.Checksums != f.Checksums() {
+			t.Errorf("%s listed as %+v; expected %d bytes, %s", name, af, f.Size(), f.Checksums())
+		}
+	}
+	if _, ok := listed[uploading]; ok {
+		t.Errorf("Upload in progress listed")
+	}
+
+	var one adminFile
+	if status := getJSON(t, srv.URL + "/files/" + nested, &one); status != http.StatusOK || one.Name != nested || one.Size != 300 {
+		t.Errorf("GET /files/%s: status %d, %+v", nested, status, one)
+	}
+
+	var failed map[string]string
+	if status := getJSON(t, srv.URL + "/files/" + uploading, &failed); status != http.StatusNotFound || failed["error"] == "" {
+		t.Errorf("GET /files/%s, an upload in progress: status %d, %v; expected 404", uploading, status, failed)
+	}
+}
+
+// The metrics report what the chunk store holds - a file uploaded twice counts twice in the logical bytes, and
+// once in the physical bytes.
+
+func TestAdminMetrics(t *testing.T) {
+	srv := httptest.NewServer(adminHandler(""))
+	t.Cleanup(srv.Close)
+
+	metrics := func() map[string]float64 {
+		resp, err := http.Get(srv.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		values := make(map[string]float64)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var name string
+			var value float64
+			if strings.HasPrefix(scanner.Text(), "#") == false {
+				fmt.Sscan(scanner.Text(), &name, &value)
+				values[name] = value
+			}
+		}
+		return values
+	}
+
+	before := metrics()
+
+	data := testData(26, 5000)
+	a, b := uploadFile(data), uploadFile(data)
+	t.Cleanup(a.release)
+	t.Cleanup(b.release)
+
+	after := metrics()
+	if got := after["tftpd_store_logical_bytes"] - before["tftpd_store_logical_bytes"]; got != 10000 {
+		t.Errorf("Logical bytes grew by %g; expected 10000", got)
+	}
+	if got := after["tftpd_store_physical_bytes"] - before["tftpd_store_physical_bytes"]; got != 5000 {
+		t.Errorf("Physical bytes grew by %g; expected 5000", got)
+	}
+	if got := after["tftpd_store_chunks"] - before["tftpd_store_chunks"]; got != 1 {
+		t.Errorf("Chunks grew by %g; expected 1", got)
+	}
+	if ratio := after["tftpd_store_logical_bytes"] / after["tftpd_store_physical_bytes"]; after["tftpd_store_dedup_ratio"] != ratio {
+		t.Errorf("Dedup ratio %g; expected %g", after["tftpd_store_dedup_ratio"], ratio)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"../../../tftp"
+	"net"
+)
+
+// Number of datagrams moved per batched read or write.
+
+const batchSize = 64
+
+// A datagram read or written by a batchConn.
+//
+// ReadBatch reads into Buf and sets N and Addr. WriteBatch sends Buf to Addr.
+
+type message struct {
+	Buf  []byte
+	N    int
+	Addr net.Addr
+}
+
+// Moves many datagrams per call. On Linux this is one recvmmsg/sendmmsg syscall per batch, through
+// golang.org/x/net's ipv4 and ipv6 ReadBatch/WriteBatch (see BatchConn_linux.go), elsewhere it falls back to
+// one ReadFrom/WriteTo per datagram.
+
+type batchConn interface {
+
+	// Reads at least one datagram, and as many more as are already queued, up to len(ms).
+	// Returns the number of messages filled in.
+	ReadBatch(ms []message) (int, error)
+
+	// Writes all of ms, returning the number of messages written.
+	WriteBatch(ms []message) (int, error)
+}
+
+// The portable batchConn - one syscall per datagram.
+
+type singleConn struct {
+	pc net.PacketConn
+}
+
+func (c *singleConn) ReadBatch(ms []message) (int, error) {
+
+	if len(ms) == 0 {
+		return 0, nil
+	}
+
+	n, addr, err := c.pc.ReadFrom(ms[0].Buf)
+	if err != nil {
+		return 0, err
+	}
+
+	ms[0].N = n
+	ms[0].Addr = addr
+	return 1, nil
+}
+
+func (c *singleConn) WriteBatch(ms []message) (int, error) {
+
+	for i := range ms {
+		if _, err := c.pc.WriteTo(ms[i].Buf, ms[i].Addr); err != nil {
+			return i, err
+		}
+	}
+	return len(ms), nil
+}
+
+// Wraps the listening connection so writes from the handlers are queued, and a single goroutine flushes
+// everything queued so far with one WriteBatch. Handlers keep using the net.PacketConn interface unchanged.
+//
+// WriteTo copies the datagram into a pooled buffer, so callers may reuse their buffer as soon as it returns,
+// just as with a plain WriteTo. Write errors are logged rather than returned - the handlers already treat
+// sends as fire and forget, and rely on retransmission.
+
+type batchWriter struct {
+	net.PacketConn
+	bc    batchConn
+	queue chan queuedWrite
+}
+
+type queuedWrite struct {
+	buf  *[]byte
+	n    int
+	addr net.Addr
+}
+
+func newBatchWriter(pc net.PacketConn, bc batchConn) *batchWriter {
+
+	w := &batchWriter{PacketConn: pc, bc: bc, queue: make(chan queuedWrite, 4 * batchSize)}
+	go w.flush()
+	return w
+}
+
+func (w *batchWriter) WriteTo(b []byte, addr net.Addr) (int, error) {
+
+	if len(b) > tftp.MaxPacketSize {
+		return w.PacketConn.WriteTo(b, addr)
+	}
+
+	buf := getPacketBuffer()
+	n := copy(*buf, b)
+	w.queue <- queuedWrite{buf, n, addr}
+	return n, nil
+}
+
+func (w *batchWriter) flush() {
+
+	pending := make([]queuedWrite, 0, batchSize)
+	ms := make([]message, batchSize)
+
+	for qw := range w.queue {
+
+		// Block for the first write, then take whatever else is already queued.
+
+		pending = append(pending[:0], qw)
+
+	drain:
+		for len(pending) < batchSize {
+			select {
+			case qw, ok := <-w.queue:
+				if !ok {
+					break drain
+				}
+				pending = append(pending, qw)
+			default:
+				break drain
+			}
+		}
+
+		for i, qw := range pending {
+			ms[i].Buf = (*qw.buf)[:qw.n]
+			ms[i].Addr = qw.addr
+		}
+
+		if _, err := w.bc.WriteBatch(ms[:len(pending)]); err != nil {
+			debugLog.Printf("Batch write failed: %v \n", err)
+		}
+
+		for i, qw := range pending {
+			putPacketBuffer(qw.buf)
+			ms[i] = message{}
+		}
+	}
+}
+
+// Stops the flush goroutine and closes the underlying connection. Writes must not be issued after Close.
+
+func (w *batchWriter) Close() error {
+
+	close(w.queue)
+	return w.PacketConn.Close()
+}
@@ -0,0 +1,123 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// The batch methods of golang.org/x/net's ipv4.PacketConn and ipv6.PacketConn, which are one recvmmsg/sendmmsg
+// syscall on Linux. ipv4.Message and ipv6.Message are the same type.
+
+type xnetBatchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// A batchConn that moves up to batchSize datagrams per recvmmsg/sendmmsg syscall.
+//
+// The Messages are allocated once per connection, so a batch costs one syscall and no allocations beyond the
+// net.Addr of each datagram read. A mmsgConn must only be used by one reader and one writer at a time - the
+// listener loop reads, and the batchWriter goroutine writes.
+
+type mmsgConn struct {
+	xc     xnetBatchConn
+	reads  []ipv4.Message
+	writes []ipv4.Message
+}
+
+// Returns the recvmmsg/sendmmsg batchConn for UDP sockets, and the portable fallback for anything else.
+
+func newBatchConn(pc net.PacketConn) batchConn {
+
+	uc, ok := pc.(*net.UDPConn)
+	if ok == false {
+		return &singleConn{pc}
+	}
+
+	// A socket listening on ":port" is dual stack AF_INET6. Linux takes IPv4 destinations on it as they are -
+	// x/net writes them as AF_INET sockaddrs.
+
+	var xc xnetBatchConn = ipv6.NewPacketConn(uc)
+	if addr, ok := uc.LocalAddr().(*net.UDPAddr); ok == true && addr.IP.To4() != nil {
+		xc = ipv4.NewPacketConn(uc)
+	}
+
+	c := &mmsgConn{
+		xc:     xc,
+		reads:  make([]ipv4.Message, batchSize),
+		writes: make([]ipv4.Message, batchSize),
+	}
+
+	for i := 0; i < batchSize; i++ {
+		c.reads[i].Buffers = make([][]byte, 1)
+		c.writes[i].Buffers = make([][]byte, 1)
+	}
+
+	return c
+}
+
+// A datagram from an address family x/net does not know has no IP - its Addr is left nil, for the caller to
+// skip.
+
+func (c *mmsgConn) ReadBatch(ms []message) (int, error) {
+
+	if len(ms) > batchSize {
+		ms = ms[:batchSize]
+	}
+	if len(ms) == 0 {
+		return 0, nil
+	}
+
+	for i := range ms {
+		c.reads[i].Buffers[0] = ms[i].Buf
+	}
+
+	n, err := c.xc.ReadBatch(c.reads[:len(ms)], 0)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		ms[i].N = c.reads[i].N
+		ms[i].Addr = nil
+		if addr, ok := c.reads[i].Addr.(*net.UDPAddr); ok == true && addr.IP != nil {
+			ms[i].Addr = addr
+		}
+		c.reads[i].Addr = nil
+	}
+	return n, nil
+}
+
+func (c *mmsgConn) WriteBatch(ms []message) (int, error) {
+
+	written := 0
+
+	for written < len(ms) {
+
+		batch := ms[written:min(written + batchSize, len(ms))]
+
+		for i := range batch {
+			c.writes[i].Buffers[0] = batch[i].Buf
+			c.writes[i].Addr = batch[i].Addr
+		}
+
+		n, err := c.xc.WriteBatch(c.writes[:len(batch)], 0)
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+
+		// sendmmsg may stop short of the whole batch, loop to send the rest.
+
+		written += n
+	}
+
+	return written, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+)
+
+// x/net only batches on Linux, elsewhere use one syscall per datagram.
+
+func newBatchConn(pc net.PacketConn) batchConn {
+
+	return &singleConn{pc}
+}
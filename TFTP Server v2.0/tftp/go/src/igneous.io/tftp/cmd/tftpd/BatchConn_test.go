@@ -0,0 +1,154 @@
+package main
+
+import (
+	"../../../tftp"
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func listenUDP(t testing.TB, address string) *net.UDPConn {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := pc.(*net.UDPConn)
+	uc.SetReadBuffer(1 << 20)
+	return uc
+}
+
+func TestBatchConnRoundTrip(t *testing.T) {
+	conns := []struct {
+		name string
+		new  func(net.PacketConn) batchConn
+	}{
+		{"batch", newBatchConn},
+		{"single", func(pc net.PacketConn) batchConn { return &singleConn{pc} }},
+	}
+
+	for _, conn := range conns {
+		// ":0" is a dual stack IPv6 socket, which must address IPv4 peers by their v4-mapped address.
+		for _, address := range []string{"127.0.0.1:0", ":0"} {
+			sender := listenUDP(t, address)
+			receiver := listenUDP(t, "127.0.0.1:0")
+
+			out := make([]message, 10)
+			for i := range out {
+				out[i].Buf = []byte(fmt.Sprintf("datagram %d", i))
+				out[i].Addr = receiver.LocalAddr()
+			}
+			if n, err := conn.new(sender).WriteBatch(out); n != len(out) || err != nil {
+				t.Fatalf("%s %s: WriteBatch returned %d, %v", conn.name, address, n, err)
+			}
+
+			in := make([]message, batchSize)
+			for i := range in {
+				in[i].Buf = make([]byte, tftp.MaxPacketSize)
+			}
+
+			bc := conn.new(receiver)
+			received := 0
+			for received < len(out) {
+				n, err := bc.ReadBatch(in)
+				if err != nil {
+					t.Fatalf("%s %s: ReadBatch: %s", conn.name, address, err)
+				}
+				for i := 0; i < n; i++ {
+					if !bytes.Equal(in[i].Buf[:in[i].N], out[received].Buf) {
+						t.Errorf("%s %s: expected %q; got %q", conn.name, address, out[received].Buf, in[i].Buf[:in[i].N])
+					}
+					if in[i].Addr.(*net.UDPAddr).Port != sender.LocalAddr().(*net.UDPAddr).Port {
+						t.Errorf("%s %s: expected source port %d; got %s", conn.name, address, sender.LocalAddr().(*net.UDPAddr).Port, in[i].Addr)
+					}
+					received++
+				}
+			}
+
+			sender.Close()
+			receiver.Close()
+		}
+	}
+}
+
+// Compares packets/sec for one datagram per syscall against recvmmsg/sendmmsg. Each iteration moves batchSize
+// DATA sized datagrams.
+
+func BenchmarkBatchConnRead(b *testing.B) {
+	for _, conn := range []struct {
+		name string
+		new  func(net.PacketConn) batchConn
+	}{
+		{"single", func(pc net.PacketConn) batchConn { return &singleConn{pc} }},
+		{"batch", newBatchConn},
+	} {
+		b.Run(conn.name, func(b *testing.B) {
+			sender := listenUDP(b, "127.0.0.1:0")
+			receiver := listenUDP(b, "127.0.0.1:0")
+			defer sender.Close()
+			defer receiver.Close()
+
+			out := make([]message, batchSize)
+			for i := range out {
+				out[i].Buf = make([]byte, 4+dataBlockSize)
+				out[i].Addr = receiver.LocalAddr()
+			}
+			in := make([]message, batchSize)
+			for i := range in {
+				in[i].Buf = make([]byte, tftp.MaxPacketSize)
+			}
+
+			sbc := newBatchConn(sender)
+			rbc := conn.new(receiver)
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				sbc.WriteBatch(out)
+				b.StartTimer()
+
+				for received := 0; received < batchSize; {
+					r, err := rbc.ReadBatch(in)
+					if err != nil {
+						b.Fatal(err)
+					}
+					received += r
+				}
+			}
+			b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "pkts/s")
+		})
+	}
+}
+
+func BenchmarkBatchConnWrite(b *testing.B) {
+	for _, conn := range []struct {
+		name string
+		new  func(net.PacketConn) batchConn
+	}{
+		{"single", func(pc net.PacketConn) batchConn { return &singleConn{pc} }},
+		{"batch", newBatchConn},
+	} {
+		b.Run(conn.name, func(b *testing.B) {
+			sender := listenUDP(b, "127.0.0.1:0")
+			sink := listenUDP(b, "127.0.0.1:0")
+			defer sender.Close()
+			defer sink.Close()
+
+			out := make([]message, batchSize)
+			for i := range out {
+				out[i].Buf = make([]byte, 4+dataBlockSize)
+				out[i].Addr = sink.LocalAddr()
+			}
+
+			sbc := conn.new(sender)
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, err := sbc.WriteBatch(out); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "pkts/s")
+		})
+	}
+}
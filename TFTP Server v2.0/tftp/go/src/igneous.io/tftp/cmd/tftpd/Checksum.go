@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"os"
+	"strings"
+)
+
+// Every file in the cache carries its SHA-256, so what a device pulled can be matched against what was pushed.
+// An upload's checksums are computed block by block as the blocks arrive, in handleData - the file is not read
+// again to checksum it. Other files - preloaded, restored, fetched or generated - are checksummed when they are
+// committed. CRC32 and MD5 can be computed as well, for older tooling, with -checksums.
+//
+// An upload can be verified before it is committed. With -verify-sidecar, the upload of name must match the
+// SHA-256 in the file name.sha256, if the cache holds one. With -verify-manifest, it must match the SHA-256
+// listed for name in the manifest, which is in sha256sum(1) format. The manifest takes precedence. An upload
+// that does not match is refused, and the name stays free.
+//
+// The expected checksum is looked up when the write request arrives - a sidecar uploaded while the file is
+// being uploaded is not used.
+
+// The checksums of a file, in hex. CRC32 and MD5 are empty unless -checksums asks for them.
+
+type Checksums struct {
+	SHA256 string `json:"sha256"`
+	CRC32 string `json:"crc32,omitempty"`
+	MD5 string `json:"md5,omitempty"`
+}
+
+func (c Checksums) String() string {
+
+	s := "sha256 " + c.SHA256
+	if c.CRC32 != "" {
+		s += " crc32 " + c.CRC32
+	}
+	if c.MD5 != "" {
+		s += " md5 " + c.MD5
+	}
+	return s
+}
+
+// The legacy checksums computed besides SHA-256. Set at startup, see SetChecksums.
+
+var checksumCRC32, checksumMD5 bool
+
+// Uploads are verified against a name.sha256 file in the cache.
+
+var verifySidecars bool
+
+// The SHA-256 an upload must have, by name. Loaded at startup, see LoadChecksumManifest, and not changed after.
+
+var expectedChecksums map[string]string
+
+// Sets the legacy checksums to compute, from a comma separated list: crc32, md5.
+
+func SetChecksums(list string) error {
+
+	for _, name := range strings.Split(list, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "", "sha256":
+		case "crc32":
+			checksumCRC32 = true
+		case "md5":
+			checksumMD5 = true
+		default:
+			return fmt.Errorf("unknown checksum %q, expected crc32 or md5", name)
+		}
+	}
+	return nil
+}
+
+// Computes a file's checksums incrementally, as its blocks are written.
+
+type checksummer struct {
+	sha256 hash.Hash
+	crc32 hash.Hash32
+	md5 hash.Hash
+}
+
+func newChecksummer() *checksummer {
+
+	c := &checksummer{sha256: sha256.New()}
+	if checksumCRC32 {
+		c.crc32 = crc32.NewIEEE()
+	}
+	if checksumMD5 {
+		c.md5 = md5.New()
+	}
+	return c
+}
+
+func (c *checksummer) Write(block []byte) (int, error) {
+
+	c.sha256.Write(block)
+	if c.crc32 != nil {
+		c.crc32.Write(block)
+	}
+	if c.md5 != nil {
+		c.md5.Write(block)
+	}
+	return len(block), nil
+}
+
+// Returns the checksums of the blocks written so far.
+
+func (c *checksummer) Sums() Checksums {
+
+	sums := Checksums{SHA256: hex.EncodeToString(c.sha256.Sum(nil))}
+	if c.crc32 != nil {
+		sums.CRC32 = hex.EncodeToString(c.crc32.Sum(nil))
+	}
+	if c.md5 != nil {
+		sums.MD5 = hex.EncodeToString(c.md5.Sum(nil))
+	}
+	return sums
+}
+
+func checksumsOf(data []byte) Checksums {
+
+	c := newChecksummer()
+	c.Write(data)
+	return c.Sums()
+}
+
+// Loads the SHA-256 uploads must have from a manifest in sha256sum(1) format - a hex SHA-256, then the name, per
+// line. A "*" before the name, which marks binary mode, is ignored.
+
+func LoadChecksumManifest(path string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		sum, name, ok := strings.Cut(line, " ")
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		if ok == false || name == "" || validSHA256(sum) == false {
+			return fmt.Errorf("checksum manifest %s: line %d: %q is not: sha256 name", path, n, line)
+		}
+		sums[name] = strings.ToLower(sum)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("checksum manifest %s: %w", path, err)
+	}
+
+	expectedChecksums = sums
+	return nil
+}
+
+func validSHA256(s string) bool {
+
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// Returns the SHA-256 an upload of name must have, or "" if it is not checked. Fails if name has a sidecar that
+// does not hold a checksum. The caller must hold lockMetadataChanges.
+
+func expectedChecksum(name string) (string, error) {
+
+	if sum, ok := expectedChecksums[name]; ok == true {
+		return sum, nil
+	}
+
+	if verifySidecars == false {
+		return "", nil
+	}
+
+	// A sidecar holds what sha256sum(1) prints - the checksum comes first.
+
+	promoteVersion(name + ".sha256")
+
+	sidecar, ok := fileCacheMap[name + ".sha256"]
+	if ok == false || sidecar.Committed() == false {
+		return "", nil
+	}
+	if fields := strings.Fields(string(sidecar.Bytes())); len(fields) > 0 && validSHA256(fields[0]) {
+		return strings.ToLower(fields[0]), nil
+	}
+	return "", &invalidSidecar{name + ".sha256"}
+}
+
+// A sidecar that does not start with a SHA-256. The upload it is for is refused, as nothing can match it.
+
+type invalidSidecar struct {
+	name string
+}
+
+func (e *invalidSidecar) Error() string {
+
+	return fmt.Sprintf("invalid checksum sidecar %s: no sha256 in it", e.name)
+}
+
+// An upload whose checksum is not the one expected.
+
+type checksumMismatch struct {
+	name string
+	got, want string
+}
+
+func (e *checksumMismatch) Error() string {
+
+	return fmt.Sprintf("checksum mismatch for %s: sha256 %s, expected %s", e.name, e.got, e.want)
+}
+
+// Checks an upload's checksums against the SHA-256 expected, if any.
+
+func verifyChecksum(name string, sums Checksums, want string) error {
+
+	if want != "" && sums.SHA256 != want {
+		return &checksumMismatch{name, sums.SHA256, want}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"../../client"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Computes CRC32 and MD5 as well as SHA-256 for the rest of the test. Settings are made before the server
+// starts, so its goroutines see them.
+
+func useLegacyChecksums(t *testing.T) {
+	checksumCRC32, checksumMD5 = true, true
+	t.Cleanup(func() { checksumCRC32, checksumMD5 = false, false })
+}
+
+// Expects an upload to be refused for its checksum, and the name to be left free.
+
+func expectMismatch(t *testing.T, c *client.Client, addr, name string, data []byte) {
+	t.Helper()
+
+	err := c.PutBytes(testContext(t), addr, name, data)
+	var e *client.Error
+	if errors.As(err, &e) == false || !strings.Contains(e.Msg, "checksum mismatch") {
+		t.Fatalf("Upload of %s that does not match: expected a checksum mismatch; got %v", name, err)
+	}
+	if _, ok := cachedFile(name); ok {
+		t.Fatalf("Refused upload of %s left in the cache", name)
+	}
+}
+
+// An upload's checksums are computed as its blocks arrive, kept with the file, and logged when it is written
+// and read.
+
+func TestIntegrationChecksums(t *testing.T) {
+	useLegacyChecksums(t)
+	addr := startServer(t)
+	logged := captureRequestLog(t)
+	c := newTestClient()
+
+	for _, size := range []int{0, 511, 512, 5000} {
+		name := testFileName(t)
+		data := testData(size, size)
+		if err := roundTrip(testContext(t), c, addr, name, data); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { dropFiles(map[string][]byte{name: nil}) })
+
+		md5Sum := md5.Sum(data)
+		want := Checksums{
+			SHA256: sha256Hex(data),
+			CRC32: fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)),
+			MD5: hex.EncodeToString(md5Sum[:]),
+		}
+		f, _ := cachedFile(name)
+		if got := f.Checksums(); got != want {
+			t.Errorf("%d bytes: checksums %+v; expected %+v", size, got, want)
+		}
+
+		// The read is logged once the client's last ack arrives, which may be after GetBytes returns.
+
+		for _, what := range []string{"Write complete", "Read complete"} {
+			deadline := time.Now().Add(5 * time.Second)
+			for !containsLine(logged.String(), what, name, want.String()) {
+				if time.Now().After(deadline) {
+					t.Fatalf("%s %s with %s not logged: %q", what, name, want, logged.String())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+}
+
+// Reports whether a line of log holds every one of parts.
+
+func containsLine(log string, parts ...string) bool {
+	for _, line := range strings.Split(log, "\n") {
+		found := true
+		for _, part := range parts {
+			found = found && strings.Contains(line, part)
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// Files that are not uploaded are checksummed when they are committed.
+
+func TestCommitChecksums(t *testing.T) {
+	data := testData(1, 3000)
+	if got := newCommittedFile(data).Checksums(); got.SHA256 != sha256Hex(data) || got.CRC32 != "" {
+		t.Errorf("Checksums %+v; expected only sha256 %s", got, sha256Hex(data))
+	}
+}
+
+// With -verify-sidecar, an upload must match the checksum in the name.sha256 file, if there is one.
+
+func TestIntegrationVerifySidecar(t *testing.T) {
+	verifySidecars = true
+	t.Cleanup(func() { verifySidecars = false })
+	addr := startServer(t)
+	c := newTestClient()
+
+	name := testFileName(t)
+	data := testData(2, 2000)
+	t.Cleanup(func() { dropFiles(map[string][]byte{name: nil, name + ".sha256": nil}) })
+
+	sidecar := []byte(sha256Hex(data) + "  " + name + "\n")
+	if err := c.PutBytes(testContext(t), addr, name + ".sha256", sidecar); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMismatch(t, c, addr, name, testData(3, 2000))
+
+	if err := roundTrip(testContext(t), c, addr, name, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// A sidecar that holds no checksum refuses the upload, and says so.
+
+	bad := testFileName(t)
+	t.Cleanup(func() { dropFiles(map[string][]byte{bad: nil, bad + ".sha256": nil}) })
+	if err := c.PutBytes(testContext(t), addr, bad + ".sha256", []byte("not a checksum\n")); err != nil {
+		t.Fatal(err)
+	}
+	err := c.PutBytes(testContext(t), addr, bad, data)
+	var e *client.Error
+	if errors.As(err, &e) == false || !strings.Contains(e.Msg, "invalid checksum sidecar") || strings.Contains(e.Msg, "mismatch") {
+		t.Errorf("Upload with an invalid sidecar: expected \"invalid checksum sidecar\"; got %v", err)
+	}
+	if _, ok := cachedFile(bad); ok {
+		t.Errorf("Upload with an invalid sidecar left in the cache")
+	}
+
+	// A name without a sidecar is not checked.
+
+	other := testFileName(t)
+	t.Cleanup(func() { dropFiles(map[string][]byte{other: nil}) })
+	if err := c.PutBytes(testContext(t), addr, other, data[:10]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// With -verify-manifest, an upload must match the checksum listed for it.
+
+func TestIntegrationVerifyManifest(t *testing.T) {
+	name := testFileName(t)
+	data := testData(4, 1500)
+	t.Cleanup(func() { dropFiles(map[string][]byte{name: nil}) })
+
+	manifest := filepath.Join(t.TempDir(), "SHA256SUMS")
+	contents := "# Release images\n" + strings.ToUpper(sha256Hex(data)) + " *" + name + "\n"
+	if err := os.WriteFile(manifest, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadChecksumManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { expectedChecksums = nil })
+
+	addr := startServer(t)
+	c := newTestClient()
+
+	expectMismatch(t, c, addr, name, data[:1499])
+
+	if err := roundTrip(testContext(t), c, addr, name, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadChecksumManifestErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, line := range []string{
+		"d41d8cd98f00b204e9800998ecf8427e  md5-not-sha256",
+		sha256Hex(nil),
+		"not-hex  name",
+	} {
+		path := filepath.Join(dir, "SHA256SUMS")
+		os.WriteFile(path, []byte("\n" + line + "\n"), 0o644)
+		if err := LoadChecksumManifest(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("Manifest line %q: expected an error for line 2; got %v", line, err)
+		}
+	}
+	if expectedChecksums != nil {
+		t.Errorf("Manifests with errors loaded")
+	}
+}
+
+func TestSetChecksums(t *testing.T) {
+	t.Cleanup(func() { checksumCRC32, checksumMD5 = false, false })
+
+	if err := SetChecksums("sha256, CRC32"); err != nil || checksumCRC32 == false || checksumMD5 == true {
+		t.Errorf("SetChecksums: %v, crc32 %t, md5 %t", err, checksumCRC32, checksumMD5)
+	}
+	if err := SetChecksums("sha1"); err == nil {
+		t.Errorf("Unknown checksum accepted")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// Files in the cache are stored as fixed size chunks, content addressed by their SHA-256 and reference counted,
+// so a chunk that is in several files - the same config backup uploaded by a hundred devices, a crash bundle
+// uploaded again under a new name - is held once. An upload of a file the cache already holds costs only the
+// list of its chunks.
+//
+// An upload is cut into chunks as its blocks arrive, see CacheFile.Append, so a duplicate is never held in full.
+// The chunk size is a multiple of the block size, so a block is always served as a slice of one chunk.
+//
+// A file holds a reference to each of its chunks until it leaves the cache - see dropFile. Snapshots are
+// content addressed too: each chunk is saved once, see Snapshot.go.
+
+const chunkSize = 64 * 1024
+
+type chunk struct {
+	sum [sha256.Size]byte
+	data []byte
+	refs int							// Guarded by ChunkStore.mux
+}
+
+// The chunks held, by SHA-256. mux is a leaf lock - nothing else is taken while it is held.
+
+type ChunkStore struct {
+	mux sync.Mutex
+	chunks map[[sha256.Size]byte]*chunk
+	logical int64						// Bytes in all the files held - a chunk counts once per reference
+	physical int64						// Bytes held - each chunk counts once
+}
+
+var chunkStore = NewChunkStore()
+
+func NewChunkStore() *ChunkStore {
+
+	return &ChunkStore{chunks: make(map[[sha256.Size]byte]*chunk)}
+}
+
+// Returns the chunk holding data, with a reference taken for the caller. Reports whether data was kept, as a new
+// chunk - if it was, the caller must not modify data afterwards. With clone, a new chunk holds a copy of data
+// instead, and the caller's buffer is never kept.
+
+func (s *ChunkStore) Put(data []byte, clone bool) (*chunk, bool) {
+
+	sum := sha256.Sum256(data)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.logical += int64(len(data))
+
+	if c, ok := s.chunks[sum]; ok == true {
+		c.refs++
+		return c, false
+	}
+
+	if clone == true {
+		data = bytes.Clone(data)
+	}
+
+	c := &chunk{sum: sum, data: data[:len(data):len(data)], refs: 1}
+	s.chunks[sum] = c
+	s.physical += int64(len(data))
+	return c, clone == false
+}
+
+// Drops a reference to each of chunks. A chunk with no references left is forgotten - a read still serving it
+// keeps its data.
+
+func (s *ChunkStore) Release(chunks []*chunk) {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, c := range chunks {
+		s.logical -= int64(len(c.data))
+		c.refs--
+		if c.refs == 0 {
+			delete(s.chunks, c.sum)
+			s.physical -= int64(len(c.data))
+		}
+	}
+}
+
+// What the store holds, for the metrics.
+
+type ChunkStats struct {
+	Chunks int
+	LogicalBytes int64
+	PhysicalBytes int64
+}
+
+func (s *ChunkStore) Stats() ChunkStats {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return ChunkStats{Chunks: len(s.chunks), LogicalBytes: s.logical, PhysicalBytes: s.physical}
+}
+
+// Returns the bytes in the files for each byte held - 1 when nothing is shared, or nothing is held.
+
+func (st ChunkStats) DedupRatio() float64 {
+
+	if st.PhysicalBytes == 0 {
+		return 1
+	}
+	return float64(st.LogicalBytes) / float64(st.PhysicalBytes)
+}
+
+func (c *chunk) Hex() string {
+
+	return hex.EncodeToString(c.sum[:])
+}
+
+// Releases the chunks of f, which has left name, unless name still holds it - as the current version, an old
+// version, or a replacement being uploaded. The caller must hold lockMetadataChanges.
+
+func dropFile(name string, f *CacheFile) {
+
+	if f == nil || fileCacheMap[name] == f || replacing[name] == f {
+		return
+	}
+	for _, v := range fileVersions[name] {
+		if v.File == f {
+			return
+		}
+	}
+	f.release()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func chunkRefs(c *chunk) int {
+	chunkStore.mux.Lock()
+	defer chunkStore.mux.Unlock()
+	return c.refs
+}
+
+// A chunk put twice is held once, and forgotten when both references are released.
+
+func TestChunkStore(t *testing.T) {
+	s := NewChunkStore()
+	data := testData(21, 1000)
+
+	a, kept := s.Put(data, false)
+	if kept == false {
+		t.Errorf("New chunk: data not kept")
+	}
+	b, kept := s.Put(bytes.Clone(data), false)
+	if b != a || kept == true || a.refs != 2 {
+		t.Fatalf("Chunk put twice: same chunk %t, kept %t, %d references", b == a, kept, a.refs)
+	}
+
+	if st := s.Stats(); st != (ChunkStats{Chunks: 1, LogicalBytes: 2000, PhysicalBytes: 1000}) || st.DedupRatio() != 2 {
+		t.Errorf("Stats %+v, dedup ratio %g; expected 1 chunk, 2000 bytes in 1000, ratio 2", st, st.DedupRatio())
+	}
+
+	s.Release([]*chunk{a})
+	if st := s.Stats(); st.Chunks != 1 || st.DedupRatio() != 1 {
+		t.Errorf("After one release: stats %+v", st)
+	}
+	s.Release([]*chunk{b})
+	if st := s.Stats(); st != (ChunkStats{}) || st.DedupRatio() != 1 {
+		t.Errorf("After both releases: stats %+v, dedup ratio %g; expected nothing held, ratio 1", st, st.DedupRatio())
+	}
+
+	// A clone never keeps the caller's buffer.
+
+	c, kept := s.Put(data, true)
+	if kept == true || &c.data[0] == &data[0] {
+		t.Errorf("Cloned chunk kept the caller's buffer")
+	}
+}
+
+// Two uploads of the same data share their chunks, and the chunks go when both files are released.
+
+func TestCacheFileSharesChunks(t *testing.T) {
+	data := testData(22, 2 * chunkSize + 1000)
+
+	a := uploadFile(data)
+	b := uploadFile(data)
+	if len(a.chunks) != 3 || len(b.chunks) != 3 {
+		t.Fatalf("Files of %d bytes: %d and %d chunks; expected 3", len(data), len(a.chunks), len(b.chunks))
+	}
+	for i := range a.chunks {
+		if a.chunks[i] != b.chunks[i] || chunkRefs(a.chunks[i]) != 2 {
+			t.Errorf("Chunk %d: shared %t, %d references", i, a.chunks[i] == b.chunks[i], chunkRefs(a.chunks[i]))
+		}
+	}
+	if !bytes.Equal(a.Bytes(), data) || a.Checksums() != b.Checksums() || a.Checksums().SHA256 != sha256Hex(data) {
+		t.Errorf("Chunked file does not hold the data uploaded")
+	}
+
+	a.release()
+	a.release()
+	if chunkRefs(b.chunks[0]) != 1 {
+		t.Errorf("Released twice: %d references left; expected 1", chunkRefs(b.chunks[0]))
+	}
+	b.release()
+	if chunkRefs(b.chunks[0]) != 0 {
+		t.Errorf("Both released: %d references left", chunkRefs(b.chunks[0]))
+	}
+
+	// A discarded upload releases what it stored, and keeps nothing after.
+
+	c := new(CacheFile)
+	c.Append(data[:chunkSize])
+	c.Discard()
+	c.Append(data[chunkSize:])
+	if chunkRefs(c.chunks[0]) != 0 || len(c.chunks) != 1 {
+		t.Errorf("Discarded upload: %d chunks, %d references", len(c.chunks), chunkRefs(c.chunks[0]))
+	}
+}
+
+// A block size that does not divide the chunk size has blocks that span two chunks.
+
+func TestCacheFileBlocksSpanChunks(t *testing.T) {
+	data := testData(23, 3 * chunkSize)
+	f := newStoredFile(data)
+	f.Commit()
+	t.Cleanup(f.release)
+
+	const blockSize = 1000
+
+	var served []byte
+	for i := 0; i < f.BlockCount(blockSize); i++ {
+		block := f.Block(i, blockSize)
+		if cap(block) != len(block) {
+			t.Errorf("Block %d has spare capacity %d", i, cap(block) - len(block))
+		}
+		served = append(served, block...)
+	}
+	if !bytes.Equal(served, data) {
+		t.Errorf("Served data does not match the data stored")
+	}
+}
+
+// A version dropped from the history releases its chunks, unless a later version holds the same file.
+
+func TestVersionsReleaseChunks(t *testing.T) {
+	useVersions(t, 2)
+	name := testFileName(t)
+	dropVersions(t, name)
+
+	var files []*CacheFile
+	for i := 0; i < 3; i++ {
+		files = append(files, newStoredFile(testData(30 + i, 1000)))
+		files[i].Commit()
+	}
+
+	lockMetadataChanges.Lock()
+	for _, f := range files {
+		addVersion(name, f, clk.Now(), "test")
+	}
+	addVersion(name, files[1], clk.Now(), "rollback to version 2")
+	lockMetadataChanges.Unlock()
+
+	for i, want := range []int{0, 1, 1} {
+		if got := chunkRefs(files[i].chunks[0]); got != want {
+			t.Errorf("Version %d: %d references; expected %d", i + 1, got, want)
+		}
+	}
+}
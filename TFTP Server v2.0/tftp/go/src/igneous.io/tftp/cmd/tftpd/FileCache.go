@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Where sendData reads a file's blocks from - a CacheFile, or a file still being fetched from the upstream origin
+// (see Upstream.go), whose blocks may not have arrived yet. Both wait at most until abort is closed, and then
+// return errAborted.
+
+type BlockSource interface {
+
+	// Returns block i (zero based), and whether it is the last block. The last block is shorter than blockSize,
+	// perhaps empty. The block must not be modified.
+
+	ReadBlock(i int, blockSize int, abort <-chan bool) ([]byte, bool, error)
+
+	// Returns the file's size for the tsize option, if it is known before the last block is read.
+
+	TransferSize(abort <-chan bool) (int, bool, error)
+}
+
+var errAborted = errors.New("transfer aborted")
+
+// Where handleData writes an upload's blocks - a CacheFile, or an upload to the object store (see
+// ObjectStore.go). Called with RequestTracker.Mux held, one block at a time, in order.
+
+type BlockSink interface {
+
+	// Adds the next block. The block is copied, the caller may reuse its buffer.
+
+	WriteBlock(block []byte) error
+
+	// Called after the final block. The file is not visible to readers until Finish returns without error.
+
+	Finish() error
+
+	// Drops an upload that did not complete. May be called with lockMetadataChanges held, so must not block.
+
+	Discard()
+}
+
+// A BlockSink that may have to wait for its store - an upload to the object store. handleData waits on these
+// channels without RequestTracker.Mux held, see waitForStore, so WriteBlock and Finish do not wait under the lock.
+
+type storeSink interface {
+
+	// Returns a channel closed once WriteBlock can take a block of n bytes, the final block if last, without
+	// waiting. nil if it can now.
+
+	Room(n int, last bool) <-chan struct{}
+
+	// Called after the final block is written. Returns a channel closed once Finish will not wait.
+
+	Flush() <-chan struct{}
+}
+
+// Holds the contents of one file in the in-memory cache.
+//
+// A file in the cache is a list of chunks from the chunk store, see ChunkStore.go. An upload fills one chunk at
+// a time, and puts it in the store when it is full, so the cost of adding a block is O(1) and an upload of n
+// bytes is O(n) overall - the old string cache rebuilt the whole file on every block, which made uploads O(n^2).
+// A generated file is served once and not kept, so it holds its data whole, outside the store.
+//
+// Once an upload is committed the file is immutable. Reads serve each block as a sub-slice of a chunk, so there
+// is no per-read copy of the file, and any number of concurrent reads share the same chunks.
+//
+// Only the goroutine processing the upload (serialized by RequestTracker.Mux) appends to an uncommitted file,
+// and readers never look at the chunks until Committed returns true. The atomic flag orders the two. mux orders
+// the upload with Discard, which may run at any time.
+
+type CacheFile struct {
+	data      []byte    // A generated file's contents - not in the chunk store
+	chunks    []*chunk  // A cached file's contents, chunkSize bytes each but the last
+	fill      []byte    // The chunk an upload is filling
+	size      int
+	mux       sync.Mutex // Guards chunks, fill and released while the file is uncommitted - a leaf lock, but for ChunkStore.mux
+	released  bool      // The chunks have been released - see release
+	committed atomic.Bool
+	modTime   time.Time // When the file was committed - set before, and immutable after
+	readOnly  bool      // Write requests for the name are refused - see Preload.go
+	checksums Checksums // Set before the file is committed, and immutable after - see Checksum.go
+	source    string    // The client that uploaded the file, if it was uploaded - set before it is committed
+}
+
+// Returns a committed file holding data, for files served from outside the cache - see Providers.go. The
+// caller must not modify data afterwards.
+
+func newCommittedFile(data []byte) *CacheFile {
+
+	f := &CacheFile{data: data, size: len(data)}
+	f.Commit()
+	return f
+}
+
+// Returns an uncommitted file holding a copy of data in the chunk store, for files added to the cache whole -
+// preloaded, restored or fetched. Commit it to publish it.
+
+func newStoredFile(data []byte) *CacheFile {
+
+	f := new(CacheFile)
+	for i := 0; i < len(data); i += chunkSize {
+		c, _ := chunkStore.Put(data[i:min(i + chunkSize, len(data))], true)
+		f.chunks = append(f.chunks, c)
+	}
+	f.size = len(data)
+	return f
+}
+
+// Returns an uncommitted file made of chunks, which the caller holds a reference to each of - see Snapshot.go.
+
+func newChunkedFile(chunks []*chunk) *CacheFile {
+
+	f := &CacheFile{chunks: chunks}
+	for _, c := range chunks {
+		f.size += len(c.data)
+	}
+	return f
+}
+
+// Appends a block of data to an uncommitted file. The block is copied, the caller may reuse its buffer.
+
+func (f *CacheFile) Append(block []byte) {
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	// A discarded upload keeps nothing.
+
+	if f.released == true {
+		return
+	}
+
+	f.size += len(block)
+
+	for len(block) > 0 {
+		if f.fill == nil {
+			f.fill = make([]byte, 0, chunkSize)
+		}
+
+		n := min(len(block), chunkSize - len(f.fill))
+		f.fill = append(f.fill, block[:n]...)
+		block = block[n:]
+
+		// Put a full chunk in the store. If the store has it already the buffer is filled again.
+
+		if len(f.fill) == chunkSize {
+			c, kept := chunkStore.Put(f.fill, false)
+			f.chunks = append(f.chunks, c)
+			if kept == true {
+				f.fill = nil
+			} else {
+				f.fill = f.fill[:0]
+			}
+		}
+	}
+}
+
+// Publishes the file to readers. The file must not be modified after it is committed.
+
+func (f *CacheFile) Commit() {
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	// The last chunk is put in the store as a copy, so it does not keep the spare capacity of the buffer it was
+	// filled in. A generated file's data drops any spare capacity from the slice header, so a reader can never
+	// append into the shared backing array.
+
+	if len(f.fill) > 0 && f.released == false {
+		c, _ := chunkStore.Put(f.fill, true)
+		f.chunks = append(f.chunks, c)
+	}
+	f.fill = nil
+	f.data = f.data[:len(f.data):len(f.data)]
+
+	if f.modTime.IsZero() {
+		f.modTime = clk.Now()
+	}
+
+	// An upload's checksums are computed as its blocks arrive, other files are checksummed here.
+
+	if f.checksums.SHA256 == "" {
+		c := newChecksummer()
+		f.WriteTo(c)
+		f.checksums = c.Sums()
+	}
+	f.committed.Store(true)
+}
+
+func (f *CacheFile) Committed() bool {
+
+	return f.committed.Load()
+}
+
+func (f *CacheFile) ModTime() time.Time {
+
+	return f.modTime
+}
+
+func (f *CacheFile) Checksums() Checksums {
+
+	return f.checksums
+}
+
+func (f *CacheFile) Size() int {
+
+	return f.size
+}
+
+// Writes the contents of a committed file, a chunk at a time.
+
+func (f *CacheFile) WriteTo(w io.Writer) (int64, error) {
+
+	n, err := w.Write(f.data)
+	written := int64(n)
+
+	for _, c := range f.chunks {
+		if err != nil {
+			break
+		}
+		n, err = w.Write(c.data)
+		written += int64(n)
+	}
+	return written, err
+}
+
+// Returns the contents of a committed file in one slice. The caller must not modify it. A file of more than
+// one chunk is copied.
+
+func (f *CacheFile) Bytes() []byte {
+
+	switch {
+	case f.data != nil || len(f.chunks) == 0:
+		return f.data
+	case len(f.chunks) == 1:
+		return f.chunks[0].data
+	}
+
+	data := make([]byte, 0, f.size)
+	for _, c := range f.chunks {
+		data = append(data, c.data...)
+	}
+	return data
+}
+
+// Drops the file's references to its chunks, when it leaves the cache - see dropFile. Safe to call more than
+// once. Reads still serving the file keep its data.
+
+func (f *CacheFile) release() {
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.released == false {
+		f.released = true
+		chunkStore.Release(f.chunks)
+	}
+}
+
+// Returns the number of DATA packets needed to send the file. A file whose size is an exact multiple of the
+// block size needs a final zero length packet, so there is always at least one block.
+
+func (f *CacheFile) BlockCount(blockSize int) int {
+
+	return (f.size / blockSize) + 1
+}
+
+// Returns block i (zero based) of the file as a slice of the cached data - no copy is made, unless the block
+// spans two chunks, which it cannot when the block size divides the chunk size.
+// The last block may be shorter than blockSize, or empty.
+
+func (f *CacheFile) Block(i int, blockSize int) []byte {
+
+	start := min(i * blockSize, f.size)
+	end := min(start + blockSize, f.size)
+
+	switch {
+	case f.data != nil:
+		return f.data[start:end:end]
+	case start == end:
+		return []byte{}
+	}
+
+	c := f.chunks[start / chunkSize].data
+	off := start % chunkSize
+	if off + (end - start) <= len(c) {
+		return c[off:off + end - start:off + end - start]
+	}
+
+	block := make([]byte, 0, end - start)
+	for pos := start; pos < end; {
+		c := f.chunks[pos / chunkSize].data[pos % chunkSize:]
+		n := min(len(c), end - pos)
+		block = append(block, c[:n]...)
+		pos += n
+	}
+	return block
+}
+
+// BlockSource for a committed file - every block is at hand.
+
+func (f *CacheFile) ReadBlock(i int, blockSize int, abort <-chan bool) ([]byte, bool, error) {
+
+	return f.Block(i, blockSize), i >= f.BlockCount(blockSize) - 1, nil
+}
+
+func (f *CacheFile) TransferSize(abort <-chan bool) (int, bool, error) {
+
+	return f.size, true, nil
+}
+
+// BlockSink for an upload to the cache. discardUpload frees the name of a discarded upload.
+
+func (f *CacheFile) WriteBlock(block []byte) error {
+
+	f.Append(block)
+	return nil
+}
+
+func (f *CacheFile) Finish() error {
+
+	f.Commit()
+	return nil
+}
+
+// Releases the chunks of an upload that did not complete. A committed file is left alone - a client may send an
+// error after its upload completed.
+
+func (f *CacheFile) Discard() {
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.committed.Load() == false && f.released == false {
+		f.released = true
+		chunkStore.Release(f.chunks)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestCacheFileBlocks(t *testing.T) {
+	tests := []struct {
+		size   int
+		blocks []int // expected length of each block
+	}{
+		{0, []int{0}},
+		{1, []int{1}},
+		{511, []int{511}},
+		{512, []int{512, 0}},
+		{513, []int{512, 1}},
+		{1024, []int{512, 512, 0}},
+		{1500, []int{512, 512, 476}},
+	}
+
+	for _, test := range tests {
+		data := make([]byte, test.size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+
+		// Upload in uneven pieces, to check appends are independent of the block size.
+
+		f := new(CacheFile)
+		for rest := data; len(rest) > 0; {
+			n := 100
+			if n > len(rest) {
+				n = len(rest)
+			}
+			f.Append(rest[:n])
+			rest = rest[n:]
+		}
+
+		if f.Committed() {
+			t.Errorf("Size %d: file committed before Commit", test.size)
+		}
+		f.Commit()
+		if !f.Committed() {
+			t.Errorf("Size %d: file not committed after Commit", test.size)
+		}
+
+		if f.Size() != test.size {
+			t.Errorf("Size %d: Size returned %d", test.size, f.Size())
+		}
+		if f.BlockCount(dataBlockSize) != len(test.blocks) {
+			t.Errorf("Size %d: expected %d blocks; got %d", test.size, len(test.blocks), f.BlockCount(dataBlockSize))
+			continue
+		}
+
+		var served []byte
+		for i, expected := range test.blocks {
+			block := f.Block(i, dataBlockSize)
+			if len(block) != expected {
+				t.Errorf("Size %d: block %d expected %d bytes; got %d", test.size, i, expected, len(block))
+			}
+			if cap(block) != len(block) {
+				t.Errorf("Size %d: block %d has spare capacity %d", test.size, i, cap(block)-len(block))
+			}
+			served = append(served, block...)
+		}
+		if !bytes.Equal(served, data) {
+			t.Errorf("Size %d: served data does not match uploaded data", test.size)
+		}
+	}
+}
+
+// Upload throughput should stay flat as the file size grows - the cost of each block must not depend on the
+// size of the data already received.
+
+func BenchmarkCacheFileUpload(b *testing.B) {
+	block := make([]byte, dataBlockSize)
+
+	for _, size := range []int{64 << 10, 1 << 20, 16 << 20} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for n := 0; n < b.N; n++ {
+				f := new(CacheFile)
+				for written := 0; written < size; written += dataBlockSize {
+					f.Append(block)
+				}
+				f.Commit()
+			}
+		})
+	}
+}
+
+func BenchmarkCacheFileRead(b *testing.B) {
+	f := new(CacheFile)
+	f.Append(make([]byte, 16<<20))
+	f.Commit()
+
+	b.SetBytes(int64(f.Size()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		count := f.BlockCount(dataBlockSize)
+		for i := 0; i < count; i++ {
+			_ = f.Block(i, dataBlockSize)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One host in the inventory, see loadInventory. Templates see it as .Host.
+
+type Host struct {
+	IP string
+	MAC string						// Lower case, colon separated
+	Hostname string
+	Role string
+	Image string
+	Extra map[string]string			// Any other columns or fields, keyed by name
+}
+
+// The host inventory, loaded from a CSV or JSON file. Reloaded when the file changes, so hosts can be added
+// without a restart - the file is checked at most once per inventoryCheckInterval.
+
+type Inventory struct {
+	path string
+	mux sync.Mutex
+	modTime time.Time				// Of the file last loaded
+	checked time.Time				// When the file was last checked for changes
+	byIP map[string]*Host
+	byMAC map[string]*Host
+}
+
+const inventoryCheckInterval = time.Second
+
+func NewInventory(path string) (*Inventory, error) {
+
+	inv := &Inventory{path: path}
+	if err := inv.reload(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// Returns the host with the given MAC address, or failing that the given IP address. Either may be empty.
+// Returns nil if neither is in the inventory.
+
+func (inv *Inventory) Lookup(ip string, mac string) *Host {
+
+	inv.mux.Lock()
+	defer inv.mux.Unlock()
+
+	// Keep serving the last good inventory if the file is mid-edit, or has gone.
+
+	if now := clk.Now(); now.Sub(inv.checked) >= inventoryCheckInterval {
+		inv.checked = now
+		if fi, err := os.Stat(inv.path); err == nil && fi.ModTime().Equal(inv.modTime) == false {
+			if err := inv.reloadLocked(); err != nil {
+				requestLog.Printf("Inventory %s not reloaded: %s \n", inv.path, err)
+			}
+		}
+	}
+
+	if h, ok := inv.byMAC[normalizeMAC(mac)]; ok == true {
+		return h
+	}
+	if h, ok := inv.byIP[ip]; ok == true {
+		return h
+	}
+	return nil
+}
+
+func (inv *Inventory) reload() error {
+
+	inv.mux.Lock()
+	defer inv.mux.Unlock()
+
+	return inv.reloadLocked()
+}
+
+func (inv *Inventory) reloadLocked() error {
+
+	f, err := os.Open(inv.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hosts, err := loadInventory(f, filepath.Ext(inv.path))
+	if err != nil {
+		return fmt.Errorf("%s: %w", inv.path, err)
+	}
+
+	byIP := make(map[string]*Host)
+	byMAC := make(map[string]*Host)
+	for _, h := range hosts {
+		if h.IP != "" {
+			byIP[h.IP] = h
+		}
+		if h.MAC != "" {
+			byMAC[h.MAC] = h
+		}
+	}
+
+	inv.byIP, inv.byMAC, inv.modTime = byIP, byMAC, fi.ModTime()
+	inv.checked = clk.Now()
+	return nil
+}
+
+// Reads the hosts from an inventory. A ".json" file holds an array of objects, anything else is CSV with a
+// header row. The ip, mac, hostname, role and image columns or fields fill in the Host, in any case and order;
+// any others go in Extra. Every host needs an ip or a mac.
+
+func loadInventory(r io.Reader, ext string) ([]*Host, error) {
+
+	var records []map[string]string
+
+	if strings.EqualFold(ext, ".json") {
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return nil, err
+		}
+	} else {
+		cr := csv.NewReader(r)
+		cr.TrimLeadingSpace = true
+		cr.Comment = '#'
+
+		rows, err := cr.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return nil, nil
+		}
+		for _, row := range rows[1:] {
+			record := make(map[string]string)
+			for i, name := range rows[0] {
+				record[name] = row[i]
+			}
+			records = append(records, record)
+		}
+	}
+
+	hosts := make([]*Host, 0, len(records))
+
+	for i, record := range records {
+		h := &Host{Extra: make(map[string]string)}
+		for name, value := range record {
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "ip":
+				h.IP = value
+			case "mac":
+				h.MAC = value
+			case "hostname":
+				h.Hostname = value
+			case "role":
+				h.Role = value
+			case "image":
+				h.Image = value
+			default:
+				h.Extra[name] = value
+			}
+		}
+
+		if h.IP != "" {
+			ip := net.ParseIP(h.IP)
+			if ip == nil {
+				return nil, fmt.Errorf("host %d: bad ip %q", i+1, h.IP)
+			}
+			h.IP = ip.String()
+		}
+		if h.MAC != "" {
+			mac := normalizeMAC(h.MAC)
+			if mac == "" {
+				return nil, fmt.Errorf("host %d: bad mac %q", i+1, h.MAC)
+			}
+			h.MAC = mac
+		}
+		if h.IP == "" && h.MAC == "" {
+			return nil, fmt.Errorf("host %d: no ip or mac", i+1)
+		}
+
+		hosts = append(hosts, h)
+	}
+
+	return hosts, nil
+}
+
+// Returns mac as lower case, colon separated hex - the form Host.MAC is kept in - or "" if it is not a MAC.
+// Accepts the dash separated form PXELINUX puts in config file names.
+
+func normalizeMAC(mac string) string {
+
+	hw, err := net.ParseMAC(strings.ReplaceAll(mac, "-", ":"))
+	if err != nil {
+		return ""
+	}
+	return hw.String()
+}
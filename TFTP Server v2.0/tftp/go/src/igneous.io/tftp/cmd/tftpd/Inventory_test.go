@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testInventoryCSV = `# hosts in rack 12
+ip, mac, hostname, role, image, console
+10.0.12.1, 52:54:00:12:00:01, r12-n01, compute, compute-2024.img, ttyS0
+10.0.12.2, 52-54-00-12-00-02, r12-n02, storage, storage-2024.img, ttyS1
+, 52:54:00:12:00:03, r12-n03, compute, compute-2024.img, ttyS0
+`
+
+const testInventoryJSON = `[
+	{"ip": "10.0.12.1", "mac": "52:54:00:12:00:01", "hostname": "r12-n01", "role": "compute", "image": "compute-2024.img", "console": "ttyS0"},
+	{"IP": "10.0.12.2", "MAC": "52-54-00-12-00-02", "Hostname": "r12-n02", "Role": "storage", "Image": "storage-2024.img", "console": "ttyS1"},
+	{"mac": "52:54:00:12:00:03", "hostname": "r12-n03", "role": "compute", "image": "compute-2024.img", "console": "ttyS0"}
+]`
+
+func writeInventory(t *testing.T, name string, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestInventoryLookup(t *testing.T) {
+	for _, file := range []struct{ name, contents string }{
+		{"hosts.csv", testInventoryCSV},
+		{"hosts.json", testInventoryJSON},
+	} {
+		inv, err := NewInventory(writeInventory(t, file.name, file.contents))
+		if err != nil {
+			t.Fatalf("%s: %s", file.name, err)
+		}
+
+		tests := []struct {
+			ip, mac  string
+			hostname string
+		}{
+			{"10.0.12.1", "", "r12-n01"},
+			{"", "52-54-00-12-00-02", "r12-n02"},
+			{"", "52:54:00:12:00:03", "r12-n03"},
+			{"10.0.12.2", "52:54:00:12:00:01", "r12-n01"},		// The MAC wins
+			{"10.0.12.9", "52:54:00:12:00:09", ""},
+			{"", "", ""},
+		}
+
+		for _, test := range tests {
+			h := inv.Lookup(test.ip, test.mac)
+			switch {
+			case h == nil && test.hostname != "":
+				t.Errorf("%s: %s %s not found; expected %s", file.name, test.ip, test.mac, test.hostname)
+			case h != nil && h.Hostname != test.hostname:
+				t.Errorf("%s: %s %s found %s; expected %q", file.name, test.ip, test.mac, h.Hostname, test.hostname)
+			}
+		}
+
+		h := inv.Lookup("10.0.12.2", "")
+		if h == nil || h.MAC != "52:54:00:12:00:02" || h.Role != "storage" || h.Image != "storage-2024.img" || h.Extra["console"] != "ttyS1" {
+			t.Errorf("%s: r12-n02 loaded as %+v", file.name, h)
+		}
+	}
+}
+
+func TestInventoryErrors(t *testing.T) {
+	for _, contents := range []string{
+		"ip,hostname\n10.0.0.300,bad\n",
+		"mac,hostname\n52:54:00,bad\n",
+		"hostname,role\nnowhere,compute\n",
+		"ip,hostname\n10.0.0.1\n",
+	} {
+		if _, err := loadInventory(strings.NewReader(contents), ".csv"); err == nil {
+			t.Errorf("%q loaded without error", contents)
+		}
+	}
+
+	if _, err := loadInventory(strings.NewReader(`{"ip": "10.0.0.1"}`), ".json"); err == nil {
+		t.Errorf("JSON object loaded without error; expected an array")
+	}
+}
+
+// An edited inventory is picked up without a restart. A broken edit is logged, and the last good one kept.
+
+func TestInventoryReload(t *testing.T) {
+	fc := useFakeClock(t)
+	logged := captureRequestLog(t)
+
+	path := writeInventory(t, "hosts.csv", "ip,hostname\n10.0.0.1,before\n")
+	inv, err := NewInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edit := func(contents string, age time.Duration) {
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(age)
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	edit("ip,hostname\n10.0.0.1,after\n", time.Minute)
+	if h := inv.Lookup("10.0.0.1", ""); h == nil || h.Hostname != "before" {
+		t.Errorf("Inventory reloaded within the check interval: %+v", h)
+	}
+
+	fc.Advance(inventoryCheckInterval)
+	if h := inv.Lookup("10.0.0.1", ""); h == nil || h.Hostname != "after" {
+		t.Errorf("Edited inventory not reloaded: %+v", h)
+	}
+
+	edit("ip,hostname\n10.0.0.300,broken\n", 2*time.Minute)
+	fc.Advance(inventoryCheckInterval)
+	if h := inv.Lookup("10.0.0.1", ""); h == nil || h.Hostname != "after" {
+		t.Errorf("Broken inventory replaced the last good one: %+v", h)
+	}
+	if got := logged.String(); !strings.Contains(got, "not reloaded") {
+		t.Errorf("Broken inventory not logged: %q", got)
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Files can be kept in an S3-compatible bucket rather than in memory, so uploads such as crash dumps land in
+// object storage, and survive the server. Any S3-compatible endpoint works - AWS, or a MinIO server.
+//
+// An upload is a multipart upload. Blocks are gathered into parts of PartSize, each uploaded while the client
+// sends the next, and the upload is completed when the final DATA block arrives - the object does not exist
+// until then. If the store falls behind, the block that would queue a second part is not acked until the store
+// takes the first, see waitForStore. If the transfer fails, the multipart upload is aborted. The object is completed with
+// If-None-Match: *, so an upload never replaces an object, as an upload never replaces a file in the cache.
+//
+// A read is a series of ranged GETs of ReadSize, the first of which also gives the size for tsize.
+//
+// Objects are addressed path style, endpoint/bucket/prefix/name.
+
+type ObjectStore struct {
+	Endpoint *url.URL
+	Bucket string
+	Prefix string					// Prepended to file names to make object keys
+	Region string
+	Credentials awsCredentials		// Requests are not signed if there is no access key
+	Client *http.Client
+	PartSize int					// S3 requires parts of at least 5MB, but for the last
+	ReadSize int					// Bytes asked for by each ranged GET
+
+	mux sync.Mutex					// Guards uploads, never held with another lock
+	uploads map[string]*objectUpload	// In flight, by file name
+}
+
+// The object store, or nil if files are kept in memory. Set up by main before the server starts.
+
+var objectStore *ObjectStore
+
+// Ends a request to the object store that takes longer than this.
+
+const objectStoreTimeout = 2 * time.Minute
+
+// bucket may be followed by a prefix for the object keys, as bucket/crash-dumps. Credentials are taken from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+
+func NewObjectStore(endpoint string, region string, bucket string) (*ObjectStore, error) {
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("object store endpoint %q is not an http or https URL", endpoint)
+	}
+
+	bucket, prefix, _ := strings.Cut(strings.Trim(bucket, "/"), "/")
+	if bucket == "" {
+		return nil, errors.New("no object store bucket")
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &ObjectStore{
+		Endpoint: u,
+		Bucket: bucket,
+		Prefix: prefix,
+		Region: region,
+		Credentials: awsCredentials{
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		},
+		Client: &http.Client{Timeout: objectStoreTimeout},
+		PartSize: 8 << 20,
+		ReadSize: 1 << 20,
+		uploads: make(map[string]*objectUpload),
+	}, nil
+}
+
+// Returns the BlockSource for a read of name. Nothing is asked of the store until the first block is read - a
+// missing object fails the read then, with File not found.
+
+func (s *ObjectStore) Open(name string) BlockSource {
+
+	return &objectReader{store: s, name: name, size: -1}
+}
+
+// Starts an upload of name. Returns false if name is already being uploaded. Called with lockMetadataChanges
+// held, nothing is asked of the store until the first part is ready.
+
+func (s *ObjectStore) Create(name string) (BlockSink, bool) {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.uploads[name]; ok == true {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	upload := &objectUpload{
+		store: s,
+		name: name,
+		ctx: ctx,
+		cancel: cancel,
+		parts: make(chan []byte, 1),
+		taken: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.uploads[name] = upload
+
+	go upload.run()
+
+	return upload, true
+}
+
+// An S3 error response.
+
+type objectStoreError struct {
+	Code string
+	Message string
+}
+
+// Sends a request for the object holding name, signed. Returns the response if the store answered with one of
+// the ok statuses, which the caller must close, and an error otherwise. A missing object or bucket is
+// os.ErrNotExist, a request that is not allowed os.ErrPermission, a failed If-None-Match os.ErrExist.
+
+func (s *ObjectStore) do(ctx context.Context, method string, name string, query url.Values, header http.Header, body []byte, ok ...int) (*http.Response, error) {
+
+	// The path is sent as the signature encodes it.
+
+	key := s.Prefix + name
+	u := *s.Endpoint
+	u.Path = strings.TrimSuffix(s.Endpoint.Path, "/") + "/" + s.Bucket + "/" + key
+	u.RawPath = strings.TrimSuffix(s.Endpoint.EscapedPath(), "/") + "/" + uriEncode(s.Bucket, true) + "/" + uriEncode(key, false)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if s.Credentials.AccessKey != "" {
+		signRequest(req, s.Credentials, s.Region, payloadHash(body), time.Now())
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+
+	return nil, objectError(method, name, resp)
+}
+
+func objectError(method string, name string, resp *http.Response) error {
+
+	var e objectStoreError
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64 * 1024))
+	xml.Unmarshal(b, &e)
+
+	err := fmt.Errorf("object store %s %s: %s %s %s", method, name, resp.Status, e.Code, e.Message)
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %w", err, os.ErrNotExist)
+	case resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: %w", err, os.ErrPermission)
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return fmt.Errorf("%w: %w", err, os.ErrExist)
+	case e.Code == "EntityTooLarge" || e.Code == "QuotaExceeded":
+		return fmt.Errorf("%w: %w", err, syscall.ENOSPC)
+	}
+	return err
+}
+
+// Reads an object a ReadSize chunk at a time. Only sendData uses it, so there is no lock.
+
+type objectReader struct {
+	store *ObjectStore
+	name string
+	chunk []byte
+	offset int						// Of chunk in the object
+	size int						// Of the object, from the first response - -1 until then
+}
+
+func (r *objectReader) ReadBlock(i int, blockSize int, abort <-chan bool) ([]byte, bool, error) {
+
+	start := i * blockSize
+
+	if r.size < 0 || start < r.offset || start + blockSize > r.offset + len(r.chunk) && r.offset + len(r.chunk) < r.size {
+
+		// Ask for whole blocks, so no block spans two chunks.
+
+		n := (r.store.ReadSize + blockSize - 1) / blockSize * blockSize
+		if err := r.fetch(start, n, abort); err != nil {
+			return nil, false, err
+		}
+		if start < r.offset || start > r.offset + len(r.chunk) {
+			return nil, false, fmt.Errorf("object store GET %s: asked for bytes from %d, got %d from %d", r.name, start, len(r.chunk), r.offset)
+		}
+	}
+
+	end := start + blockSize
+	if end > r.offset + len(r.chunk) {
+		end = r.offset + len(r.chunk)
+	}
+	if start > end {
+		start = end
+	}
+
+	// A block cut short by the end of the chunk, rather than of the object, is not the last.
+
+	last := end - start < blockSize && end >= r.size
+	if end - start < blockSize && last == false {
+		return nil, false, fmt.Errorf("object store GET %s: %d bytes from %d, short of the %d byte object", r.name, len(r.chunk), r.offset, r.size)
+	}
+
+	return r.chunk[start - r.offset : end - r.offset : end - r.offset], last, nil
+}
+
+func (r *objectReader) TransferSize(abort <-chan bool) (int, bool, error) {
+
+	if r.size < 0 {
+		if err := r.fetch(0, r.store.ReadSize, abort); err != nil {
+			return 0, false, err
+		}
+	}
+	return r.size, true, nil
+}
+
+// Reads n bytes at start into chunk.
+
+func (r *objectReader) fetch(start int, n int, abort <-chan bool) error {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", start, start + n - 1)}}
+
+	resp, err := r.store.do(ctx, "GET", r.name, nil, header, nil, http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable)
+	if err != nil {
+		if ctx.Err() != nil {
+			return errAborted
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return errAborted
+		}
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+
+		// The store sent the whole object.
+
+		r.chunk, r.offset, r.size = body, 0, len(body)
+
+	case http.StatusPartialContent:
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		size, err := strconv.Atoi(total)
+		if err != nil {
+			return fmt.Errorf("object store GET %s: bad Content-Range %q", r.name, resp.Header.Get("Content-Range"))
+		}
+		r.chunk, r.offset, r.size = body, start, size
+
+	default:
+
+		// Nothing at start - the object is empty, or ends there.
+
+		r.chunk, r.offset, r.size = nil, start, start
+	}
+
+	return nil
+}
+
+// A multipart upload. handleData writes the blocks, run uploads the parts.
+
+type objectUpload struct {
+	store *ObjectStore
+	name string
+	buf []byte						// The part being gathered
+	sent int						// Parts handed to run
+	flushed bool					// The last part has been handed to run, see Flush
+	ctx context.Context				// Cancelled to discard the upload
+	cancel context.CancelFunc
+	parts chan []byte				// To run, closed after the last part. Holds one part while run uploads another
+	mux sync.Mutex					// Guards taken
+	taken chan struct{}				// Closed, and replaced, by run as it takes each part - nil once run returns
+	done chan struct{}				// Closed when run returns, err is then set
+	err error
+}
+
+func (u *objectUpload) WriteBlock(block []byte) error {
+
+	u.buf = append(u.buf, block...)
+	if len(u.buf) < u.store.PartSize {
+		return nil
+	}
+	return u.send()
+}
+
+// Hands the part gathered to run - waits while a part is already waiting for it, unless Room said there is room.
+
+func (u *objectUpload) send() error {
+
+	part := u.buf
+	u.buf = nil
+
+	select {
+	case u.parts <- part:
+		u.sent++
+		return nil
+	case <-u.done:
+		return u.err
+	}
+}
+
+// Returns a channel closed once WriteBlock can take a block of n bytes, and Flush after it if it is the last,
+// without waiting - once run has taken the part waiting for it. nil if they can now. handleData waits on it
+// without RequestTracker.Mux held, see waitForStore.
+
+func (u *objectUpload) Room(n int, last bool) <-chan struct{} {
+
+	full := len(u.buf) + n >= u.store.PartSize
+	final := last && (len(u.buf) + n > 0 || u.sent == 0)
+	if full == false && final == false {
+		return nil
+	}
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	if len(u.parts) < cap(u.parts) {
+		return nil
+	}
+	return u.taken
+}
+
+// Hands run the last part, and closes parts so run completes the upload. A multipart upload has at least one
+// part, even if it is empty. Returns a channel closed once the upload is complete, or has failed.
+
+func (u *objectUpload) Flush() <-chan struct{} {
+
+	if u.flushed == false {
+		u.flushed = true
+		if len(u.buf) > 0 || u.sent == 0 {
+			u.send()
+		}
+		close(u.parts)
+	}
+	return u.done
+}
+
+func (u *objectUpload) Finish() error {
+
+	<-u.Flush()
+	return u.err
+}
+
+func (u *objectUpload) Discard() {
+
+	u.cancel()
+}
+
+// Creates the multipart upload, uploads each part, and completes it once the last part is in. On failure, or if
+// the upload is discarded, the multipart upload is aborted so the store does not keep the parts.
+
+func (u *objectUpload) run() {
+
+	var uploadID string
+	var etags []string
+
+	err := func() error {
+		for {
+			select {
+			case part, more := <-u.parts:
+				u.took()
+				if uploadID == "" {
+					var err error
+					if uploadID, err = u.create(); err != nil {
+						return err
+					}
+				}
+				if more == false {
+					return u.complete(uploadID, etags)
+				}
+				etag, err := u.uploadPart(uploadID, len(etags) + 1, part)
+				if err != nil {
+					return err
+				}
+				etags = append(etags, etag)
+
+			case <-u.ctx.Done():
+				return errAborted
+			}
+		}
+	}()
+
+	if err != nil && uploadID != "" {
+		u.abort(uploadID)
+	}
+	if err != nil && err != errAborted {
+		requestLog.Printf("Object store upload of %s failed: %s \n", u.name, err)
+	}
+
+	u.store.mux.Lock()
+	if u.store.uploads[u.name] == u {
+		delete(u.store.uploads, u.name)
+	}
+	u.store.mux.Unlock()
+
+	u.mux.Lock()
+	close(u.taken)
+	u.taken = nil
+	u.mux.Unlock()
+
+	u.err = err
+	close(u.done)
+}
+
+// Wakes whoever waits for run to take a part, see Room.
+
+func (u *objectUpload) took() {
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	close(u.taken)
+	u.taken = make(chan struct{})
+}
+
+func (u *objectUpload) create() (string, error) {
+
+	resp, err := u.store.do(u.ctx, "POST", u.name, url.Values{"uploads": {""}}, nil, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct{ UploadId string }
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadId == "" {
+		return "", fmt.Errorf("object store POST %s: no upload ID in the response: %v", u.name, err)
+	}
+	return result.UploadId, nil
+}
+
+func (u *objectUpload) uploadPart(uploadID string, n int, part []byte) (string, error) {
+
+	query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+
+	resp, err := u.store.do(u.ctx, "PUT", u.name, query, nil, part, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	return resp.Header.Get("ETag"), nil
+}
+
+func (u *objectUpload) complete(uploadID string, etags []string) error {
+
+	type completedPart struct {
+		PartNumber int
+		ETag string
+	}
+	var request struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts []completedPart `xml:"Part"`
+	}
+	for i, etag := range etags {
+		request.Parts = append(request.Parts, completedPart{i + 1, etag})
+	}
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{"If-None-Match": {"*"}, "Content-Type": {"application/xml"}}
+
+	resp, err := u.store.do(u.ctx, "POST", u.name, url.Values{"uploadId": {uploadID}}, header, body, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The store may fail the upload after it has answered 200 - the error is then in the body.
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var e objectStoreError
+	if xml.Unmarshal(b, &e) == nil && bytes.Contains(b, []byte("<Error>")) {
+		return fmt.Errorf("object store POST %s: %s %s", u.name, e.Code, e.Message)
+	}
+	return nil
+}
+
+// Aborts the multipart upload - even if the upload was discarded, so u.ctx is done.
+
+func (u *objectUpload) abort(uploadID string) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), objectStoreTimeout)
+	defer cancel()
+
+	resp, err := u.store.do(ctx, "DELETE", u.name, url.Values{"uploadId": {uploadID}}, nil, nil, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		requestLog.Printf("Object store abort of %s failed, the parts are left in the bucket: %s \n", u.name, err)
+		return
+	}
+	resp.Body.Close()
+}
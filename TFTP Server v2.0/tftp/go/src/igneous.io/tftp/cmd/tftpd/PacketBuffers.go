@@ -0,0 +1,32 @@
+package main
+
+import (
+	"../../../tftp"
+	"sync"
+)
+
+// Receive buffers are recycled through a pool rather than allocated per packet. Buffers are sized to the
+// largest packet we accept, which covers the largest DATA packet (4 + dataBlockSize), and request packets
+// carrying long file names.
+//
+// The pool holds *[]byte rather than []byte, so Put does not allocate to box the slice header.
+
+var packetBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, tftp.MaxPacketSize)
+		return &b
+	},
+}
+
+func getPacketBuffer() *[]byte {
+
+	return packetBufferPool.Get().(*[]byte)
+}
+
+// Returns a buffer to the pool. The caller must not reference the buffer, or any slice of it, afterwards.
+
+func putPacketBuffer(b *[]byte) {
+
+	*b = (*b)[:cap(*b)]
+	packetBufferPool.Put(b)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Files can be loaded into the cache when the server starts, so boot images are there before the first client
+// asks, from any of:
+//
+//   a directory       every file in the tree, named by its path below the directory
+//   an archive        .tar, .tar.gz, .tgz or .zip - every file in it, named by its path in the archive
+//   a manifest        any other file - one path per line, optionally followed by the name to serve it as.
+//                     Relative paths are below the manifest's directory. Blank lines and # comments are ignored.
+//
+// Preloaded files may be marked read-only, and a write request for one is then refused with an access
+// violation. A preloaded directory may also be watched (see PreloadWatch_linux.go), so files added, changed or
+// removed there are added, replaced or removed in the cache.
+//
+// Preloaded files are not saved in snapshots - they are loaded again. A name that was uploaded, or is being
+// uploaded, is never replaced by a preloaded file.
+
+// The preloaded files in the cache, by name. Guarded by lockMetadataChanges.
+
+var preloaded = make(map[string]*CacheFile)
+
+// A repeatable string flag.
+
+type listFlag []string
+
+func (f *listFlag) String() string {
+
+	return strings.Join(*f, " ")
+}
+
+func (f *listFlag) Set(s string) error {
+
+	*f = append(*f, s)
+	return nil
+}
+
+// Loads the files in source, a directory, archive or manifest, into the cache. Returns the number of files loaded.
+
+func Preload(source string, readOnly bool) (int, error) {
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return 0, err
+	}
+
+	var files map[string][]byte
+
+	lower := strings.ToLower(source)
+	switch {
+	case info.IsDir():
+		files, err = readPreloadDir(source)
+	case strings.HasSuffix(lower, ".zip"):
+		files, err = readPreloadZip(source)
+	case strings.HasSuffix(lower, ".tar"), strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		files, err = readPreloadTar(source)
+	default:
+		files, err = readPreloadManifest(source)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("preload %s: %w", source, err)
+	}
+
+	n := 0
+	for name, data := range files {
+		if addPreloaded(name, data, readOnly) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Adds or replaces a preloaded file. Reports whether it was added - a name that was uploaded is left alone.
+
+func addPreloaded(name string, data []byte, readOnly bool) bool {
+
+	f := newStoredFile(data)
+	f.readOnly = readOnly
+	f.Commit()
+
+	debugLog.Printf("Take Metadata Lock \n")
+
+	lockMetadataChanges.Lock()
+	defer deferredMetadataUnlock()
+
+	cur, ok := fileCacheMap[name]
+	if ok == true && preloaded[name] != cur {
+		requestLog.Printf("Not preloading %s, it was uploaded \n", name)
+		f.release()
+		return false
+	}
+
+	fileCacheMap[name] = f
+	preloaded[name] = f
+	dropFile(name, cur)
+	return true
+}
+
+// Removes a preloaded file from the cache, unless it has been replaced by an upload since. Reports whether the
+// name was preloaded.
+
+func removePreloaded(name string) bool {
+
+	debugLog.Printf("Take Metadata Lock \n")
+
+	lockMetadataChanges.Lock()
+	defer deferredMetadataUnlock()
+
+	f, ok := preloaded[name]
+	if ok == false {
+		return false
+	}
+	delete(preloaded, name)
+
+	if cur, ok := fileCacheMap[name]; ok == true && cur == f {
+		delete(fileCacheMap, name)
+	}
+	dropFile(name, f)
+	return true
+}
+
+// Returns the names of the preloaded files below the directory dir, a name as preloadName returns - "." for
+// the top.
+
+func preloadedBelow(dir string) []string {
+
+	debugLog.Printf("Take Metadata Lock \n")
+
+	lockMetadataChanges.Lock()
+	defer deferredMetadataUnlock()
+
+	var names []string
+	for name := range preloaded {
+		if dir == "." || strings.HasPrefix(name, dir + "/") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Returns the name a file below root is served as.
+
+func preloadName(root string, file string) (string, error) {
+
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func readPreloadDir(root string) (map[string][]byte, error) {
+
+	files := make(map[string][]byte)
+
+	err := filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type().IsRegular() == false {
+			return err
+		}
+
+		name, err := preloadName(root, file)
+		if err != nil {
+			return err
+		}
+		files[name], err = os.ReadFile(file)
+		return err
+	})
+
+	return files, err
+}
+
+// Returns the name a file in an archive is served as, or "" for names that are not a file below the archive's
+// top - absolute, or climbing out with "..".
+
+func archiveName(name string) string {
+
+	name = path.Clean(strings.TrimPrefix(name, "./"))
+	if path.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return ""
+	}
+	return name
+}
+
+func readPreloadTar(source string) (map[string][]byte, error) {
+
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(strings.ToLower(source), "gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	files := make(map[string][]byte)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := archiveName(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || name == "" {
+			continue
+		}
+		if files[name], err = io.ReadAll(tr); err != nil {
+			return nil, fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+func readPreloadZip(source string) (map[string][]byte, error) {
+
+	zr, err := zip.OpenReader(source)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	files := make(map[string][]byte)
+
+	for _, zf := range zr.File {
+		name := archiveName(zf.Name)
+		if zf.Mode().IsRegular() == false || name == "" {
+			continue
+		}
+
+		r, err := zf.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", zf.Name, err)
+		}
+		files[name], err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", zf.Name, err)
+		}
+	}
+
+	return files, nil
+}
+
+func readPreloadManifest(source string) (map[string][]byte, error) {
+
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(source)
+	files := make(map[string][]byte)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: %q is not: path [name]", n, line)
+		}
+
+		file := fields[0]
+		name := strings.TrimPrefix(strings.TrimLeft(filepath.ToSlash(file), "/"), "./")
+		if len(fields) == 2 {
+			name = fields[1]
+		}
+		if filepath.IsAbs(file) == false {
+			file = filepath.Join(dir, file)
+		}
+
+		if files[name], err = os.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+
+	return files, scanner.Err()
+}
@@ -0,0 +1,218 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Watches a preloaded directory tree with inotify, and keeps the cache in step with it. A file is loaded when it
+// is closed after writing, or moved into the tree - not while it is being written. A file deleted or moved out
+// of the tree is removed. Directories created in the tree are watched too.
+//
+// If the kernel's event queue overflows, events are lost, so the whole tree is loaded again.
+
+type preloadWatcher struct {
+	root string
+	readOnly bool
+	f *os.File						// The inotify instance
+	fd int							// Its descriptor - f.Fd would make it blocking
+	dirs map[int32]string			// Watched directories, by watch descriptor - only run uses it after start
+}
+
+const preloadWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_CREATE |
+	syscall.IN_DELETE
+
+// Starts watching root. Close the watcher to stop.
+
+func watchPreload(root string, readOnly bool) (*preloadWatcher, error) {
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	// The descriptor is non-blocking, so reads park in the runtime poller, and Close wakes them.
+
+	w := &preloadWatcher{
+		root: root,
+		readOnly: readOnly,
+		f: os.NewFile(uintptr(fd), "inotify"),
+		fd: fd,
+		dirs: make(map[int32]string),
+	}
+
+	if err := w.watchTree(root); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+func (w *preloadWatcher) Close() error {
+
+	return w.f.Close()
+}
+
+// Watches dir and every directory below it.
+
+func (w *preloadWatcher) watchTree(dir string) error {
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() == false {
+			return err
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, preloadWatchMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch " + path, err)
+		}
+		w.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+func (w *preloadWatcher) run() {
+
+	buf := make([]byte, 64 * 1024)
+
+	for {
+		n, err := w.f.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return
+		}
+		if err != nil {
+			requestLog.Printf("Watching %s failed, preloaded files are no longer updated: %s \n", w.root, err)
+			return
+		}
+
+		for off := 0; off + syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off + syscall.SizeofInotifyEvent : off + syscall.SizeofInotifyEvent + int(event.Len)]
+			off += syscall.SizeofInotifyEvent + int(event.Len)
+
+			w.handle(event.Wd, event.Mask, strings.TrimRight(string(nameBytes), "\x00"))
+		}
+	}
+}
+
+func (w *preloadWatcher) handle(wd int32, mask uint32, name string) {
+
+	if mask & syscall.IN_Q_OVERFLOW != 0 {
+		requestLog.Printf("Watching %s: events lost, loading the tree again \n", w.root)
+		w.reload(w.root)
+		return
+	}
+
+	dir, ok := w.dirs[wd]
+	if ok == false {
+		return
+	}
+	if mask & syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+		return
+	}
+
+	path := filepath.Join(dir, name)
+
+	switch {
+	case mask & syscall.IN_ISDIR != 0 && mask & (syscall.IN_CREATE | syscall.IN_MOVED_TO) != 0:
+
+		// Files may have been added before the directory was watched.
+
+		if err := w.watchTree(path); err != nil {
+			requestLog.Printf("Watching %s: %s \n", path, err)
+		}
+		w.reload(path)
+
+	case mask & syscall.IN_ISDIR != 0 && mask & (syscall.IN_DELETE | syscall.IN_MOVED_FROM) != 0:
+		w.removeTree(path)
+
+	case mask & (syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO) != 0:
+		w.load(path)
+
+	case mask & (syscall.IN_DELETE | syscall.IN_MOVED_FROM) != 0:
+		if name, err := preloadName(w.root, path); err == nil && removePreloaded(name) {
+			requestLog.Printf("Preloaded %s removed \n", name)
+		}
+	}
+}
+
+// Loads the file at path into the cache, if it is a regular file.
+
+func (w *preloadWatcher) load(path string) {
+
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode().IsRegular() == false {
+		return
+	}
+
+	name, err := preloadName(w.root, path)
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		requestLog.Printf("Preloading %s failed: %s \n", path, err)
+		return
+	}
+
+	if addPreloaded(name, data, w.readOnly) {
+		requestLog.Printf("Preloaded %s: %d bytes \n", name, len(data))
+	}
+}
+
+// Loads every file below dir again, and removes the preloaded files below it that have gone.
+
+func (w *preloadWatcher) reload(dir string) {
+
+	found := make(map[string]bool)
+
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if name, err := preloadName(w.root, path); err == nil {
+				found[name] = true
+				w.load(path)
+			}
+		}
+		return nil
+	})
+
+	prefix, _ := preloadName(w.root, dir)
+	for _, name := range preloadedBelow(prefix) {
+		if found[name] == false {
+			removePreloaded(name)
+		}
+	}
+}
+
+// Removes the preloaded files below dir, and stops watching it - a directory moved out of the tree would
+// otherwise still be watched.
+
+func (w *preloadWatcher) removeTree(dir string) {
+
+	for wd, path := range w.dirs {
+		if path == dir || strings.HasPrefix(path, dir + string(filepath.Separator)) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+
+	prefix, err := preloadName(w.root, dir)
+	if err != nil {
+		return
+	}
+	for _, name := range preloadedBelow(prefix) {
+		removePreloaded(name)
+	}
+	requestLog.Printf("Preloaded %s/ removed \n", prefix)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Waits until the cache holds data as name, or not at all if data is nil.
+
+func waitPreloaded(t *testing.T, name string, data []byte) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f, ok := cachedFile(name)
+		if data == nil && ok == false {
+			return
+		}
+		if data != nil && ok && bytes.Equal(f.Bytes(), data) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: cached %t; expected %d bytes", name, ok, len(data))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Files created, changed, renamed and removed in a watched directory - and in directories created there - are
+// added, replaced and removed in the cache.
+
+func TestPreloadWatch(t *testing.T) {
+	prefix := testFileName(t)
+	dropPreloaded(t, prefix)
+
+	root := t.TempDir()
+	dir := filepath.Join(root, prefix)
+	os.MkdirAll(dir, 0o755)
+	os.WriteFile(filepath.Join(dir, "first"), testData(1, 100), 0o644)
+
+	w, err := watchPreload(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := Preload(root, false); err != nil {
+		t.Fatal(err)
+	}
+	waitPreloaded(t, prefix + "/first", testData(1, 100))
+
+	os.WriteFile(filepath.Join(dir, "second"), testData(2, 2000), 0o644)
+	waitPreloaded(t, prefix + "/second", testData(2, 2000))
+
+	os.WriteFile(filepath.Join(dir, "first"), testData(3, 300), 0o644)
+	waitPreloaded(t, prefix + "/first", testData(3, 300))
+
+	os.Rename(filepath.Join(dir, "second"), filepath.Join(dir, "renamed"))
+	waitPreloaded(t, prefix + "/second", nil)
+	waitPreloaded(t, prefix + "/renamed", testData(2, 2000))
+
+	os.Remove(filepath.Join(dir, "first"))
+	waitPreloaded(t, prefix + "/first", nil)
+
+	sub := filepath.Join(dir, "sub")
+	os.Mkdir(sub, 0o755)
+	os.WriteFile(filepath.Join(sub, "nested"), testData(4, 400), 0o644)
+	waitPreloaded(t, prefix + "/sub/nested", testData(4, 400))
+
+	// A directory moved out of the tree takes its files with it, and is no longer watched.
+
+	outside := filepath.Join(t.TempDir(), "moved")
+	if err := os.Rename(sub, outside); err != nil {
+		t.Fatal(err)
+	}
+	waitPreloaded(t, prefix + "/sub/nested", nil)
+
+	os.WriteFile(filepath.Join(outside, "late"), testData(5, 500), 0o644)
+	os.WriteFile(filepath.Join(dir, "marker"), testData(6, 600), 0o644)
+	waitPreloaded(t, prefix + "/marker", testData(6, 600))
+	if _, ok := cachedFile(prefix + "/sub/late"); ok {
+		t.Errorf("File written outside the tree preloaded")
+	}
+}
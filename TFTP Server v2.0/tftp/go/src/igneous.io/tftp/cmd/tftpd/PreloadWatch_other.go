@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// Watching a preloaded directory needs inotify, see PreloadWatch_linux.go.
+
+type preloadWatcher struct{}
+
+func watchPreload(root string, readOnly bool) (*preloadWatcher, error) {
+
+	return nil, errors.New("watching a preloaded directory is only supported on Linux")
+}
+
+func (w *preloadWatcher) Close() error {
+
+	return nil
+}
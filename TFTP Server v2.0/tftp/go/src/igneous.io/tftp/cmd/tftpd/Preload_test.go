@@ -0,0 +1,212 @@
+package main
+
+import (
+	"../../client"
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Drops the preloaded files named below prefix when the test ends - every test shares the server's file cache.
+
+func dropPreloaded(t *testing.T, prefix string) {
+	t.Cleanup(func() {
+		for _, name := range preloadedBelow(prefix) {
+			removePreloaded(name)
+		}
+	})
+}
+
+// Checks the cache holds files, by name, preloaded with readOnly.
+
+func checkPreloaded(t *testing.T, files map[string][]byte, readOnly bool) {
+	t.Helper()
+
+	for name, data := range files {
+		f, ok := cachedFile(name)
+		switch {
+		case ok == false:
+			t.Errorf("%s not preloaded", name)
+		case f.Committed() == false || !bytes.Equal(f.Bytes(), data):
+			t.Errorf("%s preloaded as %d bytes, committed %t; expected %d", name, f.Size(), f.Committed(), len(data))
+		case f.readOnly != readOnly:
+			t.Errorf("%s preloaded read-only %t; expected %t", name, f.readOnly, readOnly)
+		}
+	}
+}
+
+func TestPreloadDir(t *testing.T) {
+	prefix := testFileName(t)
+	dropPreloaded(t, prefix)
+
+	root := t.TempDir()
+	files := map[string][]byte{
+		prefix + "/pxelinux.0":   testData(1, 3000),
+		prefix + "/boot/vmlinuz": testData(2, 70000),
+		prefix + "/boot/empty":   {},
+	}
+	for name, data := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(file), 0o755)
+		if err := os.WriteFile(file, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := Preload(root, false)
+	if err != nil || n != len(files) {
+		t.Fatalf("Preloaded %d, %v; expected %d", n, err, len(files))
+	}
+	checkPreloaded(t, files, false)
+}
+
+func TestPreloadArchives(t *testing.T) {
+	prefix := testFileName(t)
+	dropPreloaded(t, prefix)
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		prefix + "/grub.cfg":   testData(3, 900),
+		prefix + "/initrd.img": testData(4, 40000),
+	}
+
+	var tgz bytes.Buffer
+	zw := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(zw)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./" + prefix + "/", Mode: 0o755})
+	for name, data := range files {
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./" + name, Size: int64(len(data)), Mode: 0o644})
+		tw.Write(data)
+	}
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "../escaped", Size: 1, Mode: 0o644})
+	tw.Write([]byte{1})
+	tw.Close()
+	zw.Close()
+
+	tgzPath := filepath.Join(dir, "images.tar.gz")
+	if err := os.WriteFile(tgzPath, tgz.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := Preload(tgzPath, true)
+	if err != nil || n != len(files) {
+		t.Fatalf("Preloaded %d from the tar, %v; expected %d", n, err, len(files))
+	}
+	checkPreloaded(t, files, true)
+	if _, ok := cachedFile("escaped"); ok {
+		t.Errorf("Name climbing out of the archive preloaded")
+	}
+
+	// The same files from a zip replace them.
+
+	for name := range files {
+		files[name] = testData(5, len(files[name]))
+	}
+
+	var zipped bytes.Buffer
+	w := zip.NewWriter(&zipped)
+	for name, data := range files {
+		fw, _ := w.Create(name)
+		fw.Write(data)
+	}
+	w.Close()
+
+	zipPath := filepath.Join(dir, "images.zip")
+	if err := os.WriteFile(zipPath, zipped.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err = Preload(zipPath, false)
+	if err != nil || n != len(files) {
+		t.Fatalf("Preloaded %d from the zip, %v; expected %d", n, err, len(files))
+	}
+	checkPreloaded(t, files, false)
+}
+
+func TestPreloadManifest(t *testing.T) {
+	prefix := testFileName(t)
+	dropPreloaded(t, prefix)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.bin"), testData(6, 100), 0o644)
+	os.WriteFile(filepath.Join(dir, "b.bin"), testData(7, 200), 0o644)
+	absolute := filepath.Join(t.TempDir(), "c.bin")
+	os.WriteFile(absolute, testData(8, 300), 0o644)
+
+	manifest := filepath.Join(dir, "manifest")
+	contents := strings.Join([]string{
+		"# Boot images",
+		"",
+		"a.bin " + prefix + "/a",
+		"./b.bin   " + prefix + "/b",
+		absolute + " " + prefix + "/c",
+	}, "\n")
+	if err := os.WriteFile(manifest, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Preload(manifest, false); err != nil {
+		t.Fatal(err)
+	}
+	checkPreloaded(t, map[string][]byte{
+		prefix + "/a": testData(6, 100),
+		prefix + "/b": testData(7, 200),
+		prefix + "/c": testData(8, 300),
+	}, false)
+
+	// A missing file, or a line that is not a path and a name, is an error naming the line.
+
+	for _, line := range []string{"missing.bin", "a.bin two names"} {
+		os.WriteFile(manifest, []byte("# Boot images\n" + line + "\n"), 0o644)
+		if _, err := Preload(manifest, false); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("Manifest line %q: expected an error for line 2; got %v", line, err)
+		}
+	}
+}
+
+// A read-only preloaded file is refused to a write request, and served as it was. A file that was uploaded is
+// not replaced by a preloaded one. Preloaded files are not saved in snapshots.
+
+func TestIntegrationPreloadReadOnly(t *testing.T) {
+	addr := startServer(t)
+	ctx := testContext(t)
+	c := newTestClient()
+
+	prefix := testFileName(t)
+	dropPreloaded(t, prefix)
+
+	uploaded := prefix + "/uploaded"
+	if err := c.PutBytes(ctx, addr, uploaded, testData(9, 600)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dropFiles(map[string][]byte{uploaded: nil}) })
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, prefix), 0o755)
+	os.WriteFile(filepath.Join(root, prefix, "kernel"), testData(10, 5000), 0o644)
+	os.WriteFile(filepath.Join(root, prefix, "uploaded"), testData(11, 700), 0o644)
+
+	n, err := Preload(root, true)
+	if err != nil || n != 1 {
+		t.Fatalf("Preloaded %d, %v; expected 1 - the upload kept", n, err)
+	}
+
+	err = c.PutBytes(ctx, addr, prefix + "/kernel", testData(12, 10))
+	if !errors.Is(err, client.ErrAccessViolation) {
+		t.Fatalf("Upload over a read-only file: expected ErrAccessViolation; got %v", err)
+	}
+	expectRead(t, c, addr, prefix + "/kernel", testData(10, 5000))
+	expectRead(t, c, addr, uploaded, testData(9, 600))
+
+	for _, sf := range snapshotFiles() {
+		if sf.name == prefix + "/kernel" {
+			t.Errorf("Preloaded file saved in the snapshot")
+		}
+	}
+}
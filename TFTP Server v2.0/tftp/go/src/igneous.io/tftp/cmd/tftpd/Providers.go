@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"path"
+	"sync"
+)
+
+// Generates the contents of a file when a client reads it, so files such as per-host PXE configs
+// (pxelinux.cfg/01-<mac>) need not be uploaded ahead of time. Called with the client's address and the name it
+// asked for. An error is sent to the client as its TFTP equivalent, see tftp.ErrorFor - return os.ErrNotExist
+// for a name the provider has nothing for.
+//
+// Providers run on the read's goroutine, with the metadata lock released, so a slow provider only delays its
+// own client. A provider is run once per read, and only if no file in the cache answers it - not for a
+// retransmitted request. They may be called concurrently.
+
+type Provider func(addr net.Addr, name string) ([]byte, error)
+
+type providerEntry struct {
+	pattern string
+	fn      Provider
+}
+
+// Registered providers, in registration order. Guarded by providerChanges, which is never held with the locks
+// listed in the README.
+
+var providers []providerEntry
+
+var providerChanges sync.RWMutex
+
+// Serves read requests for names matching pattern (path.Match syntax, e.g. "pxelinux.cfg/01-*") from fn.
+// The first provider registered for a name wins. A file uploaded under the same name takes precedence over
+// the provider, so a generated file can be overridden without a code change.
+
+func RegisterProvider(pattern string, fn Provider) error {
+
+	// Check the pattern now, rather than have every lookup fail.
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+
+	providerChanges.Lock()
+	defer providerChanges.Unlock()
+
+	providers = append(providers, providerEntry{pattern, fn})
+	return nil
+}
+
+// Returns the provider for name, or nil if there is none.
+
+func lookupProvider(name string) Provider {
+
+	providerChanges.RLock()
+	defer providerChanges.RUnlock()
+
+	for _, e := range providers {
+		if ok, _ := path.Match(e.pattern, name); ok == true {
+			return e.fn
+		}
+	}
+	return nil
+}
+
+// Runs fn, the provider for name. The generated file is not added to the cache - it belongs to this read alone,
+// and is dropped when the read completes.
+
+func generateFile(addr net.Addr, name string, fn Provider) (*CacheFile, error) {
+
+	data, err := fn(addr, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCommittedFile(data), nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"../../../tftp"
+	"../../client"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Registers a provider for the rest of the test.
+
+func useProvider(t *testing.T, pattern string, fn Provider) {
+	t.Helper()
+
+	providerChanges.RLock()
+	saved := providers
+	providerChanges.RUnlock()
+
+	if err := RegisterProvider(pattern, fn); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		providerChanges.Lock()
+		providers = saved
+		providerChanges.Unlock()
+	})
+}
+
+// A PXELINUX style config per host, named for the client's MAC address, which says which host asked for it.
+
+func pxeConfig(addr net.Addr, name string) ([]byte, error) {
+	mac := strings.TrimPrefix(path.Base(name), "01-")
+	if mac == "ff-ff-ff-ff-ff-ff" {
+		return nil, os.ErrNotExist
+	}
+	return []byte(fmt.Sprintf("DEFAULT linux\nAPPEND hostmac=%s client=%s\n", mac, addr)), nil
+}
+
+func TestRegisterProviderBadPattern(t *testing.T) {
+	if err := RegisterProvider("pxelinux.cfg/[", pxeConfig); err == nil {
+		t.Errorf("Expected an error for a malformed pattern")
+	}
+	if lookupProvider("pxelinux.cfg/[") != nil {
+		t.Errorf("Malformed pattern was registered")
+	}
+}
+
+func TestProviderServesRead(t *testing.T) {
+	useProvider(t, "pxelinux.cfg/01-*", pxeConfig)
+
+	pc := newRecordingConn()
+	addr := nextTestAddr()
+	name := "pxelinux.cfg/01-aa-bb-cc-dd-ee-ff"
+
+	handleRead(pc, addr, tftp.PacketRequest{Op: tftp.OpRRQ, Filename: name, Mode: "octet"})
+
+	want, _ := pxeConfig(addr, name)
+	p, ok := pc.next(5 * time.Second).(*tftp.PacketData)
+	if ok == false || p.BlockNum != 1 || string(p.Data) != string(want) {
+		t.Fatalf("Expected DATA 1 %q; got %s", want, describe(p))
+	}
+	handleAck(pc, addr, tftp.PacketAck{BlockNum: 1})
+
+	for deadline := time.Now().Add(5 * time.Second); hasTracker(readAddrMap, addr); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Read tracker still present after the final ack")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The generated file belongs to the read - it is not cached.
+
+	lockMetadataChanges.Lock()
+	_, cached := fileCacheMap[name]
+	lockMetadataChanges.Unlock()
+	if cached {
+		t.Errorf("Generated file added to the cache")
+	}
+}
+
+func TestProviderErrors(t *testing.T) {
+	useProvider(t, "pxelinux.cfg/01-*", pxeConfig)
+	useProvider(t, "denied/*", func(net.Addr, string) ([]byte, error) { return nil, os.ErrPermission })
+	useProvider(t, "broken/*", func(net.Addr, string) ([]byte, error) { return nil, errors.New("inventory unavailable") })
+
+	tests := []struct {
+		name string
+		code uint16
+		msg  string
+	}{
+		{"pxelinux.cfg/01-ff-ff-ff-ff-ff-ff", 1, "File not found."},
+		{"pxelinux.cfg/default", 1, "File not found."},
+		{"denied/secret", 2, "Access violation."},
+		{"broken/config", 0, "inventory unavailable"},
+	}
+
+	for _, test := range tests {
+		pc := newRecordingConn()
+		addr := nextTestAddr()
+
+		handleRead(pc, addr, tftp.PacketRequest{Op: tftp.OpRRQ, Filename: test.name, Mode: "octet"})
+
+		p, ok := pc.next(5 * time.Second).(*tftp.PacketError)
+		if ok == false || p.Code != test.code || p.Msg != test.msg {
+			t.Errorf("%s: expected ERROR %d %q; got %s", test.name, test.code, test.msg, describe(p))
+		}
+		handleAck(pc, addr, tftp.PacketAck{BlockNum: 1})
+	}
+}
+
+// The first provider registered for a name serves it, and an uploaded file overrides both.
+
+func TestProviderPrecedence(t *testing.T) {
+	useProvider(t, "boot/*.cfg", func(net.Addr, string) ([]byte, error) { return []byte("first"), nil })
+	useProvider(t, "boot/*", func(net.Addr, string) ([]byte, error) { return []byte("second"), nil })
+
+	read := func(name string) string {
+		pc := newRecordingConn()
+		addr := nextTestAddr()
+		handleRead(pc, addr, tftp.PacketRequest{Op: tftp.OpRRQ, Filename: name, Mode: "octet"})
+		p, ok := pc.next(5 * time.Second).(*tftp.PacketData)
+		if ok == false {
+			t.Fatalf("%s: expected DATA 1; got %s", name, describe(p))
+		}
+		handleError(pc, addr, tftp.PacketError{Code: 0, Msg: "done"})
+		return string(p.Data)
+	}
+
+	if got := read("boot/a.cfg"); got != "first" {
+		t.Errorf("boot/a.cfg served %q; expected the first provider's", got)
+	}
+	if got := read("boot/a.img"); got != "second" {
+		t.Errorf("boot/a.img served %q; expected the second provider's", got)
+	}
+
+	addCommittedFile("boot/b.cfg", 3)
+	if got := read("boot/b.cfg"); got != "\x00\x00\x00" {
+		t.Errorf("boot/b.cfg served %q; expected the uploaded file", got)
+	}
+}
+
+// A provider runs once per read - not again for a retransmitted request - and not at all when an uploaded file
+// answers the read.
+
+func TestProviderRunsOncePerRead(t *testing.T) {
+	var mux sync.Mutex
+	calls := make(map[string]int)
+	useProvider(t, "once/*", func(_ net.Addr, name string) ([]byte, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		calls[name]++
+		return []byte("generated"), nil
+	})
+
+	pc := newRecordingConn()
+	addr := nextTestAddr()
+	req := tftp.PacketRequest{Op: tftp.OpRRQ, Filename: "once/a.cfg", Mode: "octet"}
+
+	handleRead(pc, addr, req)
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketData); ok == false || string(p.Data) != "generated" {
+		t.Fatalf("Expected DATA 1 \"generated\"; got %s", describe(p))
+	}
+	handleRead(pc, addr, req)
+	handleError(pc, addr, tftp.PacketError{Code: 0, Msg: "done"})
+
+	addCommittedFile("once/b.cfg", 3)
+	t.Cleanup(func() { dropFiles(map[string][]byte{"once/b.cfg": nil}) })
+
+	addr = nextTestAddr()
+	handleRead(pc, addr, tftp.PacketRequest{Op: tftp.OpRRQ, Filename: "once/b.cfg", Mode: "octet"})
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketData); ok == false || string(p.Data) != "\x00\x00\x00" {
+		t.Fatalf("Expected DATA 1 from the uploaded file; got %s", describe(p))
+	}
+	handleError(pc, addr, tftp.PacketError{Code: 0, Msg: "done"})
+
+	mux.Lock()
+	defer mux.Unlock()
+	if calls["once/a.cfg"] != 1 || calls["once/b.cfg"] != 0 {
+		t.Errorf("Provider calls %v; expected once/a.cfg once, once/b.cfg never", calls)
+	}
+}
+
+// Many hosts fetching their own config at once, end to end.
+
+func TestIntegrationProviderPerHost(t *testing.T) {
+	useProvider(t, "pxelinux.cfg/01-*", func(addr net.Addr, name string) ([]byte, error) {
+		return []byte(strings.Repeat(path.Base(name)+"\n", 100)), nil
+	})
+
+	addr := startServer(t)
+	ctx := testContext(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("01-52-54-00-00-00-%02x", i)
+			got, err := newTestClient().GetBytes(ctx, addr, "pxelinux.cfg/"+name)
+			if err != nil {
+				t.Errorf("%s: %s", name, err)
+			} else if string(got) != strings.Repeat(name+"\n", 100) {
+				t.Errorf("%s: got another host's config, or a damaged one: %.40q...", name, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if _, err := newTestClient().GetBytes(ctx, addr, "pxelinux.cfg/default"); !errors.Is(err, client.ErrFileNotFound) {
+		t.Errorf("Expected ErrFileNotFound for a name no provider serves; got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+)
+
+const ReapInterval = 60			// Seconds between sweeps of the error map.
+
+
+// Sweeps the error map every ReapInterval, until stop is closed. A client that never acks an error packet would
+// otherwise leave its entry in the map for good.
+
+func reapErrorMap(stop chan struct{}) {
+
+	for {
+		timer := clk.NewTimer(time.Second * ReapInterval)
+
+		select {
+		case <- timer.C():
+		case <- stop:
+			timer.Stop()
+			return
+		}
+
+		reapErrors()
+	}
+}
+
+// Removes the error map entries older than TimeoutInterval. A client acks an error packet at once, or not at all.
+
+func reapErrors() {
+
+	debugLog.Printf("Take Error Map Lock \n")
+
+	errorMapChanges.Lock()
+	defer deferredErrorMapUnlock()
+
+	now := clk.Now()
+
+	for a, sent := range errorAddrMap {
+		if now.Sub(sent) >= time.Second * TimeoutInterval {
+			delete(errorAddrMap, a)
+			debugLog.Printf("Reaped unacked error for %s, sent %s \n", a, sent)
+		}
+	}
+}
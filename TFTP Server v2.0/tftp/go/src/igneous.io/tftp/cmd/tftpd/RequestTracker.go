@@ -2,12 +2,14 @@ package main
 
 import (
 	"../../../tftp"
+	"../../clock"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const RetryInterval = 5			// TODO Seconds to wait for an ack before resending a data packet
 const TimeoutInterval = 30		// TODO Seconds to wait before timing out the transfer when retries are being sent.
+const DallyInterval = 5			// Seconds a finished upload is remembered, to ack the final block again if it is resent.
 
 
 // Tracks the last block sent or received per request, whether or not the request is incomplete, and the timestamp
@@ -15,16 +17,26 @@ const TimeoutInterval = 30		// TODO Seconds to wait before timing out the transf
 
 type RequestTracker struct {
 	PacketReq tftp.PacketRequest
+	File *CacheFile					// Writes, and reads of cached files
+	Source BlockSource				// Reads - the file, its fetch from upstream, or the object store
+	Sink BlockSink					// Writes - the file, or an upload to the object store
+	Hash *checksummer				// Writes - checksums of the blocks written so far
+	ExpectedSHA256 string			// Writes - what the upload must match, if anything, see Checksum.go
+	ExpectedErr error				// Writes - why there is no checksum to match, an invalid sidecar - see Checksum.go
+	SendBuf []byte					// Reads and writes - DATA or ACK packet being sent, reused per block
 	BlockNum uint16
 	Mux sync.Mutex
-	Acked chan bool					// Reads
+	Acked chan uint16				// Reads - block number of the latest ack received, see PostAck
 	BlockAcked bool					// Reads
-	Retry chan bool					// Reads and writes
-	Timeout chan bool				// Reads and writes
+	Rtt RttEstimator				// Reads and writes - retransmission timeout and RTT stats
 	ReceivedBlockNum chan uint16	// Writes
-	LastBlockWritten bool			// Writes
+	LastBlockWritten atomic.Bool	// Writes - the upload is committed, see finishUpload. handleRead reads it without Mux
+	Storing bool					// Writes - waiting for the store with Mux released, see waitForStore
 	PrevAckReceived chan bool		// Writes
+	Abort chan bool					// Reads and writes - closed when the transfer is aborted, see AbortTransfer
+	abortOnce sync.Once
 	LastTranferTime time.Time
+	Clock clock.Clock				// Reads and writes - timers and timestamps, see clk
 }
 
 func (rt *RequestTracker) DeferredUnlock() {
@@ -34,16 +46,61 @@ func (rt *RequestTracker) DeferredUnlock() {
 	debugLog.Printf("Released RequestTracker Lock  %p %+v \n", &rt, rt)
 }
 
-func (rt *RequestTracker) RetryTimer()  {
+// Stops the transfer. Every goroutine waiting on the transfer selects on Abort, and gives up when it is closed.
+// Safe to call more than once.
 
-	time.Sleep(time.Second * RetryInterval)
-	rt.Timeout <- true
-	return
+func (rt *RequestTracker) AbortTransfer() {
+
+	rt.abortOnce.Do(func() {
+		close(rt.Abort)
+	})
+}
+
+func (rt *RequestTracker) Aborted() bool {
+
+	select {
+	case <-rt.Abort:
+		return true
+	default:
+		return false
+	}
 }
 
-func (rt *RequestTracker) TimeoutTimer()  {
+// Hands an ack to the goroutine sending data. The channel holds only the latest ack - if an earlier ack has not
+// been consumed yet it is replaced, so a burst of duplicate acks can never block the ack handler.
+// Safe for concurrent callers - if two acks race, one may be lost, as it could be on the wire.
+
+func (rt *RequestTracker) PostAck(blockNum uint16) {
+
+	select {
+	case rt.Acked <- blockNum:
+		return
+	default:
+	}
+
+	select {
+	case <-rt.Acked:
+	default:
+	}
+
+	select {
+	case rt.Acked <- blockNum:
+	default:
+	}
+}
+
+// Starts a timer for the current retransmission timeout. Started each time a packet is sent, and stopped by
+// the caller when the reply arrives, so a stale timer never fires into a later exchange.
+
+func (rt *RequestTracker) RetryTimer() clock.Timer {
+
+	return rt.Clock.NewTimer(rt.Rtt.RTO())
+}
+
+// Starts a timer that ends the transfer if no progress is made. Started once per block - retransmits of the
+// block do not restart it.
+
+func (rt *RequestTracker) TimeoutTimer() clock.Timer {
 
-	time.Sleep(time.Second * TimeoutInterval)
-	rt.Timeout <- true
-	return
+	return rt.Clock.NewTimer(time.Second * TimeoutInterval)
 }
\ No newline at end of file
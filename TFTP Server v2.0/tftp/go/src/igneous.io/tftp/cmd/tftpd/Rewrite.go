@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Rewrites the file names in read and write requests before they are looked up, so clients that ask for the same
+// file by different paths - /pxelinux.0, pxelinux.0, \boot\pxeboot.n12, PXELINUX.0 - all get it.
+//
+// Rules are applied in order, each to the name the rules before it produced, in the style of tftp-hpa's remap
+// files. A rule file holds one rule per line, as
+//
+//   flags  regex  [replacement]
+//
+// The replacement may use the regex's captures as $1 or ${name}, and defaults to nothing. Flags are any of:
+//
+//   r   rewrite - a rule with no other flags, may be given as -
+//   g   replace every match, rather than the first
+//   i   match case-insensitively
+//   e   end - if this rule matches, apply no more rules
+//
+// Blank lines, and lines starting with #, are ignored. For example:
+//
+//   g   \\         /
+//   r   ^/+
+//   ie  ^pxelinux\.0$       pxelinux.0
+//   i   ^boot/(.*)\.n12$    boot/$1.n12
+
+type RewriteRule struct {
+	Pattern *regexp.Regexp
+	Replacement string
+	Global bool						// Replace every match
+	End bool						// Stop after this rule if it matches
+}
+
+// The rules, in order. Guarded by rewriteChanges, which is never held with the locks listed in the README.
+
+var rewriteRules []RewriteRule
+
+var rewriteChanges sync.RWMutex
+
+// Adds a rule, after those already added. The rule is given as a line of a rule file.
+
+func AddRewriteRule(line string) error {
+
+	rule, err := parseRewriteRule(line)
+	if err != nil {
+		return err
+	}
+
+	rewriteChanges.Lock()
+	defer rewriteChanges.Unlock()
+
+	rewriteRules = append(rewriteRules, rule)
+	return nil
+}
+
+// Adds the rules in a rule file, after those already added. No rule is added if any line is bad.
+
+func LoadRewriteRules(path string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rules, err := readRewriteRules(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	rewriteChanges.Lock()
+	defer rewriteChanges.Unlock()
+
+	rewriteRules = append(rewriteRules, rules...)
+	return nil
+}
+
+func readRewriteRules(r io.Reader) ([]RewriteRule, error) {
+
+	var rules []RewriteRule
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRewriteRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+func parseRewriteRule(line string) (RewriteRule, error) {
+
+	var rule RewriteRule
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return rule, fmt.Errorf("%q is not: flags regex [replacement]", line)
+	}
+
+	caseless := false
+
+	for _, flag := range fields[0] {
+		switch flag {
+		case 'r', '-':
+		case 'g':
+			rule.Global = true
+		case 'i':
+			caseless = true
+		case 'e':
+			rule.End = true
+		default:
+			return rule, fmt.Errorf("unknown flag %q in %q", flag, line)
+		}
+	}
+
+	expr := fields[1]
+	if caseless {
+		expr = "(?i)" + expr
+	}
+
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return rule, err
+	}
+	rule.Pattern = pattern
+
+	if len(fields) == 3 {
+		rule.Replacement = fields[2]
+	}
+
+	return rule, nil
+}
+
+// Applies the rule to name. Reports whether it matched.
+
+func (rule *RewriteRule) apply(name string) (string, bool) {
+
+	if rule.Global {
+		if rule.Pattern.MatchString(name) == false {
+			return name, false
+		}
+		return rule.Pattern.ReplaceAllString(name, rule.Replacement), true
+	}
+
+	m := rule.Pattern.FindStringSubmatchIndex(name)
+	if m == nil {
+		return name, false
+	}
+
+	var b []byte
+	b = append(b, name[:m[0]]...)
+	b = rule.Pattern.ExpandString(b, rule.Replacement, name, m)
+	b = append(b, name[m[1]:]...)
+	return string(b), true
+}
+
+// Returns name as rewritten by the rules.
+
+func rewriteFilename(name string) string {
+
+	rewriteChanges.RLock()
+	defer rewriteChanges.RUnlock()
+
+	for i := range rewriteRules {
+		var matched bool
+		name, matched = rewriteRules[i].apply(name)
+		if matched && rewriteRules[i].End {
+			break
+		}
+	}
+	return name
+}
+
+// Rewrites the file name a client asked for, and records both names in the request log if the name changed.
+
+func rewriteRequest(addr net.Addr, name string) string {
+
+	rewritten := rewriteFilename(name)
+	if rewritten != name {
+		requestLog.Printf("Rewrote %q from %s to %q \n", name, addr, rewritten)
+	}
+	return rewritten
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testRewriteRules = `
+# Windows style paths, and absolute paths.
+g   \\                  /
+r   ^/+
+
+# Every ROM's spelling of the boot loader.
+ie  ^pxelinux\.0$       pxelinux.0
+
+# Windows boot files are kept in lower case.
+i   ^boot/(.*)\.N12$    boot/${1}.n12
+i   ^boot/pxeboot       boot/pxeboot
+
+# Old image names.
+e   ^images/(\w+)-old/  images/legacy/$1/
+r   ^images/            images/current/
+`
+
+// Installs the rules for the rest of the test.
+
+func useRewriteRules(t *testing.T, text string) {
+	t.Helper()
+
+	rules, err := readRewriteRules(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewriteChanges.Lock()
+	saved := rewriteRules
+	rewriteRules = rules
+	rewriteChanges.Unlock()
+
+	t.Cleanup(func() {
+		rewriteChanges.Lock()
+		rewriteRules = saved
+		rewriteChanges.Unlock()
+	})
+}
+
+func TestRewriteFilename(t *testing.T) {
+	useRewriteRules(t, testRewriteRules)
+
+	tests := map[string]string{
+		"pxelinux.0":              "pxelinux.0",
+		"/pxelinux.0":             "pxelinux.0",
+		"//PXELinux.0":            "pxelinux.0",
+		`\boot\PXEBoot.N12`:       "boot/pxeboot.n12",
+		`boot\bootmgr.exe`:        "boot/bootmgr.exe",
+		"images/rhel-old/vmlinuz": "images/legacy/rhel/vmlinuz",
+		"images/rhel/vmlinuz":     "images/current/rhel/vmlinuz",
+		"pxelinux.cfg/default":    "pxelinux.cfg/default",
+	}
+	for name, want := range tests {
+		if got := rewriteFilename(name); got != want {
+			t.Errorf("rewriteFilename(%q) = %q; expected %q", name, got, want)
+		}
+	}
+}
+
+// Without the g flag only the first match is replaced.
+
+func TestRewriteFirstMatch(t *testing.T) {
+	useRewriteRules(t, `r a(\d) b$1`)
+
+	if got := rewriteFilename("a1a2a3"); got != "b1a2a3" {
+		t.Errorf("Rewrote a1a2a3 as %q; expected b1a2a3", got)
+	}
+}
+
+func TestRewriteRuleErrors(t *testing.T) {
+	for _, line := range []string{
+		"r",
+		"r a b c",
+		"x ^a b",
+		"r ^(a b",
+	} {
+		if _, err := parseRewriteRule(line); err == nil {
+			t.Errorf("%q parsed without error", line)
+		}
+	}
+
+	if _, err := readRewriteRules(strings.NewReader("r ^a b\n\nx ^a b\n")); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("Expected an error naming line 3; got %v", err)
+	}
+}
+
+// A read by another spelling of the name gets the file, and the request log records both names.
+
+func TestIntegrationRewrite(t *testing.T) {
+	useRewriteRules(t, testRewriteRules)
+	logged := captureRequestLog(t)
+
+	data := testData(1, 3000)
+	addr := startServer(t)
+	ctx := testContext(t)
+	c := newTestClient()
+
+	if err := c.PutBytes(ctx, addr, `\boot\PXEBoot.n12`, data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/boot/pxeboot.n12", `\Boot\PXEBOOT.N12`} {
+		got, err := c.GetBytes(ctx, addr, name)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("%s: read %d bytes that differ from the %d written", name, len(got), len(data))
+		}
+	}
+
+	if got := logged.String(); !strings.Contains(got, `Rewrote "\\Boot\\PXEBOOT.N12" from 127.0.0.1:`) || !strings.Contains(got, `to "boot/pxeboot.n12"`) {
+		t.Errorf("Request log does not record both names: %q", got)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Retransmission timeout bounds. The timeout adapts to the RTT measured on each transfer, so a slow VPN link
+// backs off to seconds.
+
+const InitialRetryInterval = time.Second		// RTO before the first RTT sample, RFC 6298 section 2.1
+const MaxRetryInterval = 10 * time.Second
+
+// The lowest RTO, 1 second as RFC 6298 section 2.4 asks. A lower floor retries sooner after a lost packet, but a
+// reply delayed by a burst on the LAN then looks lost too, and every block is sent twice - the spurious
+// retransmits the sorcerer's apprentice check guards against. -min-rto lowers it for links whose delay is known
+// to be steady. Set by main before the server starts.
+
+var MinRetryInterval = time.Second
+
+// Estimates the retransmission timeout (RTO) for a transfer from measured round trip times, per RFC 6298.
+//
+// The caller must only sample exchanges whose packet was sent once (Karn's algorithm) - when a packet has been
+// retransmitted, there is no way to tell which copy the reply answers. Each retransmit calls Backoff, which
+// doubles the RTO until the next valid sample.
+//
+// Also keeps the per-transfer stats written to the request log. Not safe for concurrent use - only the
+// goroutine sending for a transfer touches it.
+
+type RttEstimator struct {
+	srtt        time.Duration
+	rttvar      time.Duration
+	rto         time.Duration
+	Samples     int
+	Retransmits int
+	MinRtt      time.Duration
+	MaxRtt      time.Duration
+}
+
+// RFC 6298 constants - alpha = 1/8, beta = 1/4, K = 4, and G is the clock granularity.
+
+const rttAlphaShift = 3
+const rttBetaShift = 2
+const rttK = 4
+const rttClockGranularity = time.Millisecond
+
+func (e *RttEstimator) RTO() time.Duration {
+
+	if e.rto == 0 {
+		return InitialRetryInterval
+	}
+	return e.rto
+}
+
+// Records a round trip time measured for a packet that was sent exactly once.
+
+func (e *RttEstimator) Sample(rtt time.Duration) {
+
+	if e.Samples == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.MinRtt = rtt
+		e.MaxRtt = rtt
+	} else {
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar += (delta - e.rttvar) >> rttBetaShift
+		e.srtt += (rtt - e.srtt) >> rttAlphaShift
+
+		if rtt < e.MinRtt {
+			e.MinRtt = rtt
+		}
+		if rtt > e.MaxRtt {
+			e.MaxRtt = rtt
+		}
+	}
+
+	e.Samples++
+
+	variance := rttK * e.rttvar
+	if variance < rttClockGranularity {
+		variance = rttClockGranularity
+	}
+	e.rto = clampRetryInterval(e.srtt + variance)
+}
+
+// Doubles the RTO after a retransmit, RFC 6298 section 5.5.
+
+func (e *RttEstimator) Backoff() {
+
+	e.Retransmits++
+	e.rto = clampRetryInterval(2 * e.RTO())
+}
+
+func (e *RttEstimator) SmoothedRtt() time.Duration {
+
+	return e.srtt
+}
+
+func (e *RttEstimator) String() string {
+
+	return fmt.Sprintf("rtt srtt=%v min=%v max=%v samples=%d retransmits=%d rto=%v",
+		e.srtt, e.MinRtt, e.MaxRtt, e.Samples, e.Retransmits, e.RTO())
+}
+
+func clampRetryInterval(d time.Duration) time.Duration {
+
+	if d < MinRetryInterval {
+		return MinRetryInterval
+	}
+	if d > MaxRetryInterval {
+		return MaxRetryInterval
+	}
+	return d
+}
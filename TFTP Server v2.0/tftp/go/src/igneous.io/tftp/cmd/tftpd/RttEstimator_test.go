@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRttEstimator(t *testing.T) {
+	var e RttEstimator
+
+	if e.RTO() != InitialRetryInterval {
+		t.Errorf("Initial RTO: expected %v; got %v", InitialRetryInterval, e.RTO())
+	}
+
+	// First sample: SRTT = R, RTTVAR = R/2, RTO = SRTT + 4 * RTTVAR.
+
+	e.Sample(100 * time.Millisecond)
+	if e.SmoothedRtt() != 100*time.Millisecond || e.RTO() != 300*time.Millisecond {
+		t.Errorf("First sample: expected srtt 100ms, rto 300ms; got %s", &e)
+	}
+
+	// A steady RTT shrinks the variance, and the RTO converges on the RTT.
+
+	for i := 0; i < 100; i++ {
+		e.Sample(100 * time.Millisecond)
+	}
+	if e.RTO() < 100*time.Millisecond || e.RTO() > 110*time.Millisecond {
+		t.Errorf("Steady samples: expected rto close to 100ms; got %s", &e)
+	}
+	if e.MinRtt != 100*time.Millisecond || e.MaxRtt != 100*time.Millisecond || e.Samples != 101 {
+		t.Errorf("Steady samples: unexpected stats %s", &e)
+	}
+
+	// Each retransmit doubles the RTO, up to the maximum.
+
+	rto := e.RTO()
+	e.Backoff()
+	if e.RTO() != 2*rto || e.Retransmits != 1 {
+		t.Errorf("Backoff: expected rto %v; got %s", 2*rto, &e)
+	}
+	for i := 0; i < 20; i++ {
+		e.Backoff()
+	}
+	if e.RTO() != MaxRetryInterval {
+		t.Errorf("Backoff: expected rto capped at %v; got %s", MaxRetryInterval, &e)
+	}
+
+	// The next valid sample replaces the backed off RTO.
+
+	e.Sample(100 * time.Millisecond)
+	if e.RTO() >= MaxRetryInterval {
+		t.Errorf("Sample after backoff: expected rto to recover; got %s", &e)
+	}
+}
+
+func TestRttEstimatorBounds(t *testing.T) {
+	var fast RttEstimator
+	fast.Sample(10 * time.Microsecond)
+	if fast.RTO() != MinRetryInterval {
+		t.Errorf("Loopback RTT: expected rto %v; got %s", MinRetryInterval, &fast)
+	}
+
+	var slow RttEstimator
+	slow.Sample(30 * time.Second)
+	if slow.RTO() != MaxRetryInterval {
+		t.Errorf("Slow RTT: expected rto %v; got %s", MaxRetryInterval, &slow)
+	}
+}
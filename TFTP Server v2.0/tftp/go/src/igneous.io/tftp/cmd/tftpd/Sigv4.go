@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, for requests to the object store. Only what S3 needs - header auth, one service.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+
+type awsCredentials struct {
+	AccessKey string
+	SecretKey string
+	SessionToken string				// Temporary credentials only
+}
+
+const amzDateFormat = "20060102T150405Z"
+
+// The payload hash of a request with no body.
+
+var emptyPayloadHash = payloadHash(nil)
+
+func payloadHash(body []byte) string {
+
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Signs req, made at t, whose body has the hex SHA-256 bodyHash. Every header already set on req is signed,
+// along with the ones added here - set them all first.
+
+func signRequest(req *http.Request, creds awsCredentials, region string, bodyHash string, t time.Time) {
+
+	req.Header.Set("X-Amz-Date", t.UTC().Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", bodyHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	req.Header.Set("Authorization", sigv4Authorization(req, creds, region, bodyHash, t))
+}
+
+// Returns the Authorization header for req, signing the host and every header but Authorization.
+
+func sigv4Authorization(req *http.Request, creds awsCredentials, region string, bodyHash string, t time.Time) string {
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if name == "Authorization" {
+			continue
+		}
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req),
+		canonicalHeaders.String(),
+		signedHeaders,
+		bodyHash,
+	}, "\n")
+
+	date := t.UTC().Format("20060102")
+	scope := date + "/" + region + "/s3/aws4_request"
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.UTC().Format(amzDateFormat),
+		scope,
+		payloadHash([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4" + creds.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s", creds.AccessKey, scope, signedHeaders, signature)
+}
+
+// The query string with its parameters sorted, and keys and values encoded as uriEncode does.
+
+func canonicalQuery(req *http.Request) string {
+
+	query := req.URL.Query()
+
+	var params []string
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(key, true) + "=" + uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+// Percent-encodes everything but the unreserved characters - and '/' too, if encodeSlash. Unlike url.PathEscape
+// and url.QueryEscape, this is the encoding the signature is computed over.
+
+func uriEncode(s string, encodeSlash bool) string {
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && encodeSlash == false:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
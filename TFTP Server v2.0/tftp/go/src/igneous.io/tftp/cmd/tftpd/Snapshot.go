@@ -0,0 +1,353 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The cache can be saved to a snapshot file - every -snapshot-interval, and when the server shuts down - and
+// restored from it when the server starts, so a restart does not lose the uploaded files.
+//
+// A snapshot is a tar archive, so it can be looked at with tar(1). Like the cache, it is content addressed: it
+// holds an entry per chunk, chunks/<SHA-256>, each saved once however many files share it, then an entry per
+// committed file, which holds no data. PAX records on the file's entry list its chunks, and record its size and
+// SHA-256, which is checked when the file is restored, and the entry's modification time is its commit time.
+// Snapshots from before chunks, with the file's data in its entry, are restored too. Uploads in progress, files
+// fetched from upstream and preloaded files are not saved.
+//
+// The snapshot is written to a temporary file in the same directory, synced, and renamed over the last one, so
+// a crash while it is written leaves the last snapshot as it was.
+
+const snapshotChecksumRecord = "TFTPD.sha256"
+const snapshotSizeRecord = "TFTPD.size"
+const snapshotChunksRecord = "TFTPD.chunks"			// The file's chunks' SHA-256s, comma separated
+const snapshotChunkDir = "chunks/"
+
+// A file to save, as it was when the snapshot was taken. Committed files are immutable, so the contents are
+// written without holding any lock.
+
+type snapshotFile struct {
+	name string
+	file *CacheFile
+}
+
+// Saves the committed files to path. Returns the number of files saved.
+
+func saveSnapshot(path string) (int, error) {
+
+	files := snapshotFiles()
+
+	err := replaceFile(path, func(w io.Writer) error { return writeSnapshot(w, files) })
+	if err != nil {
+		return 0, fmt.Errorf("snapshot %s: %w", path, err)
+	}
+	return len(files), nil
+}
+
+// Replaces the file at path with what write writes, atomically - if write fails, or the server crashes, the
+// file is left as it was.
+
+func replaceFile(path string, write func(w io.Writer) error) error {
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := os.CreateTemp(dir, base + ".tmp*")
+	if err != nil {
+		return err
+	}
+
+	// Remove the temporary file, unless it has been renamed into place.
+
+	defer os.Remove(tmp.Name())
+
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Sync the directory, so the rename itself survives a crash.
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Returns the committed files in the cache, by name.
+
+func snapshotFiles() []snapshotFile {
+
+	debugLog.Printf("Take Metadata Lock \n")
+
+	lockMetadataChanges.Lock()
+	defer deferredMetadataUnlock()
+
+	promoteVersions()
+
+	var files []snapshotFile
+	for name, f := range fileCacheMap {
+		if f.Committed() == false {
+			continue
+		}
+		if upstream != nil && upstream.fetchedFile(name, f) {
+			continue
+		}
+		if preloaded[name] == f {
+			continue
+		}
+		files = append(files, snapshotFile{name, f})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files
+}
+
+func writeSnapshot(w io.Writer, files []snapshotFile) error {
+
+	tw := tar.NewWriter(w)
+
+	// Each chunk once, before the files made of it.
+
+	saved := make(map[*chunk]bool)
+
+	for _, sf := range files {
+		for _, c := range sf.file.chunks {
+			if saved[c] == true {
+				continue
+			}
+			saved[c] = true
+
+			hdr := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name: snapshotChunkDir + c.Hex(),
+				Size: int64(len(c.data)),
+				Mode: 0o644,
+				ModTime: sf.file.ModTime(),
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tw.Write(c.data); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, sf := range files {
+		sums := make([]string, len(sf.file.chunks))
+		for i, c := range sf.file.chunks {
+			sums[i] = c.Hex()
+		}
+
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name: sf.name,
+			Mode: 0o644,
+			ModTime: sf.file.ModTime(),
+			Format: tar.FormatPAX,
+			PAXRecords: map[string]string{
+				snapshotChecksumRecord: sf.file.Checksums().SHA256,
+				snapshotSizeRecord: strconv.Itoa(sf.file.Size()),
+			},
+		}
+		if len(sums) > 0 {
+			hdr.PAXRecords[snapshotChunksRecord] = strings.Join(sums, ",")
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// Restores the files saved in the snapshot at path into the cache. A missing snapshot restores nothing. A
+// damaged one restores nothing, and is an error - the server should not start, and overwrite it with a snapshot
+// that is missing files. Returns the number of files restored.
+
+func loadSnapshot(path string) (int, error) {
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	files, err := readSnapshot(f)
+	if err != nil {
+		return 0, fmt.Errorf("snapshot %s: %w", path, err)
+	}
+
+	debugLog.Printf("Take Metadata Lock \n")
+
+	lockMetadataChanges.Lock()
+	defer deferredMetadataUnlock()
+
+	n := 0
+	for _, sf := range files {
+		if _, ok := fileCacheMap[sf.name]; ok == false {
+			fileCacheMap[sf.name] = sf.file
+			n++
+		} else {
+			sf.file.release()
+		}
+	}
+	return n, nil
+}
+
+// Reads the files saved in a snapshot into the chunk store. If the snapshot is damaged, none are.
+
+func readSnapshot(r io.Reader) ([]snapshotFile, error) {
+
+	var files []snapshotFile
+
+	fail := func(err error) ([]snapshotFile, error) {
+		for _, sf := range files {
+			sf.file.release()
+		}
+		return nil, err
+	}
+
+	// The chunks saved, by SHA-256. A chunk is checked when a file is made of it, so the error names the file.
+
+	chunks := make(map[string][]byte)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return fail(fmt.Errorf("%s: not a file", hdr.Name))
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fail(fmt.Errorf("%s: %w", hdr.Name, err))
+		}
+
+		var f *CacheFile
+
+		switch size, chunked := hdr.PAXRecords[snapshotSizeRecord]; {
+		case chunked == true:
+			f, err = restoreChunks(hdr.PAXRecords[snapshotChunksRecord], chunks)
+			if err == nil && strconv.Itoa(f.Size()) != size {
+				err = fmt.Errorf("%d bytes, %s recorded", f.Size(), size)
+			}
+		case strings.HasPrefix(hdr.Name, snapshotChunkDir):
+			chunks[strings.TrimPrefix(hdr.Name, snapshotChunkDir)] = data
+			continue
+		default:
+			f = newStoredFile(data)
+		}
+
+		if err == nil {
+			f.modTime = hdr.ModTime
+			f.Commit()
+			if want := hdr.PAXRecords[snapshotChecksumRecord]; f.Checksums().SHA256 != want {
+				err = fmt.Errorf("SHA-256 %s does not match the %q recorded", f.Checksums().SHA256, want)
+			}
+		}
+		if err != nil {
+			if f != nil {
+				f.release()
+			}
+			return fail(fmt.Errorf("%s: %w", hdr.Name, err))
+		}
+
+		files = append(files, snapshotFile{hdr.Name, f})
+	}
+}
+
+// Returns a file made of the chunks listed, from those saved in the snapshot.
+
+func restoreChunks(list string, saved map[string][]byte) (*CacheFile, error) {
+
+	var chunks []*chunk
+	var err error
+
+	for _, sum := range strings.Split(list, ",") {
+		if sum == "" {
+			continue
+		}
+
+		data, ok := saved[sum]
+		if ok == false {
+			err = fmt.Errorf("chunk %s is missing", sum)
+			break
+		}
+
+		c, _ := chunkStore.Put(data, false)
+		chunks = append(chunks, c)
+		if c.Hex() != sum {
+			err = fmt.Errorf("chunk %s is damaged, its SHA-256 is %s", sum, c.Hex())
+			break
+		}
+	}
+
+	if err != nil {
+		chunkStore.Release(chunks)
+		return nil, err
+	}
+	return newChunkedFile(chunks), nil
+}
+
+// Saves a snapshot every interval, until stop is closed.
+
+func snapshotPeriodically(path string, interval time.Duration, stop chan struct{}) {
+
+	for {
+		timer := clk.NewTimer(interval)
+
+		select {
+		case <- timer.C():
+		case <- stop:
+			timer.Stop()
+			return
+		}
+
+		takeSnapshot(path)
+	}
+}
+
+// Saves a snapshot, and logs how it went.
+
+func takeSnapshot(path string) {
+
+	start := time.Now()
+
+	n, err := saveSnapshot(path)
+	if err != nil {
+		requestLog.Printf("Snapshot failed, the last one is kept: %s \n", err)
+		return
+	}
+	requestLog.Printf("Snapshot saved to %s: %d files in %s \n", path, n, time.Since(start))
+}
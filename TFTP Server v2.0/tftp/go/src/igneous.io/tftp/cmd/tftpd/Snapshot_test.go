@@ -0,0 +1,336 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Adds committed files holding distinct data to the cache. Returns them by name.
+
+func addSnapshotFiles(t *testing.T, sizes ...int) map[string][]byte {
+	t.Helper()
+
+	files := make(map[string][]byte)
+	for _, size := range sizes {
+		name := testFileName(t)
+		files[name] = testData(size, size)
+		f := uploadFile(files[name])
+
+		lockMetadataChanges.Lock()
+		fileCacheMap[name] = f
+		lockMetadataChanges.Unlock()
+	}
+
+	t.Cleanup(func() { dropFiles(files) })
+	return files
+}
+
+func dropFiles(files map[string][]byte) {
+	lockMetadataChanges.Lock()
+	defer lockMetadataChanges.Unlock()
+	for name := range files {
+		f := fileCacheMap[name]
+		delete(fileCacheMap, name)
+		dropFile(name, f)
+	}
+}
+
+func cachedFile(name string) (*CacheFile, bool) {
+	lockMetadataChanges.Lock()
+	defer lockMetadataChanges.Unlock()
+	f, ok := fileCacheMap[name]
+	return f, ok
+}
+
+// Files saved are restored after a restart - here, after they are dropped from the cache - with the same
+// contents and commit time. Uploads in progress are not saved.
+
+func TestSnapshotRestore(t *testing.T) {
+	files := addSnapshotFiles(t, 0, 1, 512, 70000)
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	uploading := testFileName(t)
+	lockMetadataChanges.Lock()
+	fileCacheMap[uploading] = new(CacheFile)
+	lockMetadataChanges.Unlock()
+	t.Cleanup(func() { dropFiles(map[string][]byte{uploading: nil}) })
+
+	modTimes := make(map[string]time.Time)
+	for name := range files {
+		f, _ := cachedFile(name)
+		modTimes[name] = f.ModTime()
+	}
+
+	if _, err := saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	dropFiles(files)
+
+	if _, err := loadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range files {
+		f, ok := cachedFile(name)
+		switch {
+		case ok == false:
+			t.Errorf("%s not restored", name)
+		case f.Committed() == false || !bytes.Equal(f.Bytes(), data):
+			t.Errorf("%s restored as %d bytes, committed %t; expected %d", name, f.Size(), f.Committed(), len(data))
+		case f.ModTime().Equal(modTimes[name]) == false:
+			t.Errorf("%s restored with commit time %s; expected %s", name, f.ModTime(), modTimes[name])
+		}
+	}
+
+	if f, _ := cachedFile(uploading); f != nil && f.Committed() {
+		t.Errorf("Upload in progress restored as a committed file")
+	}
+
+	// No temporary files are left behind.
+
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("Expected only the snapshot in its directory; found %d entries", len(entries))
+	}
+}
+
+// A snapshot that is missing is no snapshot. One that is damaged restores nothing, and is an error.
+
+func TestSnapshotDamaged(t *testing.T) {
+	files := addSnapshotFiles(t, 3000, 5000)
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	if n, err := loadSnapshot(path); n != 0 || err != nil {
+		t.Fatalf("Missing snapshot: restored %d, %v", n, err)
+	}
+
+	if _, err := saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var name string
+	for name = range files {
+		break
+	}
+	at := bytes.Index(saved, files[name])
+	if at < 0 {
+		t.Fatalf("%s not found in the snapshot", name)
+	}
+
+	damaged := bytes.Clone(saved)
+	damaged[at+100] ^= 0xff
+
+	for what, contents := range map[string][]byte{
+		"a flipped bit": damaged,
+		"truncated":     saved[:at+100],
+	} {
+		dropFiles(files)
+		if err := os.WriteFile(path, contents, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := loadSnapshot(path)
+		if err == nil {
+			t.Errorf("Snapshot with %s restored %d files without error", what, n)
+		}
+		if what == "a flipped bit" && (err == nil || !strings.Contains(err.Error(), name)) {
+			t.Errorf("Snapshot with %s: expected an error naming %s; got %v", what, name, err)
+		}
+		for name := range files {
+			if _, ok := cachedFile(name); ok {
+				t.Errorf("Snapshot with %s restored %s", what, name)
+			}
+		}
+	}
+}
+
+// A chunk is saved once however many files hold it, and the files restored share it again.
+
+func TestSnapshotDedup(t *testing.T) {
+	data := testData(25, chunkSize + 1000)
+	files := map[string][]byte{testFileName(t): data, testFileName(t) + "-copy": data}
+	t.Cleanup(func() { dropFiles(files) })
+
+	lockMetadataChanges.Lock()
+	for name := range files {
+		fileCacheMap[name] = newStoredFile(data)
+		fileCacheMap[name].Commit()
+	}
+	lockMetadataChanges.Unlock()
+
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	if _, err := saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	chunks := 0
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(hdr.Name, snapshotChunkDir) && bytes.Contains(data, mustReadAll(t, tr)) {
+			chunks++
+		}
+	}
+	if chunks != 2 {
+		t.Errorf("Snapshot holds %d chunks of the files; expected 2", chunks)
+	}
+
+	dropFiles(files)
+	if _, err := loadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	var restored []*CacheFile
+	for name := range files {
+		f, ok := cachedFile(name)
+		if ok == false || !bytes.Equal(f.Bytes(), data) {
+			t.Fatalf("%s not restored", name)
+		}
+		restored = append(restored, f)
+	}
+	if restored[0].chunks[0] != restored[1].chunks[0] {
+		t.Errorf("Restored files do not share their chunks")
+	}
+}
+
+func mustReadAll(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Snapshots from before chunks, with each file's data in its entry, are restored.
+
+func TestSnapshotOldFormat(t *testing.T) {
+	name := testFileName(t)
+	data := testData(5, 3000)
+
+	var old bytes.Buffer
+	tw := tar.NewWriter(&old)
+	tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name: name,
+		Size: int64(len(data)),
+		Mode: 0o644,
+		ModTime: time.Unix(1700000000, 0),
+		Format: tar.FormatPAX,
+		PAXRecords: map[string]string{snapshotChecksumRecord: sha256Hex(data)},
+	})
+	tw.Write(data)
+	tw.Close()
+
+	files, err := readSnapshot(&old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].name != name || !bytes.Equal(files[0].file.Bytes(), data) {
+		t.Fatalf("Old snapshot restored %+v", files)
+	}
+	files[0].file.release()
+}
+
+// A save that fails part way leaves the last snapshot as it was, and no temporary file.
+
+func TestSnapshotAtomic(t *testing.T) {
+	addSnapshotFiles(t, 3000)
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	if _, err := saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := os.ReadFile(path)
+
+	failed := errors.New("disk on fire")
+	err := replaceFile(path, func(w io.Writer) error {
+		writeSnapshot(w, snapshotFiles())
+		return failed
+	})
+	if err != failed {
+		t.Errorf("Expected the write's error; got %v", err)
+	}
+
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, saved) {
+		t.Errorf("Failed save changed the last snapshot")
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("Expected only the snapshot in its directory; found %d entries", len(entries))
+	}
+}
+
+// Snapshots are saved every interval, and the request log says so.
+
+func TestSnapshotPeriodically(t *testing.T) {
+	fc := useFakeClock(t)
+	logged := captureRequestLog(t)
+	files := addSnapshotFiles(t, 2000)
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		snapshotPeriodically(path, time.Minute, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	fc.BlockUntil(1)
+	if _, err := os.Stat(path); err == nil {
+		t.Fatalf("Snapshot saved before the interval")
+	}
+
+	fc.Advance(time.Minute)
+	fc.BlockUntil(1)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	restored, err := readSnapshot(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, sf := range restored {
+		if data, ok := files[sf.name]; ok && bytes.Equal(sf.file.Bytes(), data) {
+			found = true
+		}
+		sf.file.release()
+	}
+	if found == false {
+		t.Errorf("Snapshot of %d files does not hold the file added", len(restored))
+	}
+	if got := logged.String(); !strings.Contains(got, "Snapshot saved to "+path) {
+		t.Errorf("Snapshot not logged: %q", got)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Boot configs rendered per client from Go text/template files, so each host in the netboot fleet gets its own
+// kernel arguments without a generator job staging a file per host. A template is served through a Provider -
+// it is rendered in full before the first block is sent, so the size is known up front for the tsize option.
+
+// What a template is rendered with.
+
+type TemplateData struct {
+	Name string						// The file name the client asked for
+	ClientIP string
+	MAC string						// From the file name (e.g. pxelinux.cfg/01-<mac>), or the inventory; may be empty
+	Host *Host						// The client's inventory entry; nil if there is none
+	Server map[string]string		// Server settings, see -template-var
+}
+
+// The inventory templates look hosts up in, and the server settings they see. Set up by main before the server
+// starts, and not changed after.
+
+var inventory *Inventory
+
+var templateVars = map[string]string{}
+
+// Matches a MAC address at the end of a file name, before any extension - in the dash separated form PXELINUX
+// and GRUB use (after the 01- ARP type prefix), or colon separated.
+
+var macPattern = regexp.MustCompile(`(?i)([0-9a-f]{2}(?:[-:][0-9a-f]{2}){5})(?:\.[a-z0-9]+)?$`)
+
+// Serves names matching pattern by rendering tmpl, see RegisterProvider. The template is executed with a
+// TemplateData, and must not refer to missing Server settings or Host.Extra fields.
+//
+// A name carrying a MAC address is per host - if there is an inventory and the host is not in it, the client
+// is told the file is not found. PXELINUX relies on this to fall back to its next candidate name, and in the
+// end pxelinux.cfg/default.
+
+func RegisterTemplate(pattern string, tmpl *template.Template) error {
+
+	tmpl = tmpl.Option("missingkey=error")
+
+	return RegisterProvider(pattern, func(addr net.Addr, name string) ([]byte, error) {
+		return renderTemplate(tmpl, addr, name)
+	})
+}
+
+// Loads a template file, and serves names matching pattern from it.
+
+func RegisterTemplateFile(pattern string, file string) error {
+
+	tmpl, err := template.ParseFiles(file)
+	if err != nil {
+		return err
+	}
+	return RegisterTemplate(pattern, tmpl)
+}
+
+func renderTemplate(tmpl *template.Template, addr net.Addr, name string) ([]byte, error) {
+
+	data := TemplateData{
+		Name: name,
+		ClientIP: hostIP(addr),
+		MAC: macFromName(name),
+		Server: templateVars,
+	}
+
+	// A per-host name is looked up by its MAC alone - the client may be asking for another host's file.
+
+	if inventory != nil && data.MAC != "" {
+		data.Host = inventory.Lookup("", data.MAC)
+		if data.Host == nil {
+			return nil, fmt.Errorf("no inventory entry for %s: %w", data.MAC, os.ErrNotExist)
+		}
+	} else if inventory != nil {
+		data.Host = inventory.Lookup(data.ClientIP, "")
+		if data.Host != nil {
+			data.MAC = data.Host.MAC
+		}
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Returns the MAC address a per-host file name carries, normalized as Host.MAC is, or "".
+
+func macFromName(name string) string {
+
+	m := macPattern.FindStringSubmatch(path.Base(name))
+	if m == nil {
+		return ""
+	}
+	return normalizeMAC(m[1])
+}
+
+// Returns the IP address of a client, without the port.
+
+func hostIP(addr net.Addr) string {
+
+	if udp, ok := addr.(*net.UDPAddr); ok == true {
+		return udp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// A flag that may be given more than once, each time as name=value. Keeps the order given - the first template
+// registered for a name wins.
+
+type pairsFlag [][2]string
+
+func (f *pairsFlag) String() string {
+
+	var pairs []string
+	for _, p := range *f {
+		pairs = append(pairs, p[0]+"="+p[1])
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (f *pairsFlag) Set(s string) error {
+
+	name, value, ok := strings.Cut(s, "=")
+	if ok == false || name == "" {
+		return fmt.Errorf("%q is not name=value", s)
+	}
+	*f = append(*f, [2]string{name, value})
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"../../../tftp"
+	"../../client"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+	"time"
+)
+
+const testPXETemplate = `DEFAULT {{.Host.Role}}
+LABEL {{.Host.Role}}
+  KERNEL vmlinuz
+  APPEND initrd=initrd.img root=/dev/nfs image={{.Host.Image}} hostname={{.Host.Hostname}} console={{.Host.Extra.console}} ip={{.ClientIP}} mac={{.MAC}} nfs={{.Server.nfs}}
+`
+
+const testDefaultTemplate = `DEFAULT install
+LABEL install
+  APPEND ip={{.ClientIP}}{{with .Host}} hostname={{.Hostname}}{{end}}
+`
+
+// Sets up an inventory and server settings for templates, for the rest of the test.
+
+func useTemplateSetup(t *testing.T, inventoryCSV string, vars map[string]string) {
+	t.Helper()
+
+	inv, err := NewInventory(writeInventory(t, "hosts.csv", inventoryCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedInventory, savedVars := inventory, templateVars
+	inventory, templateVars = inv, vars
+	t.Cleanup(func() { inventory, templateVars = savedInventory, savedVars })
+
+	providerChanges.RLock()
+	saved := providers
+	providerChanges.RUnlock()
+	t.Cleanup(func() {
+		providerChanges.Lock()
+		providers = saved
+		providerChanges.Unlock()
+	})
+}
+
+func TestMACFromName(t *testing.T) {
+	tests := map[string]string{
+		"pxelinux.cfg/01-52-54-00-12-00-01":  "52:54:00:12:00:01",
+		"pxelinux.cfg/01-52-54-00-AB-CD-EF":  "52:54:00:ab:cd:ef",
+		"grub/grub.cfg-01-52-54-00-12-00-01": "52:54:00:12:00:01",
+		"ipxe/52:54:00:12:00:01.ipxe":        "52:54:00:12:00:01",
+		"pxelinux.cfg/0A000C01":              "",
+		"pxelinux.cfg/default":               "",
+		"52-54-00-12-00-01/boot.cfg":         "",
+	}
+	for name, want := range tests {
+		if got := macFromName(name); got != want {
+			t.Errorf("macFromName(%q) = %q; expected %q", name, got, want)
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	useTemplateSetup(t, testInventoryCSV, map[string]string{"nfs": "10.0.0.5:/images"})
+
+	pxe := template.Must(template.New("pxe").Option("missingkey=error").Parse(testPXETemplate))
+	def := template.Must(template.New("default").Option("missingkey=error").Parse(testDefaultTemplate))
+
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 12, 2), Port: 2000}
+
+	got, err := renderTemplate(pxe, client, "pxelinux.cfg/01-52-54-00-12-00-03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `DEFAULT compute
+LABEL compute
+  KERNEL vmlinuz
+  APPEND initrd=initrd.img root=/dev/nfs image=compute-2024.img hostname=r12-n03 console=ttyS0 ip=10.0.12.2 mac=52:54:00:12:00:03 nfs=10.0.0.5:/images
+`
+	if string(got) != want {
+		t.Errorf("Rendered\n%s\nexpected\n%s", got, want)
+	}
+
+	// An unknown host is not found, so PXELINUX moves on to its next candidate name.
+
+	if _, err := renderTemplate(pxe, client, "pxelinux.cfg/01-52-54-00-99-99-99"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unknown MAC: expected os.ErrNotExist; got %v", err)
+	}
+
+	// A name that is not per host is rendered for any client, with the host if it is known by IP.
+
+	got, err = renderTemplate(def, client, "pxelinux.cfg/default")
+	if err != nil || string(got) != "DEFAULT install\nLABEL install\n  APPEND ip=10.0.12.2 hostname=r12-n02\n" {
+		t.Errorf("Default for a known host: got %q, %v", got, err)
+	}
+	got, err = renderTemplate(def, &net.UDPAddr{IP: net.IPv4(10, 9, 9, 9), Port: 2000}, "pxelinux.cfg/default")
+	if err != nil || string(got) != "DEFAULT install\nLABEL install\n  APPEND ip=10.9.9.9\n" {
+		t.Errorf("Default for an unknown host: got %q, %v", got, err)
+	}
+
+	// A missing server setting fails the read, rather than rendering "<no value>" into a boot config.
+
+	templateVars = map[string]string{}
+	if _, err := renderTemplate(pxe, client, "pxelinux.cfg/01-52-54-00-12-00-03"); err == nil {
+		t.Errorf("Rendered with the nfs setting missing")
+	}
+}
+
+// Each host reads its own config end to end, and is told its size up front with tsize.
+
+func TestIntegrationTemplatePerHost(t *testing.T) {
+	useTemplateSetup(t, "ip,mac,hostname,role,image,console\n127.0.0.1,52:54:00:12:00:01,r12-n01,compute,compute-2024.img,ttyS0\n", map[string]string{"nfs": "10.0.0.5:/images"})
+
+	file := filepath.Join(t.TempDir(), "pxe.tmpl")
+	if err := os.WriteFile(file, []byte(testPXETemplate), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterTemplateFile("pxelinux.cfg/01-*", file); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startServer(t)
+	ctx := testContext(t)
+
+	c := newTestClient()
+	c.TransferSize = true
+
+	r, err := c.Get(ctx, addr, "pxelinux.cfg/01-52-54-00-12-00-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, ok := r.(*client.Reader).Size(); ok == false || size != int64(len(got)) {
+		t.Errorf("tsize %d, %t; read %d bytes", size, ok, len(got))
+	}
+
+	want, _ := renderTemplate(template.Must(template.New("").Parse(testPXETemplate)), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, "pxelinux.cfg/01-52-54-00-12-00-01")
+	if string(got) != string(want) {
+		t.Errorf("Read\n%s\nexpected\n%s", got, want)
+	}
+
+	if _, err := c.GetBytes(ctx, addr, "pxelinux.cfg/01-52-54-00-99-99-99"); !errors.Is(err, client.ErrFileNotFound) {
+		t.Errorf("Unknown host: expected ErrFileNotFound; got %v", err)
+	}
+}
+
+// A read asking for tsize gets an OACK with the size, acked as block 0, before the first block. Without tsize
+// there is no OACK.
+
+func TestReadTransferSize(t *testing.T) {
+	addCommittedFile("tsize.bin", dataBlockSize+100)
+
+	pc := newRecordingConn()
+	addr := nextTestAddr()
+
+	handleRead(pc, addr, tftp.PacketRequest{Op: tftp.OpRRQ, Filename: "tsize.bin", Mode: "octet",
+		Options: map[string]string{"tsize": "0", "blksize": "1428"}})
+
+	oack, ok := pc.next(5 * time.Second).(*tftp.PacketOAck)
+	if ok == false || len(oack.Options) != 1 || oack.Options["tsize"] != "612" {
+		t.Fatalf("Expected OACK tsize=612; got %s", describe(oack))
+	}
+
+	// The first block waits for ACK 0. An ack for any other block is ignored.
+
+	handleAck(pc, addr, tftp.PacketAck{BlockNum: 1})
+	if p := pc.next(50 * time.Millisecond); p != nil {
+		t.Fatalf("Before ACK 0: unexpected packet %s", describe(p))
+	}
+
+	for block := uint16(0); block < 2; block++ {
+		handleAck(pc, addr, tftp.PacketAck{BlockNum: block})
+		if p, ok := pc.next(5 * time.Second).(*tftp.PacketData); ok == false || p.BlockNum != block+1 {
+			t.Fatalf("After ACK %d: expected DATA %d; got %s", block, block+1, describe(p))
+		}
+	}
+	handleAck(pc, addr, tftp.PacketAck{BlockNum: 2})
+}
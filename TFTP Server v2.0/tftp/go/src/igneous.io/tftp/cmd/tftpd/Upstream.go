@@ -0,0 +1,460 @@
+package main
+
+import (
+	"../../../tftp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files missing from the cache can be fetched from an HTTP(S) origin, so devices that only speak TFTP can boot
+// from an artifact server. The file is streamed to the client as it downloads - sendData waits for each block to
+// arrive - and then cached, so the next read is served from memory.
+//
+// A cached file is served for MaxAge, then revalidated with a conditional GET (If-None-Match, If-Modified-Since).
+// If the origin says it has not changed, or cannot be reached, the cached file is served. If it has changed the
+// new version is streamed, and replaces the cached one when it is complete.
+//
+// Several clients reading a file at once share one fetch. A file larger than MaxSize is not fetched: the fetch
+// stops once the origin has sent MaxSize bytes, or at once if its Content-Length is over, and the read fails
+// with ERROR 3, so one large file on the origin cannot take the server's memory. A cached file that grew past
+// MaxSize is dropped.
+
+type Upstream struct {
+	Origin *url.URL					// File names are resolved against this
+	Client *http.Client
+	MaxAge time.Duration			// How long a fetched file is served before it is revalidated
+	MaxSize int						// Largest file fetched, in bytes
+
+	mux sync.Mutex					// Guards fetches and fetched - see the lock order in the README
+	fetches map[string]*upstreamFetch		// In flight, by file name
+	fetched map[string]*upstreamEntry		// Files in the cache that came from the origin, by file name
+}
+
+// A file fetched into the cache, and what is needed to revalidate it.
+
+type upstreamEntry struct {
+	file *CacheFile
+	etag string
+	lastModified string
+	checked time.Time				// When the origin last confirmed the file
+}
+
+// The origin, or nil if files are not fetched. Set up by main before the server starts.
+
+var upstream *Upstream
+
+// A file on the origin that is larger than MaxSize.
+
+var errUpstreamTooLarge = &tftp.Error{Code: tftp.ErrCodeDiskFull, Msg: "File too large."}
+
+// Ends a fetch whose origin sends nothing for this long.
+
+const upstreamIdleTimeout = time.Second * TimeoutInterval
+
+func NewUpstream(origin string, maxAge time.Duration, maxSize int) (*Upstream, error) {
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("upstream %q is not an http or https URL", origin)
+	}
+
+	return &Upstream{
+		Origin: u,
+		Client: &http.Client{},
+		MaxAge: maxAge,
+		MaxSize: maxSize,
+		fetches: make(map[string]*upstreamFetch),
+		fetched: make(map[string]*upstreamEntry),
+	}, nil
+}
+
+// Returns where a read of name should take its blocks from, given the committed file in the cache (nil if there
+// is none): a fetch from the origin, or nil to serve the cached file as it is. Called with lockMetadataChanges
+// held, takes Upstream.mux.
+
+func (u *Upstream) source(name string, cached *CacheFile) BlockSource {
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	if fetch, ok := u.fetches[name]; ok == true {
+		return fetch
+	}
+
+	entry, ok := u.fetched[name]
+	if ok == true && entry.file != cached {
+
+		// The file was uploaded, or has gone, since it was fetched.
+
+		delete(u.fetched, name)
+		entry = nil
+	}
+
+	if cached != nil {
+
+		// An uploaded file is never fetched, nor is one the origin has confirmed lately.
+
+		if entry == nil || clk.Since(entry.checked) < u.MaxAge {
+			return nil
+		}
+	}
+
+	fetch := newUpstreamFetch()
+	u.fetches[name] = fetch
+	go u.fetch(name, fetch, entry)
+
+	return fetch
+}
+
+// Reports whether f, cached as name, was fetched from the origin - see Snapshot.go. Called with
+// lockMetadataChanges held, takes Upstream.mux.
+
+func (u *Upstream) fetchedFile(name string, f *CacheFile) bool {
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	entry, ok := u.fetched[name]
+	return ok == true && entry.file == f
+}
+
+// Fetches name from the origin into fetch, and caches it. prev is the cached copy to revalidate, or nil.
+
+func (u *Upstream) fetch(name string, fetch *upstreamFetch, prev *upstreamEntry) {
+
+	requestLog.Printf("Fetching %s from upstream \n", name)
+
+	data, entry, err := u.get(name, fetch, prev)
+	gone := errors.Is(err, os.ErrNotExist) || errors.Is(err, errUpstreamTooLarge)
+
+	// Update the cache before the reads are told the fetch is over, so the next read finds the file there.
+
+	u.cache(name, data, entry, err, prev)
+
+	switch {
+	case err != nil && prev != nil && gone == false:
+
+		// The origin could not be asked - keep serving the cached file.
+
+		requestLog.Printf("Upstream revalidation of %s failed, serving the cached file: %s \n", name, err)
+		fetch.finishCached(prev.file)
+
+	case err != nil:
+		requestLog.Printf("Upstream fetch of %s failed: %s \n", name, err)
+		fetch.fail(err)
+
+	case data == nil:
+		requestLog.Printf("Upstream %s not modified \n", name)
+		fetch.finishCached(prev.file)
+
+	default:
+		requestLog.Printf("Fetched %s from upstream: %d bytes \n", name, len(data))
+		fetch.finish()
+	}
+}
+
+// Records the outcome of a fetch in the cache, unless the file was uploaded while it was being fetched.
+
+func (u *Upstream) cache(name string, data []byte, entry *upstreamEntry, err error, prev *upstreamEntry) {
+
+	lockMetadataChanges.Lock()
+	defer lockMetadataChanges.Unlock()
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	delete(u.fetches, name)
+
+	current, ok := fileCacheMap[name]
+	ours := prev != nil && ok == true && current == prev.file
+
+	switch {
+	case err != nil && ours == true && (errors.Is(err, os.ErrNotExist) || errors.Is(err, errUpstreamTooLarge)):
+
+		// Gone from the origin, or grown too large to fetch, so gone from here.
+
+		delete(fileCacheMap, name)
+		delete(u.fetched, name)
+		dropFile(name, current)
+
+	case err != nil && ours == true:
+
+		// Serve the cached file for another MaxAge, rather than ask an origin that is down on every read.
+
+		prev.checked = clk.Now()
+
+	case err != nil:
+
+	case data == nil && ours == true:
+		prev.checked = clk.Now()
+
+	case data != nil && (ok == false || ours == true):
+		entry.file = newStoredFile(data)
+		entry.file.Commit()
+		fileCacheMap[name] = entry.file
+		u.fetched[name] = entry
+		dropFile(name, current)
+	}
+}
+
+// Does the GET, streaming the body into fetch. Returns the body and the entry to cache it with, or a nil body if
+// prev has not been modified. A file the origin does not have is os.ErrNotExist, one it will not give us
+// os.ErrPermission.
+
+func (u *Upstream) get(name string, fetch *upstreamFetch, prev *upstreamEntry) ([]byte, *upstreamEntry, error) {
+
+	// A name that climbs out of the origin's path is not on the origin.
+
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return nil, nil, os.ErrNotExist
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.Origin.JoinPath(name).String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if prev != nil {
+		if prev.etag != "" {
+			req.Header.Set("If-None-Match", prev.etag)
+		}
+		if prev.lastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.lastModified)
+		}
+	}
+
+	// A stalled origin would hold every reader of the file - give up on it if it sends nothing for a while.
+
+	idle := time.AfterFunc(upstreamIdleTimeout, cancel)
+	defer idle.Stop()
+
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && prev != nil:
+		return nil, nil, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, nil, fmt.Errorf("upstream %s: %s: %w", name, resp.Status, os.ErrNotExist)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, nil, fmt.Errorf("upstream %s: %s: %w", name, resp.Status, os.ErrPermission)
+	case resp.StatusCode != http.StatusOK:
+		return nil, nil, fmt.Errorf("upstream %s: %s", name, resp.Status)
+	}
+
+	if resp.ContentLength > int64(u.MaxSize) {
+		return nil, nil, fmt.Errorf("upstream %s: %d bytes is over the %d byte limit: %w", name, resp.ContentLength, u.MaxSize, errUpstreamTooLarge)
+	}
+
+	entry := &upstreamEntry{
+		etag: resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		checked: clk.Now(),
+	}
+
+	fetch.start(int(resp.ContentLength))
+
+	// An origin that does not send a Content-Length, or sends more than it said, is cut off at MaxSize.
+
+	buf := make([]byte, 32 * 1024)
+	for got := 0; ; {
+		n, err := resp.Body.Read(buf)
+		if got += n; got > u.MaxSize {
+			return nil, nil, fmt.Errorf("upstream %s: over the %d byte limit: %w", name, u.MaxSize, errUpstreamTooLarge)
+		}
+		if n > 0 {
+			idle.Reset(upstreamIdleTimeout)
+			fetch.append(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// A body cut short is an error, io.ErrUnexpectedEOF - not the end of the file.
+
+	return fetch.bytes(), entry, nil
+}
+
+// A file being fetched, which any number of reads may be waiting on. Each change closes the changed channel, and
+// replaces it, so the waiting reads can select on it along with their abort channel.
+
+type upstreamFetch struct {
+	mux sync.Mutex
+	changed chan struct{}
+	data []byte
+	size int						// From Content-Length, -1 if unknown
+	started bool					// The origin has answered
+	done bool						// data is the whole file
+	cached *CacheFile				// Set instead, if the cached file is to be served
+	err error
+}
+
+func newUpstreamFetch() *upstreamFetch {
+
+	return &upstreamFetch{changed: make(chan struct{}), size: -1}
+}
+
+// Runs f with the fetch locked, then wakes the reads waiting on it.
+
+func (fetch *upstreamFetch) update(f func()) {
+
+	fetch.mux.Lock()
+	defer fetch.mux.Unlock()
+
+	f()
+	close(fetch.changed)
+	fetch.changed = make(chan struct{})
+}
+
+func (fetch *upstreamFetch) start(size int) {
+
+	fetch.update(func() { fetch.started, fetch.size = true, size })
+}
+
+func (fetch *upstreamFetch) append(b []byte) {
+
+	fetch.update(func() { fetch.data = append(fetch.data, b...) })
+}
+
+func (fetch *upstreamFetch) finish() {
+
+	fetch.update(func() { fetch.done = true })
+}
+
+func (fetch *upstreamFetch) finishCached(f *CacheFile) {
+
+	fetch.update(func() { fetch.cached = f })
+}
+
+func (fetch *upstreamFetch) fail(err error) {
+
+	fetch.update(func() { fetch.err = err })
+}
+
+func (fetch *upstreamFetch) bytes() []byte {
+
+	fetch.mux.Lock()
+	defer fetch.mux.Unlock()
+
+	return fetch.data[:len(fetch.data):len(fetch.data)]
+}
+
+// Waits until ready returns true, or the read is aborted. ready is called with the fetch locked.
+
+func (fetch *upstreamFetch) wait(abort <-chan bool, ready func() bool) error {
+
+	for {
+		fetch.mux.Lock()
+		ok, changed := ready(), fetch.changed
+		fetch.mux.Unlock()
+
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-abort:
+			return errAborted
+		}
+	}
+}
+
+// BlockSource for the file being fetched. Bytes once appended are never changed, so a block can be handed out as
+// a slice of data while the fetch goes on appending.
+
+func (fetch *upstreamFetch) ReadBlock(i int, blockSize int, abort <-chan bool) ([]byte, bool, error) {
+
+	end := (i + 1) * blockSize
+
+	err := fetch.wait(abort, func() bool {
+		return len(fetch.data) >= end || fetch.done || fetch.cached != nil || fetch.err != nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	fetch.mux.Lock()
+	defer fetch.mux.Unlock()
+
+	switch {
+	case fetch.cached != nil:
+		return fetch.cached.ReadBlock(i, blockSize, abort)
+	case fetch.err != nil:
+		return nil, false, fetch.err
+	}
+
+	// A full block is never the last - a file that is a multiple of the block size ends with an empty block.
+
+	start := i * blockSize
+	if start > len(fetch.data) {
+		start = len(fetch.data)
+	}
+	if end > len(fetch.data) {
+		end = len(fetch.data)
+	}
+	return fetch.data[start:end:end], end - start < blockSize, nil
+}
+
+func (fetch *upstreamFetch) TransferSize(abort <-chan bool) (int, bool, error) {
+
+	err := fetch.wait(abort, func() bool {
+		return fetch.started || fetch.cached != nil || fetch.err != nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	fetch.mux.Lock()
+	defer fetch.mux.Unlock()
+
+	switch {
+	case fetch.cached != nil:
+		return fetch.cached.TransferSize(abort)
+	case fetch.err != nil:
+		return 0, false, fetch.err
+	}
+	return fetch.size, fetch.size >= 0, nil
+}
+
+// Parses a size flag such as 32MB. Plain numbers are bytes.
+
+func parseSize(s string) (int, error) {
+
+	multiplier := 1
+	for suffix, m := range map[string]int{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(strings.ToUpper(s), suffix) {
+			s, multiplier = s[:len(s) - len(suffix)], m
+			break
+		}
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"../../../tftp"
+	"../../client"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// An origin serving files from a map, with an ETag for each version. Counts the GETs it answers, and the
+// conditional ones it answers with 304.
+
+type testOrigin struct {
+	mux sync.Mutex
+	files map[string][]byte
+	gets, notModified atomic.Int32
+	down atomic.Bool				// Answer every GET with 503
+	unsized atomic.Bool				// Send no Content-Length
+	release chan struct{}			// If set, the body after the first half waits for it to close
+}
+
+func (o *testOrigin) set(name string, data []byte) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if data == nil {
+		delete(o.files, name)
+	} else {
+		o.files[name] = data
+	}
+}
+
+func (o *testOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.gets.Add(1)
+	if o.down.Load() {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+		return
+	}
+
+	o.mux.Lock()
+	data, ok := o.files[strings.TrimPrefix(r.URL.Path, "/tftp/")]
+	release := o.release
+	o.mux.Unlock()
+
+	if ok == false {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%d-%d"`, len(data), data[len(data)/2])
+	if r.Header.Get("If-None-Match") == etag {
+		o.notModified.Add(1)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	if o.unsized.Load() == false {
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	}
+	if release == nil {
+		w.Write(data)
+		return
+	}
+
+	w.Write(data[:len(data)/2])
+	w.(http.Flusher).Flush()
+	<-release
+	w.Write(data[len(data)/2:])
+}
+
+// Starts an origin, and fetches missing files from it for the rest of the test.
+
+func useUpstream(t *testing.T, maxSize int) *testOrigin {
+	t.Helper()
+
+	origin := &testOrigin{files: make(map[string][]byte)}
+	srv := httptest.NewServer(origin)
+	t.Cleanup(srv.Close)
+
+	u, err := NewUpstream(srv.URL + "/tftp/", 5*time.Minute, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream = u
+	t.Cleanup(func() { upstream = nil })
+
+	return origin
+}
+
+func expectRead(t *testing.T, c *client.Client, addr, name string, want []byte) {
+	t.Helper()
+	got, err := c.GetBytes(testContext(t), addr, name)
+	if err != nil {
+		t.Fatalf("Get %s: %s", name, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Get %s: %d bytes that differ from the %d on the origin", name, len(got), len(want))
+	}
+}
+
+// A missing file is fetched once, then served from the cache. Several clients reading it at once share the fetch.
+
+func TestIntegrationUpstream(t *testing.T) {
+	origin := useUpstream(t, 1<<20)
+	name := testFileName(t)
+	data := testData(3, 5000)
+	origin.set(name, data)
+
+	addr := startServer(t)
+	c := newTestClient()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := c.GetBytes(testContext(t), addr, name)
+			if err == nil && !bytes.Equal(got, data) {
+				err = fmt.Errorf("read %d bytes that differ from the %d on the origin", len(got), len(data))
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	expectRead(t, c, addr, name, data)
+	if n := origin.gets.Load(); n != 1 {
+		t.Errorf("Origin asked %d times; expected once", n)
+	}
+
+	if _, err := c.GetBytes(testContext(t), addr, "missing-"+name); !errors.Is(err, client.ErrFileNotFound) {
+		t.Errorf("File not on the origin: expected ErrFileNotFound; got %v", err)
+	}
+	if _, err := c.GetBytes(testContext(t), addr, "../"+name); !errors.Is(err, client.ErrFileNotFound) {
+		t.Errorf("Name outside the origin: expected ErrFileNotFound; got %v", err)
+	}
+	if n := origin.gets.Load(); n != 2 {
+		t.Errorf("Origin asked %d times; expected twice - the name with .. should not be sent", n)
+	}
+}
+
+// The client gets the first blocks while the rest of the file is still on its way, and the size up front.
+
+func TestIntegrationUpstreamStreaming(t *testing.T) {
+	origin := useUpstream(t, 1<<20)
+	origin.release = make(chan struct{})
+	name := testFileName(t)
+	data := testData(5, 8*dataBlockSize)
+	origin.set(name, data)
+
+	addr := startServer(t)
+	c := newTestClient()
+	c.TransferSize = true
+
+	r, err := c.Get(testContext(t), addr, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if size, ok := r.(*client.Reader).Size(); ok == false || size != int64(len(data)) {
+		t.Errorf("tsize %d, %t; expected %d", size, ok, len(data))
+	}
+
+	half := make([]byte, len(data)/2)
+	if _, err := io.ReadFull(r, half); err != nil {
+		t.Fatalf("Reading the first half, before the origin sent the rest: %s", err)
+	}
+
+	close(origin.release)
+
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := append(half, rest...); !bytes.Equal(got, data) {
+		t.Errorf("Read %d bytes that differ from the %d on the origin", len(got), len(data))
+	}
+}
+
+// Once MaxAge has passed the cached file is revalidated: served as it is if it has not changed on the origin, or
+// if the origin is down, replaced if it has changed, and dropped if it has gone.
+
+func TestIntegrationUpstreamRevalidation(t *testing.T) {
+	fc := useFakeClock(t)
+	origin := useUpstream(t, 1<<20)
+	name := testFileName(t)
+	v1, v2 := testData(1, 3000), testData(2, 4000)
+	origin.set(name, v1)
+
+	addr := startServer(t)
+	c := newTestClient()
+
+	expectRead(t, c, addr, name, v1)
+	expectRead(t, c, addr, name, v1)
+	if n := origin.gets.Load(); n != 1 {
+		t.Errorf("Within MaxAge: origin asked %d times; expected once", n)
+	}
+
+	fc.Advance(upstream.MaxAge)
+	expectRead(t, c, addr, name, v1)
+	if n := origin.notModified.Load(); n != 1 {
+		t.Errorf("After MaxAge: %d conditional GETs answered not modified; expected 1", n)
+	}
+
+	fc.Advance(upstream.MaxAge)
+	origin.set(name, v2)
+	expectRead(t, c, addr, name, v2)
+	expectRead(t, c, addr, name, v2)
+	if n := origin.gets.Load(); n != 3 {
+		t.Errorf("After a change: origin asked %d times; expected 3", n)
+	}
+
+	// The origin is down.
+
+	origin.down.Store(true)
+	fc.Advance(upstream.MaxAge)
+	expectRead(t, c, addr, name, v2)
+	origin.down.Store(false)
+
+	origin.set(name, nil)
+	expectRead(t, c, addr, name, v2)
+	fc.Advance(upstream.MaxAge)
+	if _, err := c.GetBytes(testContext(t), addr, name); !errors.Is(err, client.ErrFileNotFound) {
+		t.Errorf("Gone from the origin: expected ErrFileNotFound; got %v", err)
+	}
+	if _, err := c.GetBytes(testContext(t), addr, name); !errors.Is(err, client.ErrFileNotFound) {
+		t.Errorf("Gone from the origin: cached copy still served: %v", err)
+	}
+}
+
+// A file that is uploaded is never replaced from the origin.
+
+func TestIntegrationUpstreamCache(t *testing.T) {
+	fc := useFakeClock(t)
+	origin := useUpstream(t, 4000)
+	addr := startServer(t)
+	c := newTestClient()
+
+	uploaded := testFileName(t)
+	origin.set(uploaded, testData(1, 3000))
+	data := testData(2, 3000)
+	if err := c.PutBytes(testContext(t), addr, uploaded, data); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(upstream.MaxAge)
+	expectRead(t, c, addr, uploaded, data)
+}
+
+// A file over MaxSize is not fetched - whether the origin says how large it is, or not - and one that grows past
+// it is dropped from the cache.
+
+func TestIntegrationUpstreamMaxSize(t *testing.T) {
+	fc := useFakeClock(t)
+	origin := useUpstream(t, 4000)
+	addr := startServer(t)
+	c := newTestClient()
+
+	for _, unsized := range []bool{false, true} {
+		origin.unsized.Store(unsized)
+
+		large := testFileName(t)
+		origin.set(large, testData(3, 5000))
+		if _, err := c.GetBytes(testContext(t), addr, large); !errors.Is(err, client.ErrDiskFull) {
+			t.Errorf("Over MaxSize, no Content-Length %t: expected ErrDiskFull; got %v", unsized, err)
+		}
+		if _, ok := cachedFile(large); ok {
+			t.Errorf("Over MaxSize, no Content-Length %t: cached", unsized)
+		}
+	}
+
+	grown := testFileName(t)
+	origin.set(grown, testData(4, 3000))
+	expectRead(t, c, addr, grown, testData(4, 3000))
+
+	origin.set(grown, testData(5, 6000))
+	fc.Advance(upstream.MaxAge)
+	if _, err := c.GetBytes(testContext(t), addr, grown); !errors.Is(err, client.ErrDiskFull) {
+		t.Errorf("Grown past MaxSize: expected ErrDiskFull; got %v", err)
+	}
+	if _, ok := cachedFile(grown); ok {
+		t.Errorf("Grown past MaxSize: cached copy kept")
+	}
+}
+
+// A fetch that fails is sent to the client as a fixed message - the error itself names the origin, and goes to
+// the request log.
+
+func TestIntegrationUpstreamFailed(t *testing.T) {
+	origin := useUpstream(t, 4000)
+	addr := startServer(t)
+	logged := captureRequestLog(t)
+	c := newTestClient()
+
+	name := testFileName(t)
+	origin.set(name, testData(6, 1000))
+	origin.down.Store(true)
+
+	_, err := c.GetBytes(testContext(t), addr, name)
+	var e *client.Error
+	if errors.As(err, &e) == false || e.Code != tftp.ErrCodeNotDefined || e.Msg != "Upstream fetch failed." {
+		t.Errorf("Origin down: expected ERROR 0 \"Upstream fetch failed.\"; got %v", err)
+	}
+	if got := logged.String(); !strings.Contains(got, "503") {
+		t.Errorf("Failed fetch not logged with its reason: %q", got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int{
+		"0":     0,
+		"1500":  1500,
+		"64KB":  64 << 10,
+		"32mb":  32 << 20,
+		"2GB":   2 << 30,
+		"-1":    -1,
+		"MB":    -1,
+		"12 TB": -1,
+	}
+	for s, want := range tests {
+		got, err := parseSize(s)
+		switch {
+		case want < 0 && err == nil:
+			t.Errorf("parseSize(%q) = %d; expected an error", s, got)
+		case want >= 0 && (err != nil || got != want):
+			t.Errorf("parseSize(%q) = %d, %v; expected %d", s, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -versions N, an upload may replace a file in the cache, and the last N versions of each file are kept.
+// Without it an upload of a name that exists is refused, as before.
+//
+// A replacement is staged in replacing, not in fileCacheMap, so readers see the current version until the new
+// one is committed. It is committed with RequestTracker.Mux held, where lockMetadataChanges cannot be taken -
+// see the lock order in the README - so it is moved into fileCacheMap, and the history, by the next holder of
+// lockMetadataChanges that looks at the name: a read or write request, the admin API, a snapshot, or the upload's
+// own dally timer. A read after the final ack always finds it.
+//
+// An old version is read by its number after the name, e.g. pxelinux.0@v3, with the suffix set by
+// -version-suffix. A file named that way in the cache takes precedence. The admin API lists the versions of a
+// file, and rolls it back to an earlier one - the rollback is a new version, so nothing is lost.
+//
+// Versions are kept in the in-memory cache only - snapshots save the current version, and the object store
+// refuses to replace an object. Read-only files are never replaced.
+
+// The number of versions kept of each file - 0 when uploads may not replace files. Set at startup.
+
+var maxVersions int
+
+// What separates a name from a version number in a read request. Set at startup.
+
+var versionSuffix = "@v"
+
+// One version of a file.
+
+type fileVersion struct {
+	Number int
+	File *CacheFile
+	Time time.Time					// When it became the current version
+	Source string					// What made it current - the uploading client's address, or a rollback
+}
+
+// The versions of each file that was replaced, oldest first - the last is the current version. A file that was
+// never replaced has no history, and is version 1. Guarded by lockMetadataChanges.
+
+var fileVersions = make(map[string][]fileVersion)
+
+// Uploads replacing a file, by name. Guarded by lockMetadataChanges.
+
+var replacing = make(map[string]*CacheFile)
+
+// Returns the versions of name kept, oldest first. The caller must hold lockMetadataChanges.
+
+func versionsOf(name string) []fileVersion {
+
+	history := fileVersions[name]
+
+	// A file that was never replaced is version 1. One that was replaced from outside - fetched from upstream
+	// again, say - is a version of its own.
+
+	f, ok := fileCacheMap[name]
+	if ok == true && f.Committed() == true && (len(history) == 0 || history[len(history) - 1].File != f) {
+		history = append(history, fileVersion{Number: nextVersion(history), File: f, Time: f.ModTime(), Source: f.source})
+	}
+	return history
+}
+
+func nextVersion(history []fileVersion) int {
+
+	if len(history) == 0 {
+		return 1
+	}
+	return history[len(history) - 1].Number + 1
+}
+
+// Makes f the current version of name, and drops the oldest versions beyond maxVersions. The caller must hold
+// lockMetadataChanges.
+
+func addVersion(name string, f *CacheFile, at time.Time, source string) fileVersion {
+
+	history := versionsOf(name)
+	v := fileVersion{Number: nextVersion(history), File: f, Time: at, Source: source}
+	history = append(history, v)
+
+	var dropped []fileVersion
+	if keep := max(maxVersions, 1); len(history) > keep {
+		dropped = history[:len(history) - keep]
+		history = append([]fileVersion(nil), history[len(history) - keep:]...)
+	}
+
+	fileVersions[name] = history
+	fileCacheMap[name] = f
+
+	// Release the chunks of the versions dropped - unless a rollback made one of them a later version too.
+
+	for _, d := range dropped {
+		dropFile(name, d.File)
+	}
+	return v
+}
+
+// Moves a committed replacement of name into the cache. The caller must hold lockMetadataChanges.
+
+func promoteVersion(name string) {
+
+	f, ok := replacing[name]
+	if ok == false || f.Committed() == false {
+		return
+	}
+	delete(replacing, name)
+
+	v := addVersion(name, f, f.ModTime(), f.source)
+	debugLog.Printf("%s version %d is current \n", name, v.Number)
+}
+
+// As promoteVersion, for every name. The caller must hold lockMetadataChanges.
+
+func promoteVersions() {
+
+	for name := range replacing {
+		promoteVersion(name)
+	}
+}
+
+// Drops a replacement that did not complete. The caller must hold lockMetadataChanges.
+
+func discardVersion(name string, f *CacheFile) {
+
+	if cur, ok := replacing[name]; ok == true && cur == f && f.Committed() == false {
+		delete(replacing, name)
+	}
+}
+
+// Looks up a read request for an old version, e.g. pxelinux.0@v3. The caller must hold lockMetadataChanges.
+
+func lookupVersion(name string) (*CacheFile, bool) {
+
+	i := strings.LastIndex(name, versionSuffix)
+	if maxVersions == 0 || i < 0 {
+		return nil, false
+	}
+	number, err := strconv.Atoi(name[i + len(versionSuffix):])
+	if err != nil {
+		return nil, false
+	}
+
+	base := name[:i]
+	promoteVersion(base)
+
+	for _, v := range versionsOf(base) {
+		if v.Number == number {
+			return v.File, true
+		}
+	}
+	return nil, false
+}
+
+// Makes an earlier version of name current again, as a new version - number 0 for the one before the current
+// version. Returns the new version.
+
+func rollbackVersion(name string, number int) (fileVersion, error) {
+
+	debugLog.Printf("Take Metadata Lock \n")
+
+	lockMetadataChanges.Lock()
+	defer deferredMetadataUnlock()
+
+	promoteVersion(name)
+
+	if _, ok := replacing[name]; ok == true {
+		return fileVersion{}, fmt.Errorf("%s is being uploaded", name)
+	}
+
+	history := versionsOf(name)
+	if len(history) == 0 {
+		return fileVersion{}, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	current := history[len(history) - 1]
+
+	if number == 0 && len(history) > 1 {
+		number = history[len(history) - 2].Number
+	}
+
+	var target fileVersion
+	for _, v := range history {
+		if v.Number == number {
+			target = v
+		}
+	}
+	switch {
+	case target.File == nil:
+		return fileVersion{}, fmt.Errorf("%s has no version %d: %w", name, number, os.ErrNotExist)
+	case target.Number == current.Number:
+		return fileVersion{}, fmt.Errorf("%s version %d is the current version", name, number)
+	}
+
+	v := addVersion(name, target.File, clk.Now(), fmt.Sprintf("rollback to version %d", target.Number))
+	requestLog.Printf("Rolled back %s to version %d, now version %d \n", name, target.Number, v.Number)
+	return v, nil
+}
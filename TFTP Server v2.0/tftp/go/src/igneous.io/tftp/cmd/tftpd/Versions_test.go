@@ -0,0 +1,237 @@
+package main
+
+import (
+	"../../../tftp"
+	"../../client"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Lets uploads replace files, keeping n versions, for the rest of the test. Set before the server starts, so
+// its goroutines see it.
+
+func useVersions(t *testing.T, n int) {
+	maxVersions = n
+	t.Cleanup(func() { maxVersions = 0 })
+}
+
+func dropVersions(t *testing.T, name string) {
+	t.Cleanup(func() {
+		lockMetadataChanges.Lock()
+		defer lockMetadataChanges.Unlock()
+		delete(fileCacheMap, name)
+		delete(fileVersions, name)
+		delete(replacing, name)
+	})
+}
+
+func postRollback(t *testing.T, url string, v any) int {
+	t.Helper()
+	return postRollbackToken(t, url, "", v)
+}
+
+func postRollbackToken(t *testing.T, url string, token string, v any) int {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Admin-Token", token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("POST %s: %s", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// Uploads replace a file, the last versions are kept and read by number, and the admin API lists them with
+// where they came from and their checksums.
+
+func TestIntegrationVersions(t *testing.T) {
+	useVersions(t, 3)
+	addr := startServer(t)
+	c := newTestClient()
+	admin := httptest.NewServer(adminHandler(""))
+	t.Cleanup(admin.Close)
+
+	name := testFileName(t)
+	dropVersions(t, name)
+
+	versions := make([][]byte, 5)
+	for i := 1; i <= 4; i++ {
+		versions[i] = testData(i, 1000 + i)
+		if err := roundTrip(testContext(t), c, addr, name, versions[i]); err != nil {
+			t.Fatalf("Version %d: %s", i, err)
+		}
+	}
+
+	expectRead(t, c, addr, name, versions[4])
+	for i := 2; i <= 4; i++ {
+		expectRead(t, c, addr, fmt.Sprintf("%s@v%d", name, i), versions[i])
+	}
+	if _, err := c.GetBytes(testContext(t), addr, name + "@v1"); !errors.Is(err, client.ErrFileNotFound) {
+		t.Errorf("Version dropped: expected ErrFileNotFound; got %v", err)
+	}
+
+	var af adminFile
+	if status := getJSON(t, admin.URL + "/files/" + name, &af); status != http.StatusOK {
+		t.Fatalf("GET /files/%s: status %d", name, status)
+	}
+	if af.Version != 4 || len(af.Versions) != 3 {
+		t.Fatalf("Version %d with %d versions listed; expected version 4 with 3", af.Version, len(af.Versions))
+	}
+	for i, v := range af.Versions {
+		data := versions[i + 2]
+		if v.Version != i + 2 || v.Size != len(data) || v.Checksums.SHA256 != sha256Hex(data) || v.Source == "" {
+			t.Errorf("Version %d listed as %+v", i + 2, v)
+		}
+	}
+}
+
+// A rollback makes an earlier version current, as a new version.
+
+func TestIntegrationVersionRollback(t *testing.T) {
+	useVersions(t, 5)
+	addr := startServer(t)
+	c := newTestClient()
+	admin := httptest.NewServer(adminHandler(""))
+	t.Cleanup(admin.Close)
+
+	name := testFileName(t)
+	dropVersions(t, name)
+
+	first, second := testData(1, 700), testData(2, 800)
+	for _, data := range [][]byte{first, second} {
+		if err := c.PutBytes(testContext(t), addr, name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var v adminVersion
+	if status := postRollback(t, admin.URL + "/rollback/" + name, &v); status != http.StatusOK || v.Version != 3 {
+		t.Fatalf("Rollback: status %d, %+v; expected version 3", status, v)
+	}
+	expectRead(t, c, addr, name, first)
+
+	if status := postRollback(t, admin.URL + "/rollback/" + name + "?version=2", &v); status != http.StatusOK || v.Version != 4 {
+		t.Fatalf("Rollback to version 2: status %d, %+v; expected version 4", status, v)
+	}
+	expectRead(t, c, addr, name, second)
+	expectRead(t, c, addr, name + "@v3", first)
+
+	for query, want := range map[string]int{
+		"?version=9": http.StatusNotFound,
+		"?version=4": http.StatusConflict,
+		"?version=x": http.StatusBadRequest,
+	} {
+		if status := postRollback(t, admin.URL + "/rollback/" + name + query, nil); status != want {
+			t.Errorf("Rollback %s: status %d; expected %d", query, status, want)
+		}
+	}
+	if status := postRollback(t, admin.URL + "/rollback/" + testFileName(t), nil); status != http.StatusNotFound {
+		t.Errorf("Rollback of a missing file: status %d; expected 404", status)
+	}
+}
+
+// A rollback needs the X-Admin-Token header, and the token if one is set. Nothing is rolled back without it.
+
+func TestAdminRollbackToken(t *testing.T) {
+	useVersions(t, 5)
+	addr := startServer(t)
+	c := newTestClient()
+
+	name := testFileName(t)
+	dropVersions(t, name)
+
+	first, second := testData(1, 700), testData(2, 800)
+	for _, data := range [][]byte{first, second} {
+		if err := c.PutBytes(testContext(t), addr, name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	open := httptest.NewServer(adminHandler(""))
+	t.Cleanup(open.Close)
+
+	resp, err := http.Post(open.URL + "/rollback/" + name, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Rollback without the header: status %d; expected 401", resp.StatusCode)
+	}
+
+	admin := httptest.NewServer(adminHandler("s3cret"))
+	t.Cleanup(admin.Close)
+
+	for _, token := range []string{"", "wrong", "s3cret2"} {
+		if status := postRollbackToken(t, admin.URL + "/rollback/" + name, token, nil); status != http.StatusUnauthorized {
+			t.Errorf("Rollback with token %q: status %d; expected 401", token, status)
+		}
+	}
+	expectRead(t, c, addr, name, second)
+
+	var v adminVersion
+	if status := postRollbackToken(t, admin.URL + "/rollback/" + name, "s3cret", &v); status != http.StatusOK || v.Version != 3 {
+		t.Fatalf("Rollback with the token: status %d, %+v; expected version 3", status, v)
+	}
+	expectRead(t, c, addr, name, first)
+}
+
+// While a replacement is uploaded, readers see the current version, and another upload of the name is refused.
+// Read-only files are not replaced.
+
+func TestIntegrationVersionDuringUpload(t *testing.T) {
+	useVersions(t, 2)
+	addr := startServer(t)
+	ctx := testContext(t)
+	c := newTestClient()
+
+	name := testFileName(t)
+	dropVersions(t, name)
+
+	current := testData(1, 600)
+	if err := c.PutBytes(ctx, addr, name, current); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newRawClient(t, addr)
+	w.send(&tftp.PacketRequest{Op: tftp.OpWRQ, Filename: name, Mode: "octet"})
+	if p, ok := w.receive(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 0 {
+		t.Fatalf("Expected ACK 0; got %s", describe(p))
+	}
+
+	expectRead(t, c, addr, name, current)
+	if err := c.PutBytes(ctx, addr, name, []byte("other")); !errors.Is(err, client.ErrFileExists) {
+		t.Errorf("Write during replacement: expected ErrFileExists; got %v", err)
+	}
+
+	next := testData(2, 10)
+	w.send(&tftp.PacketData{BlockNum: 1, Data: next})
+	if p, ok := w.receive(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 1 {
+		t.Fatalf("Expected ACK 1; got %s", describe(p))
+	}
+	expectRead(t, c, addr, name, next)
+
+	locked := testFileName(t)
+	t.Cleanup(func() { removePreloaded(locked) })
+	addPreloaded(locked, current, true)
+	if err := c.PutBytes(ctx, addr, locked, next); !errors.Is(err, client.ErrAccessViolation) {
+		t.Errorf("Replacing a read-only file: expected ErrAccessViolation; got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"../../conformance"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// Checks the server is known to fail. Fix the server, then take the check off this list - the test fails when a
+// listed check starts passing, so the list can't go stale.
+
+var knownConformanceFailures = map[string]string{
+	"server-tid": "all transfers are served from port 69",
+}
+
+// Runs the conformance suite against the server on a loopback port, so a change that breaks the protocol fails
+// here. The slow rollover check is left out - block numbers don't wrap on writes yet.
+
+func TestConformance(t *testing.T) {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go listen(pc)
+
+	cfg := conformance.Config{
+		Addr:           pc.LocalAddr().String(),
+		Timeout:        500 * time.Millisecond,
+		RetransmitWait: 3 * InitialRetryInterval,
+		Short:          true,
+	}
+
+	for _, c := range conformance.Checks {
+		r := c.Run(context.Background(), cfg)
+		reason, known := knownConformanceFailures[c.Name]
+
+		switch {
+		case r.Status == conformance.Fail && !known:
+			t.Errorf("%s", r)
+		case r.Status != conformance.Fail && known:
+			t.Errorf("%s now passes (%s); remove it from knownConformanceFailures", c.Name, reason)
+		default:
+			t.Logf("%s", r)
+		}
+	}
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"../../../tftp"
-	"bytes"
+	"../../clock"
 	"net"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -13,9 +13,9 @@ import (
 
 const dataBlockSize = 512
 
-// Maps file names to file contents - TODO File size is limited, OK since this is just a code exercise
+// Maps file names to file contents. See CacheFile.
 
-var fileCacheMap map[string]string
+var fileCacheMap map[string]*CacheFile
 
 // Maps client addr to the last block transmitted.
 
@@ -26,11 +26,15 @@ var readAddrMap map[string]*RequestTracker
 var writeAddrMap map[string]*RequestTracker
 
 // Maps client addr to the last error packet sent to the client.
-// Track the timestamp so we can cleanup the list if the client fails to ack the error.
-// TODO Add cleanup code.
+// Track the timestamp so we can cleanup the list if the client fails to ack the error - see reapErrorMap.
 
 var errorAddrMap map[string]time.Time
 
+// The clock for every timer and timestamp in the transfer code. Tests swap in a clock.Fake, to step through
+// retries and timeouts without waiting for them. Each transfer keeps the clock it started with, see RequestTracker.
+
+var clk clock.Clock = clock.Real()
+
 // Mutex to serialize metadata changes done in response to read and write requests.
 
 var lockMetadataChanges sync.Mutex
@@ -42,7 +46,7 @@ var errorMapChanges sync.Mutex
 
 func init() {
 
-	fileCacheMap = make(map[string]string)
+	fileCacheMap = make(map[string]*CacheFile)
 	writeAddrMap = make(map[string]*RequestTracker)
 	readAddrMap = make(map[string]*RequestTracker)
 	errorAddrMap = make(map[string]time.Time)
@@ -52,6 +56,11 @@ func handleRead(pc net.PacketConn, addr net.Addr, p tftp.PacketRequest) {
 
 	debugLog.Printf("Handle Read Packet: %+v \n", p)
 
+	// Whether a provider serves the name. It is only run if the cache does not answer the read, see below.
+
+	provider := lookupProvider(p.Filename)
+	provided := provider != nil
+
 	// Take a lock while we setup and verify metadata.
 
 	debugLog.Printf("Take Metadata Lock \n")
@@ -59,41 +68,129 @@ func handleRead(pc net.PacketConn, addr net.Addr, p tftp.PacketRequest) {
 	lockMetadataChanges.Lock()
 	defer deferredMetadataUnlock()
 
+	// A client retransmits its request if the first data packet is lost. The read already in progress answers it,
+	// its retry timer resends the block.
+
+	if duplicateRead(addr, p) {
+		return
+	}
+
 	// Lookup the file in our cache, return an error if the file is not found.
+	// A file that is still being uploaded is not visible until the final block is received.
+
+	f, ok := lookupReadFile(p.Filename)
+
+	// An uploaded file takes precedence over a generated one, so the provider is only run if there is none. It may
+	// be slow, and must not hold up every other request waiting on the metadata lock, so it runs with the lock
+	// released - the request may have been retransmitted, or the file uploaded, meanwhile.
+
+	if (ok == false || f.Committed() == false) && provided {
+		lockMetadataChanges.Unlock()
+		generated, genErr := generateFile(addr, p.Filename, provider)
+		debugLog.Printf("Take Metadata Lock \n")
+		lockMetadataChanges.Lock()
+
+		if duplicateRead(addr, p) {
+			return
+		}
+
+		if f, ok = lookupReadFile(p.Filename); ok == false || f.Committed() == false {
+			if genErr != nil {
+				e := tftp.ErrorFor(genErr)
+				requestLog.Printf("Provider failed %s %s: %s \n", addr, p.Filename, genErr)
+				sendError(pc, addr, e.Code, e.Msg, true)
+				return
+			}
 
-	if _, ok := fileCacheMap[p.Filename]; ok == false {
-		sendError(pc, addr, 1, "File not found.", true)
+			requestLog.Printf("Generated %s for %s: %d bytes \n", p.Filename, addr, generated.Size())
+			f, ok = generated, true
+		}
+	}
+
+	// A file missing from the cache, or cached from the upstream origin and due for revalidation, is read from
+	// the origin - see Upstream.go.
+
+	var src BlockSource
+	if ok == true && f.Committed() == true {
+		src = f
+	} else {
+		f = nil
+	}
+
+	// With an object store, a file that is not in the cache is read from the bucket - see ObjectStore.go.
+
+	if objectStore != nil && src == nil && provided == false {
+		src = objectStore.Open(p.Filename)
+	} else if upstream != nil && provided == false {
+		if fetch := upstream.source(p.Filename, f); fetch != nil {
+			src = fetch
+		}
+	}
+
+	if src == nil {
+		sendError(pc, addr, tftp.ErrCodeFileNotFound, "File not found.", true)
 		return
 	}
 
 	// Lookup the RequestTracker object in the write request map, if it is found, return an error.
 	// The RequestTracker object will be removed from this map when the write completes.
 	// Do not allow reads against a file that is being written.
+	//
+	// A finished upload's tracker stays in the map for DallyInterval, only to ack a resent final block - see
+	// finishUpload. It does not hold up a read by the same client.
 
-	if _, ok := writeAddrMap[addr.String()]; ok == true {
-		sendError(pc, addr, 0, "File write is in progress.", true)
+	if rt, ok := writeAddrMap[addr.String()]; ok == true && rt.LastBlockWritten.Load() == false {
+		sendError(pc, addr, tftp.ErrCodeNotDefined, "File write is in progress.", true)
 		return
 	}
 
 	// Process only one read for a given file, per client, at a time.
 
 	if _, ok := readAddrMap[addr.String()]; ok == true {
-		sendError(pc, addr, 0, "File read is already in progress for this client.", true)
+		sendError(pc, addr, tftp.ErrCodeNotDefined, "File read is already in progress for this client.", true)
 		return
 	}
 
 	// Create a new map entry. Used to find the RequestTracker object given the client address when sending data packets.
 
-	readAddrMap[addr.String()] = createTrackingEntry(p)
+	rt := createTrackingEntry(p, f)
+	rt.Source = src
+	readAddrMap[addr.String()] = rt
 
 	// Spec: "RRQ ... packets are acknowledged by DATA or ERROR packets. No ack needed here,
 	// just send the first data packet."
 
-	go sendData(pc, addr, p)
+	go sendData(pc, addr, p, rt)
 
 	debugLog.Printf("Handle Read Packet Exit: %+v \n  %+v \n  %+v \n", fileCacheMap, readAddrMap, writeAddrMap)
 }
 
+// Whether p is a retransmission of the request for the read in progress for addr. The caller must hold
+// lockMetadataChanges.
+
+func duplicateRead(addr net.Addr, p tftp.PacketRequest) bool {
+
+	if rt, ok := readAddrMap[addr.String()]; ok == true && rt.PacketReq.Filename == p.Filename {
+		debugLog.Printf("Duplicate read request ignored: %s %s \n", addr, p.Filename)
+		return true
+	}
+	return false
+}
+
+// Returns the file a read of name is served from, if it is in the cache - an old version of a file is read by its
+// number, see Versions.go. The caller must hold lockMetadataChanges.
+
+func lookupReadFile(name string) (*CacheFile, bool) {
+
+	promoteVersion(name)
+
+	f, ok := fileCacheMap[name]
+	if ok == false {
+		f, ok = lookupVersion(name)
+	}
+	return f, ok
+}
+
 func handleWrite(pc net.PacketConn, addr net.Addr, p tftp.PacketRequest) {
 
 	debugLog.Printf("Handle Write Packet: %+v \n", p)
@@ -105,31 +202,79 @@ func handleWrite(pc net.PacketConn, addr net.Addr, p tftp.PacketRequest) {
 	lockMetadataChanges.Lock()
 	defer deferredMetadataUnlock()
 
-	// Lookup the file in our cache, return an error if the file already exists.
+	// A client retransmits its request if ack 0 is lost. The write already in progress answers it, its retry
+	// timer resends the ack. Without this check the retransmitted request would find its own file reserved below.
 
-	if _, ok := fileCacheMap[p.Filename]; ok == true {
-		sendError(pc, addr, 1, "File already exists.", false)
+	if rt, ok := writeAddrMap[addr.String()]; ok == true && rt.PacketReq.Filename == p.Filename {
+		debugLog.Printf("Duplicate write request ignored: %s %s \n", addr, p.Filename)
 		return
 	}
 
-	// Create a new cache entry for the file.
+	// Lookup the file in our cache, return an error if the file already exists - unless uploads replace files,
+	// and the file is not being uploaded already, see Versions.go.
+
+	promoteVersion(p.Filename)
+
+	replace := false
+
+	if f, ok := fileCacheMap[p.Filename]; ok == true {
+		if f.readOnly {
+			sendError(pc, addr, tftp.ErrCodeAccessViolation, "Access violation.", false)
+			return
+		}
+
+		_, uploading := replacing[p.Filename]
+		if maxVersions == 0 || objectStore != nil || f.Committed() == false || uploading == true {
+			sendError(pc, addr, tftp.ErrCodeFileExists, "File already exists.", false)
+			return
+		}
+		replace = true
+	}
+
+	// Create a new cache entry for the file. The entry reserves the name, readers do not see it until it is committed.
+	// A replacement is staged until it is committed.
+	// With an object store the file is uploaded to the bucket instead, and the upload reserves the name.
 
-	fileCacheMap[p.Filename] = ""
+	var f *CacheFile
+	var sink BlockSink
+
+	if objectStore != nil {
+		upload, ok := objectStore.Create(p.Filename)
+		if ok == false {
+			sendError(pc, addr, tftp.ErrCodeFileExists, "File already exists.", false)
+			return
+		}
+		sink = upload
+	} else {
+		f = &CacheFile{source: addr.String()}
+		if replace == true {
+			replacing[p.Filename] = f
+		} else {
+			fileCacheMap[p.Filename] = f
+		}
+		sink = f
+	}
 
 	// Create a map entry. Used to find the RequestTracker object given the client address during data packet transfers.
 
-	writeAddrMap[addr.String()] = createTrackingEntry(p)
+	rt := createTrackingEntry(p, f)
+	rt.Sink = sink
+	rt.Hash = newChecksummer()
+	rt.ExpectedSHA256, rt.ExpectedErr = expectedChecksum(p.Filename)
+	writeAddrMap[addr.String()] = rt
 
 	// Spec: "A WRQ is acknowledged with an ACK packet with block number set to zero."
 
-	rt := writeAddrMap[addr.String()]
-
 	go sendAck(pc, addr, 0, false, rt)
 
 	debugLog.Printf("Handle Write Packet Exit: %+v \n  %+v \n  %+v \n", fileCacheMap, readAddrMap, writeAddrMap)
 }
 
-func handleData(pc net.PacketConn, addr net.Addr, p tftp.PacketData) {
+func handleData(pc net.PacketConn, addr net.Addr, p tftp.PacketData, buf *[]byte) {
+
+	// p.Data aliases the receive buffer, return the buffer to the pool once the block has been appended to the file.
+
+	defer putPacketBuffer(buf)
 
 	// If we are receiving a data packet, then the client is writing to the server.
 
@@ -143,8 +288,9 @@ func handleData(pc net.PacketConn, addr net.Addr, p tftp.PacketData) {
 	//
 	// Note that if the final data packet is sent twice, we will execute this block.
 
-	if _, ok := writeAddrMap[addr.String()]; ok == false {
-		sendError(pc, addr, 5, "Unknown transfer ID.", false)
+	rt, ok := lookupTracker(writeAddrMap, addr)
+	if ok == false {
+		sendError(pc, addr, tftp.ErrCodeUnknownTID, "Unknown transfer ID.", false)
 		return
 	}
 
@@ -158,10 +304,6 @@ func handleData(pc net.PacketConn, addr net.Addr, p tftp.PacketData) {
 		last = true
 	}
 
-	// Get the request tracking data.
-
-	rt := writeAddrMap[addr.String()]
-
 	// Serialize access to the code between Mux.Lock() and Mux.Unlock(), per client address.
 	// This serializes the block writes.
 	// The first block takes the lock, acks, and continues with the write.
@@ -177,32 +319,67 @@ func handleData(pc net.PacketConn, addr net.Addr, p tftp.PacketData) {
 	// Check for duplicate blocks being sent, and that the last packet written corresponds to the data block
 	// preceding the current data block.
 
+	// The upload is complete, but the client did not get our final ack, and resent the final block. Ack it again.
+
+	if rt.LastBlockWritten.Load() == true {
+		if p.BlockNum == rt.BlockNum {
+			pc.WriteTo(rt.SendBuf, addr)
+			debugLog.Printf("Final block %d resent, acked again \n", p.BlockNum)
+		}
+		return
+	}
+
+	// The client resent a block that waits for the store - see waitForStore. It is acked once the store is ready.
+
+	if rt.Storing {
+		return
+	}
+
 	if p.BlockNum <= rt.BlockNum {
 		// Duplicate block - ignore it. The ack routine retries.
 		return
 	} else if rt.BlockNum + 1 != p.BlockNum {
-		sendError(pc, addr, 0, "Missing data block in transfer sequence.", false)
+		sendError(pc, addr, tftp.ErrCodeNotDefined, "Missing data block in transfer sequence.", false)
+		return
+	}
+
+	// The transfer may have been aborted by an error packet while this block waited for the lock.
+
+	if rt.Aborted() {
 		return
 	}
 
 	// Let the sendAck routine know that the last ack is acknowledged.
 
-	rt.ReceivedBlockNum <- p.BlockNum
+	select {
+	case rt.ReceivedBlockNum <- p.BlockNum:
+	case <-rt.Abort:
+		return
+	}
 
 	// Wait for previous sendAck routine to exit.
 
 	select {
 	case <-rt.PrevAckReceived:
+	case <-rt.Abort:
+		return
+	}
+
+	// An upload to the object store may have to wait for the store to take the part before. Wait before acking,
+	// without the lock held.
+
+	if sink, ok := rt.Sink.(storeSink); ok == true {
+		if waitForStore(rt, sink.Room(len(p.Data), last)) == false {
+			return
+		}
 	}
 
-	// If this is the final transfer packet, and it is empty, ack, delete the RequestTracker entry and return.
-	// OK to delete here before the deferred fn to unlock runs - memory will not be garbage collected until
-	// the last ref is released. The rt var takes a ref.
+	// If this is the final transfer packet, and it is empty, ack, retire the RequestTracker entry and return.
 
 	if len(p.Data) == 0 {
-		sendAck(pc, addr, p.BlockNum, last, rt)
-		delete(writeAddrMap, addr.String())
-		debugLog.Printf("Handle Data Packet Exit: %+v \n  %+v \n  %+v \n", fileCacheMap, readAddrMap, writeAddrMap)
+		rt.BlockNum = p.BlockNum
+		commitUpload(pc, addr, rt)
+		debugLog.Printf("Handle Data Packet Exit: %d \n", p.BlockNum)
 		return
 	}
 
@@ -227,40 +404,30 @@ func handleData(pc net.PacketConn, addr net.Addr, p tftp.PacketData) {
 		go sendAck(pc, addr, p.BlockNum, last, rt)
 	}
 
-	// Write the next block of data to the in-memory file.
-
-	var newBlock bytes.Buffer
-	newBlock.Write(p.Data)
+	// Append the next block of data to the in-memory file, or the upload to the object store.
 
-	// TODO Next code block causes memory to hold two copies of the file data ...
-	// TODO instead, use the block number to multiply by DataBlockSize and find the correct position, maybe slice
-	// TODO functions...
-
-	var fileData []string
-	fileData = append(fileData, fileCacheMap[rt.PacketReq.Filename])	// Current data
-	fileData = append(fileData, newBlock.String())						// New block
+	if err := rt.Sink.WriteBlock(p.Data); err != nil {
+		failUpload(pc, addr, rt, err, "Object store write failed.")
+		return
+	}
 
-	fileCacheMap[rt.PacketReq.Filename] = strings.Join(fileData, "")
+	rt.Hash.Write(p.Data)
 
 	// Update the meta data with the last block written and timestamp.
 
 	rt.BlockNum = p.BlockNum
-	rt.LastTranferTime = time.Now()
+	rt.LastTranferTime = rt.Clock.Now()
 
-	// If this is the final transfer packet, ack and delete the RequestTracker entry
-	// OK to delete here before the deferred fn to unlock runs - see above.
+	// If this is the final transfer packet, publish the file, ack and retire the RequestTracker entry.
 
 	if last {
-		sendAck(pc, addr, p.BlockNum, last, rt)
-		delete(writeAddrMap, addr.String())
+		commitUpload(pc, addr, rt)
 	}
 
-	// TODO If the transfer for some reason stops before we receive a final transfer packet, then the file is
-	// TODO partially written. Added LastTransferTime to the RequestTracker. At some point
-	// TODO these should be cleaned up... and this case should not block a second transfer of the same file.
-	// TODO See items #2 and #7 in the spec...
+	// If the transfer stops before we receive a final transfer packet, the staged file is discarded - see
+	// handleError and the sendAck timeout.
 
-	debugLog.Printf("Handle Data Packet Exit: %+v \n  %+v \n  %+v \n", fileCacheMap, readAddrMap, writeAddrMap)
+	debugLog.Printf("Handle Data Packet Exit: %d \n", p.BlockNum)
 }
 
 func handleAck(pc net.PacketConn, addr net.Addr, p tftp.PacketAck) {
@@ -269,24 +436,21 @@ func handleAck(pc net.PacketConn, addr net.Addr, p tftp.PacketAck) {
 
 	// Client is ack'ing an error packet.
 
-	debugLog.Printf("Take Error Map Lock \n")
-
-	errorMapChanges.Lock()
-	defer deferredErrorMapUnlock()
-
-	if _, ok := errorAddrMap[addr.String()]; ok == true {
-		delete(errorAddrMap, addr.String())
+	if errorAcked(addr) {
 		return
 	}
 
 	// Client is ack'ing a data packet.
 
-	if _, ok := readAddrMap[addr.String()]; ok == false {
-		sendError(pc, addr, 5, "Unknown transfer ID.", false)
+	rt, ok := lookupTracker(readAddrMap, addr)
+	if ok == false {
+		sendError(pc, addr, tftp.ErrCodeUnknownTID, "Unknown transfer ID.", false)
 		return
 	}
 
-	readAddrMap[addr.String()].Acked <- true
+	// Pass the block number along - sendData only accepts an ack for the block in flight.
+
+	rt.PostAck(p.BlockNum)
 
 	debugLog.Printf("Handle Ack Packet Exit: %d \n", p.BlockNum)
 }
@@ -295,7 +459,37 @@ func handleError(pc net.PacketConn, addr net.Addr, p tftp.PacketError) {
 
 	debugLog.Printf("Handle Error Packet: %d   %s \n", p.Code, p.Msg)
 
-	// See items #2 #7 in the spec.
+	// Spec: "Most errors cause termination of the connection. An error is signalled by sending an error packet.
+	//   This packet is not acknowledged, and not retransmitted" - items #2 and #7.
+	//
+	// Stop the peer's transfer now, rather than retransmitting to a client that has gone away until the transfer
+	// times out. Nothing is sent back.
+
+	debugLog.Printf("Take Metadata Lock \n")
+
+	lockMetadataChanges.Lock()
+	defer deferredMetadataUnlock()
+
+	found := false
+
+	if rt, ok := readAddrMap[addr.String()]; ok == true {
+		found = true
+		deleteTracker(readAddrMap, addr, rt)
+		rt.AbortTransfer()
+		requestLog.Printf("Read aborted by client %s %s: error %d %q \n", addr, rt.PacketReq.Filename, p.Code, p.Msg)
+	}
+
+	if rt, ok := writeAddrMap[addr.String()]; ok == true {
+		found = true
+		deleteTracker(writeAddrMap, addr, rt)
+		rt.AbortTransfer()
+		discardUpload(rt)
+		requestLog.Printf("Write aborted by client %s %s: error %d %q \n", addr, rt.PacketReq.Filename, p.Code, p.Msg)
+	}
+
+	if found == false {
+		requestLog.Printf("Error from %s, no transfer in progress: error %d %q \n", addr, p.Code, p.Msg)
+	}
 }
 
 func sendAck(pc net.PacketConn, addr net.Addr, blockNum uint16, last bool, rt *RequestTracker) {
@@ -307,12 +501,15 @@ func sendAck(pc net.PacketConn, addr net.Addr, blockNum uint16, last bool, rt *R
 	var ackPacket tftp.PacketAck
 	ackPacket.BlockNum = blockNum
 
-	b := make([]byte, 1024)
-	b = ackPacket.Serialize()
+	// Serialize into the transfer's send buffer. Only one sendAck runs at a time for a transfer - handleData
+	// waits for the previous sendAck to exit before starting the next.
+
+	rt.SendBuf = ackPacket.AppendSerialize(rt.SendBuf[:0])
+	b := rt.SendBuf
 
 	// Special case the last packet. Our signal that an ack is received, is that the next data packet is sent.
 	// For the last packet, handle as per the spec item #6. OK to send one ack, or, ack again if the last packet
-	// is received again. Doing the former for this code exercise.
+	// is received again. Doing the latter - handleData acks a resent final block, see finishUpload.
 
 	if last {
 		pc.WriteTo(b, addr)
@@ -320,23 +517,26 @@ func sendAck(pc net.PacketConn, addr net.Addr, blockNum uint16, last bool, rt *R
 		return
 	}
 
-	// Start the timeout fn.
+	// Start the timeout timer.
 
-	//rt := writeAddrMap[addr.String()]
+	timeoutTimer := rt.TimeoutTimer()
+	defer timeoutTimer.Stop()
 
-	go rt.TimeoutTimer()
+	retransmitted := false
 
 	// Send the ack packet - loop to do retries.
 
 	for {
 
+		sent := rt.Clock.Now()
+
 		pc.WriteTo(b, addr)
 
 		debugLog.Printf("Ack Packet data: %+v \n", b)
 
-		go rt.RetryTimer()
+		retryTimer := rt.RetryTimer()
 
-		// Wait for the next data packet. If we get no data packet within 'retry' seconds, resend.
+		// Wait for the next data packet. If we get no data packet within the retransmission timeout, resend.
 		// We will not retransmit forever - if there is no data packet received, we must timeout.
 
 		received := false
@@ -347,30 +547,50 @@ func sendAck(pc net.PacketConn, addr net.Addr, blockNum uint16, last bool, rt *R
 		case  rcb := <-rt.ReceivedBlockNum:
 			if rcb == (blockNum + 1) {
 				received = true
-				rt.PrevAckReceived <- true
 			} else {
 				failure = true
 			}
-		case <- rt.Retry:
+		case <- retryTimer.C():
+			rt.Rtt.Backoff()
+			retransmitted = true
 			continue
-		case <- rt.Timeout:
+		case <- timeoutTimer.C():
 			timeout = true
+		case <- rt.Abort:
+			retryTimer.Stop()
+			debugLog.Printf("Send Ack Packet Aborted: %d \n", blockNum)
+			return
 		}
 
+		retryTimer.Stop()
+
 		if received {
+
+			// The next data block doubles as the ack for our ack - time the exchange, unless the ack was
+			// retransmitted (Karn's algorithm).
+
+			if retransmitted == false {
+				rt.Rtt.Sample(rt.Clock.Since(sent))
+			}
+
+			// Let handleData go on to ack the next block. Only then - the next sendAck shares the RTT estimator.
+
+			rt.PrevAckReceived <- true
+
 			debugLog.Printf("Ack received for block %d \n", blockNum)
 			break
 		}
 
 		if timeout {
-			delete(writeAddrMap, addr.String())
-			sendError(pc, addr, 0, "Timeout", false)
+			abortUpload(addr, rt)
+			sendError(pc, addr, tftp.ErrCodeNotDefined, "Timeout", false)
+			requestLog.Printf("Write timed out %s %s: %s \n", addr, rt.PacketReq.Filename, &rt.Rtt)
 			debugLog.Printf("Send Ack Packet Timeout: %d \n", blockNum)
 			break
 		}
 
 		if failure {
-			debugLog.Printf("Ack - unexpected block %d: %d \n", blockNum)
+			debugLog.Printf("Ack - unexpected block %d \n", blockNum)
 			break
 		}
 	}
@@ -378,7 +598,7 @@ func sendAck(pc net.PacketConn, addr net.Addr, blockNum uint16, last bool, rt *R
 	debugLog.Printf("Send Ack Packet Exit: %d \n", blockNum)
 }
 
-func sendError(pc net.PacketConn, addr net.Addr, code uint16, msg string, ackExpected bool) {
+func sendError(pc net.PacketConn, addr net.Addr, code tftp.ErrorCode, msg string, ackExpected bool) {
 
 	debugLog.Printf("Send Error Packet: %+v  %d  %s \n", addr, code, msg)
 
@@ -391,37 +611,29 @@ func sendError(pc net.PacketConn, addr net.Addr, code uint16, msg string, ackExp
 		errorMapChanges.Lock()
 		defer deferredErrorMapUnlock()
 
-		errorAddrMap[addr.String()] = time.Now()
+		errorAddrMap[addr.String()] = clk.Now()
 	}
 
 	// Construct an error packet and send it to the client
 
-	var errorPacket tftp.PacketError
-	errorPacket.Code = code
-	errorPacket.Msg = msg
+	errorPacket := tftp.Error{Code: code, Msg: msg}
 
-	b := make([]byte, 1024)
-	b = errorPacket.Serialize()
+	b := errorPacket.Packet().Serialize()
 
 	pc.WriteTo(b, addr)
 
 	debugLog.Printf("Send Error Packet Exit: %d   %s \n", code, msg)
 }
 
-func sendData(pc net.PacketConn, addr net.Addr, p tftp.PacketRequest) {
+func sendData(pc net.PacketConn, addr net.Addr, p tftp.PacketRequest, rt *RequestTracker) {
 
 	debugLog.Printf("Send Data Packet: %+v \n", p)
 
-	// Lookup the file in our cache.
+	// The file was looked up by handleRead. A cached file is immutable once committed - blocks are served as
+	// slices of the cached data, nothing is copied. A file fetched from upstream may make us wait for a block.
 	// TODO Not yet handling deletes, so if we get here, we know the file exists.
 
-	data := fileCacheMap[p.Filename]
-
-	// The return value n is the length of the buffer; err is always nil.
-	// TODO If the buffer (the file) becomes too large, Write will panic with ErrTooLarge.
-
-	var dataBuffer bytes.Buffer
-	n, _ := dataBuffer.WriteString(data)
+	src := rt.Source
 
 	// Loop sending data packets until all file data has been sent.
 	// Ensure that a final zero size packet is sent if needed.
@@ -433,87 +645,165 @@ func sendData(pc net.PacketConn, addr net.Addr, p tftp.PacketRequest) {
 	//   last packet (which may be data or an acknowledgment), thus causing
 	//   the sender of the lost packet to retransmit that lost packet."
 
-	blockCount := (n / dataBlockSize) + 1
-	lastBlockSize := (n % dataBlockSize)
-
-	for i := 0;  i < blockCount; i++ {
-
-		// Get the next block.
-
-		start := i * dataBlockSize
-		var end int
-
-		if 	i == (blockCount - 1) {
-			end = start + lastBlockSize
-		} else {
-			end = (i + 1) * dataBlockSize
+	timeout := false
+	aborted := false
+	var failed error
+
+	// RFC 2349: a client that asks for tsize is told the file's size in an OACK before the first block, and acks
+	// it as block 0. The size is known for cached and generated files, which are rendered in full before the read
+	// starts, and for most fetches from upstream - if it is not, there is no OACK.
+	// No other option is supported, so none is acknowledged, see RFC 2347.
+
+	first := 0
+	size := 0
+	if _, ok := p.Options["tsize"]; ok == true {
+		known := false
+		size, known, failed = src.TransferSize(rt.Abort)
+		if known == true {
+			first = -1
 		}
+	}
 
-		newBlock := dataBuffer.Bytes()[start:end]
+	last := false
+
+	for i := first; failed == nil && last == false; i++ {
 
 		// Construct a data packet.
 
 		var dp tftp.PacketData
 		dp.BlockNum = uint16(i + 1)				// TODO downcast is a bad idea...not production ready
-		dp.Data = newBlock
 
-		b := make([]byte, 1024)
-		b = dp.Serialize()
+		// Serialize into the transfer's send buffer, which is reused for every block.
 
-		// Set the block number, set BlockAcked to false and start the timeout fn.
+		if i < 0 {
+			oack := tftp.PacketOAck{Options: map[string]string{"tsize": strconv.Itoa(size)}}
+			rt.SendBuf = oack.AppendSerialize(rt.SendBuf[:0])
+		} else {
+			var block []byte
+			block, last, failed = src.ReadBlock(i, dataBlockSize, rt.Abort)
+			if failed != nil {
+				break
+			}
+			dp.Data = block
+			rt.SendBuf = dp.AppendSerialize(rt.SendBuf[:0])
+		}
+		b := rt.SendBuf
 
-		rt := readAddrMap[addr.String()]
+		// Set the block number, set BlockAcked to false and start the timeout timer.
 
 		rt.BlockNum = dp.BlockNum
 		rt.BlockAcked = false
-		timeout := false
+		timeout = false
+		retransmitted := false
 
-		go rt.TimeoutTimer()
+		timeoutTimer := rt.TimeoutTimer()
 
 		// Send the data packet - loop to do retries.
 
 		for {
 
+			sent := rt.Clock.Now()
+
 			pc.WriteTo(b, addr)
 
-			debugLog.Printf("Data for get: %+v \n", b)
+			debugLog.Printf("Data for get: block %d, %d bytes \n", dp.BlockNum, len(dp.Data))
 
-			go rt.RetryTimer()
+			retryTimer := rt.RetryTimer()
 
-			// Wait for the ack. If we get no ack within 'retry' seconds, resend.
+			// Wait for the ack. If we get no ack within the retransmission timeout, resend.
 			// We will not retransmit forever - if there is no ack, we must timeout.
+			//
+			// Only an ack for the block in flight counts. A duplicate or delayed ack for an earlier block is
+			// dropped, and does not trigger a retransmit either - only the retry timer does. Answering each
+			// duplicate ack with a resend is the Sorcerer's Apprentice bug (RFC 1123 section 4.2.3.1): every
+			// block after the duplicate would be sent twice, and acked twice, for the rest of the transfer.
+
+			resend := false
+
+			for rt.BlockAcked == false && resend == false && timeout == false && aborted == false {
+				select {
+				case ackNum := <- rt.Acked:
+					if ackNum == dp.BlockNum {
+						rt.BlockAcked = true
+					} else {
+						debugLog.Printf("Ignoring ack for block %d, waiting for block %d \n", ackNum, dp.BlockNum)
+					}
+				case <- retryTimer.C():
+					rt.Rtt.Backoff()
+					retransmitted = true
+					resend = true
+				case <- timeoutTimer.C():
+					timeout = true
+				case <- rt.Abort:
+					aborted = true
+				}
+			}
 
-			select {
-			case <- rt.Acked:
-				rt.BlockAcked = true
-			case <- rt.Retry:
+			if aborted {
+				break
+			}
+
+			retryTimer.Stop()
+
+			if resend {
 				continue
-			case <- rt.Timeout:
-				timeout = true
 			}
 
 			if rt.BlockAcked {
+
+				// Karn's algorithm - an ack for a retransmitted block may answer either copy, so only time
+				// blocks that were sent once.
+
+				if retransmitted == false {
+					rt.Rtt.Sample(rt.Clock.Since(sent))
+				}
 				break
 			}
 
 			if timeout {
-				sendError(pc, addr, 0, "Timeout", true)
+				sendError(pc, addr, tftp.ErrCodeNotDefined, "Timeout", true)
 				break
 			}
 		}
-		if timeout {
+
+		timeoutTimer.Stop()
+
+		if timeout || aborted {
 			break
 		}
 	}
 
-	// TODO Should not need to check for the entry, since we only allow one read, per client, for a given file,
-	// TODO at a time.
+	// The file could not be read - the fetch from upstream or the object store failed. The client is told why,
+	// as far as it can act on it.
 
-	if _, ok := readAddrMap[addr.String()]; ok == true {
-		delete(readAddrMap, addr.String())
+	if failed == errAborted {
+		aborted = true
+	} else if failed != nil {
+		msg := "Upstream fetch failed."
+		if _, ok := src.(*upstreamFetch); ok == false {
+			msg = "Object store read failed."
+		}
+		e := storeError(failed, msg)
+		requestLog.Printf("Read failed %s %s: %s \n", addr, p.Filename, failed)
+		sendError(pc, addr, e.Code, e.Msg, true)
+	}
+
+	// Record the transfer's RTT stats in the request log. handleError logs aborted transfers.
+
+	if aborted {
+		debugLog.Printf("Send Data Packet Aborted: %+v \n", p)
+		return
+	} else if timeout {
+		requestLog.Printf("Read timed out %s %s: %s \n", addr, p.Filename, &rt.Rtt)
+	} else if failed == nil && rt.File != nil {
+		requestLog.Printf("Read complete %s %s: %d blocks, %s, %s \n", addr, p.Filename, rt.BlockNum, &rt.Rtt, rt.File.Checksums())
+	} else if failed == nil {
+		requestLog.Printf("Read complete %s %s: %d blocks, %s \n", addr, p.Filename, rt.BlockNum, &rt.Rtt)
 	}
 
-	debugLog.Printf("Send Data Packet Exit: %+v \n  %+v \n  %+v \n", fileCacheMap, readAddrMap, writeAddrMap)
+	removeTracker(readAddrMap, addr, rt)
+
+	debugLog.Printf("Send Data Packet Exit: %+v \n", p)
 }
 
 func deferredMetadataUnlock() {
@@ -530,21 +820,215 @@ func deferredErrorMapUnlock() {
 	debugLog.Printf("Released Error Map Lock \n")
 }
 
-func createTrackingEntry(p tftp.PacketRequest) *RequestTracker {
+func createTrackingEntry(p tftp.PacketRequest, f *CacheFile) *RequestTracker {
 
 	rt := new(RequestTracker)
 	rt.PacketReq = p
+	rt.File = f
+	rt.SendBuf = make([]byte, 0, 4 + dataBlockSize)
 	rt.BlockNum = 0
-	rt.LastTranferTime = time.Now()
-	rt.Acked = make(chan bool, 1)
-	rt.Retry = make(chan bool, 1)
-	rt.Timeout = make(chan bool, 1)
+	rt.Clock = clk
+	rt.LastTranferTime = rt.Clock.Now()
+	rt.Acked = make(chan uint16, 1)
 	rt.ReceivedBlockNum = make(chan uint16, 1)
 	rt.PrevAckReceived = make(chan bool, 1)
+	rt.Abort = make(chan bool)
 	rt.BlockAcked = false
 	return rt
 }
 
+// Looks up the tracker for a client in the read or write map. Takes lockMetadataChanges.
+
+func lookupTracker(m map[string]*RequestTracker, addr net.Addr) (*RequestTracker, bool) {
+
+	debugLog.Printf("Take Metadata Lock \n")
+
+	lockMetadataChanges.Lock()
+	defer deferredMetadataUnlock()
+
+	rt, ok := m[addr.String()]
+	return rt, ok
+}
+
+// As deleteTracker, but takes lockMetadataChanges.
+
+func removeTracker(m map[string]*RequestTracker, addr net.Addr, rt *RequestTracker) {
+
+	debugLog.Printf("Take Metadata Lock \n")
+
+	lockMetadataChanges.Lock()
+	defer deferredMetadataUnlock()
+
+	deleteTracker(m, addr, rt)
+}
+
+// Removes a transfer's tracker from the read or write map. A client may start a new transfer as soon as the
+// old one is aborted, so only delete the entry if it still belongs to rt. The caller must hold lockMetadataChanges.
+
+func deleteTracker(m map[string]*RequestTracker, addr net.Addr, rt *RequestTracker) {
+
+	if cur, ok := m[addr.String()]; ok == true && cur == rt {
+		delete(m, addr.String())
+	}
+}
+
+// Consumes the client's ack for an error packet we sent, if we are waiting for one. Takes errorMapChanges.
+
+func errorAcked(addr net.Addr) bool {
+
+	debugLog.Printf("Take Error Map Lock \n")
+
+	errorMapChanges.Lock()
+	defer deferredErrorMapUnlock()
+
+	if _, ok := errorAddrMap[addr.String()]; ok == true {
+		delete(errorAddrMap, addr.String())
+		return true
+	}
+	return false
+}
+
+// Marks an upload complete. The tracker stays in the write map for DallyInterval, so a final block the client
+// resends, because our final ack was lost, is acked again rather than answered with "Unknown transfer ID".
+// The caller must hold rt.Mux.
 
+func finishUpload(addr net.Addr, rt *RequestTracker) {
 
+	rt.LastBlockWritten.Store(true)
 
+	rt.Clock.AfterFunc(time.Second * DallyInterval, func() {
+		lockMetadataChanges.Lock()
+		defer deferredMetadataUnlock()
+
+		deleteTracker(writeAddrMap, addr, rt)
+		promoteVersion(rt.PacketReq.Filename)
+	})
+}
+
+// Publishes an upload once its final block is written, acks the block and retires the tracker. If the store
+// will not take the file, the client is told why instead. The caller must hold rt.Mux.
+
+func commitUpload(pc net.PacketConn, addr net.Addr, rt *RequestTracker) {
+
+	// Refuse an upload that is not what it was expected to be, or whose sidecar is invalid - see Checksum.go.
+
+	sums := rt.Hash.Sums()
+	err := rt.ExpectedErr
+	if err == nil {
+		err = verifyChecksum(rt.PacketReq.Filename, sums, rt.ExpectedSHA256)
+	}
+	if err != nil {
+		failUpload(pc, addr, rt, err, err.Error())
+		return
+	}
+
+	// Readers do not look at the file until Finish commits it.
+
+	if rt.File != nil {
+		rt.File.checksums = sums
+	}
+
+	if sink, ok := rt.Sink.(storeSink); ok == true {
+		if waitForStore(rt, sink.Flush()) == false {
+			return
+		}
+	}
+
+	if err := rt.Sink.Finish(); err != nil {
+		failUpload(pc, addr, rt, err, "Object store write failed.")
+		return
+	}
+
+	sendAck(pc, addr, rt.BlockNum, true, rt)
+	finishUpload(addr, rt)
+	requestLog.Printf("Write complete %s %s: %d blocks, %s, %s \n", addr, rt.PacketReq.Filename, rt.BlockNum, &rt.Rtt, sums)
+}
+
+// Waits for ready with rt.Mux released, so a slow store does not hold the lock, and every block the client
+// resends meanwhile does not queue behind it. The caller holds rt.Mux, and has not acked the block: handleData
+// drops the client's resends while rt.Storing is set, and the block is acked once the store is ready.
+//
+// No sendAck runs during the wait, so its timeout does not end the transfer, and the reaper only sweeps the error
+// map, so neither does it. The wait is bounded by objectStoreTimeout, after which the store fails the upload, or by
+// the client sending an ERROR, which aborts the transfer. A client that gives up silently is caught by the timeout
+// of the sendAck that follows. LastTranferTime is refreshed once the store is ready, so the wait does not count as
+// idle time. Returns false if the transfer was aborted meanwhile.
+
+func waitForStore(rt *RequestTracker, ready <-chan struct{}) bool {
+
+	if ready == nil {
+		return true
+	}
+
+	rt.Storing = true
+	rt.Mux.Unlock()
+
+	select {
+	case <-ready:
+	case <-rt.Abort:
+	}
+
+	rt.Mux.Lock()
+	rt.Storing = false
+	rt.LastTranferTime = rt.Clock.Now()
+
+	return rt.Aborted() == false
+}
+
+// Ends an upload the store failed, and tells the client why - as msg, unless err is one the client can act on,
+// see storeError. The caller holds rt.Mux, so the tracker is removed from the write map after it is released -
+// see the lock order in the README. Blocks that arrive in between find the transfer aborted.
+
+func failUpload(pc net.PacketConn, addr net.Addr, rt *RequestTracker, err error, msg string) {
+
+	rt.AbortTransfer()
+
+	e := storeError(err, msg)
+	requestLog.Printf("Write failed %s %s: %s \n", addr, rt.PacketReq.Filename, err)
+	sendError(pc, addr, e.Code, e.Msg, false)
+
+	go abortUpload(addr, rt)
+}
+
+// Returns the ERROR for a transfer the upstream origin or the object store failed with err. An error a client can
+// act on - a missing file, say - keeps its code and fixed message. Anything else is sent as msg: the error's own
+// text can name the origin or endpoint URL, and run past what fits in a packet. The request log has it.
+
+func storeError(err error, msg string) *tftp.Error {
+
+	e := tftp.ErrorFor(err)
+	if e.Code == tftp.ErrCodeNotDefined {
+		e = &tftp.Error{Code: tftp.ErrCodeNotDefined, Msg: msg}
+	}
+	return e
+}
+
+// Drops the staged data of an upload that did not complete, so the name is free for the next upload.
+// The caller must hold lockMetadataChanges.
+
+func discardUpload(rt *RequestTracker) {
+
+	if f, ok := fileCacheMap[rt.PacketReq.Filename]; ok == true && f == rt.File && f.Committed() == false {
+		delete(fileCacheMap, rt.PacketReq.Filename)
+	}
+	discardVersion(rt.PacketReq.Filename, rt.File)
+
+	if rt.Sink != nil {
+		rt.Sink.Discard()
+	}
+}
+
+// Ends an upload that failed - removes the tracker, stops any goroutine waiting on it, and discards the
+// staged data.
+
+func abortUpload(addr net.Addr, rt *RequestTracker) {
+
+	debugLog.Printf("Take Metadata Lock \n")
+
+	lockMetadataChanges.Lock()
+	defer deferredMetadataUnlock()
+
+	deleteTracker(writeAddrMap, addr, rt)
+	rt.AbortTransfer()
+	discardUpload(rt)
+}
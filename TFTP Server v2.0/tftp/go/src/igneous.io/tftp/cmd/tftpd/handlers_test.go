@@ -0,0 +1,313 @@
+package main
+
+import (
+	"../../../tftp"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	requestLog = log.New(io.Discard, "", 0)
+	debugLog = log.New(io.Discard, "", 0)
+
+	// The tests run on loopback, where the delay is steady - with the RFC's 1 second floor, every packet a test
+	// drops would take a second to resend.
+
+	MinRetryInterval = 20 * time.Millisecond
+
+	os.Exit(m.Run())
+}
+
+// A net.PacketConn that hands every packet written to a channel, so a test can play the client by calling the
+// handlers directly.
+
+type recordingConn struct {
+	written chan []byte
+}
+
+func newRecordingConn() *recordingConn {
+	return &recordingConn{written: make(chan []byte, 1024)}
+}
+
+func (c *recordingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.written <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (c *recordingConn) ReadFrom(b []byte) (int, net.Addr, error) { select {} }
+func (c *recordingConn) Close() error                               { return nil }
+func (c *recordingConn) LocalAddr() net.Addr                        { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 69} }
+func (c *recordingConn) SetDeadline(t time.Time) error              { return nil }
+func (c *recordingConn) SetReadDeadline(t time.Time) error          { return nil }
+func (c *recordingConn) SetWriteDeadline(t time.Time) error         { return nil }
+
+// Returns the next packet written, or nil if nothing is written within the wait.
+
+func (c *recordingConn) next(wait time.Duration) tftp.Packet {
+	select {
+	case b := <-c.written:
+		p, err := tftp.ParsePacket(b)
+		if err != nil {
+			return nil
+		}
+		return p
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// Returns a client address not used by any other test, so trackers left behind by one test can't collide
+// with the next.
+
+var lastTestPort int32 = 30000
+
+func nextTestAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(atomic.AddInt32(&lastTestPort, 1))}
+}
+
+// Formats a packet for test failures without dumping DATA payloads.
+
+func describe(p tftp.Packet) string {
+	switch p := p.(type) {
+	case *tftp.PacketData:
+		return fmt.Sprintf("DATA %d (%d bytes)", p.BlockNum, len(p.Data))
+	case *tftp.PacketAck:
+		return fmt.Sprintf("ACK %d", p.BlockNum)
+	case *tftp.PacketError:
+		return fmt.Sprintf("ERROR %d %q", p.Code, p.Msg)
+	}
+	return fmt.Sprintf("%#v", p)
+}
+
+// Returns a committed file holding data, appended a block at a time as an upload is. It is not in the cache.
+
+func uploadFile(data []byte) *CacheFile {
+	f := new(CacheFile)
+	for rest := data; len(rest) > 0; rest = rest[min(dataBlockSize, len(rest)):] {
+		f.Append(rest[:min(dataBlockSize, len(rest))])
+	}
+	f.Commit()
+	return f
+}
+
+func addCommittedFile(name string, size int) {
+	f := uploadFile(make([]byte, size))
+
+	lockMetadataChanges.Lock()
+	fileCacheMap[name] = f
+	lockMetadataChanges.Unlock()
+}
+
+// Sorcerer's Apprentice regression: while each block is in flight the client repeats its previous ack, as a
+// delayed duplicate would. The duplicate must not advance the sender, or be answered with a resend - the only
+// extra copies of a block allowed are the ones the retry timer sends.
+
+func TestReadIgnoresDuplicateAcks(t *testing.T) {
+	const blocks = 8
+	addCommittedFile("sas.bin", (blocks-1)*dataBlockSize+100)
+
+	pc := newRecordingConn()
+	addr := nextTestAddr()
+
+	handleRead(pc, addr, tftp.PacketRequest{Op: tftp.OpRRQ, Filename: "sas.bin", Mode: "octet"})
+
+	sent := make(map[uint16]int)
+	var acked uint16
+
+	for acked < blocks {
+		p := pc.next(5 * time.Second)
+		dp, ok := p.(*tftp.PacketData)
+		if ok == false || dp.BlockNum != acked+1 {
+			t.Fatalf("After ack %d: expected DATA %d; got %s", acked, acked+1, describe(p))
+		}
+		sent[dp.BlockNum]++
+
+		// Duplicate the previous ack, and watch for the server to move on without the real one.
+
+		handleAck(pc, addr, tftp.PacketAck{BlockNum: acked})
+
+		for p := pc.next(30 * time.Millisecond); p != nil; p = pc.next(30 * time.Millisecond) {
+			if retransmit, ok := p.(*tftp.PacketData); ok == false || retransmit.BlockNum != dp.BlockNum {
+				t.Fatalf("Duplicate ack %d while block %d in flight: server sent %s", acked, dp.BlockNum, describe(p))
+			}
+			sent[dp.BlockNum]++
+		}
+
+		acked = dp.BlockNum
+		handleAck(pc, addr, tftp.PacketAck{BlockNum: acked})
+	}
+
+	// A timer retransmit may race the real ack, but a block sent more than twice means acks are being
+	// answered with resends.
+
+	for block, count := range sent {
+		if count > 2 {
+			t.Errorf("Block %d sent %d times", block, count)
+		}
+	}
+}
+
+// A bytes.Buffer safe for the request log to write while a test reads it.
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Sends the request log to a buffer for the rest of the test.
+
+func captureRequestLog(t *testing.T) *syncBuffer {
+	b := new(syncBuffer)
+	requestLog.SetOutput(b)
+	t.Cleanup(func() { requestLog.SetOutput(io.Discard) })
+	return b
+}
+
+func hasTracker(m map[string]*RequestTracker, addr net.Addr) bool {
+	lockMetadataChanges.Lock()
+	defer lockMetadataChanges.Unlock()
+	_, ok := m[addr.String()]
+	return ok
+}
+
+func TestErrorAbortsRead(t *testing.T) {
+	addCommittedFile("abort-read.bin", 10*dataBlockSize)
+	logged := captureRequestLog(t)
+
+	pc := newRecordingConn()
+	addr := nextTestAddr()
+	req := tftp.PacketRequest{Op: tftp.OpRRQ, Filename: "abort-read.bin", Mode: "octet"}
+
+	handleRead(pc, addr, req)
+
+	// Ack the first block promptly, so the retransmission timeout drops to its minimum.
+
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketData); ok == false || p.BlockNum != 1 {
+		t.Fatalf("Expected DATA 1; got %s", describe(p))
+	}
+	handleAck(pc, addr, tftp.PacketAck{BlockNum: 1})
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketData); ok == false || p.BlockNum != 2 {
+		t.Fatalf("Expected DATA 2; got %s", describe(p))
+	}
+
+	handleError(pc, addr, tftp.PacketError{Code: 0, Msg: "user cancelled"})
+
+	if hasTracker(readAddrMap, addr) {
+		t.Errorf("Read tracker still present after ERROR")
+	}
+
+	// Nothing is sent in reply to the error, and block 2 is not retransmitted.
+
+	if p := pc.next(10 * MinRetryInterval); p != nil {
+		t.Errorf("After ERROR: unexpected packet %s", describe(p))
+	}
+
+	if !strings.Contains(logged.String(), `error 0 "user cancelled"`) {
+		t.Errorf("Request log does not record the client's error: %q", logged.String())
+	}
+
+	// The client may start again straight away.
+
+	handleRead(pc, addr, req)
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketData); ok == false || p.BlockNum != 1 {
+		t.Fatalf("Read after abort: expected DATA 1; got %s", describe(p))
+	}
+	handleError(pc, addr, tftp.PacketError{Code: 0, Msg: "done"})
+}
+
+func TestErrorAbortsWrite(t *testing.T) {
+	logged := captureRequestLog(t)
+
+	pc := newRecordingConn()
+	addr := nextTestAddr()
+	req := tftp.PacketRequest{Op: tftp.OpWRQ, Filename: "abort-write.bin", Mode: "octet"}
+
+	handleWrite(pc, addr, req)
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 0 {
+		t.Fatalf("Expected ACK 0; got %s", describe(p))
+	}
+
+	buf := getPacketBuffer()
+	handleData(pc, addr, tftp.PacketData{BlockNum: 1, Data: (*buf)[:dataBlockSize]}, buf)
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 1 {
+		t.Fatalf("Expected ACK 1; got %s", describe(p))
+	}
+
+	handleError(pc, addr, tftp.PacketError{Code: 3, Msg: "disk full"})
+
+	if hasTracker(writeAddrMap, addr) {
+		t.Errorf("Write tracker still present after ERROR")
+	}
+
+	lockMetadataChanges.Lock()
+	_, staged := fileCacheMap["abort-write.bin"]
+	lockMetadataChanges.Unlock()
+	if staged {
+		t.Errorf("Staged upload still in the cache after ERROR")
+	}
+
+	if p := pc.next(10 * MinRetryInterval); p != nil {
+		t.Errorf("After ERROR: unexpected packet %s", describe(p))
+	}
+
+	if !strings.Contains(logged.String(), `error 3 "disk full"`) {
+		t.Errorf("Request log does not record the client's error: %q", logged.String())
+	}
+
+	// The name is free for the next upload.
+
+	handleWrite(pc, addr, req)
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 0 {
+		t.Fatalf("Write after abort: expected ACK 0; got %s", describe(p))
+	}
+	handleError(pc, addr, tftp.PacketError{Code: 0, Msg: "done"})
+}
+
+func TestResentFinalBlockIsAckedAgain(t *testing.T) {
+	pc := newRecordingConn()
+	addr := nextTestAddr()
+	req := tftp.PacketRequest{Op: tftp.OpWRQ, Filename: "resent-final.bin", Mode: "octet"}
+
+	handleWrite(pc, addr, req)
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 0 {
+		t.Fatalf("Expected ACK 0; got %s", describe(p))
+	}
+
+	// Our final ack is lost, so the client sends the final block again.
+
+	for i := 0; i < 2; i++ {
+		buf := getPacketBuffer()
+		handleData(pc, addr, tftp.PacketData{BlockNum: 1, Data: (*buf)[:10]}, buf)
+		if p, ok := pc.next(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 1 {
+			t.Fatalf("Final block, copy %d: expected ACK 1; got %s", i+1, describe(p))
+		}
+	}
+
+	lockMetadataChanges.Lock()
+	f, ok := fileCacheMap["resent-final.bin"]
+	lockMetadataChanges.Unlock()
+	if ok == false || f.Committed() == false || f.Size() != 10 {
+		t.Errorf("Expected a committed 10 byte file; got %+v", f)
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"../../../tftp"
+	"../../client"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// End to end tests - the server listens on a loopback port, and the client package, or a test playing the client
+// packet by packet, talks to it over UDP. Run with -race, many transfers share the server's maps.
+
+// Starts the server on an ephemeral loopback port, for the rest of the test. Returns its address.
+
+func startServer(t *testing.T) string {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go listen(pc)
+
+	return pc.LocalAddr().String()
+}
+
+func newTestClient() *client.Client {
+	return &client.Client{Timeout: 500 * time.Millisecond}
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// Returns size bytes that differ from file to file, so a mixed up transfer shows. No two chunks of them are the
+// same either, so each takes its own place in the chunk store.
+
+func testData(seed, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(seed + i*7 + (i>>8)*3 + (i>>16)*5)
+	}
+	return data
+}
+
+// Returns a file name no other test uses - every test shares the server's file cache.
+
+func testFileName(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", t.Name(), nextTestAddr().Port)
+}
+
+func roundTrip(ctx context.Context, c *client.Client, addr, name string, data []byte) error {
+	if err := c.PutBytes(ctx, addr, name, data); err != nil {
+		return fmt.Errorf("Put %s: %w", name, err)
+	}
+	got, err := c.GetBytes(ctx, addr, name)
+	if err != nil {
+		return fmt.Errorf("Get %s: %w", name, err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("Get %s: %d bytes that differ from the %d written", name, len(got), len(data))
+	}
+	return nil
+}
+
+// Sizes around the block boundaries. A file that is an exact multiple of the block size ends with an empty block.
+
+func TestIntegrationSizes(t *testing.T) {
+	addr := startServer(t)
+	ctx := testContext(t)
+	c := newTestClient()
+
+	sizes := []int{0, 1, dataBlockSize - 1, dataBlockSize, dataBlockSize + 1, 2 * dataBlockSize, 100 * dataBlockSize, 100*dataBlockSize + 1}
+	for i, size := range sizes {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			if err := roundTrip(ctx, c, addr, testFileName(t), testData(i, size)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestIntegrationConcurrentReads(t *testing.T) {
+	addr := startServer(t)
+	ctx := testContext(t)
+	c := newTestClient()
+
+	name := testFileName(t)
+	data := testData(1, 40*dataBlockSize+17)
+	if err := c.PutBytes(ctx, addr, name, data); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := c.GetBytes(ctx, addr, name)
+			if err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("Get: %d bytes that differ from the %d written", len(got), len(data))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestIntegrationConcurrentWrites(t *testing.T) {
+	addr := startServer(t)
+	ctx := testContext(t)
+	c := newTestClient()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("%s-%d", testFileName(t), i)
+			if err := roundTrip(ctx, c, addr, name, testData(i, i*dataBlockSize+i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Many clients race to upload the same name. One wins, the rest are refused, and the file holds the winner's data.
+
+func TestIntegrationConcurrentWritesSameName(t *testing.T) {
+	addr := startServer(t)
+	ctx := testContext(t)
+	c := newTestClient()
+
+	name := testFileName(t)
+	const writers = 10
+
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.PutBytes(ctx, addr, name, testData(i, 10*dataBlockSize))
+		}(i)
+	}
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil && winner >= 0:
+			t.Errorf("Writers %d and %d both succeeded", winner, i)
+		case err == nil:
+			winner = i
+		case !errors.Is(err, client.ErrFileExists):
+			t.Errorf("Writer %d: expected ErrFileExists; got %v", i, err)
+		}
+	}
+	if winner < 0 {
+		t.Fatal("No writer succeeded")
+	}
+
+	got, err := c.GetBytes(ctx, addr, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, testData(winner, 10*dataBlockSize)) {
+		t.Errorf("File does not hold the data of writer %d", winner)
+	}
+}
+
+func TestIntegrationDuplicateUpload(t *testing.T) {
+	addr := startServer(t)
+	ctx := testContext(t)
+	c := newTestClient()
+
+	name := testFileName(t)
+	data := testData(1, 3*dataBlockSize)
+	if err := c.PutBytes(ctx, addr, name, data); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.PutBytes(ctx, addr, name, testData(2, 5))
+	if !errors.Is(err, client.ErrFileExists) {
+		t.Fatalf("Second upload: expected ErrFileExists; got %v", err)
+	}
+
+	got, err := c.GetBytes(ctx, addr, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Refused upload changed the file")
+	}
+}
+
+func TestIntegrationFileNotFound(t *testing.T) {
+	addr := startServer(t)
+	ctx := testContext(t)
+
+	_, err := newTestClient().GetBytes(ctx, addr, testFileName(t))
+	if !errors.Is(err, client.ErrFileNotFound) {
+		t.Fatalf("Expected ErrFileNotFound; got %v", err)
+	}
+}
+
+// A test playing the client packet by packet, over its own UDP socket.
+
+type rawClient struct {
+	t      *testing.T
+	pc     net.PacketConn
+	server net.Addr
+}
+
+func newRawClient(t *testing.T, addr string) *rawClient {
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return &rawClient{t: t, pc: pc, server: server}
+}
+
+func (c *rawClient) send(p tftp.Packet) {
+	c.t.Helper()
+	if _, err := c.pc.WriteTo(p.Serialize(), c.server); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Sends b as it is, for packets Serialize would not produce.
+
+func (c *rawClient) sendBytes(b []byte) {
+	c.t.Helper()
+	if _, err := c.pc.WriteTo(b, c.server); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Returns the next packet from the server, or nil if none arrives within the wait.
+
+func (c *rawClient) receive(wait time.Duration) tftp.Packet {
+	c.t.Helper()
+	c.pc.SetReadDeadline(time.Now().Add(wait))
+	b := make([]byte, 1024)
+	n, _, err := c.pc.ReadFrom(b)
+	if err != nil {
+		return nil
+	}
+	p, err := tftp.ParsePacket(b[:n])
+	if err != nil {
+		c.t.Fatalf("Unparseable reply: %s", err)
+	}
+	return p
+}
+
+// An upload is not visible until its final block arrives - a reader meanwhile is told the file is not found, and
+// a second upload of the name is refused.
+
+func TestIntegrationReadDuringWrite(t *testing.T) {
+	addr := startServer(t)
+	ctx := testContext(t)
+	c := newTestClient()
+
+	name := testFileName(t)
+	w := newRawClient(t, addr)
+
+	w.send(&tftp.PacketRequest{Op: tftp.OpWRQ, Filename: name, Mode: "octet"})
+	if p, ok := w.receive(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 0 {
+		t.Fatalf("Expected ACK 0; got %s", describe(p))
+	}
+
+	first := testData(1, dataBlockSize)
+	w.send(&tftp.PacketData{BlockNum: 1, Data: first})
+	if p, ok := w.receive(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 1 {
+		t.Fatalf("Expected ACK 1; got %s", describe(p))
+	}
+
+	if _, err := c.GetBytes(ctx, addr, name); !errors.Is(err, client.ErrFileNotFound) {
+		t.Errorf("Read during write: expected ErrFileNotFound; got %v", err)
+	}
+	if err := c.PutBytes(ctx, addr, name, []byte("other")); !errors.Is(err, client.ErrFileExists) {
+		t.Errorf("Write during write: expected ErrFileExists; got %v", err)
+	}
+
+	last := testData(2, 10)
+	w.send(&tftp.PacketData{BlockNum: 2, Data: last})
+	if p, ok := w.receive(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 2 {
+		t.Fatalf("Expected ACK 2; got %s", describe(p))
+	}
+
+	got, err := c.GetBytes(ctx, addr, name)
+	if err != nil {
+		t.Fatalf("Read after write: %s", err)
+	}
+	if !bytes.Equal(got, append(first, last...)) {
+		t.Errorf("Read after write: %d bytes that differ from the %d written", len(got), len(first)+len(last))
+	}
+}
+
+// A client may read from the port it just uploaded from. The finished upload's tracker, kept to ack a resent
+// final block, does not make the read "File write is in progress", and still acks the final block meanwhile.
+
+func TestIntegrationReadAfterWriteSamePort(t *testing.T) {
+	addr := startServer(t)
+
+	name := testFileName(t)
+	data := testData(3, 100)
+	c := newRawClient(t, addr)
+
+	c.send(&tftp.PacketRequest{Op: tftp.OpWRQ, Filename: name, Mode: "octet"})
+	if p, ok := c.receive(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 0 {
+		t.Fatalf("Expected ACK 0; got %s", describe(p))
+	}
+	c.send(&tftp.PacketData{BlockNum: 1, Data: data})
+	if p, ok := c.receive(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 1 {
+		t.Fatalf("Expected ACK 1; got %s", describe(p))
+	}
+
+	c.send(&tftp.PacketRequest{Op: tftp.OpRRQ, Filename: name, Mode: "octet"})
+	reply := c.receive(5 * time.Second)
+	if p, ok := reply.(*tftp.PacketData); ok == false || p.BlockNum != 1 || !bytes.Equal(p.Data, data) {
+		t.Fatalf("Read from the upload's port: expected DATA 1 with the %d bytes written; got %s", len(data), describe(reply))
+	}
+
+	// The read resends its DATA 1 until acked, so skip those.
+
+	c.send(&tftp.PacketData{BlockNum: 1, Data: data})
+	p := c.receive(5 * time.Second)
+	for _, ok := p.(*tftp.PacketData); ok == true; _, ok = p.(*tftp.PacketData) {
+		p = c.receive(5 * time.Second)
+	}
+	if ack, ok := p.(*tftp.PacketAck); ok == false || ack.BlockNum != 1 {
+		t.Errorf("Final block resent during the read: expected ACK 1; got %s", describe(p))
+	}
+	c.send(&tftp.PacketAck{BlockNum: 1})
+}
+
+// Packets for a transfer that does not exist are answered with ERROR 5, and do not disturb the server.
+
+func TestIntegrationUnknownTransfer(t *testing.T) {
+	addr := startServer(t)
+
+	c := newRawClient(t, addr)
+
+	c.send(&tftp.PacketData{BlockNum: 1, Data: []byte("stray")})
+	if p, ok := c.receive(5 * time.Second).(*tftp.PacketError); ok == false || p.Code != 5 {
+		t.Errorf("DATA with no transfer: expected ERROR 5; got %s", describe(p))
+	}
+
+	c.send(&tftp.PacketAck{BlockNum: 1})
+	if p, ok := c.receive(5 * time.Second).(*tftp.PacketError); ok == false || p.Code != 5 {
+		t.Errorf("ACK with no transfer: expected ERROR 5; got %s", describe(p))
+	}
+
+	if err := roundTrip(testContext(t), newTestClient(), addr, testFileName(t), testData(1, 700)); err != nil {
+		t.Error(err)
+	}
+}
+
+// Malformed packets are refused with ERROR 4 and logged, except a truncated ERROR, which is not answered.
+
+func TestIntegrationMalformedPackets(t *testing.T) {
+	addr := startServer(t)
+	logged := captureRequestLog(t)
+
+	c := newRawClient(t, addr)
+
+	for _, b := range [][]byte{
+		[]byte("\x00\x02\x00\x00"),
+		[]byte("\x00\x01foo\x00binary\x00"),
+		[]byte("\x00\x01foo\x00octet"),
+		[]byte("\x00\x04\x00\x01junk"),
+		append([]byte("\x00\x03\x00\x01"), testData(1, dataBlockSize+1)...),
+		[]byte("\x00\x09"),
+	} {
+		c.sendBytes(b)
+		if p, ok := c.receive(5 * time.Second).(*tftp.PacketError); ok == false || p.Code != 4 {
+			t.Errorf("%q: expected ERROR 4; got %s", b, describe(p))
+		}
+	}
+
+	c.sendBytes([]byte("\x00\x05\x00\x01no terminator"))
+	if p := c.receive(100 * time.Millisecond); p != nil {
+		t.Errorf("Truncated ERROR answered with %s", describe(p))
+	}
+
+	if got := logged.String(); strings.Count(got, "Unrecognized packet") != 7 {
+		t.Errorf("Expected 7 unrecognized packets logged; got %q", got)
+	}
+
+	if err := roundTrip(testContext(t), newTestClient(), addr, testFileName(t), testData(1, 700)); err != nil {
+		t.Error(err)
+	}
+}
+
+// A client that gives up on a download with an ERROR is sent nothing more, and the file can be read again.
+
+func TestIntegrationClientAbortsRead(t *testing.T) {
+	addr := startServer(t)
+	ctx := testContext(t)
+	c := newTestClient()
+
+	name := testFileName(t)
+	data := testData(1, 10*dataBlockSize)
+	if err := c.PutBytes(ctx, addr, name, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Any ERROR ends the transfer - one with a code no RFC defines too.
+
+	for _, code := range []uint16{0, 99} {
+		r := newRawClient(t, addr)
+		r.send(&tftp.PacketRequest{Op: tftp.OpRRQ, Filename: name, Mode: "octet"})
+		if p, ok := r.receive(5 * time.Second).(*tftp.PacketData); ok == false || p.BlockNum != 1 {
+			t.Fatalf("Expected DATA 1; got %s", describe(p))
+		}
+
+		r.send(&tftp.PacketError{Code: code, Msg: "cancelled"})
+		if p := r.receive(3 * InitialRetryInterval); p != nil {
+			t.Errorf("After ERROR %d: unexpected packet %s", code, describe(p))
+		}
+	}
+
+	got, err := c.GetBytes(ctx, addr, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Get after abort: %d bytes that differ from the %d written", len(got), len(data))
+	}
+}
+
+// A client that gives up on an upload with an ERROR leaves nothing behind - the name is free again.
+
+func TestIntegrationClientAbortsWrite(t *testing.T) {
+	addr := startServer(t)
+	ctx := testContext(t)
+	c := newTestClient()
+
+	name := testFileName(t)
+	w := newRawClient(t, addr)
+
+	w.send(&tftp.PacketRequest{Op: tftp.OpWRQ, Filename: name, Mode: "octet"})
+	if p, ok := w.receive(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 0 {
+		t.Fatalf("Expected ACK 0; got %s", describe(p))
+	}
+	w.send(&tftp.PacketData{BlockNum: 1, Data: testData(1, dataBlockSize)})
+	if p, ok := w.receive(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 1 {
+		t.Fatalf("Expected ACK 1; got %s", describe(p))
+	}
+	w.send(&tftp.PacketError{Code: 3, Msg: "disk full"})
+
+	// The server handles the ERROR in its own time - wait for the name to come free.
+
+	data := testData(2, 3*dataBlockSize)
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err = roundTrip(ctx, c, addr, name, data); errors.Is(err, client.ErrFileExists) == false {
+			break
+		}
+	}
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"../../../tftp"
+	"../../client"
+	"../../netsim"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// End to end transfers between the client package and the server, over an in-memory network that impairs the
+// datagrams in both directions. Each condition is seeded, so a failure can be replayed with the same faults.
+
+type lossyCondition struct {
+	name       string
+	conditions netsim.Conditions
+	mayFail    bool // a transfer may end with an error, but must end, and must not return the wrong data
+}
+
+var lossyConditions = []lossyCondition{
+	{"clean", netsim.Conditions{}, false},
+	{"loss", netsim.Conditions{Loss: 0.1}, false},
+	{"duplicates", netsim.Conditions{Duplicate: 0.2}, false},
+	{"reorder", netsim.Conditions{Reorder: 0.2}, false},
+	{"delay", netsim.Conditions{Delay: 2 * time.Millisecond, Jitter: 3 * time.Millisecond}, false},
+
+	// Corruption is limited to the 4 byte header (opcode and block number). UDP checksums catch most payload
+	// corruption before it reaches the application, and TFTP has no checksum of its own to catch the rest.
+	// A corrupt block number looks like a missing block, which the server treats as fatal.
+
+	{"corrupt-header", netsim.Conditions{Corrupt: 0.05, CorruptWithin: 4}, true},
+	{"everything", netsim.Conditions{Loss: 0.05, Duplicate: 0.05, Reorder: 0.05, Delay: time.Millisecond, Jitter: 2 * time.Millisecond}, false},
+}
+
+var lossyFileCount int32
+
+// Starts the server on a new in-memory network, and returns a client for it. Datagrams the server writes are
+// impaired by serverPolicy, and datagrams the client writes by clientPolicy.
+
+func newLossyServer(t *testing.T, serverPolicy, clientPolicy netsim.Policy) (*client.Client, string, []*netsim.Conn) {
+
+	network := new(netsim.Network)
+
+	pc, err := network.ListenPacket("udp", "127.0.0.1:69")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := netsim.Wrap(pc, serverPolicy)
+	t.Cleanup(func() { server.Close() })
+	go listen(server)
+
+	conns := []*netsim.Conn{server}
+
+	cl := &client.Client{
+		Timeout: 50 * time.Millisecond,
+		Retries: 40, // outlasts the server's first retransmit, InitialRetryInterval
+		ListenPacket: func() (net.PacketConn, error) {
+			pc, err := network.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				return nil, err
+			}
+			conn := netsim.Wrap(pc, clientPolicy)
+			conns = append(conns, conn)
+			return conn, nil
+		},
+	}
+
+	return cl, pc.LocalAddr().String(), conns
+}
+
+// Uploads data under a new name and reads it back. Returns the first error.
+
+func lossyRoundTrip(cl *client.Client, addr string, data []byte) error {
+
+	name := fmt.Sprintf("lossy-%d", atomic.AddInt32(&lossyFileCount, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := cl.PutBytes(ctx, addr, name, data); err != nil {
+		return fmt.Errorf("Put: %w", err)
+	}
+
+	got, err := cl.GetBytes(ctx, addr, name)
+	if err != nil {
+		return fmt.Errorf("Get: %w", err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("Get returned %d bytes that differ from the %d written", len(got), len(data))
+	}
+	return nil
+}
+
+func TestLossyTransfers(t *testing.T) {
+
+	sizes := []int{0, 511, 512, 20*dataBlockSize + 100}
+
+	for _, lc := range lossyConditions {
+		t.Run(lc.name, func(t *testing.T) {
+			const seed = 1
+			cl, addr, conns := newLossyServer(t, netsim.Random(seed, lc.conditions), netsim.Random(seed+1, lc.conditions))
+
+			for _, size := range sizes {
+				err := lossyRoundTrip(cl, addr, testData(0, size))
+				if err == nil {
+					continue
+				}
+
+				// Under corruption a transfer may fail, but only with an error from the peer - not a hang, or the
+				// wrong data.
+
+				var te *client.Error
+				if lc.mayFail && errors.As(err, &te) {
+					t.Logf("%d bytes: %s", size, err)
+					continue
+				}
+				t.Errorf("%d bytes: %s", size, err)
+			}
+
+			for _, c := range conns {
+				if s := c.Stats(); s != (netsim.Stats{Written: s.Written}) {
+					t.Logf("%v: %+v", c.LocalAddr(), s)
+				}
+			}
+		})
+	}
+}
+
+// Faults aimed at particular packets of a transfer.
+
+func TestScriptedFaults(t *testing.T) {
+
+	none := netsim.Script(func(d netsim.Datagram) netsim.Fault { return netsim.Fault{} })
+
+	// The server's first packet to each client is ack 0 for the upload, then data block 1 for the download.
+	// Each is lost once, so the client retransmits its request.
+
+	droppedData := false
+	firstReplyLost := netsim.Script(func(d netsim.Datagram) netsim.Fault {
+		if d.Seq == 0 {
+			return netsim.Fault{Drop: true}
+		}
+		if droppedData == false && isFirstData(d.Data) {
+			droppedData = true
+			return netsim.Fault{Drop: true}
+		}
+		return netsim.Fault{}
+	})
+
+	tests := []struct {
+		name           string
+		server, client netsim.Policy
+	}{
+		{"first reply lost", firstReplyLost, none},
+		{
+			"every client packet twice", none, netsim.Script(func(d netsim.Datagram) netsim.Fault {
+				return netsim.Fault{Duplicate: true}
+			}),
+		},
+		{
+			"client packets swapped in pairs", none, netsim.Script(func(d netsim.Datagram) netsim.Fault {
+				return netsim.Fault{Reorder: d.Seq%2 == 0}
+			}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cl, addr, _ := newLossyServer(t, test.server, test.client)
+			if err := lossyRoundTrip(cl, addr, testData(0, 5*dataBlockSize+1)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func isFirstData(b []byte) bool {
+
+	p, err := tftp.ParsePacket(b)
+	if err != nil {
+		return false
+	}
+	dp, ok := p.(*tftp.PacketData)
+	return ok && dp.BlockNum == 1
+}
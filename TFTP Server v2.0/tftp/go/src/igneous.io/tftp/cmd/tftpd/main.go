@@ -2,9 +2,14 @@ package main
 
 import (
 	"../../../tftp"
+	"errors"
+	"flag"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 /// http://computernetworkingsimplified.in/application-layer/tftp-works/
@@ -13,8 +18,54 @@ import (
 var requestLog *log.Logger
 var debugLog  *log.Logger
 
+var batchIO = flag.Bool("batch", false, "move many datagrams per syscall with recvmmsg/sendmmsg (Linux only)")
+
+var inventoryFile = flag.String("inventory", "", "host inventory for templates, a CSV or JSON `file` mapping IP/MAC to hostname, role and image")
+
+var rewriteRulesFile = flag.String("rewrite-rules", "", "rewrite requested file names with the rules in `file`, see Rewrite.go")
+
+var upstreamOrigin = flag.String("upstream", "", "fetch files missing from the cache from this http(s) `URL`, and cache them")
+var upstreamMaxAge = flag.Duration("upstream-max-age", 5 * time.Minute, "serve a file fetched from upstream for this long before revalidating it")
+var upstreamMaxSize = flag.String("upstream-max-size", "32MB", "largest file fetched from upstream - reads of larger files fail")
+
+var s3Bucket = flag.String("s3", "", "keep files in this S3 `bucket[/prefix]` rather than in memory - credentials from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+var s3Endpoint = flag.String("s3-endpoint", "https://s3.amazonaws.com", "the S3-compatible object store's `URL`")
+var s3Region = flag.String("s3-region", "us-east-1", "the object store's region, for request signing")
+var s3PartSize = flag.String("s3-part-size", "8MB", "size of the parts uploads are sent in, at least 5MB for S3")
+
+var snapshotPath = flag.String("snapshot", "", "save the cache to `file` periodically and on shutdown, and restore it from there on startup")
+var snapshotInterval = flag.Duration("snapshot-interval", 5 * time.Minute, "time between snapshots, 0 to save only on shutdown")
+
+var adminAddr = flag.String("admin", "", "serve the admin HTTP API on this `address`, e.g. 127.0.0.1:8069, see Admin.go")
+var minRTO = flag.Duration("min-rto", MinRetryInterval, "lowest retransmission timeout - RFC 6298 asks for 1s, lower only on a link with steady delay")
+
+var adminToken = flag.String("admin-token", "", "`token` a rollback on the admin API must send in its X-Admin-Token header")
+
+var checksumList = flag.String("checksums", "", "legacy `checksums` to compute besides SHA-256, comma separated: crc32, md5")
+var verifySidecar = flag.Bool("verify-sidecar", false, "refuse an upload of name that does not match the SHA-256 in the cached file name.sha256")
+var verifyManifest = flag.String("verify-manifest", "", "refuse uploads that do not match the SHA-256 listed for them in this sha256sum `file`")
+
+var versionsKept = flag.Int("versions", 0, "let uploads replace files, and keep the last `n` versions of each, see Versions.go - 0 refuses uploads of a name that exists")
+var versionSuffixFlag = flag.String("version-suffix", "@v", "what separates a name from a version number in a read request, as in name@v3")
+
+var preloadReadOnly = flag.Bool("preload-read-only", false, "refuse write requests for preloaded files")
+var preloadWatch = flag.Bool("preload-watch", false, "watch preloaded directories, and add, replace or remove files as they change there (Linux only)")
+
+var preloadSources listFlag
+var templateFlags pairsFlag
+var templateVarFlags pairsFlag
+
+func init() {
+
+	flag.Var(&preloadSources, "preload", "load the files in this directory, archive or manifest `path` into the cache on startup, see Preload.go (repeatable)")
+	flag.Var(&templateFlags, "template", "serve names matching `pattern=file` by rendering the template file per client (repeatable)")
+	flag.Var(&templateVarFlags, "template-var", "a `name=value` templates see as .Server.name (repeatable)")
+}
+
 func main() {
 
+	flag.Parse()
+
 	// Setup logs.
 
 	fileRequest, fileDebug :=  setupLogFiles()
@@ -24,6 +75,97 @@ func main() {
 	requestLog = log.New(fileRequest, "", log.Ldate | log.Ltime)
 	debugLog = log.New(fileDebug, "", log.Ldate | log.Ltime)
 
+	// Load the file name rewrite rules, the templates, and what they are rendered with.
+
+	if *rewriteRulesFile != "" {
+		if err := LoadRewriteRules(*rewriteRulesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	setupTemplates()
+
+	// Set up retransmission.
+
+	if *minRTO <= 0 || *minRTO > MaxRetryInterval {
+		log.Fatalf("-min-rto must be more than 0, and at most %s", MaxRetryInterval)
+	}
+	MinRetryInterval = *minRTO
+
+	// Set up file versions.
+
+	if *versionsKept < 0 || *versionSuffixFlag == "" {
+		log.Fatal("-versions must be 0 or more, and -version-suffix must not be empty")
+	}
+	maxVersions = *versionsKept
+	versionSuffix = *versionSuffixFlag
+
+	// Set up the checksums computed for files, and what uploads are verified against.
+
+	if err := SetChecksums(*checksumList); err != nil {
+		log.Fatal(err)
+	}
+	verifySidecars = *verifySidecar
+	if *verifyManifest != "" {
+		if err := LoadChecksumManifest(*verifyManifest); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Set up the upstream origin.
+
+	if *upstreamOrigin != "" {
+		maxSize, err := parseSize(*upstreamMaxSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		upstream, err = NewUpstream(*upstreamOrigin, *upstreamMaxAge, maxSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Set up the object store.
+
+	if *s3Bucket != "" {
+		partSize, err := parseSize(*s3PartSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		objectStore, err = NewObjectStore(*s3Endpoint, *s3Region, *s3Bucket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		objectStore.PartSize = partSize
+	}
+
+	// Restore the cache from the last snapshot.
+
+	if *snapshotPath != "" {
+		n, err := loadSnapshot(*snapshotPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		requestLog.Printf("Restored %d files from %s \n", n, *snapshotPath)
+	}
+
+	// Preload files - after the snapshot is restored, so files uploaded since the last start are kept. A watched
+	// directory is watched before it is loaded, so no change in between is missed.
+
+	for _, source := range preloadSources {
+		if info, err := os.Stat(source); *preloadWatch == true && err == nil && info.IsDir() {
+			if _, err := watchPreload(source, *preloadReadOnly); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		n, err := Preload(source, *preloadReadOnly)
+		if err != nil {
+			log.Fatal(err)
+		}
+		requestLog.Printf("Preloaded %d files from %s \n", n, source)
+	}
+
 	// Listen on port 69 for all IPs on the local network (localhost only).
 
 	pc, err := net.ListenPacket("udp", ":69")
@@ -35,83 +177,239 @@ func main() {
 	debugLog.Printf("Connection: %+v \n", pc)
 	debugLog.Printf("Local Addr: %+v \n", pc.LocalAddr())
 
+	// The admin API.
+
+	if *adminAddr != "" {
+		if err := serveAdmin(*adminAddr, *adminToken); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Cleanup, and snapshots, in the background.
+
+	go reapErrorMap(nil)
+
+	if *snapshotPath != "" && *snapshotInterval > 0 {
+		go snapshotPeriodically(*snapshotPath, *snapshotInterval, nil)
+	}
+
+	// Shut down on SIGINT or SIGTERM - closing the connection stops the receive loop.
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		requestLog.Printf("Shutting down: %s \n", sig)
+		pc.Close()
+	}()
+
 	// Handle requests
 
+	if *batchIO {
+		listenBatch(pc)
+	} else {
+		listen(pc)
+	}
+
+	// Save the cache for the next start. Transfers still in progress are lost.
+
+	if *snapshotPath != "" {
+		takeSnapshot(*snapshotPath)
+	}
+}
+
+// Reads one datagram per syscall, and dispatches it.
+
+func listen(pc net.PacketConn) {
+
+	var set tftp.PacketSet
+	var delay time.Duration
+
 	for {
-		buf := make([]byte, 1024)
+		b := getPacketBuffer()
 
-		n, addr, err := pc.ReadFrom(buf)
+		n, addr, err := pc.ReadFrom(*b)
 		if err != nil {
+			putPacketBuffer(b)
+
+			// The connection is only closed when the server shuts down (or a test ends).
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = readBackoff(err, delay)
 			continue
 		}
+		delay = 0
 
-		serve(pc, addr, buf[:n])
+		serve(pc, &set, addr, b, n)
 	}
 }
 
-func serve(pc net.PacketConn, addr net.Addr, buf []byte) {
+// Logs a read error, and waits before the listener reads again - 5ms after the first error in a row, doubling
+// up to a second - so an error that persists, EBADF or ENOMEM say, does not spin the listener. Returns the wait
+// for the next error in the row.
 
-	// Parse the op code from the buffer.
+func readBackoff(err error, delay time.Duration) time.Duration {
 
-	op_code, err := tftp.ParseOpCodeFromPacket(buf)
-	if err != nil {
-		return
+	if delay == 0 {
+		delay = 5 * time.Millisecond
+	} else {
+		delay = min(2 * delay, time.Second)
+	}
+
+	requestLog.Printf("Read failed: %v, reading again in %s \n", err, delay)
+	time.Sleep(delay)
+	return delay
+}
+
+// Reads up to batchSize datagrams per syscall, and dispatches each. Handler writes are queued and flushed
+// in batches too, see batchWriter. Falls back to one datagram per syscall on platforms without recvmmsg.
+
+func listenBatch(pc net.PacketConn) {
+
+	bc := newBatchConn(pc)
+	wc := newBatchWriter(pc, bc)
+
+	ms := make([]message, batchSize)
+	bufs := make([]*[]byte, batchSize)
+
+	var set tftp.PacketSet
+	var delay time.Duration
+
+	for {
+
+		// Replace the buffers handed off to serve in the previous batch.
+
+		for i := range bufs {
+			if bufs[i] == nil {
+				bufs[i] = getPacketBuffer()
+				ms[i].Buf = *bufs[i]
+			}
+		}
+
+		n, err := bc.ReadBatch(ms)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = readBackoff(err, delay)
+			continue
+		}
+		delay = 0
+
+		// A datagram from an address the batchConn could not decode cannot be answered - its buffer is
+		// read into again.
+
+		for i := 0; i < n; i++ {
+			if ms[i].Addr == nil {
+				debugLog.Printf("Dropped a datagram from an unknown address family \n")
+				continue
+			}
+			serve(wc, &set, ms[i].Addr, bufs[i], ms[i].N)
+			bufs[i] = nil
+		}
 	}
+}
 
-	// Switch on the op code, create the target object type, and forward the packet to the correct handler.
+// Takes ownership of the pooled receive buffer b, which holds a packet of n bytes. The packet is parsed into
+// set, which the receive loop reuses - the handlers are given copies.
 
-	switch op_code {
+func serve(pc net.PacketConn, set *tftp.PacketSet, addr net.Addr, b *[]byte, n int) {
 
-	case tftp.OpRRQ:
+	buf := (*b)[:n]
 
-		requestLog.Println("Read")
+	// The buffer goes back to the pool as soon as the packet is parsed, except for DATA packets - the payload
+	// aliases the buffer, so handleData returns it once the block is written.
 
-		var packetRequest tftp.PacketRequest
-		packetRequest.Parse(buf)
+	pooled := true
+	defer func() {
+		if pooled {
+			putPacketBuffer(b)
+		}
+	}()
 
-		go handleRead(pc, addr, packetRequest)
+	// Parse and check the packet. Anything malformed is refused with ERROR 4 - except a malformed ERROR, which
+	// must not be answered with another.
+	//
+	// ERROR codes are not checked, StrictOptions.ErrorCodes is left off: an ERROR ends the transfer whatever its
+	// code, as RFC 1350 requires.
 
-	case tftp.OpWRQ:
+	packet, err := set.ParseStrict(buf, tftp.StrictOptions{BlockSize: dataBlockSize})
+	if err != nil {
+
+		requestLog.Printf("Unrecognized packet from %s: %s", addr, err)
+
+		var parseError *tftp.ParseError
+		if errors.As(err, &parseError) == false || parseError.Op != tftp.OpError {
+			sendError(pc, addr, tftp.ErrCodeIllegalOperation, "Illegal TFTP operation.", false)
+		}
+		return
+	}
 
-		requestLog.Println("Write")
+	// Switch on the packet type and forward the packet to the correct handler.
 
-		var packetRequest tftp.PacketRequest
-		packetRequest.Parse(buf)
+	switch p := packet.(type) {
 
-		go handleWrite(pc, addr, packetRequest)
+	case *tftp.PacketRequest:
 
-	case tftp.OpData:
+		req := *p
+		req.Filename = rewriteRequest(addr, req.Filename)
 
-		var packetData tftp.PacketData
-		packetData.Parse(buf)
+		if req.Op == tftp.OpRRQ {
+			requestLog.Println("Read")
+			go handleRead(pc, addr, req)
+		} else {
+			requestLog.Println("Write")
+			go handleWrite(pc, addr, req)
+		}
 
-		go handleData(pc, addr, packetData)
+	case *tftp.PacketData:
 
-	case tftp.OpAck:
+		pooled = false
+		go handleData(pc, addr, *p, b)
 
-		var packetAck tftp.PacketAck
-		packetAck.Parse(buf)
+	case *tftp.PacketAck:
 
-		go handleAck(pc, addr, packetAck)
+		go handleAck(pc, addr, *p)
 
-	case tftp.OpError:
+	case *tftp.PacketError:
 
 		// TFTP recognizes only one error condition that does not cause
 		//   termination, the source port of a received packet being incorrect.
 		//   In this case, an error packet is sent to the originating host.
 
-		var packetError tftp.PacketError
-		packetError.Parse(buf)
-
-		go handleError(pc, addr, packetError)
+		go handleError(pc, addr, *p)
 
 	default:
 
-		requestLog.Printf("Unexpected packet type %s", op_code)
+		op_code, _ := tftp.ParseOpCodeFromPacket(buf)
+		requestLog.Printf("Unexpected packet type %d from %s", op_code, addr)
 		return
 	}
 }
 
+func setupTemplates() {
+
+	if *inventoryFile != "" {
+		inv, err := NewInventory(*inventoryFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		inventory = inv
+	}
+
+	for _, v := range templateVarFlags {
+		templateVars[v[0]] = v[1]
+	}
+
+	for _, t := range templateFlags {
+		if err := RegisterTemplateFile(t[0], t[1]); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
 func setupLogFiles() (*os.File, *os.File) {
 
 	// Setup logs.
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"../../../tftp"
+	"../../clock"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Retries, timeouts and cleanup, stepped through on a fake clock. Each test covers minutes of protocol time in a
+// few milliseconds.
+
+// Swaps in a fake clock for the rest of the test.
+
+func useFakeClock(t *testing.T) *clock.Fake {
+	fc := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	clk = fc
+	t.Cleanup(func() { clk = clock.Real() })
+	return fc
+}
+
+// Returns the first ERROR written, skipping the retransmits before it.
+
+func nextError(t *testing.T, pc *recordingConn) *tftp.PacketError {
+	t.Helper()
+	for {
+		p := pc.next(5 * time.Second)
+		if p == nil {
+			t.Fatalf("Expected ERROR; got nothing")
+		}
+		if ep, ok := p.(*tftp.PacketError); ok == true {
+			return ep
+		}
+	}
+}
+
+func hasErrorEntry(addr string) bool {
+	errorMapChanges.Lock()
+	defer errorMapChanges.Unlock()
+	_, ok := errorAddrMap[addr]
+	return ok
+}
+
+func TestReadRetransmitsWithBackoff(t *testing.T) {
+	fc := useFakeClock(t)
+	addCommittedFile("virtual-retry.bin", 2*dataBlockSize)
+
+	pc := newRecordingConn()
+	addr := nextTestAddr()
+
+	handleRead(pc, addr, tftp.PacketRequest{Op: tftp.OpRRQ, Filename: "virtual-retry.bin", Mode: "octet"})
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketData); ok == false || p.BlockNum != 1 {
+		t.Fatalf("Expected DATA 1; got %s", describe(p))
+	}
+
+	// The block is resent when each retransmission timeout expires, and not before. The timeout doubles each time.
+
+	for _, rto := range []time.Duration{InitialRetryInterval, 2 * InitialRetryInterval, 4 * InitialRetryInterval} {
+		fc.BlockUntil(2) // the transfer's timeout timer, and the retry timer
+
+		fc.Advance(rto - time.Millisecond)
+		if p := pc.next(10 * time.Millisecond); p != nil {
+			t.Fatalf("Before the %s retry: unexpected packet %s", rto, describe(p))
+		}
+
+		fc.Advance(time.Millisecond)
+		if p, ok := pc.next(5 * time.Second).(*tftp.PacketData); ok == false || p.BlockNum != 1 {
+			t.Fatalf("After %s: expected DATA 1 again; got %s", rto, describe(p))
+		}
+	}
+
+	// The transfer carries on once the block is acked.
+
+	handleAck(pc, addr, tftp.PacketAck{BlockNum: 1})
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketData); ok == false || p.BlockNum != 2 {
+		t.Fatalf("After ACK 1: expected DATA 2; got %s", describe(p))
+	}
+	handleError(pc, addr, tftp.PacketError{Code: 0, Msg: "done"})
+}
+
+func TestReadTimesOut(t *testing.T) {
+	fc := useFakeClock(t)
+	logged := captureRequestLog(t)
+	addCommittedFile("virtual-read-timeout.bin", dataBlockSize)
+
+	pc := newRecordingConn()
+	addr := nextTestAddr()
+
+	handleRead(pc, addr, tftp.PacketRequest{Op: tftp.OpRRQ, Filename: "virtual-read-timeout.bin", Mode: "octet"})
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketData); ok == false || p.BlockNum != 1 {
+		t.Fatalf("Expected DATA 1; got %s", describe(p))
+	}
+
+	// The client never acks. The retry timer and the transfer timeout may come due together - either way the
+	// transfer times out, perhaps after one more retransmit.
+
+	fc.BlockUntil(2)
+	fc.Advance(time.Second * TimeoutInterval)
+
+	if ep := nextError(t, pc); ep.Code != 0 || ep.Msg != "Timeout" {
+		t.Fatalf("Expected ERROR 0 Timeout; got %s", describe(ep))
+	}
+
+	// The tracker is removed once the timeout is logged.
+
+	for deadline := time.Now().Add(5 * time.Second); hasTracker(readAddrMap, addr); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Read tracker still present after timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !hasErrorEntry(addr.String()) {
+		t.Errorf("Timeout error not recorded in the error map")
+	}
+	if got := logged.String(); !strings.Contains(got, "Read timed out") {
+		t.Errorf("Request log does not record the timeout: %q", got)
+	}
+}
+
+func TestWriteTimesOut(t *testing.T) {
+	fc := useFakeClock(t)
+
+	pc := newRecordingConn()
+	addr := nextTestAddr()
+	req := tftp.PacketRequest{Op: tftp.OpWRQ, Filename: "virtual-write-timeout.bin", Mode: "octet"}
+
+	handleWrite(pc, addr, req)
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 0 {
+		t.Fatalf("Expected ACK 0; got %s", describe(p))
+	}
+
+	// The client never sends block 1.
+
+	fc.BlockUntil(2)
+	fc.Advance(time.Second * TimeoutInterval)
+
+	if ep := nextError(t, pc); ep.Code != 0 || ep.Msg != "Timeout" {
+		t.Fatalf("Expected ERROR 0 Timeout; got %s", describe(ep))
+	}
+
+	// The upload is discarded before the error is sent.
+
+	if hasTracker(writeAddrMap, addr) {
+		t.Errorf("Write tracker still present after timeout")
+	}
+	lockMetadataChanges.Lock()
+	_, staged := fileCacheMap[req.Filename]
+	lockMetadataChanges.Unlock()
+	if staged {
+		t.Errorf("Staged upload still in the cache after timeout")
+	}
+}
+
+func TestFinishedUploadForgottenAfterDally(t *testing.T) {
+	fc := useFakeClock(t)
+
+	pc := newRecordingConn()
+	addr := nextTestAddr()
+
+	handleWrite(pc, addr, tftp.PacketRequest{Op: tftp.OpWRQ, Filename: "virtual-dally.bin", Mode: "octet"})
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 0 {
+		t.Fatalf("Expected ACK 0; got %s", describe(p))
+	}
+
+	buf := getPacketBuffer()
+	handleData(pc, addr, tftp.PacketData{BlockNum: 1, Data: (*buf)[:10]}, buf)
+	if p, ok := pc.next(5 * time.Second).(*tftp.PacketAck); ok == false || p.BlockNum != 1 {
+		t.Fatalf("Expected ACK 1; got %s", describe(p))
+	}
+
+	fc.Advance(time.Second*DallyInterval - time.Millisecond)
+	if !hasTracker(writeAddrMap, addr) {
+		t.Fatalf("Write tracker removed before the dally interval")
+	}
+
+	fc.Advance(time.Millisecond)
+	if hasTracker(writeAddrMap, addr) {
+		t.Errorf("Write tracker still present after the dally interval")
+	}
+}
+
+func TestReaperRemovesUnackedErrors(t *testing.T) {
+	fc := useFakeClock(t)
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		reapErrorMap(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	fc.BlockUntil(1)
+
+	// Two clients never ack their errors: one sent well before the first sweep, one just before it.
+
+	pc := newRecordingConn()
+	early, late := nextTestAddr(), nextTestAddr()
+
+	sendError(pc, early, 1, "File not found.", true)
+	fc.Advance(time.Second*ReapInterval - time.Second)
+	sendError(pc, late, 1, "File not found.", true)
+
+	fc.Advance(time.Second)
+	fc.BlockUntil(1) // the sweep is done, and the next one scheduled
+
+	if hasErrorEntry(early.String()) {
+		t.Errorf("Error for %s not reaped after %d seconds", early, ReapInterval)
+	}
+	if !hasErrorEntry(late.String()) {
+		t.Fatalf("Error for %s reaped after one second", late)
+	}
+
+	fc.Advance(time.Second * ReapInterval)
+	fc.BlockUntil(1)
+
+	if hasErrorEntry(late.String()) {
+		t.Errorf("Error for %s not reaped by the second sweep", late)
+	}
+}
@@ -0,0 +1,944 @@
+package conformance
+
+import (
+	"../../tftp"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Checks is the full suite, in the order it is run.
+var Checks = []Check{
+	{
+		Name:   "read-lockstep",
+		Clause: "RFC 1350 §2",
+		Desc:   "a read is sent one block at a time, each acknowledged before the next",
+		run:    checkReadLockstep,
+	},
+	{
+		Name:   "read-exact-multiple",
+		Clause: "RFC 1350 §6",
+		Desc:   "a file that fills its last block ends with an empty DATA",
+		run:    checkReadExactMultiple,
+	},
+	{
+		Name:   "write-lockstep",
+		Clause: "RFC 1350 §2",
+		Desc:   "a write is acknowledged with ACK 0, then an ACK for each block",
+		run:    checkWriteLockstep,
+	},
+	{
+		Name:   "file-not-found",
+		Clause: "RFC 1350 §5",
+		Desc:   "reading a missing file gets ERROR 1",
+		run:    checkFileNotFound,
+	},
+	{
+		Name:   "server-tid",
+		Clause: "RFC 1350 §4",
+		Desc:   "the server answers a request from a new port, its transfer ID",
+		run:    checkServerTID,
+	},
+	{
+		Name:   "lost-data",
+		Clause: "RFC 1350 §2",
+		Desc:   "the server retransmits a DATA that is not acknowledged",
+		run:    checkLostData,
+	},
+	{
+		Name:   "lost-ack",
+		Clause: "RFC 1350 §2",
+		Desc:   "the server acknowledges a retransmitted DATA again, without storing it twice",
+		run:    checkLostAck,
+	},
+	{
+		Name:   "write-retransmit",
+		Clause: "RFC 1350 §2",
+		Desc:   "the server retransmits its last ACK when the next DATA does not arrive",
+		run:    checkWriteRetransmit,
+	},
+	{
+		Name:   "duplicate-ack",
+		Clause: "RFC 1123 §4.2.3.1",
+		Desc:   "a duplicate ACK does not trigger a retransmission (Sorcerer's Apprentice)",
+		run:    checkDuplicateAck,
+	},
+	{
+		Name:   "out-of-order",
+		Clause: "RFC 1350 §2",
+		Desc:   "a DATA ahead of the expected block is not acknowledged or stored, or ends the transfer",
+		run:    checkOutOfOrder,
+	},
+	{
+		Name:   "wrong-tid",
+		Clause: "RFC 1350 §4",
+		Desc:   "a packet from the wrong port gets ERROR 5, and the transfer carries on",
+		run:    checkWrongTID,
+	},
+	{
+		Name:   "oversized-request",
+		Clause: "RFC 2347 §2",
+		Desc:   "a request larger than 512 bytes is refused or ignored, and the server keeps running",
+		run:    checkOversizedRequest,
+	},
+	{
+		Name:   "malformed-request",
+		Clause: "RFC 1350 §5",
+		Desc:   "a request without its terminating NULs is refused or ignored",
+		run:    checkMalformedRequest,
+	},
+	{
+		Name:   "unknown-opcode",
+		Clause: "RFC 1350 §5",
+		Desc:   "an unknown opcode gets ERROR 4 or is ignored",
+		run:    checkUnknownOpcode,
+	},
+	{
+		Name:   "blksize",
+		Clause: "RFC 2348",
+		Desc:   "a blksize request is ignored, or acknowledged with a size no larger, and used",
+		run:    checkBlockSize,
+	},
+	{
+		Name:   "blksize-range",
+		Clause: "RFC 2348",
+		Desc:   "blksize values outside 8-65464 are not acknowledged as requested",
+		run:    checkBlockSizeRange,
+	},
+	{
+		Name:   "unknown-option",
+		Clause: "RFC 2347 §4",
+		Desc:   "an unknown option is left out of the OACK",
+		run:    checkUnknownOption,
+	},
+	{
+		Name:   "tsize",
+		Clause: "RFC 2349 §4",
+		Desc:   "tsize is answered with the file size on reads, and echoed on writes",
+		run:    checkTransferSize,
+	},
+	{
+		Name:   "timeout-option",
+		Clause: "RFC 2349 §3",
+		Desc:   "a timeout in 1-255 is echoed unchanged, and one outside it is not acknowledged",
+		run:    checkTimeoutOption,
+	},
+	{
+		Name:   "oack-refused",
+		Clause: "RFC 2347 §4",
+		Desc:   "the server ends the transfer when the client answers its OACK with ERROR 8",
+		run:    checkOAckRefused,
+	},
+	{
+		Name:   "windowsize",
+		Clause: "RFC 7440",
+		Desc:   "a windowsize request is ignored, or acknowledged with a size no larger, and used",
+		run:    checkWindowSize,
+	},
+	{
+		Name:   "rollover",
+		Clause: "RFC 1350 §5",
+		Desc:   "a write and a read of more than 65535 blocks wrap the block number to 0",
+		Slow:   true,
+		run:    checkRollover,
+	},
+}
+
+// readRequest sends an RRQ and waits for the first reply.
+func readRequest(s *session, name string, options map[string]string) (tftp.Packet, error) {
+	if err := s.request(tftp.OpRRQ, name, options); err != nil {
+		return nil, err
+	}
+	p, err := s.receive(s.cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for a reply to the RRQ: %w", err)
+	}
+	if e, ok := p.(*tftp.PacketError); ok {
+		return nil, fmt.Errorf("RRQ refused with %s", describe(e))
+	}
+	return p, nil
+}
+
+// readFile reads the named file lock step, without options.
+func readFile(s *session, name string) ([]byte, error) {
+	p, err := readRequest(s, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	dp, ok := p.(*tftp.PacketData)
+	if !ok || dp.BlockNum != 1 {
+		return nil, fmt.Errorf("expected DATA 1; got %s", describe(p))
+	}
+	data := append([]byte(nil), dp.Data...)
+	if len(dp.Data) > 512 {
+		return nil, fmt.Errorf("DATA 1 has %d bytes with no blksize requested", len(dp.Data))
+	}
+	if err := s.send(&tftp.PacketAck{BlockNum: 1}); err != nil {
+		return nil, err
+	}
+	if len(dp.Data) < 512 {
+		return data, nil
+	}
+	rest, err := s.readBlocks(2, 512, 1)
+	return append(data, rest...), err
+}
+
+// negotiate sends a request with options, and returns the OACK, or nil if the
+// server ignored the options and answered with DATA 1 or ACK 0.
+func negotiate(s *session, op uint16, name string, options map[string]string) (*tftp.PacketOAck, tftp.Packet, error) {
+	if err := s.request(op, name, options); err != nil {
+		return nil, nil, err
+	}
+	p, err := s.receive(s.cfg.Timeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("waiting for a reply to the request: %w", err)
+	}
+
+	switch p := p.(type) {
+	case *tftp.PacketOAck:
+		for name := range p.Options {
+			if _, ok := options[name]; !ok {
+				return nil, nil, fmt.Errorf("OACK has option %q, which was not requested", name)
+			}
+		}
+		return p, nil, nil
+	case *tftp.PacketData:
+		if op == tftp.OpRRQ && p.BlockNum == 1 {
+			return nil, p, nil
+		}
+	case *tftp.PacketAck:
+		if op == tftp.OpWRQ && p.BlockNum == 0 {
+			return nil, p, nil
+		}
+	case *tftp.PacketError:
+		return nil, nil, fmt.Errorf("request with options %v refused with %s", options, describe(p))
+	}
+	return nil, nil, fmt.Errorf("unexpected reply to the request: %s", describe(p))
+}
+
+func checkReadLockstep(c *checker) error {
+	name, data, err := c.upload(3*512 + 100)
+	if err != nil {
+		return err
+	}
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	got, err := readFile(s, name)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("read %d bytes that differ from the %d written", len(got), len(data))
+	}
+	return s.expectNothing(c.cfg.Timeout/4, "the final block was acknowledged")
+}
+
+func checkReadExactMultiple(c *checker) error {
+	for _, size := range []int{0, 512, 1024} {
+		name, data, err := c.upload(size)
+		if err != nil {
+			return err
+		}
+		s, err := c.session()
+		if err != nil {
+			return err
+		}
+		got, err := readFile(s, name)
+		if err != nil {
+			return fmt.Errorf("%d byte file: %w", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			return fmt.Errorf("%d byte file: read %d bytes that differ", size, len(got))
+		}
+	}
+	return nil
+}
+
+func checkWriteLockstep(c *checker) error {
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	name := c.fileName()
+	data := bytes.Repeat([]byte("conformance "), 200)
+
+	if err := s.request(tftp.OpWRQ, name, nil); err != nil {
+		return err
+	}
+	if err := s.expectAck(0); err != nil {
+		return err
+	}
+	if err := s.writeBlocks(data, 512); err != nil {
+		return err
+	}
+	return c.verify(name, data)
+}
+
+func checkFileNotFound(c *checker) error {
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	if err := s.request(tftp.OpRRQ, c.fileName(), nil); err != nil {
+		return err
+	}
+	return s.expectError(1)
+}
+
+func checkServerTID(c *checker) error {
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	if err := s.request(tftp.OpRRQ, c.fileName(), nil); err != nil {
+		return err
+	}
+	if _, err := s.receive(c.cfg.Timeout); err != nil {
+		return err
+	}
+	if s.peer.String() == s.server.String() {
+		return fmt.Errorf("the server answered from its request port %s rather than a new transfer ID", s.server)
+	}
+	return nil
+}
+
+func checkLostData(c *checker) error {
+	name, data, err := c.upload(2*512 + 10)
+	if err != nil {
+		return err
+	}
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	p, err := readRequest(s, name, nil)
+	if err != nil {
+		return err
+	}
+	if dp, ok := p.(*tftp.PacketData); !ok || dp.BlockNum != 1 {
+		return fmt.Errorf("expected DATA 1; got %s", describe(p))
+	}
+
+	// Withhold ACK 1, as if DATA 1 was lost.
+	start := time.Now()
+	p, err = s.receive(c.cfg.RetransmitWait)
+	if err != nil {
+		return fmt.Errorf("DATA 1 was not retransmitted: %w", err)
+	}
+	if dp, ok := p.(*tftp.PacketData); !ok || dp.BlockNum != 1 {
+		return fmt.Errorf("expected DATA 1 to be retransmitted; got %s", describe(p))
+	}
+	c.notef("retransmitted after %v", time.Since(start).Round(time.Millisecond))
+
+	if err := s.send(&tftp.PacketAck{BlockNum: 1}); err != nil {
+		return err
+	}
+	rest, err := s.readBlocks(2, 512, 1)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(rest, data[512:]) {
+		return fmt.Errorf("the rest of the file differs after the retransmission")
+	}
+	return nil
+}
+
+func checkLostAck(c *checker) error {
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	name := c.fileName()
+	data := bytes.Repeat([]byte{'a'}, 512+100)
+
+	if err := s.request(tftp.OpWRQ, name, nil); err != nil {
+		return err
+	}
+	if err := s.expectAck(0); err != nil {
+		return err
+	}
+
+	// Send DATA 1 twice, as if the first ACK 1 was lost.
+	for i := 0; i < 2; i++ {
+		if err := s.send(&tftp.PacketData{BlockNum: 1, Data: data[:512]}); err != nil {
+			return err
+		}
+		if err := s.expectAck(1); err != nil {
+			if i == 1 {
+				return fmt.Errorf("retransmitted DATA 1 not acknowledged: %w", err)
+			}
+			return err
+		}
+	}
+
+	if err := s.send(&tftp.PacketData{BlockNum: 2, Data: data[512:]}); err != nil {
+		return err
+	}
+	if err := s.expectAck(2); err != nil {
+		return err
+	}
+	return c.verify(name, data)
+}
+
+func checkWriteRetransmit(c *checker) error {
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	name := c.fileName()
+	if err := s.request(tftp.OpWRQ, name, nil); err != nil {
+		return err
+	}
+	if err := s.expectAck(0); err != nil {
+		return err
+	}
+	if err := s.send(&tftp.PacketData{BlockNum: 1, Data: make([]byte, 512)}); err != nil {
+		return err
+	}
+	if err := s.expectAck(1); err != nil {
+		return err
+	}
+
+	// Withhold DATA 2.
+	p, err := s.receive(c.cfg.RetransmitWait)
+	if err != nil {
+		return fmt.Errorf("ACK 1 was not retransmitted: %w", err)
+	}
+	if ap, ok := p.(*tftp.PacketAck); !ok || ap.BlockNum != 1 {
+		return fmt.Errorf("expected ACK 1 to be retransmitted; got %s", describe(p))
+	}
+
+	// Finish the upload, so it isn't left half done on the server.
+	if err := s.send(&tftp.PacketData{BlockNum: 2}); err != nil {
+		return err
+	}
+	return s.expectAck(2)
+}
+
+func checkDuplicateAck(c *checker) error {
+	name, data, err := c.upload(8 * 512)
+	if err != nil {
+		return err
+	}
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	p, err := readRequest(s, name, nil)
+	if err != nil {
+		return err
+	}
+	if dp, ok := p.(*tftp.PacketData); !ok || dp.BlockNum != 1 {
+		return fmt.Errorf("expected DATA 1; got %s", describe(p))
+	}
+
+	// ACK 1 twice, then acknowledge each new block as soon as it arrives. A
+	// server with the Sorcerer's Apprentice bug sends every block after that
+	// twice.
+	for i := 0; i < 2; i++ {
+		if err := s.send(&tftp.PacketAck{BlockNum: 1}); err != nil {
+			return err
+		}
+	}
+
+	got := data[:512:512]
+	expected := uint16(2)
+	duplicates := 0
+	for {
+		p, err := s.receive(c.cfg.Timeout)
+		if err != nil {
+			return fmt.Errorf("waiting for DATA %d: %w", expected, err)
+		}
+		dp, ok := p.(*tftp.PacketData)
+		if !ok {
+			return fmt.Errorf("expected DATA %d; got %s", expected, describe(p))
+		}
+		if dp.BlockNum != expected {
+			duplicates++
+			continue
+		}
+		got = append(got, dp.Data...)
+		if err := s.send(&tftp.PacketAck{BlockNum: expected}); err != nil {
+			return err
+		}
+		expected++
+		if len(dp.Data) < 512 {
+			break
+		}
+	}
+
+	if duplicates > 0 {
+		return fmt.Errorf("the duplicate ACK 1 caused %d duplicate DATA packets", duplicates)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("read %d bytes that differ from the %d written", len(got), len(data))
+	}
+	return nil
+}
+
+func checkOutOfOrder(c *checker) error {
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	name := c.fileName()
+	data := make([]byte, 2*512+50)
+	for i := range data {
+		data[i] = byte(i / 512)
+	}
+
+	if err := s.request(tftp.OpWRQ, name, nil); err != nil {
+		return err
+	}
+	if err := s.expectAck(0); err != nil {
+		return err
+	}
+
+	// DATA 2 arrives before DATA 1. The server must not acknowledge or keep it.
+	if err := s.send(&tftp.PacketData{BlockNum: 2, Data: data[512:1024]}); err != nil {
+		return err
+	}
+	// Ending the transfer with an ERROR is allowed too.
+	if p, err := s.receive(c.cfg.Timeout / 4); err == nil {
+		if ep, ok := p.(*tftp.PacketError); ok {
+			c.notef("transfer ended with %s", describe(ep))
+			return nil
+		}
+		if ap, ok := p.(*tftp.PacketAck); !ok || ap.BlockNum != 0 {
+			return fmt.Errorf("DATA 2 sent before DATA 1 was answered with %s", describe(p))
+		}
+	}
+
+	if err := s.writeBlocks(data, 512); err != nil {
+		return err
+	}
+	return c.verify(name, data)
+}
+
+func checkWrongTID(c *checker) error {
+	name, data, err := c.upload(3 * 512)
+	if err != nil {
+		return err
+	}
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	p, err := readRequest(s, name, nil)
+	if err != nil {
+		return err
+	}
+	if dp, ok := p.(*tftp.PacketData); !ok || dp.BlockNum != 1 {
+		return fmt.Errorf("expected DATA 1; got %s", describe(p))
+	}
+
+	// An ACK 1 from another port, the wrong transfer ID.
+	stray, err := c.session()
+	if err != nil {
+		return err
+	}
+	stray.peer = s.peer
+	if err := stray.send(&tftp.PacketAck{BlockNum: 1}); err != nil {
+		return err
+	}
+	if err := stray.expectError(5); err != nil {
+		return fmt.Errorf("packet from the wrong port: %w", err)
+	}
+
+	// The real transfer is unaffected: DATA 2 only comes once the real ACK 1
+	// is sent. A retransmission of DATA 1 in the meantime is fine.
+	for {
+		p, err := s.receive(c.cfg.Timeout / 4)
+		if err == errNoReply {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if dp, ok := p.(*tftp.PacketData); !ok || dp.BlockNum != 1 {
+			return fmt.Errorf("the ACK from the wrong port was answered with %s", describe(p))
+		}
+	}
+	if err := s.send(&tftp.PacketAck{BlockNum: 1}); err != nil {
+		return err
+	}
+	rest, err := s.readBlocks(2, 512, 1)
+	if err != nil {
+		return fmt.Errorf("transfer after the wrong TID: %w", err)
+	}
+	if !bytes.Equal(rest, data[512:]) {
+		return fmt.Errorf("the rest of the file differs after the wrong TID")
+	}
+	return nil
+}
+
+func checkOversizedRequest(c *checker) error {
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	name := strings.Repeat("x", 600)
+	if err := s.request(tftp.OpRRQ, name, nil); err != nil {
+		return err
+	}
+	if err := refusedOrIgnored(s, "a 600 byte filename"); err != nil {
+		return err
+	}
+	return c.alive()
+}
+
+func checkMalformedRequest(c *checker) error {
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	for _, b := range [][]byte{
+		[]byte("\x00\x01name"),
+		[]byte("\x00\x01name\x00octet"),
+		[]byte("\x00\x02"),
+	} {
+		if err := s.sendRaw(b, s.server); err != nil {
+			return err
+		}
+		if err := refusedOrIgnored(s, fmt.Sprintf("request %q", b)); err != nil {
+			return err
+		}
+	}
+	return c.alive()
+}
+
+func checkUnknownOpcode(c *checker) error {
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	if err := s.sendRaw([]byte("\x00\x63junk"), s.server); err != nil {
+		return err
+	}
+	p, err := s.receive(c.cfg.Timeout / 2)
+	switch {
+	case err == errNoReply:
+		c.notef("ignored rather than answered with ERROR 4")
+	case err != nil:
+		return err
+	default:
+		if ep, ok := p.(*tftp.PacketError); !ok || ep.Code != 4 {
+			return fmt.Errorf("opcode 99 answered with %s rather than ERROR 4", describe(p))
+		}
+	}
+	return c.alive()
+}
+
+// refusedOrIgnored checks the server answers a bad request with an ERROR, or
+// not at all.
+func refusedOrIgnored(s *session, what string) error {
+	p, err := s.receive(s.cfg.Timeout / 2)
+	if err == errNoReply {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := p.(*tftp.PacketError); !ok {
+		return fmt.Errorf("%s was answered with %s", what, describe(p))
+	}
+	s.peer = nil
+	return nil
+}
+
+// readNegotiated finishes a read after negotiate, using the block and window
+// sizes in the OACK.
+func readNegotiated(s *session, oack *tftp.PacketOAck, first tftp.Packet) ([]byte, error) {
+	blockSize, windowSize := 512, 1
+	if oack == nil {
+		dp := first.(*tftp.PacketData)
+		if err := s.send(&tftp.PacketAck{BlockNum: 1}); err != nil {
+			return nil, err
+		}
+		data := append([]byte(nil), dp.Data...)
+		if len(dp.Data) < blockSize {
+			return data, nil
+		}
+		rest, err := s.readBlocks(2, blockSize, windowSize)
+		return append(data, rest...), err
+	}
+
+	if v, ok := oack.Options["blksize"]; ok {
+		blockSize, _ = strconv.Atoi(v)
+	}
+	if v, ok := oack.Options["windowsize"]; ok {
+		windowSize, _ = strconv.Atoi(v)
+	}
+	if err := s.send(&tftp.PacketAck{BlockNum: 0}); err != nil {
+		return nil, err
+	}
+	return s.readBlocks(1, blockSize, windowSize)
+}
+
+func checkBlockSize(c *checker) error {
+	name, data, err := c.upload(5000)
+	if err != nil {
+		return err
+	}
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	oack, first, err := negotiate(s, tftp.OpRRQ, name, map[string]string{"blksize": "1024"})
+	if err != nil {
+		return err
+	}
+	if oack == nil {
+		c.notef("options not supported")
+	} else if v, err := strconv.Atoi(oack.Options["blksize"]); err != nil || v < 8 || v > 1024 {
+		return fmt.Errorf("blksize 1024 acknowledged as %q", oack.Options["blksize"])
+	}
+
+	got, err := readNegotiated(s, oack, first)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("read %d bytes that differ from the %d written", len(got), len(data))
+	}
+	return nil
+}
+
+func checkBlockSizeRange(c *checker) error {
+	name, _, err := c.upload(100)
+	if err != nil {
+		return err
+	}
+	for _, value := range []string{"7", "65465", "0", "-1", "x"} {
+		s, err := c.session()
+		if err != nil {
+			return err
+		}
+		if err := s.request(tftp.OpRRQ, name, map[string]string{"blksize": value}); err != nil {
+			return err
+		}
+		p, err := s.receive(c.cfg.Timeout)
+		if err != nil {
+			return fmt.Errorf("blksize %s: %w", value, err)
+		}
+		switch p := p.(type) {
+		case *tftp.PacketOAck:
+			v, err := strconv.Atoi(p.Options["blksize"])
+			if _, ok := p.Options["blksize"]; ok && (err != nil || v < 8 || v > 65464) {
+				return fmt.Errorf("blksize %s acknowledged as %q", value, p.Options["blksize"])
+			}
+			s.send(&tftp.PacketError{Code: 8, Msg: "conformance check done"})
+		case *tftp.PacketError:
+			// Refusing the request is allowed.
+		case *tftp.PacketData:
+			s.send(&tftp.PacketError{Code: 0, Msg: "conformance check done"})
+		default:
+			return fmt.Errorf("blksize %s answered with %s", value, describe(p))
+		}
+	}
+	return nil
+}
+
+func checkUnknownOption(c *checker) error {
+	name, _, err := c.upload(100)
+	if err != nil {
+		return err
+	}
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	oack, _, err := negotiate(s, tftp.OpRRQ, name, map[string]string{"blksize": "1024", "x-conformance": "1"})
+	if err != nil {
+		return err
+	}
+	if oack == nil {
+		c.notef("options not supported")
+		s.send(&tftp.PacketError{Code: 0, Msg: "conformance check done"})
+		return nil
+	}
+	if _, ok := oack.Options["x-conformance"]; ok {
+		return fmt.Errorf("OACK acknowledges the unknown option x-conformance")
+	}
+	s.send(&tftp.PacketError{Code: 8, Msg: "conformance check done"})
+	return nil
+}
+
+func checkTransferSize(c *checker) error {
+	name, data, err := c.upload(1234)
+	if err != nil {
+		return err
+	}
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	oack, _, err := negotiate(s, tftp.OpRRQ, name, map[string]string{"tsize": "0"})
+	if err != nil {
+		return err
+	}
+	if oack == nil {
+		c.notef("options not supported")
+		s.send(&tftp.PacketError{Code: 0, Msg: "conformance check done"})
+		return nil
+	}
+	if v, ok := oack.Options["tsize"]; ok && v != strconv.Itoa(len(data)) {
+		return fmt.Errorf("RRQ tsize answered with %s for a %d byte file", v, len(data))
+	}
+	s.send(&tftp.PacketError{Code: 8, Msg: "conformance check done"})
+
+	w, err := c.session()
+	if err != nil {
+		return err
+	}
+	upload := make([]byte, 700)
+	oack, _, err = negotiate(w, tftp.OpWRQ, c.fileName(), map[string]string{"tsize": "700"})
+	if err != nil {
+		return err
+	}
+	if oack != nil {
+		if v, ok := oack.Options["tsize"]; ok && v != "700" {
+			return fmt.Errorf("WRQ tsize 700 answered with %s", v)
+		}
+	}
+	return w.writeBlocks(upload, 512)
+}
+
+func checkTimeoutOption(c *checker) error {
+	name, _, err := c.upload(100)
+	if err != nil {
+		return err
+	}
+	for _, value := range []string{"3", "0", "256"} {
+		s, err := c.session()
+		if err != nil {
+			return err
+		}
+		oack, _, err := negotiate(s, tftp.OpRRQ, name, map[string]string{"timeout": value})
+		if err != nil {
+			return err
+		}
+		if oack == nil {
+			s.send(&tftp.PacketError{Code: 0, Msg: "conformance check done"})
+			if value == "3" {
+				c.notef("timeout option not supported")
+			}
+			continue
+		}
+		v, ok := oack.Options["timeout"]
+		if ok && (value != "3" || v != "3") {
+			return fmt.Errorf("timeout %s acknowledged as %s", value, v)
+		}
+		s.send(&tftp.PacketError{Code: 8, Msg: "conformance check done"})
+	}
+	return nil
+}
+
+func checkOAckRefused(c *checker) error {
+	name, _, err := c.upload(2000)
+	if err != nil {
+		return err
+	}
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	oack, _, err := negotiate(s, tftp.OpRRQ, name, map[string]string{"blksize": "1024", "tsize": "0"})
+	if err != nil {
+		return err
+	}
+	if oack == nil {
+		s.send(&tftp.PacketError{Code: 0, Msg: "conformance check done"})
+		return skipf("options not supported")
+	}
+	if err := s.send(&tftp.PacketError{Code: 8, Msg: "options refused"}); err != nil {
+		return err
+	}
+	return s.expectNothing(c.cfg.Timeout, "the OACK was refused with ERROR 8")
+}
+
+func checkWindowSize(c *checker) error {
+	name, data, err := c.upload(20*512 + 7)
+	if err != nil {
+		return err
+	}
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	oack, first, err := negotiate(s, tftp.OpRRQ, name, map[string]string{"windowsize": "4"})
+	if err != nil {
+		return err
+	}
+	if oack == nil {
+		c.notef("options not supported")
+	} else if v, err := strconv.Atoi(oack.Options["windowsize"]); oack.Options["windowsize"] != "" && (err != nil || v < 1 || v > 4) {
+		return fmt.Errorf("windowsize 4 acknowledged as %q", oack.Options["windowsize"])
+	}
+
+	got, err := readNegotiated(s, oack, first)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("read %d bytes that differ from the %d written", len(got), len(data))
+	}
+	return nil
+}
+
+func checkRollover(c *checker) error {
+	// Use the smallest block size the server will take, to keep the file small.
+	blockSize := 512
+	probe, _, err := c.upload(10)
+	if err != nil {
+		return err
+	}
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	oack, _, err := negotiate(s, tftp.OpRRQ, probe, map[string]string{"blksize": "8"})
+	if err != nil {
+		return err
+	}
+	if oack != nil && oack.Options["blksize"] != "" {
+		blockSize, _ = strconv.Atoi(oack.Options["blksize"])
+	}
+	s.send(&tftp.PacketError{Code: 0, Msg: "conformance check done"})
+
+	// The write rolls over too, so a failure to upload fails the check.
+	data := make([]byte, 65540*blockSize+1)
+	rand.Read(data)
+	name, err := c.put(data)
+	if err != nil {
+		return fmt.Errorf("writing %d blocks of %d bytes: %w", len(data)/blockSize+1, blockSize, err)
+	}
+	s, err = c.session()
+	if err != nil {
+		return err
+	}
+	var options map[string]string
+	if blockSize != 512 {
+		options = map[string]string{"blksize": strconv.Itoa(blockSize)}
+	}
+	oack, first, err := negotiate(s, tftp.OpRRQ, name, options)
+	if err != nil {
+		return err
+	}
+
+	// readBlocks expects block numbers to go 65535, 0, 1...
+	got, err := readNegotiated(s, oack, first)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("read %d bytes that differ from the %d written", len(got), len(data))
+	}
+	c.notef("%d blocks of %d bytes", len(data)/blockSize+1, blockSize)
+	return nil
+}
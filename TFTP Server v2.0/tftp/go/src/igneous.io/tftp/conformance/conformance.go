@@ -0,0 +1,264 @@
+// Package conformance drives a TFTP server through scripted scenarios and
+// reports which RFC clauses it honours: lost and duplicated packets, blocks
+// out of order, stray transfer IDs, malformed and oversized requests, option
+// negotiation edge cases and block number rollover.
+//
+// The checks talk to the server with hand built packets, so they can break
+// the protocol in controlled ways. Files to read are uploaded first, with
+// names unique to the run, so the server must accept writes; checks whose
+// setup fails are skipped rather than failed.
+//
+// The tftp-conformance command runs the checks against any server. To gate a
+// server in its own tests, run the checks against it from a test:
+//
+//	for _, r := range conformance.Run(ctx, conformance.Config{Addr: addr}, conformance.Checks) {
+//		if r.Status == conformance.Fail {
+//			t.Errorf("%s", r)
+//		}
+//	}
+package conformance
+
+import (
+	"../../tftp"
+	"../client"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// Config describes the server under test.
+type Config struct {
+	// Addr is the server's request address, host:port.
+	Addr string
+
+	// Timeout is how long to wait for a reply the server should send at once.
+	// The default is 2 seconds.
+	Timeout time.Duration
+
+	// RetransmitWait is how long to wait for the server to retransmit after a
+	// packet is withheld. The default is 10 seconds.
+	RetransmitWait time.Duration
+
+	// Prefix is put in front of the names of the files the checks upload.
+	Prefix string
+
+	// Short skips the slow checks.
+	Short bool
+
+	// ListenPacket opens the local socket for a session. The default is a
+	// UDP socket on an ephemeral port.
+	ListenPacket func() (net.PacketConn, error)
+}
+
+func (cfg *Config) listen() (net.PacketConn, error) {
+	if cfg.ListenPacket != nil {
+		return cfg.ListenPacket()
+	}
+	return net.ListenPacket("udp", ":0")
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.RetransmitWait <= 0 {
+		cfg.RetransmitWait = 10 * time.Second
+	}
+	return cfg
+}
+
+// Status is the outcome of a check.
+type Status int
+
+const (
+	Pass Status = iota
+	Fail
+	Skip
+)
+
+func (s Status) String() string {
+	switch s {
+	case Pass:
+		return "PASS"
+	case Fail:
+		return "FAIL"
+	case Skip:
+		return "SKIP"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+func (s Status) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Name     string
+	Clause   string
+	Status   Status
+	Detail   string `json:",omitempty"` // why a check failed or was skipped, or a note on a pass
+	Duration time.Duration
+}
+
+func (r Result) String() string {
+	if r.Detail == "" {
+		return fmt.Sprintf("%s %s (%s)", r.Status, r.Name, r.Clause)
+	}
+	return fmt.Sprintf("%s %s (%s): %s", r.Status, r.Name, r.Clause, r.Detail)
+}
+
+// Check is one scenario.
+type Check struct {
+	Name   string
+	Clause string // the RFC clause checked, e.g. "RFC 1350 §4"
+	Desc   string
+	Slow   bool // takes more than a few seconds, skipped by Config.Short
+
+	run func(c *checker) error
+}
+
+// Run runs the checks one at a time, in order.
+func Run(ctx context.Context, cfg Config, checks []Check) []Result {
+	results := make([]Result, 0, len(checks))
+	for _, c := range checks {
+		if ctx.Err() != nil {
+			break
+		}
+		results = append(results, c.Run(ctx, cfg))
+	}
+	return results
+}
+
+// Run runs the check.
+func (c Check) Run(ctx context.Context, cfg Config) Result {
+	cfg = cfg.withDefaults()
+	r := Result{Name: c.Name, Clause: c.Clause}
+	if c.Slow && cfg.Short {
+		r.Status, r.Detail = Skip, "slow check skipped"
+		return r
+	}
+
+	ck := &checker{ctx: ctx, cfg: &cfg, name: c.Name}
+	defer ck.close()
+
+	start := time.Now()
+	err := c.run(ck)
+	r.Duration = time.Since(start)
+
+	var skip skipError
+	switch {
+	case errors.As(err, &skip):
+		r.Status, r.Detail = Skip, skip.msg
+	case err != nil:
+		r.Status, r.Detail = Fail, err.Error()
+	default:
+		r.Status, r.Detail = Pass, strings.Join(ck.notes, "; ")
+	}
+	return r
+}
+
+// skipError ends a check without a verdict, when its setup fails or the
+// server lacks an optional feature the check needs.
+type skipError struct{ msg string }
+
+func (e skipError) Error() string { return e.msg }
+
+func skipf(format string, args ...interface{}) error {
+	return skipError{fmt.Sprintf(format, args...)}
+}
+
+// checker holds the state of one running check.
+type checker struct {
+	ctx      context.Context
+	cfg      *Config
+	name     string
+	sessions []*session
+	notes    []string
+	files    int
+}
+
+func (c *checker) close() {
+	for _, s := range c.sessions {
+		s.close()
+	}
+}
+
+// session opens a new session, with its own transfer ID.
+func (c *checker) session() (*session, error) {
+	s, err := newSession(c.ctx, c.cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.sessions = append(c.sessions, s)
+	return s, nil
+}
+
+// notef records a detail of a passing check, such as an optional feature
+// the server does not have.
+func (c *checker) notef(format string, args ...interface{}) {
+	c.notes = append(c.notes, fmt.Sprintf(format, args...))
+}
+
+// fileName returns a name no other run has used.
+func (c *checker) fileName() string {
+	c.files++
+	return fmt.Sprintf("%sconformance-%s-%d-%d", c.cfg.Prefix, c.name, time.Now().UnixNano(), c.files)
+}
+
+func (c *checker) client() *client.Client {
+	return &client.Client{Timeout: c.cfg.Timeout, ListenPacket: c.cfg.ListenPacket}
+}
+
+// upload stores a new file of size random bytes on the server, and returns
+// its name and contents. The check is skipped if the server refuses it, as
+// a check of some other feature.
+func (c *checker) upload(size int) (string, []byte, error) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	name, err := c.put(data)
+	if err != nil {
+		return "", nil, skipf("setup: uploading %s: %s", name, err)
+	}
+	return name, data, nil
+}
+
+// put stores data on the server under a new name.
+func (c *checker) put(data []byte) (string, error) {
+	name := c.fileName()
+	return name, c.client().PutBytes(c.ctx, c.cfg.Addr, name, data)
+}
+
+// verify reads the named file back from the server, and compares it to data.
+func (c *checker) verify(name string, data []byte) error {
+	got, err := c.client().GetBytes(c.ctx, c.cfg.Addr, name)
+	if err != nil {
+		return fmt.Errorf("reading %s back: %w", name, err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("%s reads back as %d bytes that differ from the %d written", name, len(got), len(data))
+	}
+	return nil
+}
+
+// alive checks the server still answers requests, after a check has sent it
+// something hostile.
+func (c *checker) alive() error {
+	s, err := c.session()
+	if err != nil {
+		return err
+	}
+	if err := s.request(tftp.OpRRQ, c.fileName(), nil); err != nil {
+		return err
+	}
+	if _, err := s.receive(c.cfg.Timeout); err != nil {
+		return fmt.Errorf("server stopped answering requests: %w", err)
+	}
+	return nil
+}
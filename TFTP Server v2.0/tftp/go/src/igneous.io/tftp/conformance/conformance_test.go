@@ -0,0 +1,48 @@
+package conformance
+
+import (
+	"context"
+	"flag"
+	"testing"
+)
+
+// The suite runs against an external server when one is given:
+//
+//	go test -conformance.addr=host:port
+//
+// The server in cmd/tftpd runs it against itself in its own tests.
+var addrFlag = flag.String("conformance.addr", "", "address of a TFTP server to check")
+
+func TestConformance(t *testing.T) {
+	if *addrFlag == "" {
+		t.Skip("no server; set -conformance.addr")
+	}
+	cfg := Config{Addr: *addrFlag, Short: testing.Short()}
+
+	for _, c := range Checks {
+		t.Run(c.Name, func(t *testing.T) {
+			r := c.Run(context.Background(), cfg)
+			switch r.Status {
+			case Fail:
+				t.Errorf("%s: %s", r.Clause, r.Detail)
+			case Skip:
+				t.Skip(r.Detail)
+			default:
+				t.Log(r)
+			}
+		})
+	}
+}
+
+func TestChecksAreNamed(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, c := range Checks {
+		if c.Name == "" || c.Clause == "" || c.Desc == "" || c.run == nil {
+			t.Errorf("Incomplete check %+v", c)
+		}
+		if seen[c.Name] {
+			t.Errorf("Duplicate check name %s", c.Name)
+		}
+		seen[c.Name] = true
+	}
+}
@@ -0,0 +1,222 @@
+package conformance
+
+import (
+	"../../tftp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// errNoReply is returned by receive when nothing arrives from the server in time.
+var errNoReply = errors.New("no reply from the server")
+
+// session drives one transfer with hand built packets, so a check can
+// withhold, repeat or reorder them.
+type session struct {
+	ctx    context.Context
+	cfg    *Config
+	conn   net.PacketConn
+	server net.Addr // the server's request port
+	peer   net.Addr // the server's transfer ID, once it has answered
+	buf    []byte
+}
+
+func newSession(ctx context.Context, cfg *Config) (*session, error) {
+	server, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := cfg.listen()
+	if err != nil {
+		return nil, err
+	}
+	return &session{ctx: ctx, cfg: cfg, conn: conn, server: server, buf: make([]byte, 4+65464)}, nil
+}
+
+func (s *session) close() {
+	s.conn.Close()
+}
+
+// request sends a request to the server's request port.
+func (s *session) request(op uint16, name string, options map[string]string) error {
+	return s.sendTo(&tftp.PacketRequest{Op: op, Filename: name, Mode: "octet", Options: options}, s.server)
+}
+
+// send sends p to the server's transfer ID.
+func (s *session) send(p tftp.Packet) error {
+	return s.sendTo(p, s.peer)
+}
+
+func (s *session) sendTo(p tftp.Packet, addr net.Addr) error {
+	return s.sendRaw(p.Serialize(), addr)
+}
+
+func (s *session) sendRaw(b []byte, addr net.Addr) error {
+	_, err := s.conn.WriteTo(b, addr)
+	return err
+}
+
+// receive waits up to timeout for a packet from the server. The first reply
+// from the server's host fixes the server's transfer ID; after that, packets
+// from other ports are dropped. Packets that don't parse are returned as an
+// error, since a conforming server never sends them.
+func (s *session) receive(timeout time.Duration) (tftp.Packet, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := s.ctx.Err(); err != nil {
+			return nil, err
+		}
+		s.conn.SetReadDeadline(deadline)
+		n, addr, err := s.conn.ReadFrom(s.buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errNoReply
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if s.peer == nil {
+			if !sameHost(s.server, addr) {
+				continue
+			}
+			s.peer = addr
+		} else if addr.String() != s.peer.String() {
+			continue
+		}
+
+		p, err := tftp.ParsePacket(s.buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("malformed packet from the server: % x", s.buf[:n])
+		}
+		return p, nil
+	}
+}
+
+func sameHost(a, b net.Addr) bool {
+	ua, ok1 := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+	if !ok1 || !ok2 {
+		return a.String() == b.String()
+	}
+	return ua.IP.IsUnspecified() || ua.IP.Equal(ub.IP)
+}
+
+// expect waits for the server's next packet, and fails unless want accepts
+// it. An ERROR from the server fails with its code and message.
+func (s *session) expect(what string, want func(tftp.Packet) bool) (tftp.Packet, error) {
+	p, err := s.receive(s.cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for %s: %w", what, err)
+	}
+	if !want(p) {
+		return nil, fmt.Errorf("expected %s; got %s", what, describe(p))
+	}
+	return p, nil
+}
+
+func (s *session) expectData(block uint16) (*tftp.PacketData, error) {
+	p, err := s.expect(fmt.Sprintf("DATA %d", block), func(p tftp.Packet) bool {
+		dp, ok := p.(*tftp.PacketData)
+		return ok && dp.BlockNum == block
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p.(*tftp.PacketData), nil
+}
+
+func (s *session) expectAck(block uint16) error {
+	_, err := s.expect(fmt.Sprintf("ACK %d", block), func(p tftp.Packet) bool {
+		ap, ok := p.(*tftp.PacketAck)
+		return ok && ap.BlockNum == block
+	})
+	return err
+}
+
+func (s *session) expectError(code uint16) error {
+	_, err := s.expect(fmt.Sprintf("ERROR %d", code), func(p tftp.Packet) bool {
+		ep, ok := p.(*tftp.PacketError)
+		return ok && ep.Code == code
+	})
+	return err
+}
+
+// expectNothing fails if the server sends anything within wait.
+func (s *session) expectNothing(wait time.Duration, why string) error {
+	p, err := s.receive(wait)
+	if err == errNoReply {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s, but the server sent %s", why, describe(p))
+}
+
+// readBlocks receives a file sent a window of blocks at a time, starting with
+// block first. It acknowledges the last block of each window and the final
+// block, and returns the data.
+func (s *session) readBlocks(first uint16, blockSize, windowSize int) ([]byte, error) {
+	var data []byte
+	for block, sinceAck := first, 0; ; block++ {
+		dp, err := s.expectData(block)
+		if err != nil {
+			return nil, err
+		}
+		if len(dp.Data) > blockSize {
+			return nil, fmt.Errorf("DATA %d has %d bytes, more than the block size %d", block, len(dp.Data), blockSize)
+		}
+		data = append(data, dp.Data...)
+
+		last := len(dp.Data) < blockSize
+		if sinceAck++; last || sinceAck == windowSize {
+			if err := s.send(&tftp.PacketAck{BlockNum: block}); err != nil {
+				return nil, err
+			}
+			sinceAck = 0
+		}
+		if last {
+			return data, nil
+		}
+	}
+}
+
+// writeBlocks sends data lock step, starting with block 1 after ACK 0 or the
+// OACK has been received.
+func (s *session) writeBlocks(data []byte, blockSize int) error {
+	for block := 1; ; block++ {
+		start := (block - 1) * blockSize
+		end := start + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := s.send(&tftp.PacketData{BlockNum: uint16(block), Data: data[start:end]}); err != nil {
+			return err
+		}
+		if err := s.expectAck(uint16(block)); err != nil {
+			return err
+		}
+		if end-start < blockSize {
+			return nil
+		}
+	}
+}
+
+func describe(p tftp.Packet) string {
+	switch p := p.(type) {
+	case *tftp.PacketRequest:
+		return fmt.Sprintf("a request (opcode %d)", p.Op)
+	case *tftp.PacketData:
+		return fmt.Sprintf("DATA %d (%d bytes)", p.BlockNum, len(p.Data))
+	case *tftp.PacketAck:
+		return fmt.Sprintf("ACK %d", p.BlockNum)
+	case *tftp.PacketError:
+		return fmt.Sprintf("ERROR %d %q", p.Code, p.Msg)
+	case *tftp.PacketOAck:
+		return fmt.Sprintf("OACK %v", p.Options)
+	}
+	return fmt.Sprintf("%T", p)
+}
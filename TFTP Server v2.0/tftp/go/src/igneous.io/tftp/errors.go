@@ -0,0 +1,113 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ErrorCode is the code carried by an ERROR packet.
+type ErrorCode uint16
+
+// Error codes from RFC 1350, and RFC 2347 for option negotiation.
+const (
+	ErrCodeNotDefined        ErrorCode = 0
+	ErrCodeFileNotFound      ErrorCode = 1
+	ErrCodeAccessViolation   ErrorCode = 2
+	ErrCodeDiskFull          ErrorCode = 3
+	ErrCodeIllegalOperation  ErrorCode = 4
+	ErrCodeUnknownTID        ErrorCode = 5
+	ErrCodeFileExists        ErrorCode = 6
+	ErrCodeNoSuchUser        ErrorCode = 7
+	ErrCodeOptionNegotiation ErrorCode = 8
+)
+
+var errorCodeNames = [...]string{
+	ErrCodeNotDefined:        "not defined",
+	ErrCodeFileNotFound:      "file not found",
+	ErrCodeAccessViolation:   "access violation",
+	ErrCodeDiskFull:          "disk full or allocation exceeded",
+	ErrCodeIllegalOperation:  "illegal TFTP operation",
+	ErrCodeUnknownTID:        "unknown transfer ID",
+	ErrCodeFileExists:        "file already exists",
+	ErrCodeNoSuchUser:        "no such user",
+	ErrCodeOptionNegotiation: "option negotiation failed",
+}
+
+// String returns the meaning the RFCs give the code.
+func (c ErrorCode) String() string {
+	if int(c) < len(errorCodeNames) {
+		return errorCodeNames[c]
+	}
+	return fmt.Sprintf("error code %d", uint16(c))
+}
+
+// Error is a TFTP error, as sent or received in an ERROR packet. Compare against
+// the Err values with errors.Is, which matches on Code alone.
+type Error struct {
+	Code ErrorCode
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tftp: error %d: %s", e.Code, e.Msg)
+}
+
+// Is reports whether target is an *Error with the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Packet returns the ERROR packet that carries e.
+func (e *Error) Packet() *PacketError {
+	return &PacketError{Code: uint16(e.Code), Msg: e.Msg}
+}
+
+// ErrorFromPacket returns the error an ERROR packet carries.
+func ErrorFromPacket(p *PacketError) *Error {
+	return &Error{ErrorCode(p.Code), p.Msg}
+}
+
+// One Error for each code, to compare against with errors.Is.
+var (
+	ErrNotDefined        = &Error{ErrCodeNotDefined, ErrCodeNotDefined.String()}
+	ErrFileNotFound      = &Error{ErrCodeFileNotFound, ErrCodeFileNotFound.String()}
+	ErrAccessViolation   = &Error{ErrCodeAccessViolation, ErrCodeAccessViolation.String()}
+	ErrDiskFull          = &Error{ErrCodeDiskFull, ErrCodeDiskFull.String()}
+	ErrIllegalOperation  = &Error{ErrCodeIllegalOperation, ErrCodeIllegalOperation.String()}
+	ErrUnknownTID        = &Error{ErrCodeUnknownTID, ErrCodeUnknownTID.String()}
+	ErrFileExists        = &Error{ErrCodeFileExists, ErrCodeFileExists.String()}
+	ErrNoSuchUser        = &Error{ErrCodeNoSuchUser, ErrCodeNoSuchUser.String()}
+	ErrOptionNegotiation = &Error{ErrCodeOptionNegotiation, ErrCodeOptionNegotiation.String()}
+)
+
+// ErrorFor returns the TFTP error to send a peer when a transfer fails with err.
+// A *Error is returned as it is. Errors from storing or fetching a file map to
+// the code a client can act on - a missing file to ErrCodeFileNotFound, a
+// permission error to ErrCodeAccessViolation, an existing file to
+// ErrCodeFileExists, a full disk or exceeded quota to ErrCodeDiskFull - and a
+// malformed packet to ErrCodeIllegalOperation. Anything else is
+// ErrCodeNotDefined, with err's text as the message.
+func ErrorFor(err error) *Error {
+	var e *Error
+	var pe *ParseError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, os.ErrNotExist):
+		return &Error{ErrCodeFileNotFound, "File not found."}
+	case errors.Is(err, os.ErrPermission):
+		return &Error{ErrCodeAccessViolation, "Access violation."}
+	case errors.Is(err, os.ErrExist):
+		return &Error{ErrCodeFileExists, "File already exists."}
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return &Error{ErrCodeDiskFull, "Disk full or allocation exceeded."}
+	case errors.As(err, &pe):
+		return &Error{ErrCodeIllegalOperation, "Illegal TFTP operation."}
+	}
+	return &Error{ErrCodeNotDefined, err.Error()}
+}
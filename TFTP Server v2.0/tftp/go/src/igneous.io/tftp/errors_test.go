@@ -0,0 +1,84 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestErrorIs(t *testing.T) {
+	err := fmt.Errorf("get foo: %w", &Error{ErrCodeFileNotFound, "File not found."})
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("%v is not ErrFileNotFound", err)
+	}
+	if errors.Is(err, ErrAccessViolation) {
+		t.Errorf("%v is ErrAccessViolation", err)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%v is os.ErrNotExist", err)
+	}
+}
+
+func TestErrorPacketRoundTrip(t *testing.T) {
+	e := &Error{ErrCodeDiskFull, "No room."}
+
+	b := e.Packet().Serialize()
+	if want := "\x00\x05\x00\x03No room.\x00"; string(b) != want {
+		t.Fatalf("Serialized %q; expected %q", b, want)
+	}
+
+	p, err := ParsePacket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ErrorFromPacket(p.(*PacketError)); *got != *e {
+		t.Errorf("Round trip gave %#v; expected %#v", got, e)
+	}
+}
+
+func TestErrorCodeString(t *testing.T) {
+	for code, want := range map[ErrorCode]string{
+		ErrCodeNotDefined:            "not defined",
+		ErrCodeOptionNegotiation:     "option negotiation failed",
+		ErrCodeOptionNegotiation + 1: "error code 9",
+	} {
+		if got := code.String(); got != want {
+			t.Errorf("ErrorCode(%d).String() = %q; expected %q", uint16(code), got, want)
+		}
+	}
+}
+
+func TestErrorFor(t *testing.T) {
+	tests := []struct {
+		err  error
+		want ErrorCode
+	}{
+		{os.ErrNotExist, ErrCodeFileNotFound},
+		{&fs.PathError{Op: "open", Path: "foo", Err: syscall.ENOENT}, ErrCodeFileNotFound},
+		{os.ErrPermission, ErrCodeAccessViolation},
+		{&fs.PathError{Op: "open", Path: "foo", Err: syscall.EACCES}, ErrCodeAccessViolation},
+		{os.ErrExist, ErrCodeFileExists},
+		{&fs.PathError{Op: "write", Path: "foo", Err: syscall.ENOSPC}, ErrCodeDiskFull},
+		{fmt.Errorf("put: %w", syscall.EDQUOT), ErrCodeDiskFull},
+		{&ParseError{Err: ErrBadMode}, ErrCodeIllegalOperation},
+		{fmt.Errorf("wrapped: %w", &Error{ErrCodeNoSuchUser, "Who?"}), ErrCodeNoSuchUser},
+		{io.ErrUnexpectedEOF, ErrCodeNotDefined},
+	}
+
+	for _, test := range tests {
+		if got := ErrorFor(test.err); got.Code != test.want {
+			t.Errorf("ErrorFor(%v) = %v; expected code %d", test.err, got, test.want)
+		}
+	}
+
+	if got := ErrorFor(io.ErrUnexpectedEOF); got.Msg != io.ErrUnexpectedEOF.Error() {
+		t.Errorf("Undefined error sent as %q; expected the error's text", got.Msg)
+	}
+	if ErrorFor(nil) != nil {
+		t.Errorf("ErrorFor(nil) is not nil")
+	}
+}
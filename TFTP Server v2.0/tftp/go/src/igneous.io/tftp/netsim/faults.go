@@ -0,0 +1,221 @@
+package netsim
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxHold is how long a reordered datagram waits for a later one to overtake
+// it. Without a limit, the last datagram of a lock step exchange would wait
+// forever.
+const maxHold = 20 * time.Millisecond
+
+// Datagram is a datagram written to a Conn, as shown to a Policy.
+type Datagram struct {
+	From, To net.Addr
+	Data     []byte // only valid during the call to Fault
+	Seq      int    // number of datagrams written to the Conn before this one
+}
+
+// Fault is the fate of one datagram. The zero value delivers it intact.
+type Fault struct {
+	Drop       bool
+	Duplicate  bool          // deliver it twice
+	Reorder    bool          // deliver it after the next datagram written, or after a short hold
+	Delay      time.Duration // deliver it late
+	Corrupt    bool          // flip one bit, CorruptBit, counted from the high bit of the first byte
+	CorruptBit int
+}
+
+// Policy decides the fate of each datagram written to a Conn. It is called
+// with the Conn's lock held, one datagram at a time.
+type Policy interface {
+	Fault(d Datagram) Fault
+}
+
+// Script is a Policy written as a function, for tests that fault specific
+// datagrams.
+type Script func(d Datagram) Fault
+
+func (s Script) Fault(d Datagram) Fault {
+	return s(d)
+}
+
+// Conditions are the odds of each fault for Random. Probabilities are from 0
+// to 1, and are applied independently.
+type Conditions struct {
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+	Corrupt   float64
+
+	// Delay is added to every datagram, plus a uniformly random extra up to
+	// Jitter. Jitter alone reorders datagrams sent close together.
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// CorruptWithin limits corruption to the first CorruptWithin bytes of a
+	// datagram, such as a protocol header. 0 allows any byte.
+	CorruptWithin int
+}
+
+// Random returns a Policy that applies conditions using a random source
+// seeded with seed, so a run can be repeated.
+func Random(seed int64, c Conditions) Policy {
+	return &random{c: c, rng: rand.New(rand.NewSource(seed))}
+}
+
+type random struct {
+	c   Conditions
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (r *random) Fault(d Datagram) Fault {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var f Fault
+	f.Drop = r.rng.Float64() < r.c.Loss
+	f.Duplicate = r.rng.Float64() < r.c.Duplicate
+	f.Reorder = r.rng.Float64() < r.c.Reorder
+	f.Corrupt = r.rng.Float64() < r.c.Corrupt
+
+	f.Delay = r.c.Delay
+	if r.c.Jitter > 0 {
+		f.Delay += time.Duration(r.rng.Int63n(int64(r.c.Jitter)))
+	}
+
+	n := len(d.Data)
+	if r.c.CorruptWithin > 0 && r.c.CorruptWithin < n {
+		n = r.c.CorruptWithin
+	}
+	if n > 0 {
+		f.CorruptBit = r.rng.Intn(n * 8)
+	}
+	return f
+}
+
+// Stats counts what a Conn has done to the datagrams written to it.
+type Stats struct {
+	Written    int
+	Dropped    int
+	Duplicated int
+	Reordered  int
+	Delayed    int
+	Corrupted  int
+}
+
+// Conn is a net.PacketConn that applies a Policy to the datagrams written to
+// it. Reads are passed through untouched; to impair both directions, wrap
+// both ends.
+type Conn struct {
+	net.PacketConn
+	policy Policy
+
+	mu    sync.Mutex
+	seq   int
+	held  *held
+	stats Stats
+}
+
+type held struct {
+	data   []byte
+	to     net.Addr
+	copies int
+	timer  *time.Timer
+}
+
+// Wrap returns a Conn that writes to pc, applying policy.
+func Wrap(pc net.PacketConn, policy Policy) *Conn {
+	return &Conn{PacketConn: pc, policy: policy}
+}
+
+// Stats returns the counts of faults applied so far.
+func (c *Conn) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+
+	d := Datagram{From: c.LocalAddr(), To: addr, Data: b, Seq: c.seq}
+	c.seq++
+	c.stats.Written++
+	f := c.policy.Fault(d)
+
+	if f.Drop {
+		c.stats.Dropped++
+		c.mu.Unlock()
+		return len(b), nil
+	}
+
+	data := append([]byte(nil), b...)
+	if f.Corrupt && len(data) > 0 {
+		bit := f.CorruptBit % (len(data) * 8)
+		data[bit/8] ^= 0x80 >> (bit % 8)
+		c.stats.Corrupted++
+	}
+
+	copies := 1
+	if f.Duplicate {
+		copies = 2
+		c.stats.Duplicated++
+	}
+	if f.Delay > 0 {
+		c.stats.Delayed++
+	}
+
+	// A datagram already held back is released after this one.
+	prev := c.held
+	c.held = nil
+	if prev != nil {
+		prev.timer.Stop()
+	}
+
+	if f.Reorder && prev == nil {
+		c.stats.Reordered++
+		h := &held{data: data, to: addr, copies: copies}
+		h.timer = time.AfterFunc(f.Delay+maxHold, func() { c.release(h) })
+		c.held = h
+		c.mu.Unlock()
+		return len(b), nil
+	}
+	c.mu.Unlock()
+
+	c.deliver(data, addr, copies, f.Delay)
+	if prev != nil {
+		c.deliver(prev.data, prev.to, prev.copies, 0)
+	}
+	return len(b), nil
+}
+
+// release delivers a held datagram that nothing overtook.
+func (c *Conn) release(h *held) {
+	c.mu.Lock()
+	if c.held != h {
+		c.mu.Unlock()
+		return
+	}
+	c.held = nil
+	c.mu.Unlock()
+
+	c.deliver(h.data, h.to, h.copies, 0)
+}
+
+func (c *Conn) deliver(data []byte, to net.Addr, copies int, delay time.Duration) {
+	send := func() {
+		for i := 0; i < copies; i++ {
+			c.PacketConn.WriteTo(data, to)
+		}
+	}
+	if delay <= 0 {
+		send()
+		return
+	}
+	time.AfterFunc(delay, send)
+}
@@ -0,0 +1,204 @@
+package netsim
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func read(t *testing.T, pc net.PacketConn, wait time.Duration) ([]byte, net.Addr) {
+	t.Helper()
+	buf := make([]byte, 100)
+	pc.SetReadDeadline(time.Now().Add(wait))
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		return nil, nil
+	}
+	return buf[:n], addr
+}
+
+func TestNetwork(t *testing.T) {
+	var n Network
+	a, err := n.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := n.ListenPacket("udp", "10.0.0.1:69")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.ListenPacket("udp", "10.0.0.1:69"); err == nil {
+		t.Errorf("Expected an error listening on a port in use")
+	}
+
+	msg := []byte("hello")
+	a.WriteTo(msg, b.LocalAddr())
+	msg[0] = 'j' // the datagram is a copy
+
+	got, from := read(t, b, time.Second)
+	if string(got) != "hello" || from.String() != a.LocalAddr().String() {
+		t.Errorf("Got %q from %v; expected \"hello\" from %v", got, from, a.LocalAddr())
+	}
+
+	// Writes to nowhere are lost, as with UDP.
+	if _, err := a.WriteTo(msg, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}); err != nil {
+		t.Errorf("Write to an unused port: %s", err)
+	}
+}
+
+func TestDeadlineAndClose(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+
+	start := time.Now()
+	b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, _, err := b.ReadFrom(make([]byte, 10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected a deadline error; got %v", err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Errorf("Read returned before the deadline")
+	}
+
+	// Moving the deadline into the past wakes a blocked read.
+	b.SetReadDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, _, err := b.ReadFrom(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	b.SetReadDeadline(time.Unix(1, 0))
+	if err := <-done; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected a deadline error; got %v", err)
+	}
+
+	// Close wakes a blocked read too.
+	b.SetReadDeadline(time.Time{})
+	go func() {
+		_, _, err := b.ReadFrom(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	b.Close()
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected net.ErrClosed; got %v", err)
+	}
+}
+
+func TestScript(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	c := Wrap(a, Script(func(d Datagram) Fault {
+		switch d.Seq {
+		case 0:
+			return Fault{Drop: true}
+		case 1:
+			return Fault{Duplicate: true}
+		case 2:
+			return Fault{Reorder: true}
+		case 4:
+			return Fault{Corrupt: true, CorruptBit: 7}
+		}
+		return Fault{}
+	}))
+
+	for _, s := range []string{"0", "1", "2", "3", "4"} {
+		c.WriteTo([]byte(s), b.LocalAddr())
+	}
+
+	var got []string
+	for {
+		d, _ := read(t, b, 50*time.Millisecond)
+		if d == nil {
+			break
+		}
+		got = append(got, string(d))
+	}
+
+	// "4" is 0x34; flipping the low bit gives "5".
+	expected := []string{"1", "1", "3", "2", "5"}
+	if len(got) != len(expected) {
+		t.Fatalf("Got %q; expected %q", got, expected)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("Got %q; expected %q", got, expected)
+		}
+	}
+
+	stats := c.Stats()
+	if stats != (Stats{Written: 5, Dropped: 1, Duplicated: 1, Reordered: 1, Corrupted: 1}) {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestReorderedDatagramIsReleased(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	c := Wrap(a, Script(func(d Datagram) Fault { return Fault{Reorder: true} }))
+	c.WriteTo([]byte("x"), b.LocalAddr())
+
+	if d, _ := read(t, b, time.Second); string(d) != "x" {
+		t.Errorf("Held datagram was not released; got %q", d)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	c := Wrap(a, Random(1, Conditions{Delay: 30 * time.Millisecond}))
+	start := time.Now()
+	c.WriteTo([]byte("x"), b.LocalAddr())
+	if d, _ := read(t, b, time.Second); string(d) != "x" {
+		t.Fatalf("Got %q", d)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Delivered after %v; expected at least 30ms", elapsed)
+	}
+}
+
+// The same seed makes the same faults.
+
+func TestRandomIsRepeatable(t *testing.T) {
+	conditions := Conditions{Loss: 0.2, Duplicate: 0.2, Reorder: 0.2, Corrupt: 0.2, CorruptWithin: 4}
+	data := bytes.Repeat([]byte{0}, 16)
+
+	faults := func(seed int64) []Fault {
+		p := Random(seed, conditions)
+		var fs []Fault
+		for i := 0; i < 100; i++ {
+			f := p.Fault(Datagram{Data: data, Seq: i})
+			if f.CorruptBit >= 32 {
+				t.Fatalf("Corrupt bit %d outside the first 4 bytes", f.CorruptBit)
+			}
+			fs = append(fs, f)
+		}
+		return fs
+	}
+
+	a, b, c := faults(7), faults(7), faults(8)
+	same := func(x, y []Fault) bool {
+		for i := range x {
+			if x[i] != y[i] {
+				return false
+			}
+		}
+		return true
+	}
+	if !same(a, b) {
+		t.Errorf("Same seed gave different faults")
+	}
+	if same(a, c) {
+		t.Errorf("Different seeds gave the same faults")
+	}
+}
@@ -0,0 +1,261 @@
+// Package netsim provides net.PacketConns for testing code that speaks UDP:
+// an in-memory network, and a wrapper that drops, duplicates, reorders,
+// delays and corrupts the datagrams written through it.
+//
+// The in-memory network delivers every datagram, in order, without the
+// kernel; put a Conn from Wrap on either end to impair it. Faults are
+// decided by a Policy, either seeded random conditions or a Script that
+// picks the fate of each datagram, so a failing test can be replayed.
+package netsim
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queueLen is how many datagrams an endpoint buffers before it drops new
+// ones, as a full socket receive buffer does.
+const queueLen = 1024
+
+type datagram struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// Network is an in-memory network of UDP endpoints. The zero value is ready
+// to use.
+type Network struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpoint
+}
+
+// ListenPacket opens an endpoint on the network. It has the signature of
+// net.ListenPacket, so it can stand in for it. The network must be "udp",
+// "udp4" or "udp6"; the host defaults to 127.0.0.1, and port 0 picks an
+// unused port.
+func (n *Network) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("netsim: unsupported network %q", network)
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.IPv4(127, 0, 0, 1)
+	if host != "" {
+		if ip = net.ParseIP(host); ip == nil {
+			return nil, fmt.Errorf("netsim: %q is not an IP address", host)
+		}
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("netsim: bad port %q", portStr)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.endpoints == nil {
+		n.endpoints = make(map[string]*endpoint)
+	}
+	if port == 0 {
+		port = n.freePort(ip)
+	}
+	addr := &net.UDPAddr{IP: ip, Port: port}
+	if _, ok := n.endpoints[addr.String()]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "udp", Addr: addr, Err: errors.New("address already in use")}
+	}
+
+	e := &endpoint{
+		n:      n,
+		addr:   addr,
+		queue:  make(chan datagram, queueLen),
+		closed: make(chan struct{}),
+		rd:     makeDeadline(),
+	}
+	n.endpoints[addr.String()] = e
+	return e, nil
+}
+
+// lastPort is the last ephemeral port handed out, on any Network. Sharing
+// it means separate networks in one process don't reuse addresses, so
+// state a server keeps by client address can't leak from one test into the
+// next.
+var lastPort atomic.Int32
+
+// freePort returns an unused ephemeral port on ip. n.mu must be held.
+func (n *Network) freePort(ip net.IP) int {
+	for {
+		port := 49152 + int(lastPort.Add(1))%(65536-49152)
+		addr := &net.UDPAddr{IP: ip, Port: port}
+		if _, ok := n.endpoints[addr.String()]; !ok {
+			return port
+		}
+	}
+}
+
+func (n *Network) lookup(addr net.Addr) *endpoint {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.endpoints[addr.String()]
+}
+
+func (n *Network) remove(e *endpoint) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.endpoints[e.addr.String()] == e {
+		delete(n.endpoints, e.addr.String())
+	}
+}
+
+// Pipe returns two endpoints on a new network, for a test that needs one
+// connection.
+func Pipe() (net.PacketConn, net.PacketConn) {
+	n := new(Network)
+	a, _ := n.ListenPacket("udp", "127.0.0.1:0")
+	b, _ := n.ListenPacket("udp", "127.0.0.1:0")
+	return a, b
+}
+
+// endpoint is one open port on a Network.
+type endpoint struct {
+	n      *Network
+	addr   *net.UDPAddr
+	queue  chan datagram
+	closed chan struct{}
+	once   sync.Once
+	rd     deadline
+}
+
+func (e *endpoint) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-e.closed:
+		return 0, nil, e.opError("read", net.ErrClosed)
+	default:
+	}
+
+	select {
+	case d := <-e.queue:
+		return copy(b, d.data), d.from, nil
+	case <-e.closed:
+		return 0, nil, e.opError("read", net.ErrClosed)
+	case <-e.rd.wait():
+		return 0, nil, e.opError("read", os.ErrDeadlineExceeded)
+	}
+}
+
+// WriteTo delivers a copy of b to the endpoint at addr. As with UDP, a
+// datagram to a port nobody is listening on, or to an endpoint whose queue
+// is full, is silently lost.
+func (e *endpoint) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-e.closed:
+		return 0, e.opError("write", net.ErrClosed)
+	default:
+	}
+
+	if to := e.n.lookup(addr); to != nil {
+		select {
+		case to.queue <- datagram{append([]byte(nil), b...), e.addr}:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (e *endpoint) Close() error {
+	err := e.opError("close", net.ErrClosed)
+	e.once.Do(func() {
+		close(e.closed)
+		e.n.remove(e)
+		err = nil
+	})
+	return err
+}
+
+func (e *endpoint) LocalAddr() net.Addr { return e.addr }
+
+func (e *endpoint) SetDeadline(t time.Time) error {
+	return e.SetReadDeadline(t)
+}
+
+func (e *endpoint) SetReadDeadline(t time.Time) error {
+	e.rd.set(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never block.
+func (e *endpoint) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (e *endpoint) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: e.addr, Err: err}
+}
+
+// deadline is a read deadline that a blocked read can wait on, and that can
+// be moved while a read is waiting.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline passes
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // the timer fired; wait for it to close cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,162 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors a packet can fail to parse with, wrapped in a *ParseError; test for
+// them with errors.Is. ParsePacket checks the first three, ParseStrict all.
+var (
+	ErrTruncated     = errors.New("packet truncated")
+	ErrTrailingData  = errors.New("trailing data after packet")
+	ErrBadOpcode     = errors.New("unknown opcode")
+	ErrBadFilename   = errors.New("bad filename")
+	ErrBadMode       = errors.New("bad transfer mode")
+	ErrBadOption     = errors.New("bad option")
+	ErrBlockTooLarge = errors.New("data larger than the block size")
+	ErrBadErrorCode  = errors.New("error code out of range")
+)
+
+// ParseError describes a packet that could not be parsed.
+type ParseError struct {
+	Op     uint16 // the packet's opcode, 0 if it is too short to have one or was parsed by a packet's own Parse
+	Err    error  // one of the Err values above
+	Detail string // what was wrong, e.g. the mode asked for; may be empty
+}
+
+func (e *ParseError) Error() string {
+	msg := e.Err.Error()
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.Op != 0 {
+		msg = fmt.Sprintf("opcode %d: %s", e.Op, msg)
+	}
+	return msg
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// withOp records op in err, if it is a *ParseError that lacks one.
+func withOp(err error, op uint16) error {
+	if pe, ok := err.(*ParseError); ok && pe.Op == 0 {
+		pe.Op = op
+	}
+	return err
+}
+
+// DefaultBlockSize is the DATA payload size of RFC 1350, used when no blksize
+// option is negotiated.
+const DefaultBlockSize = 512
+
+// MaxErrorCode is the highest error code defined, by RFC 2347.
+const MaxErrorCode = uint16(ErrCodeOptionNegotiation)
+
+// StrictOptions are the limits ParseStrict checks packets against.
+type StrictOptions struct {
+	// BlockSize is the largest DATA payload allowed - the negotiated blksize.
+	// The default is DefaultBlockSize.
+	BlockSize int
+
+	// ErrorCodes refuses an ERROR whose code is not one of those defined, 0
+	// to MaxErrorCode. Off by default: RFC 1350 ends the transfer on any
+	// ERROR, so a peer in a transfer must see it whatever its code.
+	ErrorCodes bool
+}
+
+// ParseStrict parses a packet as ParsePacket does, then checks it is well
+// formed, for a peer that wants to refuse what ParsePacket lets through:
+//
+//   - a request must name a file, in printable ASCII
+//   - its mode must be netascii, octet or mail, in any case
+//   - its options must have names, and no name may appear twice
+//   - a DATA payload must be no larger than the block size
+//   - with ErrorCodes, an ERROR code must be one of those defined
+func ParseStrict(buf []byte, opts StrictOptions) (Packet, error) {
+	p, err := ParsePacket(buf)
+	if err != nil {
+		return nil, err
+	}
+	if err = check(p, buf, opts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ParseStrict is ParseStrict for a PacketSet: it checks what Parse parses into the set.
+func (s *PacketSet) ParseStrict(buf []byte, opts StrictOptions) (Packet, error) {
+	p, err := s.Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+	if err = check(p, buf, opts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func check(p Packet, buf []byte, opts StrictOptions) (err error) {
+	switch p := p.(type) {
+	case *PacketRequest:
+		err = checkRequest(p, buf)
+	case *PacketData:
+		blockSize := opts.BlockSize
+		if blockSize <= 0 {
+			blockSize = DefaultBlockSize
+		}
+		if len(p.Data) > blockSize {
+			err = &ParseError{Err: ErrBlockTooLarge, Detail: fmt.Sprintf("%d bytes, block size %d", len(p.Data), blockSize)}
+		}
+	case *PacketError:
+		if opts.ErrorCodes && p.Code > MaxErrorCode {
+			err = &ParseError{Err: ErrBadErrorCode, Detail: fmt.Sprint(p.Code)}
+		}
+	}
+	return withOp(err, opcode(buf))
+}
+
+func checkRequest(p *PacketRequest, buf []byte) error {
+	if p.Filename == "" {
+		return &ParseError{Err: ErrBadFilename, Detail: "empty"}
+	}
+	for i := 0; i < len(p.Filename); i++ {
+		if c := p.Filename[i]; c < 0x20 || c > 0x7e {
+			return &ParseError{Err: ErrBadFilename, Detail: fmt.Sprintf("%q is not printable ASCII", p.Filename)}
+		}
+	}
+
+	switch strings.ToLower(p.Mode) {
+	case "netascii", "octet", "mail":
+	default:
+		return &ParseError{Err: ErrBadMode, Detail: fmt.Sprintf("%q", p.Mode)}
+	}
+
+	// The options map keeps one value per name, so look for repeats in the packet itself.
+
+	rest := buf[2+len(p.Filename)+1+len(p.Mode)+1:]
+	seen := make(map[string]bool)
+	for len(rest) > 0 {
+		name, next, _ := parseString(rest)
+		_, next, _ = parseString(next)
+		rest = next
+
+		name = strings.ToLower(name)
+		if name == "" {
+			return &ParseError{Err: ErrBadOption, Detail: "empty name"}
+		}
+		if seen[name] {
+			return &ParseError{Err: ErrBadOption, Detail: fmt.Sprintf("%q repeated", name)}
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+func opcode(buf []byte) uint16 {
+	op, _, _ := parseUint16(buf)
+	return op
+}
@@ -0,0 +1,111 @@
+package tftp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseStrictAccepts(t *testing.T) {
+	tests := [][]byte{
+		[]byte("\x00\x01foo\x00octet\x00"),
+		[]byte("\x00\x02dir/foo.bin\x00NetASCII\x00"),
+		[]byte("\x00\x01foo\x00mail\x00"),
+		[]byte("\x00\x01foo\x00octet\x00blksize\x001428\x00tsize\x000\x00"),
+		append([]byte("\x00\x03\x00\x01"), make([]byte, DefaultBlockSize)...),
+		[]byte("\x00\x04\x00\x01"),
+		[]byte("\x00\x05\x00\x08no\x00"),
+		[]byte("\x00\x06blksize\x001428\x00"),
+	}
+
+	var set PacketSet
+	for _, test := range tests {
+		if _, err := ParseStrict(test, StrictOptions{}); err != nil {
+			t.Errorf("ParseStrict(%q): %s", test, err)
+		}
+		if _, err := set.ParseStrict(test, StrictOptions{}); err != nil {
+			t.Errorf("PacketSet.ParseStrict(%q): %s", test, err)
+		}
+	}
+}
+
+func TestParseStrictRejects(t *testing.T) {
+	tests := []struct {
+		bytes []byte
+		opts  StrictOptions
+		err   error
+	}{
+		{[]byte("\x00"), StrictOptions{}, ErrTruncated},
+		{[]byte("\x00\x01foo"), StrictOptions{}, ErrTruncated},
+		{[]byte("\x00\x01foo\x00octet"), StrictOptions{}, ErrTruncated},
+		{[]byte("\x00\x04\x00\x01junk"), StrictOptions{}, ErrTrailingData},
+		{[]byte("\x00\x09"), StrictOptions{}, ErrBadOpcode},
+		{[]byte("\x00\x01\x00octet\x00"), StrictOptions{}, ErrBadFilename},
+		{[]byte("\x00\x01caf\xc3\xa9\x00octet\x00"), StrictOptions{}, ErrBadFilename},
+		{[]byte("\x00\x01a\tb\x00octet\x00"), StrictOptions{}, ErrBadFilename},
+		{[]byte("\x00\x01foo\x00\x00"), StrictOptions{}, ErrBadMode},
+		{[]byte("\x00\x01foo\x00binary\x00"), StrictOptions{}, ErrBadMode},
+		{[]byte("\x00\x01foo\x00octet\x00\x001\x00"), StrictOptions{}, ErrBadOption},
+		{[]byte("\x00\x01foo\x00octet\x00tsize\x000\x00TSIZE\x000\x00"), StrictOptions{}, ErrBadOption},
+		{append([]byte("\x00\x03\x00\x01"), make([]byte, DefaultBlockSize+1)...), StrictOptions{}, ErrBlockTooLarge},
+		{append([]byte("\x00\x03\x00\x01"), make([]byte, 9)...), StrictOptions{BlockSize: 8}, ErrBlockTooLarge},
+		{[]byte("\x00\x05\x00\x09oops"), StrictOptions{}, ErrTruncated},
+		{[]byte("\x00\x05\x00\x09oops\x00"), StrictOptions{ErrorCodes: true}, ErrBadErrorCode},
+	}
+
+	for _, test := range tests {
+		p, err := ParseStrict(test.bytes, test.opts)
+		if !errors.Is(err, test.err) {
+			t.Errorf("ParseStrict(%q): expected %v; got %#v, %v", test.bytes, test.err, p, err)
+			continue
+		}
+
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("ParseStrict(%q): %T is not a *ParseError", test.bytes, err)
+		} else if len(test.bytes) >= 2 && pe.Op != opcode(test.bytes) {
+			t.Errorf("ParseStrict(%q): ParseError.Op %d; expected %d", test.bytes, pe.Op, opcode(test.bytes))
+		}
+
+		var set PacketSet
+		if _, err := set.ParseStrict(test.bytes, test.opts); !errors.Is(err, test.err) {
+			t.Errorf("PacketSet.ParseStrict(%q): expected %v; got %v", test.bytes, test.err, err)
+		}
+	}
+}
+
+// The checks ParseStrict adds are its own - ParsePacket still takes what it can make sense of.
+func TestParsePacketLenient(t *testing.T) {
+	for _, b := range [][]byte{
+		[]byte("\x00\x01\x00\x00"),
+		append([]byte("\x00\x03\x00\x01"), make([]byte, 1000)...),
+		[]byte("\x00\x05\x00\x63\x00"),
+	} {
+		if _, err := ParsePacket(b); err != nil {
+			t.Errorf("ParsePacket(%q): %s", b, err)
+		}
+	}
+}
+
+// An ERROR with a code no RFC defines still ends a transfer, so ParseStrict takes it unless asked to check codes.
+func TestParseStrictErrorCodes(t *testing.T) {
+	for _, code := range []uint16{0, 8, 9, 99, 0xffff} {
+		b := append([]byte{0, 5, byte(code >> 8), byte(code)}, "oops\x00"...)
+		p, err := ParseStrict(b, StrictOptions{})
+		if e, ok := p.(*PacketError); err != nil || ok == false || e.Code != code {
+			t.Errorf("ParseStrict(%q): got %#v, %v; expected ERROR %d", b, p, err, code)
+		}
+
+		_, err = ParseStrict(b, StrictOptions{ErrorCodes: true})
+		if defined := code <= MaxErrorCode; defined != (err == nil) || (err != nil && !errors.Is(err, ErrBadErrorCode)) {
+			t.Errorf("ParseStrict(%q) checking codes: got %v", b, err)
+		}
+	}
+}
+
+func TestParseErrorMessage(t *testing.T) {
+	_, err := ParseStrict([]byte("\x00\x01foo\x00binary\x00"), StrictOptions{})
+	if err == nil || !strings.Contains(err.Error(), `bad transfer mode: "binary"`) {
+		t.Errorf("Expected the mode in the error; got %v", err)
+	}
+}
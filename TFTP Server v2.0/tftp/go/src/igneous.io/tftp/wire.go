@@ -3,8 +3,10 @@ package tftp
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
 )
 
 // larger than a typical mtu (1500), and largest DATA packet (516).
@@ -17,6 +19,7 @@ const (
 	OpData         = 3
 	OpAck          = 4
 	OpError        = 5
+	OpOAck         = 6 // RFC 2347 option acknowledgment
 )
 
 // packet is the interface met by all packet structs
@@ -25,34 +28,57 @@ type Packet interface {
 	Parse([]byte) error
 	// Serialize serializes a packet to its wire representation
 	Serialize() []byte
+	// AppendSerialize appends the wire representation of a packet to buf, returning the extended buffer
+	AppendSerialize(buf []byte) []byte
+	// SerializeTo writes the wire representation of a packet into buf, returning the number of bytes written
+	SerializeTo(buf []byte) (int, error)
 }
 
 // PacketRequest represents a request to read or rite a file.
+// Options holds any RFC 2347 options appended to the request, keyed by lower case name; nil if there are none.
 type PacketRequest struct {
 	Op       uint16 // OpRRQ or OpWRQ
 	Filename string
 	Mode     string
+	Options  map[string]string
 }
 
 func (p *PacketRequest) Parse(buf []byte) (err error) {
 	if p.Op, buf, err = parseUint16(buf); err != nil {
 		return err
 	}
+	if p.Op != OpRRQ && p.Op != OpWRQ {
+		return &ParseError{Err: ErrBadOpcode, Detail: fmt.Sprintf("opcode %d is not a request", p.Op)}
+	}
 	if p.Filename, buf, err = parseString(buf); err != nil {
 		return err
 	}
 	if p.Mode, buf, err = parseString(buf); err != nil {
 		return err
 	}
+	if p.Options, err = parseOptions(buf); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (p *PacketRequest) Serialize() []byte {
-	buf := make([]byte, 2+len(p.Filename)+1+len(p.Mode)+1)
-	binary.BigEndian.PutUint16(buf, p.Op)
-	copy(buf[2:], p.Filename)
-	copy(buf[2+len(p.Filename)+1:], p.Mode)
-	return buf
+	return p.AppendSerialize(make([]byte, 0, p.size()))
+}
+
+func (p *PacketRequest) AppendSerialize(buf []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, p.Op)
+	buf = append(append(buf, p.Filename...), 0)
+	buf = append(append(buf, p.Mode...), 0)
+	return appendOptions(buf, p.Options)
+}
+
+func (p *PacketRequest) SerializeTo(buf []byte) (int, error) {
+	return serializeTo(p, buf)
+}
+
+func (p *PacketRequest) size() int {
+	return 2 + len(p.Filename) + 1 + len(p.Mode) + 1 + optionsSize(p.Options)
 }
 
 // PacketData carries a block of data in a file transmission.
@@ -62,7 +88,9 @@ type PacketData struct {
 }
 
 func (p *PacketData) Parse(buf []byte) (err error) {
-	buf = buf[2:] // skip over op
+	if buf, err = parseOp(buf, OpData); err != nil {
+		return err
+	}
 	if p.BlockNum, buf, err = parseUint16(buf); err != nil {
 		return err
 	}
@@ -71,11 +99,21 @@ func (p *PacketData) Parse(buf []byte) (err error) {
 }
 
 func (p *PacketData) Serialize() []byte {
-	buf := make([]byte, 4+len(p.Data))
-	binary.BigEndian.PutUint16(buf, OpData)
-	binary.BigEndian.PutUint16(buf[2:], p.BlockNum)
-	copy(buf[4:], p.Data)
-	return buf
+	return p.AppendSerialize(make([]byte, 0, p.size()))
+}
+
+func (p *PacketData) AppendSerialize(buf []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, OpData)
+	buf = binary.BigEndian.AppendUint16(buf, p.BlockNum)
+	return append(buf, p.Data...)
+}
+
+func (p *PacketData) SerializeTo(buf []byte) (int, error) {
+	return serializeTo(p, buf)
+}
+
+func (p *PacketData) size() int {
+	return 4 + len(p.Data)
 }
 
 // PacketAck acknowledges receipt of a data packet
@@ -84,18 +122,30 @@ type PacketAck struct {
 }
 
 func (p *PacketAck) Parse(buf []byte) (err error) {
-	buf = buf[2:] // skip over op
+	if buf, err = parseOp(buf, OpAck); err != nil {
+		return err
+	}
 	if p.BlockNum, buf, err = parseUint16(buf); err != nil {
 		return err
 	}
-	return nil
+	return parseEnd(buf)
 }
 
 func (p *PacketAck) Serialize() []byte {
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint16(buf, OpAck)
-	binary.BigEndian.PutUint16(buf[2:], p.BlockNum)
-	return buf
+	return p.AppendSerialize(make([]byte, 0, p.size()))
+}
+
+func (p *PacketAck) AppendSerialize(buf []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, OpAck)
+	return binary.BigEndian.AppendUint16(buf, p.BlockNum)
+}
+
+func (p *PacketAck) SerializeTo(buf []byte) (int, error) {
+	return serializeTo(p, buf)
+}
+
+func (p *PacketAck) size() int {
+	return 4
 }
 
 // PacketError is sent by a peer who has encountered an error condition
@@ -105,43 +155,172 @@ type PacketError struct {
 }
 
 func (p *PacketError) Parse(buf []byte) (err error) {
-	buf = buf[2:] // skip over op
+	if buf, err = parseOp(buf, OpError); err != nil {
+		return err
+	}
 	if p.Code, buf, err = parseUint16(buf); err != nil {
 		return err
 	}
 	if p.Msg, buf, err = parseString(buf); err != nil {
 		return err
 	}
-	return nil
+	return parseEnd(buf)
 }
 
 func (p *PacketError) Serialize() []byte {
-	buf := make([]byte, 4+len(p.Msg)+1)
-	binary.BigEndian.PutUint16(buf, OpError)
-	binary.BigEndian.PutUint16(buf[2:], p.Code)
-	copy(buf[4:], p.Msg)
-	return buf
+	return p.AppendSerialize(make([]byte, 0, p.size()))
+}
+
+func (p *PacketError) AppendSerialize(buf []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, OpError)
+	buf = binary.BigEndian.AppendUint16(buf, p.Code)
+	return append(append(buf, p.Msg...), 0)
+}
+
+func (p *PacketError) SerializeTo(buf []byte) (int, error) {
+	return serializeTo(p, buf)
+}
+
+func (p *PacketError) size() int {
+	return 4 + len(p.Msg) + 1
+}
+
+// PacketOAck acknowledges the options a peer accepted from a request, RFC 2347
+type PacketOAck struct {
+	Options map[string]string
+}
+
+func (p *PacketOAck) Parse(buf []byte) (err error) {
+	if buf, err = parseOp(buf, OpOAck); err != nil {
+		return err
+	}
+	if p.Options, err = parseOptions(buf); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *PacketOAck) Serialize() []byte {
+	return p.AppendSerialize(make([]byte, 0, p.size()))
+}
+
+func (p *PacketOAck) AppendSerialize(buf []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, OpOAck)
+	return appendOptions(buf, p.Options)
+}
+
+func (p *PacketOAck) SerializeTo(buf []byte) (int, error) {
+	return serializeTo(p, buf)
+}
+
+func (p *PacketOAck) size() int {
+	return 2 + optionsSize(p.Options)
+}
+
+// sizedPacket is met by all packet structs; size is the length of the wire representation.
+type sizedPacket interface {
+	Packet
+	size() int
+}
+
+// serializeTo implements SerializeTo for all packet types, failing with io.ErrShortBuffer
+// rather than growing buf.
+func serializeTo(p sizedPacket, buf []byte) (int, error) {
+	n := p.size()
+	if len(buf) < n {
+		return 0, io.ErrShortBuffer
+	}
+	p.AppendSerialize(buf[:0])
+	return n, nil
 }
 
 // parseUint16 reads a big-endian uint16 from the beginning of buf,
 // returning it along with a slice pointing at the next position in the buffer.
 func parseUint16(buf []byte) (uint16, []byte, error) {
 	if len(buf) < 2 {
-		return 0, nil, errors.New("packet truncated")
+		return 0, nil, &ParseError{Err: ErrTruncated}
 	}
 	return binary.BigEndian.Uint16(buf), buf[2:], nil
 }
 
+// parseOp reads the opcode from the beginning of buf, and checks it is op,
+// returning a slice pointing at the next position in the buffer.
+func parseOp(buf []byte, op uint16) ([]byte, error) {
+	got, buf, err := parseUint16(buf)
+	if err != nil {
+		return nil, err
+	}
+	if got != op {
+		return nil, &ParseError{Err: ErrBadOpcode, Detail: fmt.Sprintf("opcode %d, expected %d", got, op)}
+	}
+	return buf, nil
+}
+
+// parseEnd checks nothing is left of buf once a packet's fields are read.
+func parseEnd(buf []byte) error {
+	if len(buf) > 0 {
+		return &ParseError{Err: ErrTrailingData, Detail: fmt.Sprintf("%d bytes", len(buf))}
+	}
+	return nil
+}
+
 // parseString reads a null-terminated ASCII string from buf,
 // returning it along with a slice pointing at the next position in the buffer.
 func parseString(buf []byte) (string, []byte, error) {
 	i := bytes.IndexByte(buf, 0)
 	if i < 0 {
-		return "", nil, errors.New("packet truncated")
+		return "", nil, &ParseError{Err: ErrTruncated, Detail: "string not terminated"}
 	}
 	return string(buf[:i]), buf[i+1:], nil
 }
 
+// parseOptions reads the RFC 2347 name/value pairs that make up the rest of buf.
+// Option names are case insensitive, and are returned in lower case. Returns nil if buf is empty.
+func parseOptions(buf []byte) (map[string]string, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	options := make(map[string]string)
+	for len(buf) > 0 {
+		var name, value string
+		var err error
+		if name, buf, err = parseString(buf); err != nil {
+			return nil, err
+		}
+		if value, buf, err = parseString(buf); err != nil {
+			return nil, err
+		}
+		options[strings.ToLower(name)] = value
+	}
+	return options, nil
+}
+
+// appendOptions appends options to buf as null-terminated name/value pairs, sorted by name
+// so the wire representation is stable.
+func appendOptions(buf []byte, options map[string]string) []byte {
+	if len(options) == 0 {
+		return buf
+	}
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf = append(append(buf, name...), 0)
+		buf = append(append(buf, options[name]...), 0)
+	}
+	return buf
+}
+
+func optionsSize(options map[string]string) int {
+	n := 0
+	for name, value := range options {
+		n += len(name) + 1 + len(value) + 1
+	}
+	return n
+}
+
 // ParsePacket parses a packet from its wire representation.
 func ParsePacket(buf []byte) (p Packet, err error) {
 	var opcode uint16
@@ -157,11 +336,49 @@ func ParsePacket(buf []byte) (p Packet, err error) {
 		p = &PacketAck{}
 	case OpError:
 		p = &PacketError{}
+	case OpOAck:
+		p = &PacketOAck{}
+	default:
+		err = &ParseError{Op: opcode, Err: ErrBadOpcode}
+		return
+	}
+	err = withOp(p.Parse(buf), opcode)
+	return
+}
+
+// PacketSet holds one packet of each type. Parse reuses them, so a receive loop that keeps a PacketSet
+// can parse DATA and ACK packets without allocating. The packet returned by Parse is only valid until
+// the next call, and a PacketData's Data aliases the parsed buffer.
+type PacketSet struct {
+	Request PacketRequest
+	Data    PacketData
+	Ack     PacketAck
+	Error   PacketError
+	OAck    PacketOAck
+}
+
+// Parse parses a packet from its wire representation into the matching member of the set.
+func (s *PacketSet) Parse(buf []byte) (p Packet, err error) {
+	var opcode uint16
+	if opcode, _, err = parseUint16(buf); err != nil {
+		return
+	}
+	switch opcode {
+	case OpRRQ, OpWRQ:
+		p = &s.Request
+	case OpData:
+		p = &s.Data
+	case OpAck:
+		p = &s.Ack
+	case OpError:
+		p = &s.Error
+	case OpOAck:
+		p = &s.OAck
 	default:
-		err = fmt.Errorf("unexpected opcode %d", opcode)
+		err = &ParseError{Op: opcode, Err: ErrBadOpcode}
 		return
 	}
-	err = p.Parse(buf)
+	err = withOp(p.Parse(buf), opcode)
 	return
 }
 
@@ -0,0 +1,160 @@
+package tftp
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fuzzSeeds are hand-written packets in the shapes real clients and servers send - requests with the options
+// boot loaders, the Mac and tftp-hpa command line clients ask for, and the packets of a transfer - plus a few
+// near misses. They are not captured traffic.
+var fuzzSeeds = [][]byte{
+	// PXELINUX and iPXE fetching their next stage, asking for the size and a block that fits an ethernet frame.
+	[]byte("\x00\x01pxelinux.0\x00octet\x00tsize\x000\x00blksize\x001408\x00"),
+	[]byte("\x00\x01undionly.kpxe\x00octet\x00blksize\x001432\x00tsize\x000\x00"),
+
+	// U-Boot, with a timeout and upper case option names.
+	[]byte("\x00\x01uImage\x00octet\x00TIMEOUT\x005\x00TSIZE\x000\x00BLKSIZE\x001468\x00"),
+
+	// The Mac client, with no options.
+	[]byte("\x00\x01README.md\x00netascii\x00"),
+	[]byte("\x00\x02upload.bin\x00octet\x00"),
+
+	// tftp-hpa with a window, and the server's answer.
+	[]byte("\x00\x01images/rootfs.img\x00octet\x00windowsize\x0016\x00blksize\x008192\x00"),
+	[]byte("\x00\x06blksize\x001408\x00tsize\x0026800\x00"),
+	[]byte("\x00\x06"),
+
+	// A transfer: full and final DATA blocks, the ACK for an OACK, the ACK for a block, and the empty block that
+	// ends a file that is a multiple of the block size.
+	append([]byte("\x00\x03\x00\x01"), bytes.Repeat([]byte("0123456789abcdef"), 32)...),
+	[]byte("\x00\x03\x00\x02last few bytes\r\n"),
+	[]byte("\x00\x04\x00\x00"),
+	[]byte("\x00\x04\xff\xff"),
+	[]byte("\x00\x03\x00\x03"),
+
+	// Errors.
+	[]byte("\x00\x05\x00\x01File not found.\x00"),
+	[]byte("\x00\x05\x00\x05Unknown transfer ID.\x00"),
+	[]byte("\x00\x05\x00\x08blksize 99999 out of range\x00"),
+	[]byte("\x00\x05\x00\x00\x00"),
+
+	// Near misses.
+	[]byte(""),
+	[]byte("\x00"),
+	[]byte("\x00\x03"),
+	[]byte("\x00\x04\x00\x01\x00"),
+	[]byte("\x00\x01foo\x00octet\x00blksize\x00"),
+	[]byte("\x00\x05\x00\x01no terminator"),
+	[]byte("\x00\x07"),
+}
+
+func addSeeds(f *testing.F) {
+	for _, b := range fuzzSeeds {
+		f.Add(b)
+	}
+}
+
+// checkRoundTrip checks that p, parsed from b, serializes back to b. Options are kept in a map, so a request or
+// OACK with options may come back in another order or case, or without a repeated option - it must still parse
+// back to p.
+func checkRoundTrip(t *testing.T, p Packet, b []byte) {
+	t.Helper()
+
+	out := p.Serialize()
+	switch p.(type) {
+	case *PacketRequest, *PacketOAck:
+		q, err := ParsePacket(out)
+		if err != nil {
+			t.Fatalf("%q parsed to %#v, which serializes to %q, which does not parse: %s", b, p, out, err)
+		}
+		if !reflect.DeepEqual(p, q) {
+			t.Fatalf("%q parsed to %#v, which serializes to %q, which parses to %#v", b, p, out, q)
+		}
+	default:
+		if !bytes.Equal(out, b) {
+			t.Fatalf("%q parsed to %#v, which serializes to %q", b, p, out)
+		}
+	}
+
+	buf := make([]byte, len(out))
+	if n, err := p.SerializeTo(buf); err != nil || !bytes.Equal(buf[:n], out) {
+		t.Fatalf("SerializeTo %#v: got %q, %v; Serialize gave %q", p, buf[:n], err, out)
+	}
+	if got := p.AppendSerialize([]byte("x")); !bytes.Equal(got[1:], out) {
+		t.Fatalf("AppendSerialize %#v: got %q; Serialize gave %q", p, got[1:], out)
+	}
+}
+
+// FuzzParsePacket checks ParsePacket never panics, agrees with PacketSet.Parse, only accepts packets that
+// round trip, and accepts everything ParseStrict does.
+func FuzzParsePacket(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, err := ParsePacket(b)
+
+		var set PacketSet
+		q, setErr := set.Parse(b)
+		if (err == nil) != (setErr == nil) {
+			t.Fatalf("%q: ParsePacket error %v, PacketSet.Parse error %v", b, err, setErr)
+		}
+
+		s, strictErr := ParseStrict(b, StrictOptions{})
+		if err != nil {
+			if strictErr == nil {
+				t.Fatalf("%q: ParseStrict accepted %#v; ParsePacket error %v", b, s, err)
+			}
+			return
+		}
+		if strictErr == nil && !reflect.DeepEqual(p, s) {
+			t.Fatalf("%q: ParsePacket gave %#v, ParseStrict gave %#v", b, p, s)
+		}
+		if _, ok := strictErr.(*ParseError); strictErr != nil && !ok {
+			t.Fatalf("%q: ParseStrict error %T is not a *ParseError", b, strictErr)
+		}
+		if !reflect.DeepEqual(p, q) {
+			t.Fatalf("%q: ParsePacket gave %#v, PacketSet.Parse gave %#v", b, p, q)
+		}
+
+		checkRoundTrip(t, p, b)
+	})
+}
+
+// fuzzParse checks a packet type's Parse never panics, whatever it is given, and only accepts packets that
+// round trip.
+func fuzzParse(f *testing.F, newPacket func() Packet) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p := newPacket()
+		if err := p.Parse(b); err != nil {
+			return
+		}
+		checkRoundTrip(t, p, b)
+
+		if r, ok := p.(*PacketRequest); ok && strings.IndexByte(r.Filename+r.Mode, 0) >= 0 {
+			t.Fatalf("%q: parsed strings hold a NUL: %#v", b, r)
+		}
+	})
+}
+
+func FuzzPacketRequestParse(f *testing.F) {
+	fuzzParse(f, func() Packet { return &PacketRequest{} })
+}
+
+func FuzzPacketDataParse(f *testing.F) {
+	fuzzParse(f, func() Packet { return &PacketData{} })
+}
+
+func FuzzPacketAckParse(f *testing.F) {
+	fuzzParse(f, func() Packet { return &PacketAck{} })
+}
+
+func FuzzPacketErrorParse(f *testing.F) {
+	fuzzParse(f, func() Packet { return &PacketError{} })
+}
+
+func FuzzPacketOAckParse(f *testing.F) {
+	fuzzParse(f, func() Packet { return &PacketOAck{} })
+}
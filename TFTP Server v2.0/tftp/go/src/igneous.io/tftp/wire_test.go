@@ -1,6 +1,7 @@
 package tftp
 
 import (
+	"io"
 	"reflect"
 	"testing"
 )
@@ -12,11 +13,15 @@ func TestSerializationDeserialization(t *testing.T) {
 	}{
 		{
 			[]byte("\x00\x01foo\x00bar\x00"),
-			&PacketRequest{OpRRQ, "foo", "bar"},
+			&PacketRequest{OpRRQ, "foo", "bar", nil},
 		},
 		{
 			[]byte("\x00\x02foo\x00bar\x00"),
-			&PacketRequest{OpWRQ, "foo", "bar"},
+			&PacketRequest{OpWRQ, "foo", "bar", nil},
+		},
+		{
+			[]byte("\x00\x01foo\x00octet\x00blksize\x001428\x00tsize\x000\x00"),
+			&PacketRequest{OpRRQ, "foo", "octet", map[string]string{"blksize": "1428", "tsize": "0"}},
 		},
 		{
 			[]byte("\x00\x03\x12\x34fnord"),
@@ -34,6 +39,14 @@ func TestSerializationDeserialization(t *testing.T) {
 			[]byte("\x00\x05\xab\xcdparachute failure\x00"),
 			&PacketError{0xabcd, "parachute failure"},
 		},
+		{
+			[]byte("\x00\x06blksize\x001428\x00windowsize\x0016\x00"),
+			&PacketOAck{map[string]string{"blksize": "1428", "windowsize": "16"}},
+		},
+		{
+			[]byte("\x00\x06"),
+			&PacketOAck{nil},
+		},
 	}
 
 	for _, test := range tests {
@@ -42,12 +55,136 @@ func TestSerializationDeserialization(t *testing.T) {
 			t.Errorf("Serializing %#v: expected %q; got %q", test.packet, test.bytes, actualBytes)
 		}
 
+		prefix := []byte("prefix")
+		appendedBytes := test.packet.AppendSerialize(prefix)
+		if !reflect.DeepEqual(append([]byte("prefix"), test.bytes...), appendedBytes) {
+			t.Errorf("Appending %#v: expected %q; got %q", test.packet, test.bytes, appendedBytes)
+		}
+
+		buf := make([]byte, MaxPacketSize)
+		if n, err := test.packet.SerializeTo(buf); err != nil {
+			t.Errorf("Serializing %#v to buffer: %s", test.packet, err)
+		} else if !reflect.DeepEqual(test.bytes, buf[:n]) {
+			t.Errorf("Serializing %#v to buffer: expected %q; got %q", test.packet, test.bytes, buf[:n])
+		}
+
 		actualPacket, err := ParsePacket(test.bytes)
 		if err != nil {
 			t.Errorf("Unable to parse packet %q: %s", test.bytes, err)
 		} else if !reflect.DeepEqual(test.packet, actualPacket) {
 			t.Errorf("Deserializing %q: expected %#v; got %#v", test.bytes, test.packet, actualPacket)
 		}
+
+		var set PacketSet
+		setPacket, err := set.Parse(test.bytes)
+		if err != nil {
+			t.Errorf("Unable to parse packet %q into set: %s", test.bytes, err)
+		} else if !reflect.DeepEqual(test.packet, setPacket) {
+			t.Errorf("Deserializing %q into set: expected %#v; got %#v", test.bytes, test.packet, setPacket)
+		}
+	}
+}
+
+func TestSerializeToShortBuffer(t *testing.T) {
+	packets := []Packet{
+		&PacketRequest{OpRRQ, "foo", "bar", nil},
+		&PacketRequest{OpRRQ, "foo", "bar", map[string]string{"tsize": "0"}},
+		&PacketData{0x1234, []byte("fnord")},
+		&PacketAck{0xd00f},
+		&PacketError{0xabcd, "parachute failure"},
+		&PacketOAck{map[string]string{"tsize": "1024"}},
+	}
+
+	for _, p := range packets {
+		buf := make([]byte, len(p.Serialize())-1)
+		if n, err := p.SerializeTo(buf); err != io.ErrShortBuffer {
+			t.Errorf("Serializing %#v to short buffer: expected io.ErrShortBuffer; got %d, %v", p, n, err)
+		}
+	}
+}
+
+// The DATA/ACK exchange is the steady state of every transfer, and must not allocate in the wire layer. This
+// covers parsing and serializing only - the server's tracker lookup and socket still allocate per packet.
+
+func TestTransferPathAllocations(t *testing.T) {
+	data := &PacketData{0x1234, make([]byte, 512)}
+	ack := &PacketAck{0x1234}
+	dataBytes := data.Serialize()
+	ackBytes := ack.Serialize()
+
+	buf := make([]byte, 0, MaxPacketSize)
+	var set PacketSet
+
+	tests := []struct {
+		name string
+		fn   func()
+	}{
+		{"data AppendSerialize", func() { buf = data.AppendSerialize(buf[:0]) }},
+		{"ack AppendSerialize", func() { buf = ack.AppendSerialize(buf[:0]) }},
+		{"data SerializeTo", func() { data.SerializeTo(buf[:cap(buf)]) }},
+		{"ack SerializeTo", func() { ack.SerializeTo(buf[:cap(buf)]) }},
+		{"data PacketSet.Parse", func() { set.Parse(dataBytes) }},
+		{"ack PacketSet.Parse", func() { set.Parse(ackBytes) }},
+		{"data PacketSet.ParseStrict", func() { set.ParseStrict(dataBytes, StrictOptions{}) }},
+		{"ack PacketSet.ParseStrict", func() { set.ParseStrict(ackBytes, StrictOptions{}) }},
+	}
+
+	for _, test := range tests {
+		if allocs := testing.AllocsPerRun(100, test.fn); allocs != 0 {
+			t.Errorf("%s: expected no allocations; got %v", test.name, allocs)
+		}
+	}
+}
+
+func BenchmarkDataSerialize(b *testing.B) {
+	p := &PacketData{1, make([]byte, 512)}
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		p.Serialize()
+	}
+}
+
+func BenchmarkDataAppendSerialize(b *testing.B) {
+	p := &PacketData{1, make([]byte, 512)}
+	buf := make([]byte, 0, MaxPacketSize)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		buf = p.AppendSerialize(buf[:0])
+	}
+}
+
+func BenchmarkAckSerializeTo(b *testing.B) {
+	p := &PacketAck{1}
+	buf := make([]byte, MaxPacketSize)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		p.SerializeTo(buf)
+	}
+}
+
+func BenchmarkDataParsePacket(b *testing.B) {
+	buf := (&PacketData{1, make([]byte, 512)}).Serialize()
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		ParsePacket(buf)
+	}
+}
+
+func BenchmarkDataPacketSetParse(b *testing.B) {
+	buf := (&PacketData{1, make([]byte, 512)}).Serialize()
+	var set PacketSet
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		set.Parse(buf)
+	}
+}
+
+func BenchmarkAckPacketSetParse(b *testing.B) {
+	buf := (&PacketAck{1}).Serialize()
+	var set PacketSet
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		set.Parse(buf)
 	}
 }
 
@@ -58,7 +195,7 @@ func TestDeserializationInvalid(t *testing.T) {
 
 		// invalid opcode
 		[]byte("\x00\x00"),
-		[]byte("\x00\x06"),
+		[]byte("\x00\x07"),
 		[]byte("\xff\x01"),
 		[]byte("\xff\xff"),
 
@@ -87,6 +224,19 @@ func TestDeserializationInvalid(t *testing.T) {
 		[]byte("\x00\x05\xab"),
 		[]byte("\x00\x05\xab\xcd"),
 		[]byte("\x00\x05\xab\xcdparachute failure"),
+
+		// short options
+		[]byte("\x00\x01foo\x00bar\x00blksize"),
+		[]byte("\x00\x01foo\x00bar\x00blksize\x00"),
+		[]byte("\x00\x01foo\x00bar\x00blksize\x001428"),
+		[]byte("\x00\x06blksize"),
+		[]byte("\x00\x06blksize\x00"),
+
+		// trailing data
+		[]byte("\x00\x04\x00\x01\x00"),
+		[]byte("\x00\x04\x00\x01junk"),
+		[]byte("\x00\x05\x00\x01oops\x00junk"),
+		[]byte("\x00\x05\x00\x01oops\x00\x00"),
 	}
 
 	for _, test := range tests {
@@ -95,3 +245,32 @@ func TestDeserializationInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestOptionNamesCaseInsensitive(t *testing.T) {
+	p, err := ParsePacket([]byte("\x00\x01foo\x00octet\x00BlkSize\x001428\x00"))
+	if err != nil {
+		t.Fatalf("Unable to parse packet: %s", err)
+	}
+	if v := p.(*PacketRequest).Options["blksize"]; v != "1428" {
+		t.Errorf("Expected blksize 1428; got %q", v)
+	}
+}
+
+// Each packet's Parse must reject a buffer too short to hold its opcode, or holding another packet's opcode,
+// rather than panic.
+func TestParseWrongOrShortBuffer(t *testing.T) {
+	packets := []Packet{&PacketRequest{}, &PacketData{}, &PacketAck{}, &PacketError{}, &PacketOAck{}}
+	bufs := [][]byte{nil, []byte("\x00"), []byte("\x00\x00\x00\x00"), []byte("\x00\x07foo\x00bar\x00")}
+
+	for _, p := range packets {
+		for _, b := range bufs {
+			if err := p.Parse(b); err == nil {
+				t.Errorf("%T.Parse(%q): expected error", p, b)
+			}
+		}
+	}
+
+	if err := (&PacketAck{}).Parse([]byte("\x00\x03\x00\x01")); err == nil {
+		t.Errorf("PacketAck.Parse of a DATA packet: expected error")
+	}
+}